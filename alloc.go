@@ -0,0 +1,137 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylark
+
+// This file defines the approximate accounting of the memory allocated
+// by threads, which is limited by Thread.MaxAlloc.
+
+import (
+	"math"
+
+	"github.com/google/skylark/syntax"
+)
+
+// Approximate sizes in bytes of the memory allocated for values.
+const (
+	valueSize  = 16 // an interface value, e.g. an element of a list or tuple
+	stringSize = 16 // the header of a string, excluding its bytes
+	listSize   = 32 // a list or tuple, excluding its elements
+	entrySize  = 64 // an entry of the hash table of a dict or set, including its key and value
+	intSize    = 32 // an int, excluding the words of its magnitude
+)
+
+// Allocs returns the approximate number of bytes allocated by the thread for values.
+func (thread *Thread) Allocs() uint64 { return thread.allocs }
+
+// AddAllocs accounts for n bytes allocated by the thread, e.g. by a built-in function
+// supplied by the client. If the thread would exceed its allocation limit (see MaxAlloc),
+// the bytes are not accounted for, and AddAllocs returns a MemoryError.
+func (thread *Thread) AddAllocs(n int64) error {
+	if err := thread.CheckAllocs(n); err != nil {
+		return err
+	}
+	if n > 0 {
+		thread.allocs += uint64(n)
+	}
+	return nil
+}
+
+// CheckAllocs returns a MemoryError if the thread would exceed its allocation limit
+// by allocating n more bytes, without accounting for them. Operations which may
+// allocate large values check their size before allocating them.
+func (thread *Thread) CheckAllocs(n int64) error {
+	if thread.MaxAlloc == 0 || n <= 0 {
+		return nil
+	}
+	if uint64(n) > thread.MaxAlloc || thread.allocs > thread.MaxAlloc-uint64(n) {
+		return MemoryErrorf("exceeded the allocation limit of %d bytes", thread.MaxAlloc)
+	}
+	return nil
+}
+
+// allocated accounts for the allocation of the value x by the thread, and returns it.
+func (thread *Thread) allocated(x Value) (Value, error) {
+	if err := thread.AddAllocs(sizeOf(x)); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// checkElems returns a MemoryError if the thread would exceed its allocation limit by
+// allocating n elements of the given size, e.g. for the elements of a new list.
+func (thread *Thread) checkElems(n int, elemSize int64) error {
+	return thread.CheckAllocs(mulSize(int64(n), elemSize))
+}
+
+// sizeOf returns the approximate number of bytes allocated for the value x,
+// excluding the values of its elements. Ints which fit in 64 bits are not
+// accounted for.
+func sizeOf(x Value) int64 {
+	switch x := x.(type) {
+	case Int:
+		if x.bigint.BitLen() <= 64 {
+			return 0
+		}
+		return intSize + int64(x.bigint.BitLen()/8)
+	case String, *List, Tuple, *Dict, *Set:
+		return sizeOfLen(x, int64(Len(x)))
+	}
+	return 0
+}
+
+// sizeOfLen returns the approximate number of bytes allocated for a string, list,
+// tuple, dict or set of the same type as x, but with n elements.
+func sizeOfLen(x Value, n int64) int64 {
+	switch x.(type) {
+	case String:
+		return addSize(stringSize, n)
+	case *List, Tuple:
+		return addSize(listSize, mulSize(n, valueSize))
+	case *Dict, *Set:
+		return addSize(listSize, mulSize(n, entrySize))
+	}
+	return 0
+}
+
+// binarySize returns the approximate number of bytes allocated for the result of
+// Binary(op, x, y), before it is computed, such that e.g. the repetition of a string
+// fails before the repeated string is allocated.
+func binarySize(op syntax.Token, x, y Value) int64 {
+	switch op {
+	case syntax.PLUS, syntax.PIPE:
+		return addSize(sizeOf(x), sizeOf(y))
+	case syntax.STAR:
+		if _, ok := x.(Int); ok {
+			if _, ok := y.(Int); ok {
+				return addSize(sizeOf(x), sizeOf(y))
+			}
+			x, y = y, x
+		}
+		if n, err := AsInt32(y); err == nil && n > 0 {
+			return sizeOfLen(x, mulSize(int64(Len(x)), int64(n)))
+		}
+	case syntax.LTLT:
+		if n, err := AsInt32(y); err == nil && n > 0 {
+			return addSize(sizeOf(x), int64(n/8+1))
+		}
+	}
+	return 0
+}
+
+// addSize returns the sum of two sizes, saturating on overflow.
+func addSize(a, b int64) int64 {
+	if a > math.MaxInt64-b {
+		return math.MaxInt64
+	}
+	return a + b
+}
+
+// mulSize returns the product of two sizes, saturating on overflow.
+func mulSize(a, b int64) int64 {
+	if a > 0 && b > math.MaxInt64/a {
+		return math.MaxInt64
+	}
+	return a * b
+}
@@ -0,0 +1,305 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylark
+
+// A Cloneable value holds mutable values which must be copied by Thread.Clone.
+// CloneValue returns a copy of the value, whose elements are copied using the given function.
+// Values which are neither Cloneable nor known to the interpreter are shared between clones.
+type Cloneable interface {
+	Value
+	CloneValue(clone func(Value) Value) Value
+}
+
+// Clone returns an independent copy of a suspended thread, which may be resumed
+// separately from the original thread, e.g. with a different result.
+//
+// The frames of the call stack are copied, including their stacks, iterators and
+// exception handlers, along with all mutable values reachable from them, such as
+// lists, dicts, sets, generators, futures, and the globals of the thread's module. Values which are
+// referred to more than once are copied once, such that the aliasing of values
+// is preserved in the same manner as by EncodeState. Predeclared values are shared.
+// The copy has copies of the thread's journal and metadata, if any, and the same
+// budgets of steps and allocations, counting the steps and allocations of the
+// thread, as does a decoded thread, but is not cancelled if the thread is.
+func (thread *Thread) Clone() *Thread {
+	c := cloner{
+		frames:  make(map[*Frame]*Frame),
+		lists:   make(map[*List]*List),
+		dicts:   make(map[*hashtable]Value),
+		tuples:  make(map[tupleKey]Tuple),
+		funcs:   make(map[*Function]*Function),
+		gens:    make(map[*Generator]*Generator),
+		futures: make(map[*Future]*Future),
+	}
+	clone := &Thread{
+		Print:   thread.Print,
+		Load:    thread.Load,
+		Journal: thread.Journal.clone(),
+
+		MaxSteps:           thread.MaxSteps,
+		SuspendOnInterrupt: thread.SuspendOnInterrupt,
+		MaxAlloc:           thread.MaxAlloc,
+		steps:              thread.steps,
+		allocs:             thread.allocs,
+	}
+	// Copied generators run in the copy of the thread:
+	c.thread = clone
+	clone.frame = c.frame(thread.frame)
+	clone.suspended = c.frame(thread.suspended)
+	if thread.Metadata != nil {
+		clone.Metadata = make(map[string]string, len(thread.Metadata))
+		for k, v := range thread.Metadata {
+			clone.Metadata[k] = v
+		}
+	}
+	if thread.locals != nil {
+		clone.locals = make(map[string]interface{}, len(thread.locals))
+		for k, v := range thread.locals {
+			clone.locals[k] = v
+		}
+	}
+	return clone
+}
+
+// A cloner copies values, memoizing the copies of values which may be aliased.
+type cloner struct {
+	frames  map[*Frame]*Frame
+	lists   map[*List]*List
+	dicts   map[*hashtable]Value // *Dict or *Set
+	tuples  map[tupleKey]Tuple
+	funcs   map[*Function]*Function
+	gens    map[*Generator]*Generator
+	futures map[*Future]*Future
+	globals map[*Value][]Value // copies of module globals, by their first element
+	thread  *Thread            // copy of the thread
+}
+
+func (c *cloner) frame(fr *Frame) *Frame {
+	if fr == nil {
+		return nil
+	}
+	if clone, ok := c.frames[fr]; ok {
+		return clone
+	}
+	clone := &Frame{
+		posn:   fr.posn,
+		callpc: fr.callpc,
+		pc:     fr.pc,
+		sp:     fr.sp,
+	}
+	c.frames[fr] = clone
+	clone.parent = c.frame(fr.parent)
+	if fr.callable != nil {
+		clone.callable = c.value(fr.callable).(Callable)
+	}
+	if fr.stack != nil {
+		clone.stack = make([]Value, len(fr.stack))
+		for i, v := range fr.stack {
+			clone.stack[i] = c.value(v)
+		}
+	}
+	if fr.iterstack != nil {
+		clone.iterstack = make([]Iterator, len(fr.iterstack))
+		for i, it := range fr.iterstack {
+			clone.iterstack[i] = c.iterator(it)
+		}
+	}
+	clone.exhandlers = append([]exceptionHandler(nil), fr.exhandlers...)
+	clone.args = c.tuple(fr.args)
+	if fr.kwargs != nil {
+		clone.kwargs = make([]Tuple, len(fr.kwargs))
+		for i, kwarg := range fr.kwargs {
+			clone.kwargs[i] = c.tuple(kwarg)
+		}
+	}
+	clone.state = c.value(fr.state)
+	return clone
+}
+
+func (c *cloner) value(v Value) Value {
+	switch v := v.(type) {
+	case *List:
+		return c.list(v)
+	case *Dict:
+		if clone, ok := c.dicts[&v.ht]; ok {
+			return clone
+		}
+		clone := &Dict{}
+		c.dicts[&v.ht] = clone
+		c.hashtable(&clone.ht, &v.ht)
+		return clone
+	case *Set:
+		if clone, ok := c.dicts[&v.ht]; ok {
+			return clone
+		}
+		clone := &Set{}
+		c.dicts[&v.ht] = clone
+		c.hashtable(&clone.ht, &v.ht)
+		return clone
+	case Tuple:
+		return c.tuple(v)
+	case *Function:
+		return c.function(v)
+	case *Generator:
+		return c.generator(v)
+	case *Future:
+		return c.future(v)
+	case *Builtin:
+		if v.recv == nil {
+			return v
+		}
+		// Bound methods refer to their receiver, e.g. the list of list.append:
+		clone := *v
+		clone.recv = c.value(v.recv)
+		return &clone
+	case Cloneable:
+		return v.CloneValue(c.value)
+	case Exception:
+		// The arguments of an exception may be mutable:
+		return cloneException(v, c.value)
+	default:
+		// Other values are immutable, or unknown to the interpreter.
+		return v
+	}
+}
+
+func (c *cloner) list(l *List) *List {
+	if clone, ok := c.lists[l]; ok {
+		return clone
+	}
+	clone := &List{frozen: l.frozen, itercount: l.itercount}
+	c.lists[l] = clone
+	clone.elems = make([]Value, len(l.elems))
+	for i, elem := range l.elems {
+		clone.elems[i] = c.value(elem)
+	}
+	return clone
+}
+
+// hashtable copies the entries of ht into clone, which must be empty.
+func (c *cloner) hashtable(clone, ht *hashtable) {
+	for e := ht.head; e != nil; e = e.next {
+		// Keys are hashable, hence they need not be copied:
+		clone.insert(e.key, c.value(e.value))
+	}
+	clone.frozen, clone.itercount = ht.frozen, ht.itercount
+}
+
+// A tupleKey identifies a non-empty tuple by its first element and its length,
+// as tuples which share their elements are the same value.
+type tupleKey struct {
+	elems *Value
+	len   int
+}
+
+func (c *cloner) tuple(t Tuple) Tuple {
+	if len(t) == 0 {
+		return t
+	}
+	key := tupleKey{&t[0], len(t)}
+	if clone, ok := c.tuples[key]; ok {
+		return clone
+	}
+	clone := make(Tuple, len(t))
+	c.tuples[key] = clone
+	for i, elem := range t {
+		clone[i] = c.value(elem)
+	}
+	return clone
+}
+
+func (c *cloner) function(fn *Function) *Function {
+	if clone, ok := c.funcs[fn]; ok {
+		return clone
+	}
+	clone := &Function{
+		funcode:     fn.funcode,
+		predeclared: fn.predeclared,
+		constants:   fn.constants,
+	}
+	c.funcs[fn] = clone
+	clone.defaults = c.tuple(fn.defaults)
+	clone.freevars = c.tuple(fn.freevars)
+	// The globals are shared by all functions of a module, hence they are copied once:
+	if len(fn.globals) > 0 {
+		if c.globals == nil {
+			c.globals = make(map[*Value][]Value)
+		}
+		globals, ok := c.globals[&fn.globals[0]]
+		if !ok {
+			globals = make([]Value, len(fn.globals))
+			c.globals[&fn.globals[0]] = globals
+			for i, v := range fn.globals {
+				globals[i] = c.value(v)
+			}
+		}
+		clone.globals = globals
+	}
+	return clone
+}
+
+func (c *cloner) generator(g *Generator) *Generator {
+	if clone, ok := c.gens[g]; ok {
+		return clone
+	}
+	clone := &Generator{thread: c.thread, err: g.err}
+	c.gens[g] = clone
+	clone.fn = c.function(g.fn)
+	clone.frame = c.frame(g.frame)
+	return clone
+}
+
+func (c *cloner) future(f *Future) *Future {
+	if clone, ok := c.futures[f]; ok {
+		return clone
+	}
+	clone := &Future{}
+	c.futures[f] = clone
+	clone.fn = c.value(f.fn).(Callable)
+	clone.args = c.tuple(f.args)
+	if f.kwargs != nil {
+		clone.kwargs = make([]Tuple, len(f.kwargs))
+		for i, kwarg := range f.kwargs {
+			clone.kwargs[i] = c.tuple(kwarg)
+		}
+	}
+	clone.result = c.value(f.result)
+	return clone
+}
+
+func (c *cloner) iterator(it Iterator) Iterator {
+	switch it := it.(type) {
+	case *stringIterator:
+		clone := *it
+		return &clone
+	case *listIterator:
+		return &listIterator{l: c.list(it.l), i: it.i}
+	case *keyIterator:
+		owner := c.value(it.owner.(Value))
+		var ht *hashtable
+		switch owner := owner.(type) {
+		case *Dict:
+			ht = &owner.ht
+		case *Set:
+			ht = &owner.ht
+		}
+		clone := &keyIterator{ht: ht, owner: owner, offset: it.offset}
+		// Find the entry at the same offset in the copied hashtable:
+		clone.e = ht.head
+		for i := uint(0); i < it.offset && clone.e != nil; i++ {
+			clone.e = clone.e.next
+		}
+		return clone
+	case *tupleIterator:
+		return &tupleIterator{elems: c.tuple(it.elems)}
+	case *rangeIterator:
+		clone := *it
+		return &clone
+	case *Generator:
+		return c.generator(it)
+	default:
+		return it
+	}
+}
@@ -4,6 +4,11 @@
 
 // The skylark command interprets a Skylark file.
 // With no arguments, it starts a read-eval-print loop (REPL).
+//
+// The snapshot subcommand prints the state of a suspended thread,
+// as encoded by skylark.EncodeState:
+//
+//	skylark snapshot [-json] [-predeclared names] file
 package main
 
 import (
@@ -24,6 +29,8 @@ import (
 var (
 	cpuprofile = flag.String("cpuprofile", "", "gather CPU profile in this file")
 	showenv    = flag.Bool("showenv", false, "on success, print final global environment")
+	maxsteps   = flag.Uint64("maxsteps", 0, "if nonzero, fail after executing this many steps")
+	maxalloc   = flag.Uint64("maxalloc", 0, "if nonzero, raise MemoryError after allocating this many bytes")
 )
 
 // non-standard dialect flags
@@ -33,7 +40,11 @@ func init() {
 	flag.BoolVar(&resolve.AllowLambda, "lambda", resolve.AllowLambda, "allow lambda expressions")
 	flag.BoolVar(&resolve.AllowNestedDef, "nesteddef", resolve.AllowNestedDef, "allow nested def statements")
 	flag.BoolVar(&resolve.AllowBitwise, "bitwise", resolve.AllowBitwise, "allow bitwise operations (&, |, ^, ~, <<, and >>)")
-	flag.BoolVar(&resolve.AllowTryExcept, "tryexcept", resolve.AllowTryExcept, "allow try/except exception handling")
+	flag.BoolVar(&resolve.AllowTryExcept, "tryexcept", resolve.AllowTryExcept, "allow try/except exception handling and raise statements")
+	flag.BoolVar(&resolve.AllowSuspend, "suspend", resolve.AllowSuspend, "allow the suspend built-in")
+	flag.BoolVar(&resolve.AllowFutures, "futures", resolve.AllowFutures, "allow the defer and await_all built-ins")
+	flag.BoolVar(&resolve.AllowGenerators, "generators", resolve.AllowGenerators, "allow yield statements in function bodies")
+	flag.BoolVar(&resolve.AllowWhile, "while", resolve.AllowWhile, "allow while loops")
 }
 
 func main() {
@@ -41,6 +52,13 @@ func main() {
 	log.SetFlags(0)
 	flag.Parse()
 
+	if flag.NArg() > 0 && flag.Arg(0) == "snapshot" {
+		if err := snapshot(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -52,18 +70,28 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	thread := &skylark.Thread{Load: repl.MakeLoad()}
+	thread := &skylark.Thread{Load: repl.MakeLoad(), MaxSteps: *maxsteps, MaxAlloc: *maxalloc}
 	globals := make(skylark.StringDict)
 
+	// The classes of the built-in exceptions are named by except clauses.
+	var predeclared skylark.StringDict
+	if resolve.AllowTryExcept {
+		predeclared = skylark.ExceptionClasses()
+	}
+
 	switch len(flag.Args()) {
 	case 0:
 		fmt.Println("Welcome to Skylark (github.com/google/skylark)")
+		// The REPL predeclares its globals.
+		for name, value := range predeclared {
+			globals[name] = value
+		}
 		repl.REPL(thread, globals)
 	case 1:
 		// Execute specified file.
 		filename := flag.Args()[0]
 		var err error
-		globals, err = skylark.ExecFile(thread, filename, nil, nil)
+		globals, err = skylark.ExecFile(thread, filename, nil, predeclared)
 		if err != nil {
 			repl.PrintError(err)
 			os.Exit(1)
@@ -0,0 +1,173 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/google/skylark"
+)
+
+// A snapshotInfo describes the decoded state of a suspended thread.
+type snapshotInfo struct {
+	Frames  []frameInfo `json:"frames"` // innermost first
+	Globals []binding   `json:"globals"`
+}
+
+// A frameInfo describes a frame on the call stack of a suspended thread.
+type frameInfo struct {
+	Function          string    `json:"function"`
+	PC                uint32    `json:"pc"`
+	Position          string    `json:"position"`
+	Locals            []binding `json:"locals,omitempty"`
+	Iterators         []string  `json:"iterators,omitempty"`
+	ExceptionHandlers []uint32  `json:"exception_handlers,omitempty"`
+	Args              []string  `json:"args,omitempty"`
+	Kwargs            []binding `json:"kwargs,omitempty"`
+	State             string    `json:"state,omitempty"`
+}
+
+type binding struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// snapshot implements the snapshot subcommand, which prints the decoded state of a suspended thread.
+func snapshot(args []string) error {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the snapshot as JSON")
+	predeclared := flags.String("predeclared", "", "comma-separated names of predeclared values, which are stubbed out")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: skylark [dialect flags] snapshot [-json] [-predeclared names] file")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	data, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	thread, err := skylark.DecodeState(data, stubs(*predeclared))
+	if err != nil {
+		return err
+	}
+	info := inspect(thread)
+	if *asJSON {
+		out, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", out)
+		return nil
+	}
+	info.print(os.Stdout)
+	return nil
+}
+
+// stubs returns a built-in function for each of the given comma-separated names,
+// which fails when it is called.
+func stubs(names string) skylark.StringDict {
+	predeclared := make(skylark.StringDict)
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			predeclared[name] = skylark.NewBuiltin(name, func(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+				return nil, fmt.Errorf("%s is a stub", fn.Name())
+			})
+		}
+	}
+	return predeclared
+}
+
+// inspect describes the state of a decoded thread.
+func inspect(thread *skylark.Thread) *snapshotInfo {
+	info := &snapshotInfo{}
+	for fr := thread.TopFrame(); fr != nil; fr = fr.Parent() {
+		frame := frameInfo{
+			Function:          fr.Callable().Name(),
+			PC:                fr.PC(),
+			Position:          fr.Position().String(),
+			ExceptionHandlers: fr.ExceptionHandlers(),
+		}
+		names, values := fr.Locals()
+		for i, name := range names {
+			frame.Locals = append(frame.Locals, binding{name, describe(values[i])})
+		}
+		for _, it := range fr.Iterators() {
+			frame.Iterators = append(frame.Iterators, fmt.Sprintf("%T", it))
+		}
+		for _, arg := range fr.Args() {
+			frame.Args = append(frame.Args, describe(arg))
+		}
+		for _, kwarg := range fr.Kwargs() {
+			if len(kwarg) == 2 {
+				name, _ := skylark.AsString(kwarg[0])
+				frame.Kwargs = append(frame.Kwargs, binding{name, describe(kwarg[1])})
+			}
+		}
+		if state := fr.State(); state != nil {
+			frame.State = describe(state)
+		}
+		info.Frames = append(info.Frames, frame)
+	}
+	globals := thread.Globals()
+	var names []string
+	for name := range globals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info.Globals = append(info.Globals, binding{name, describe(globals[name])})
+	}
+	return info
+}
+
+func describe(v skylark.Value) string {
+	if v == nil {
+		return "<unbound>"
+	}
+	return v.String()
+}
+
+// print writes a human-readable description of the snapshot to out.
+func (info *snapshotInfo) print(out io.Writer) {
+	fmt.Fprintln(out, "Call stack (innermost first):")
+	for i, frame := range info.Frames {
+		fmt.Fprintf(out, "#%d %s at %s (pc %d)\n", i, frame.Function, frame.Position, frame.PC)
+		if len(frame.Args) > 0 || len(frame.Kwargs) > 0 {
+			args := append([]string(nil), frame.Args...)
+			for _, kwarg := range frame.Kwargs {
+				args = append(args, kwarg.Name+"="+kwarg.Value)
+			}
+			fmt.Fprintf(out, "    pending call: %s(%s)\n", frame.Function, strings.Join(args, ", "))
+		}
+		for _, local := range frame.Locals {
+			fmt.Fprintf(out, "    %s = %s\n", local.Name, local.Value)
+		}
+		for j, it := range frame.Iterators {
+			fmt.Fprintf(out, "    iterator #%d: %s\n", j, it)
+		}
+		for j, pc := range frame.ExceptionHandlers {
+			fmt.Fprintf(out, "    exception handler #%d: pc %d\n", j, pc)
+		}
+		if frame.State != "" {
+			fmt.Fprintf(out, "    state: %s\n", frame.State)
+		}
+	}
+	fmt.Fprintln(out, "Globals:")
+	for _, global := range info.Globals {
+		fmt.Fprintf(out, "    %s = %s\n", global.Name, global.Value)
+	}
+}
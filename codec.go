@@ -9,6 +9,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"math/big"
 	"reflect"
@@ -21,90 +22,150 @@ import (
 // See https://ep2013.europython.eu/media/conference/slides/advanced-pickling-with-stackless-python-and-spickle.pdf
 
 const (
-	T_Encoded_End    = 1
-	T_Toplevel       = 2
-	T_Toplevel_End   = 3
-	T_FnShared       = 4
-	T_FnShared_End   = 5
-	T_Frame          = 6
-	T_Frame_End      = 7
-	T_None           = 8
-	T_True           = 9
-	T_False          = 10
-	T_Int            = 11
-	T_Float          = 12
-	T_String         = 13
-	T_StringIterable = 14
-	T_StringIterator = 15
-	T_Function       = 16
-	T_Builtin        = 17
-	T_List           = 18
-	T_ListIterator   = 19
-	T_Dict           = 20
-	T_KeyIterator    = 21
-	T_Set            = 22
-	T_Tuple          = 23
-	T_TupleIterator  = 24
-	T_Range          = 25
-	T_RangeIterator  = 26
-	T_Ref            = 27
-	T_Funcode        = 28
-	T_Custom         = 29
-	T_CustomIterator = 30
-	T_BaseException  = 31
-	T_TypeError      = 32
-	T_ValueError     = 33
-	T_IOError        = 34
+	T_Encoded_End       = 1
+	T_Toplevel          = 2
+	T_Toplevel_End      = 3
+	T_FnShared          = 4
+	T_FnShared_End      = 5
+	T_Frame             = 6
+	T_Frame_End         = 7
+	T_None              = 8
+	T_True              = 9
+	T_False             = 10
+	T_Int               = 11
+	T_Float             = 12
+	T_String            = 13
+	T_StringIterable    = 14
+	T_StringIterator    = 15
+	T_Function          = 16
+	T_Builtin           = 17
+	T_List              = 18
+	T_ListIterator      = 19
+	T_Dict              = 20
+	T_KeyIterator       = 21
+	T_Set               = 22
+	T_Tuple             = 23
+	T_TupleIterator     = 24
+	T_Range             = 25
+	T_RangeIterator     = 26
+	T_Ref               = 27
+	T_Funcode           = 28
+	T_Custom            = 29
+	T_CustomIterator    = 30
+	T_BaseException     = 31
+	T_TypeError         = 32
+	T_ValueError        = 33
+	T_IOError           = 34
+	T_Generator         = 35
+	T_Future            = 36
+	T_MemoryError       = 37
+	T_KeyError          = 38
+	T_IndexError        = 39
+	T_ZeroDivisionError = 40
+	T_AttributeError    = 41
+	T_NameError         = 42
+	T_OverflowError     = 43
+	T_RecursionError    = 44
+	T_ExceptionClass    = 45
+	T_ExceptionInstance = 46
 
 	T_Uncompressed      = 60
 	T_HuffmanCompressed = 61
+	T_Version           = 62
+	T_Signature         = 63
+	T_DeflateCompressed = 64
+	T_GzipCompressed    = 65
+	T_ProgramRef        = 66
+	T_Metadata          = 67
+	T_Steps             = 68
+	T_Allocs            = 69
 )
 
+// tagNames holds the name of each tag of the encoded state format.
+var tagNames = [...]string{
+	T_Encoded_End:       "encoded_end",
+	T_Toplevel:          "toplevel",
+	T_Toplevel_End:      "toplevel_end",
+	T_FnShared:          "fnshared",
+	T_FnShared_End:      "fnshared_end",
+	T_Frame:             "frame",
+	T_Frame_End:         "frame_end",
+	T_None:              "none",
+	T_True:              "true",
+	T_False:             "false",
+	T_Int:               "int",
+	T_Float:             "float",
+	T_String:            "string",
+	T_StringIterable:    "string_iterable",
+	T_StringIterator:    "string_iterator",
+	T_Function:          "function",
+	T_Builtin:           "builtin",
+	T_List:              "list",
+	T_ListIterator:      "list_iterator",
+	T_Dict:              "dict",
+	T_KeyIterator:       "key_iterator",
+	T_Set:               "set",
+	T_Tuple:             "tuple",
+	T_TupleIterator:     "tuple_iterator",
+	T_Range:             "range",
+	T_RangeIterator:     "range_iterator",
+	T_Ref:               "ref",
+	T_Funcode:           "funcode",
+	T_Custom:            "custom",
+	T_CustomIterator:    "custom_iterator",
+	T_BaseException:     "base_exception",
+	T_TypeError:         "type_error",
+	T_ValueError:        "value_error",
+	T_IOError:           "io_error",
+	T_Generator:         "generator",
+	T_Future:            "future",
+	T_MemoryError:       "memory_error",
+	T_KeyError:          "key_error",
+	T_IndexError:        "index_error",
+	T_ZeroDivisionError: "zero_division_error",
+	T_AttributeError:    "attribute_error",
+	T_NameError:         "name_error",
+	T_OverflowError:     "overflow_error",
+	T_RecursionError:    "recursion_error",
+	T_ExceptionClass:    "exception_class",
+	T_ExceptionInstance: "exception_instance",
+
+	T_Uncompressed:      "uncompressed",
+	T_HuffmanCompressed: "huffman_compressed",
+	T_Version:           "version",
+	T_Signature:         "signature",
+	T_DeflateCompressed: "deflate_compressed",
+	T_GzipCompressed:    "gzip_compressed",
+	T_ProgramRef:        "program_ref",
+	T_Metadata:          "metadata",
+	T_Steps:             "steps",
+	T_Allocs:            "allocs",
+}
+
 var (
 	ErrShortBuffer = errors.New("Codec: reached end of buffer while decoding")
 	ErrBadTag      = errors.New("Codec: invalid tag while decoding")
 	ErrBadRef      = errors.New("Codec: invalid ref while decoding")
+
+	ErrVarintOverflow = errors.New("Codec: varint overflows 64 bits while decoding")
 )
 
 type CustomDecoder func(dec *Decoder) (Value, error)
 
-var CustomDecoders = map[string]CustomDecoder{}
-
 type CustomIteratorDecoder func(dec *Decoder) (Iterator, error)
 
-var CustomIteratorDecoders = map[string]CustomIteratorDecoder{}
-
 type CustomExceptionDecoder func(dec *Decoder) (Exception, error)
 
-var CustomExceptionDecoders = map[string]CustomExceptionDecoder{}
-
 type Codable interface {
 	Type() string
 	Encode(*Encoder)
 }
 
-func RegisterDecoder(typeName string, dec CustomDecoder) error {
-	if CustomDecoders[typeName] != nil {
-		return fmt.Errorf("Codec: decoder for type %s is already registered", typeName)
-	}
-	CustomDecoders[typeName] = dec
-	return nil
-}
-
-func RegisterIteratorDecoder(typeName string, dec CustomIteratorDecoder) error {
-	if CustomIteratorDecoders[typeName] != nil {
-		return fmt.Errorf("Codec: iterator decoder for type %s is already registered", typeName)
-	}
-	CustomIteratorDecoders[typeName] = dec
-	return nil
-}
-
-func RegisterExceptionDecoder(typeName string, dec CustomExceptionDecoder) error {
-	if CustomExceptionDecoders[typeName] != nil {
-		return fmt.Errorf("Codec: exception decoder for type %s is already registered", typeName)
-	}
-	CustomExceptionDecoders[typeName] = dec
-	return nil
+// A VersionedCodable is a Codable whose encoding has a version, such that it may evolve while
+// decoders for its earlier versions remain registered, see VersionedTypeName.
+type VersionedCodable interface {
+	Codable
+	EncodingVersion() int
 }
 
 type ref uint32
@@ -115,15 +176,63 @@ type taggedRef struct {
 	_   [3]byte
 }
 
+// An UnencodableValueError reports a value which the Encoder does not know how to serialize,
+// along with the location within the thread's state where the value was found.
+type UnencodableValueError struct {
+	GoType   string // Go type of the value, e.g. "*mypkg.Object"
+	Location string // location of the value, e.g. "local variable x of function f"
+}
+
+func (e *UnencodableValueError) Error() string {
+	return fmt.Sprintf("Codec: cannot encode value of type %s found in %s", e.GoType, e.Location)
+}
+
+// A codecLocation identifies the part of a thread's state which is being encoded.
+// It is only formatted when an error is reported.
+type codecLocation struct {
+	kind  string // e.g. "local variable", "global variable", "argument"
+	name  string // name of the variable, if known
+	index int    // index of the value, if its name is unknown; negative if not applicable
+	fn    string // name of the function of the enclosing frame, if any
+}
+
+func (loc codecLocation) String() string {
+	s := loc.kind
+	if s == "" {
+		return "thread state"
+	} else if loc.name != "" {
+		s += " " + loc.name
+	} else if loc.index >= 0 {
+		s += fmt.Sprintf(" #%d", loc.index)
+	}
+	if loc.fn != "" {
+		s += " of function " + loc.fn
+	}
+	return s
+}
+
 type Encoder struct {
 	strings     map[string]ref
 	dicts       map[*hashtable]taggedRef
 	lists       map[*List]ref
 	tuples      map[reflect.SliceHeader]ref
 	funcs       map[*Function]ref
+	gens        map[*Generator]ref
+	futures     map[*Future]ref
 	funcodes    map[*compile.Funcode]ref
 	buf         bytes.Buffer
 	compression byte
+	level       int             // compression level, for deflate and gzip compression
+	lossy       bool            // whether unencodable values are silently encoded as None
+	signer      Signer          // signer of encoded states, if any
+	programs    ProgramRegistry // registry of programs referred to by hash, if any
+	types       *TypeRegistry   // decoders of custom types which may be encoded
+
+	programHashes map[*compile.Program]string // hashes of the programs stored in the registry
+	location      codecLocation               // location of the values currently being encoded
+	errors        []*UnencodableValueError    // unencodable values found so far
+	out           io.Writer                   // writer to which the state is streamed, if any
+	outErr        error                       // first error of out, if any
 }
 
 type Decoder struct {
@@ -134,14 +243,39 @@ type Decoder struct {
 	predeclared StringDict         // decoded predeclared values
 	globals     []Value            // decoded globals
 	constants   []Value            // decoded constants
+	verifier    Signer             // verifier of encoded states, if any
+	programs    ProgramRegistry    // registry of programs referred to by hash, if any
+	types       *TypeRegistry      // decoders of custom types
+	limits      DecodeLimits       // limits of the resources used while decoding
+	depth       int                // nesting depth of the value being decoded
+	limitErr    *DecodeLimitError  // first limit exceeded, if any
+	metadata    map[string]string  // decoded metadata of the thread
+	steps       uint64             // decoded steps executed by the thread
+	allocs      uint64             // decoded bytes allocated by the thread
+	classes     decodedClasses     // decoded classes of exceptions
+	src         io.Reader          // reader of the data which follows Data, if the state is streamed
+	srcErr      error              // error of src other than the end of the state, if any
 }
 
+// encodeChunkSize is the size of the encoded data which an Encoder buffers before it writes
+// it to the writer to which the state is streamed.
+const encodeChunkSize = 32 << 10
+
+// A Decoder reads a window of decodeWindow bytes ahead from the reader from which the state
+// is streamed, whenever fewer than decodeLookahead bytes of the data read so far remain.
+const (
+	decodeWindow    = 64 << 10
+	decodeLookahead = 1 << 10
+)
+
+// NewEncoder returns an encoder of the custom types registered in DefaultTypes.
 func NewEncoder() *Encoder {
-	return &Encoder{compression: T_HuffmanCompressed}
+	return DefaultTypes.NewEncoder()
 }
 
+// NewDecoder returns a decoder of the custom types registered in DefaultTypes.
 func NewDecoder(data []byte, predeclared StringDict) *Decoder {
-	return &Decoder{Data: data, predeclared: predeclared}
+	return DefaultTypes.NewDecoder(data, predeclared)
 }
 
 func (enc *Encoder) Bytes() []byte {
@@ -157,21 +291,105 @@ func (enc *Encoder) EnableHuffmanCompression() *Encoder {
 	return enc
 }
 
+// EnableDeflateCompression causes encoded states to be compressed using the deflate algorithm,
+// at the given compression level, ranging from flate.BestSpeed to flate.BestCompression.
+func (enc *Encoder) EnableDeflateCompression(level int) *Encoder {
+	enc.compression, enc.level = T_DeflateCompressed, level
+	return enc
+}
+
+// EnableGzipCompression causes encoded states to be compressed using gzip,
+// at the given compression level, ranging from gzip.BestSpeed to gzip.BestCompression.
+func (enc *Encoder) EnableGzipCompression(level int) *Encoder {
+	enc.compression, enc.level = T_GzipCompressed, level
+	return enc
+}
+
 func (enc *Encoder) DisableCompression() *Encoder {
 	enc.compression = T_Uncompressed
 	return enc
 }
 
+// EnableLossyEncoding causes EncodeState to succeed even when the thread's state holds values
+// which cannot be encoded. Such values are encoded as None, and are reported by Errors.
+func (enc *Encoder) EnableLossyEncoding() *Encoder {
+	enc.lossy = true
+	return enc
+}
+
+// Errors returns an error for each value which could not be encoded since the last Reset.
+func (enc *Encoder) Errors() []*UnencodableValueError {
+	return enc.errors
+}
+
 func (enc *Encoder) Reset() *Encoder {
-	enc.strings, enc.dicts, enc.lists, enc.tuples, enc.funcs, enc.funcodes = nil, nil, nil, nil, nil, nil
+	enc.strings, enc.dicts, enc.lists, enc.tuples, enc.funcs, enc.gens, enc.futures, enc.funcodes = nil, nil, nil, nil, nil, nil, nil, nil
+	enc.location, enc.errors, enc.outErr = codecLocation{}, nil, nil
 	enc.buf.Reset()
 	return enc
 }
 
+// unencodable records a value which cannot be encoded, and encodes None in its place.
+func (enc *Encoder) unencodable(v interface{}) {
+	enc.reportUnencodable(v)
+	enc.WriteTag(T_None)
+}
+
+func (enc *Encoder) reportUnencodable(v interface{}) {
+	enc.errors = append(enc.errors, &UnencodableValueError{
+		GoType:   reflect.TypeOf(v).String(),
+		Location: enc.location.String(),
+	})
+}
+
+// spill writes the data encoded so far to the writer to which the state is streamed, once
+// enough data has been buffered.
+func (enc *Encoder) spill() {
+	if enc.out != nil && enc.buf.Len() >= encodeChunkSize {
+		enc.flush()
+	}
+}
+
+// flush writes the data encoded so far to the writer to which the state is streamed.
+func (enc *Encoder) flush() {
+	if enc.outErr == nil {
+		_, enc.outErr = enc.out.Write(enc.buf.Bytes())
+	}
+	enc.buf.Reset()
+}
+
+// Remaining returns the number of bytes of the encoded data which remain to be decoded.
+// If the state is streamed (see DecodeStateFrom), it returns the number of bytes read ahead,
+// which are at least 1KB of the state, unless it ends sooner.
 func (dec *Decoder) Remaining() int {
+	if len(dec.Data) < decodeLookahead {
+		dec.fill(decodeWindow)
+	}
 	return len(dec.Data)
 }
 
+// fill reads the data of a streamed state until Data holds at least n bytes, or the state ends.
+// Data is read into a new array, such that slices of the previous Data remain valid.
+func (dec *Decoder) fill(n int) {
+	if dec.src == nil || len(dec.Data) >= n {
+		return
+	}
+	size := n
+	if size < decodeWindow {
+		size = decodeWindow
+	}
+	buf := make([]byte, size)
+	m := copy(buf, dec.Data)
+	k, err := io.ReadFull(dec.src, buf[m:])
+	dec.Data = buf[:m+k]
+	if err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			dec.srcErr = err
+		}
+		dec.src = nil
+	}
+}
+
 func (dec *Decoder) Program() *compile.Program {
 	return dec.prog
 }
@@ -182,6 +400,8 @@ func (dec *Decoder) FnShared() (StringDict, []Value, []Value) {
 
 func (dec *Decoder) Reset(data []byte) {
 	dec.Data, dec.values, dec.funcodes, dec.prog, dec.predeclared, dec.globals, dec.constants = data, nil, nil, nil, nil, nil, nil
+	dec.src, dec.srcErr = nil, nil
+	dec.depth, dec.limitErr, dec.classes = 0, nil, nil
 }
 
 func (enc *Encoder) WriteTag(tag byte) {
@@ -189,8 +409,8 @@ func (enc *Encoder) WriteTag(tag byte) {
 }
 
 func (enc *Encoder) WriteUvarint(n uint64) {
-	var b [8]byte
-	nw := binary.PutUvarint(b[:8], n)
+	var b [binary.MaxVarintLen64]byte
+	nw := binary.PutUvarint(b[:], n)
 	enc.buf.Write(b[:nw])
 }
 
@@ -199,13 +419,18 @@ func (dec *Decoder) DecodeUvarint() (uint64, error) {
 		return 0, ErrShortBuffer
 	}
 	n, size := binary.Uvarint(dec.Data)
+	if size == 0 {
+		return 0, ErrShortBuffer
+	} else if size < 0 {
+		return 0, ErrVarintOverflow
+	}
 	dec.Data = dec.Data[size:]
 	return n, nil
 }
 
 func (enc *Encoder) WriteVarint(n int64) {
-	var b [8]byte
-	nw := binary.PutVarint(b[:8], n)
+	var b [binary.MaxVarintLen64]byte
+	nw := binary.PutVarint(b[:], n)
 	enc.buf.Write(b[:nw])
 }
 
@@ -214,12 +439,17 @@ func (dec *Decoder) DecodeVarint() (int64, error) {
 		return 0, ErrShortBuffer
 	}
 	n, size := binary.Varint(dec.Data)
+	if size == 0 {
+		return 0, ErrShortBuffer
+	} else if size < 0 {
+		return 0, ErrVarintOverflow
+	}
 	dec.Data = dec.Data[size:]
 	return n, nil
 }
 
 func (enc *Encoder) nextRef() ref {
-	return ref(len(enc.strings) + len(enc.dicts) + len(enc.lists) + len(enc.tuples) + len(enc.funcs))
+	return ref(len(enc.strings) + len(enc.dicts) + len(enc.lists) + len(enc.tuples) + len(enc.funcs) + len(enc.gens) + len(enc.futures))
 }
 
 func (dec *Decoder) GetRef(tag byte) (Value, error) {
@@ -251,7 +481,7 @@ func (dec *Decoder) DecodeRef() (byte, ref, error) {
 		return 0, ref(0), fmt.Errorf("Codec: unexpected tag (%v) while decoding ref", tag)
 	}
 	switch subtag {
-	case T_String, T_List, T_Dict, T_Set, T_Tuple, T_Function, T_Funcode:
+	case T_String, T_List, T_Dict, T_Set, T_Tuple, T_Function, T_Generator, T_Future, T_Funcode:
 	default:
 		return 0, ref(0), fmt.Errorf("Codec: unexpected reference tag (%v) while decoding ref", subtag)
 	}
@@ -329,6 +559,7 @@ func (enc *Encoder) EncodeFuncode(fc *compile.Funcode) {
 	enc.WriteUvarint(uint64(fc.NumParams))
 	enc.EncodeBool(Bool(fc.HasVarargs))
 	enc.EncodeBool(Bool(fc.HasKwargs))
+	enc.EncodeBool(Bool(fc.Generator))
 	if len(enc.funcodes) == 0 {
 		enc.funcodes = make(map[*compile.Funcode]ref)
 	}
@@ -371,25 +602,22 @@ func (dec *Decoder) DecodeFuncode() (*compile.Funcode, error) {
 	}
 	fc.Name = string(name)
 	// Code
-	var count uint64
-	count, err = dec.DecodeUvarint()
+	var count int
+	count, err = dec.decodeLength()
 	if err != nil {
 		return fc, fmt.Errorf("Codec: unexpected error while decoding funcode: %v", err)
 	}
-	if int(count) > dec.Remaining() {
-		return fc, ErrShortBuffer
-	}
 	code := make([]byte, count)
 	copy(code, dec.Data)
 	fc.Code = code
 	dec.Data = dec.Data[count:]
 	// Pclinetab
-	count, err = dec.DecodeUvarint()
+	count, err = dec.decodeLength()
 	if err != nil {
 		return fc, fmt.Errorf("Codec: unexpected error while decoding funcode: %v", err)
 	}
 	pcline := make([]uint16, count)
-	for i := uint64(0); i < count; i++ {
+	for i := 0; i < count; i++ {
 		var x uint64
 		x, err = dec.DecodeUvarint()
 		if err != nil {
@@ -399,30 +627,30 @@ func (dec *Decoder) DecodeFuncode() (*compile.Funcode, error) {
 	}
 	fc.Pclinetab = pcline
 	// Locals
-	count, err = dec.DecodeUvarint()
+	count, err = dec.decodeLength()
 	if err != nil {
 		return fc, fmt.Errorf("Codec: unexpected error while decoding funcode: %v", err)
 	}
 	fc.Locals = make([]compile.Ident, count)
-	for i := uint64(0); i < count; i++ {
+	for i := 0; i < count; i++ {
 		fc.Locals[i], err = dec.DecodeIdent()
 		if err != nil {
 			return fc, fmt.Errorf("Codec: unexpected error while decoding funcode: %v", err)
 		}
 	}
 	// Freevars
-	count, err = dec.DecodeUvarint()
+	count, err = dec.decodeLength()
 	if err != nil {
 		return fc, fmt.Errorf("Codec: unexpected error while decoding funcode: %v", err)
 	}
 	fc.Freevars = make([]compile.Ident, count)
-	for i := uint64(0); i < count; i++ {
+	for i := 0; i < count; i++ {
 		fc.Freevars[i], err = dec.DecodeIdent()
 		if err != nil {
 			return fc, fmt.Errorf("Codec: unexpected error while decoding funcode: %v", err)
 		}
 	}
-	// MaxStack, NumParams, HasVarargs, HasKwargs
+	// MaxStack, NumParams, HasVarargs, HasKwargs, Generator
 	var maxstack, numparams uint64
 	maxstack, err = dec.DecodeUvarint()
 	if err != nil {
@@ -432,6 +660,13 @@ func (dec *Decoder) DecodeFuncode() (*compile.Funcode, error) {
 	if err != nil {
 		return fc, fmt.Errorf("Codec: unexpected error while decoding funcode: %v", err)
 	}
+	// The interpreter allocates the stack of a frame according to MaxStack:
+	if max := dec.limits.orDefault().MaxLength; maxstack > uint64(max) {
+		return fc, dec.exceeded("MaxLength", max)
+	}
+	if numparams > uint64(len(fc.Locals)) {
+		return fc, fmt.Errorf("Codec: unexpected error while decoding funcode: %d parameters exceed %d locals", numparams, len(fc.Locals))
+	}
 	fc.MaxStack, fc.NumParams = int(maxstack), int(numparams)
 	var hasvargs, haskwargs Bool
 	hasvargs, err = dec.DecodeBool()
@@ -442,13 +677,24 @@ func (dec *Decoder) DecodeFuncode() (*compile.Funcode, error) {
 	if err != nil {
 		return fc, fmt.Errorf("Codec: unexpected error while decoding funcode: %v", err)
 	}
+	var generator Bool
+	generator, err = dec.DecodeBool()
+	if err != nil {
+		return fc, fmt.Errorf("Codec: unexpected error while decoding funcode: %v", err)
+	}
+	if max := dec.limits.orDefault().MaxRefs; len(dec.values)+len(dec.funcodes) >= max {
+		return fc, dec.exceeded("MaxRefs", max)
+	}
 	dec.funcodes = append(dec.funcodes, fc)
-	fc.HasVarargs, fc.HasKwargs = bool(hasvargs), bool(haskwargs)
+	fc.HasVarargs, fc.HasKwargs, fc.Generator = bool(hasvargs), bool(haskwargs), bool(generator)
 	return fc, nil
 }
 
 func (enc *Encoder) EncodeValue(v Value) {
+	enc.spill()
 	switch t := v.(type) {
+	case nil, NoneType:
+		enc.WriteTag(T_None)
 	case Bool:
 		enc.EncodeBool(t)
 	case Int:
@@ -467,27 +713,32 @@ func (enc *Encoder) EncodeValue(v Value) {
 		enc.EncodeTuple(t)
 	case *Function:
 		enc.EncodeFunction(t)
+	case *Generator:
+		enc.EncodeGenerator(t)
+	case *Future:
+		enc.EncodeFuture(t)
 	case *Builtin:
 		enc.EncodeBuiltin(t)
 	case rangeValue:
 		enc.EncodeRange(t)
 	case ExceptionKind:
 		enc.WriteTag(T_BaseException)
-	case TypeError:
-		enc.WriteTag(T_TypeError)
-		enc.EncodeString(String(t.Error()))
-	case ValueError:
-		enc.WriteTag(T_ValueError)
-		enc.EncodeString(String(t.Error()))
-	case IOError:
-		enc.WriteTag(T_IOError)
-		enc.EncodeString(String(t.Error()))
+	case TypeError, ValueError, IOError, MemoryError, KeyError, IndexError, ZeroDivisionError,
+		AttributeError, NameError, OverflowError, RecursionError, ExceptionInstance:
+		enc.encodeException(t.(classException))
+	case *ExceptionClass:
+		enc.EncodeExceptionClass(t)
 	case Codable:
+		typeName := encodedTypeName(t)
+		if !enc.types.hasValueDecoder(typeName) {
+			enc.unencodable(v)
+			return
+		}
 		enc.WriteTag(T_Custom)
-		enc.EncodeString(String(t.Type()))
+		enc.EncodeString(String(typeName))
 		t.Encode(enc)
 	default:
-		enc.WriteTag(T_None)
+		enc.unencodable(v)
 	}
 }
 
@@ -495,6 +746,10 @@ func (dec *Decoder) DecodeValue() (Value, error) {
 	if dec.Remaining() < 2 {
 		return nil, ErrShortBuffer
 	}
+	if err := dec.enter(); err != nil {
+		return nil, err
+	}
+	defer dec.leave()
 	tag := dec.Data[0]
 	switch tag {
 	case T_None:
@@ -512,6 +767,10 @@ func (dec *Decoder) DecodeValue() (Value, error) {
 		return dec.DecodeStringIterable()
 	case T_Function:
 		return dec.DecodeFunction()
+	case T_Generator:
+		return dec.DecodeGenerator()
+	case T_Future:
+		return dec.DecodeFuture()
 	case T_Builtin:
 		return dec.DecodeBuiltin()
 	case T_List:
@@ -527,27 +786,11 @@ func (dec *Decoder) DecodeValue() (Value, error) {
 	case T_BaseException:
 		dec.Data = dec.Data[1:]
 		return BaseException, nil
-	case T_TypeError:
-		dec.Data = dec.Data[1:]
-		msg, err := dec.DecodeString()
-		if err != nil {
-			return None, fmt.Errorf("Codec: error while decoding type-error: %s", err.Error())
-		}
-		return NewTypeError(errors.New(string(msg))), nil
-	case T_ValueError:
-		dec.Data = dec.Data[1:]
-		msg, err := dec.DecodeString()
-		if err != nil {
-			return None, fmt.Errorf("Codec: error while decoding value-error: %s", err.Error())
-		}
-		return NewValueError(errors.New(string(msg))), nil
-	case T_IOError:
-		dec.Data = dec.Data[1:]
-		msg, err := dec.DecodeString()
-		if err != nil {
-			return None, fmt.Errorf("Codec: error while decoding IO-error: %s", err.Error())
-		}
-		return NewIOError(errors.New(string(msg))), nil
+	case T_TypeError, T_ValueError, T_IOError, T_MemoryError, T_KeyError, T_IndexError, T_ZeroDivisionError,
+		T_AttributeError, T_NameError, T_OverflowError, T_RecursionError, T_ExceptionInstance:
+		return dec.decodeException()
+	case T_ExceptionClass:
+		return dec.DecodeExceptionClass()
 	case T_Ref:
 		return dec.GetRef(dec.Data[1])
 	case T_Custom:
@@ -556,7 +799,10 @@ func (dec *Decoder) DecodeValue() (Value, error) {
 		if err != nil {
 			return nil, fmt.Errorf("Codec: missing type name for custom type decoder: %v", err)
 		}
-		if custom := CustomDecoders[string(typeName)]; custom != nil {
+		if custom := dec.types.valueDecoder(string(typeName)); custom != nil {
+			return custom(dec)
+		}
+		if custom := dec.types.exceptionDecoder(string(typeName)); custom != nil {
 			return custom(dec)
 		}
 		return nil, fmt.Errorf("Codec: missing custom decoder for type %s", string(typeName))
@@ -605,13 +851,10 @@ func (dec *Decoder) DecodeInt() (Int, error) {
 		return Int{}, fmt.Errorf("Codec: unexpected tag (%v) while decoding int", tag)
 	}
 	dec.Data = dec.Data[1:]
-	size, err := dec.DecodeUvarint()
+	size, err := dec.decodeLength()
 	if err != nil {
 		return Int{}, fmt.Errorf("Codec: unexpected error while decoding int: %v", err)
 	}
-	if int(size) > dec.Remaining() {
-		return Int{}, ErrShortBuffer
-	}
 	raw := make([]byte, size)
 	copy(raw, dec.Data)
 	dec.Data = dec.Data[size:]
@@ -631,6 +874,7 @@ func (dec *Decoder) DecodeFloat() (Float, error) {
 	if tag != T_Float {
 		return Float(0.0), fmt.Errorf("Codec: unexpected tag (%v) while decoding float", tag)
 	}
+	dec.Data = dec.Data[1:]
 	u, err := dec.DecodeUvarint()
 	if err != nil {
 		return Float(0.0), fmt.Errorf("Codec: unexpected error while decoding float: %v", err)
@@ -672,15 +916,14 @@ func (dec *Decoder) DecodeString() (String, error) {
 	if tag != T_String {
 		return String(""), fmt.Errorf("Codec: unexpected tag (%v) while decoding string", tag)
 	}
-	size, err := dec.DecodeUvarint()
+	size, err := dec.decodeLength()
 	if err != nil {
 		return String(""), fmt.Errorf("Codec: unexpected error while decoding string: %v", err)
 	}
-	if dec.Remaining() < int(size) {
-		return String(""), ErrShortBuffer
-	}
 	s := String(string(dec.Data[:size]))
-	dec.values = append(dec.values, s)
+	if err = dec.addRef(s); err != nil {
+		return String(""), err
+	}
 	dec.Data = dec.Data[size:]
 	return s, nil
 }
@@ -735,10 +978,162 @@ func (dec *Decoder) DecodeFunction() (*Function, error) {
 		return fn, fmt.Errorf("Codec: unexpected error while decoding function: %v", err)
 	}
 
-	dec.values = append(dec.values, fn)
+	if err = dec.addRef(fn); err != nil {
+		return fn, err
+	}
 	return fn, nil
 }
 
+// EncodeGenerator encodes a generator, along with the suspended frame of its function.
+// A generator may be referred to by its own frame, hence it is referenceable before its contents.
+func (enc *Encoder) EncodeGenerator(g *Generator) {
+	if r, ok := enc.gens[g]; ok {
+		enc.EncodeRef(T_Generator, r)
+		return
+	}
+	enc.WriteTag(T_Generator)
+	if enc.gens == nil {
+		enc.gens = make(map[*Generator]ref)
+	}
+	enc.gens[g] = enc.nextRef()
+	location := enc.location
+	enc.EncodeFunction(g.fn)
+	if g.frame != nil {
+		enc.EncodeFrame(g.frame)
+	} else {
+		enc.WriteTag(T_None)
+	}
+	enc.location = location
+}
+
+func (dec *Decoder) DecodeGenerator() (*Generator, error) {
+	if dec.Remaining() < 2 {
+		return nil, ErrShortBuffer
+	}
+	tag := dec.Data[0]
+	if tag == T_Ref {
+		v, err := dec.GetRef(T_Generator)
+		if err != nil {
+			return nil, fmt.Errorf("Codec: unexpected error while decoding generator: %v", err)
+		}
+		g, ok := v.(*Generator)
+		if !ok {
+			return nil, fmt.Errorf("Codec: unexpected error while decoding generator: %v", ErrBadRef)
+		}
+		return g, nil
+	}
+	dec.Data = dec.Data[1:]
+	if tag != T_Generator {
+		return nil, fmt.Errorf("Codec: unexpected tag (%v) while decoding generator", tag)
+	}
+	g := &Generator{}
+	var err error
+	if err = dec.addRef(g); err != nil {
+		return nil, err
+	}
+	g.fn, err = dec.DecodeFunction()
+	if err != nil {
+		return nil, fmt.Errorf("Codec: unexpected error while decoding generator: %v", err)
+	}
+	if dec.Remaining() < 1 {
+		return nil, ErrShortBuffer
+	}
+	if dec.Data[0] == T_None {
+		dec.Data = dec.Data[1:]
+		return g, nil
+	}
+	g.frame, err = dec.DecodeFrame()
+	if err != nil {
+		return nil, fmt.Errorf("Codec: unexpected error while decoding generator: %v", err)
+	}
+	return g, nil
+}
+
+// EncodeFuture encodes a future: its deferred call, and its result once it is resolved.
+// A future may be referred to by the arguments of its call, hence it is referenceable
+// before its contents.
+func (enc *Encoder) EncodeFuture(f *Future) {
+	if r, ok := enc.futures[f]; ok {
+		enc.EncodeRef(T_Future, r)
+		return
+	}
+	enc.WriteTag(T_Future)
+	if enc.futures == nil {
+		enc.futures = make(map[*Future]ref)
+	}
+	enc.futures[f] = enc.nextRef()
+	enc.EncodeValue(f.fn)
+	enc.EncodeTuple(f.args)
+	enc.WriteUvarint(uint64(len(f.kwargs)))
+	for _, kv := range f.kwargs {
+		enc.EncodeTuple(kv)
+	}
+	enc.EncodeBool(Bool(f.result != nil))
+	if f.result != nil {
+		enc.EncodeValue(f.result)
+	}
+}
+
+func (dec *Decoder) DecodeFuture() (*Future, error) {
+	if dec.Remaining() < 2 {
+		return nil, ErrShortBuffer
+	}
+	tag := dec.Data[0]
+	if tag == T_Ref {
+		v, err := dec.GetRef(T_Future)
+		if err != nil {
+			return nil, fmt.Errorf("Codec: unexpected error while decoding future: %v", err)
+		}
+		f, ok := v.(*Future)
+		if !ok {
+			return nil, fmt.Errorf("Codec: unexpected error while decoding future: %v", ErrBadRef)
+		}
+		return f, nil
+	}
+	dec.Data = dec.Data[1:]
+	if tag != T_Future {
+		return nil, fmt.Errorf("Codec: unexpected tag (%v) while decoding future", tag)
+	}
+	f := &Future{}
+	var err error
+	if err = dec.addRef(f); err != nil {
+		return nil, err
+	}
+	v, err := dec.DecodeValue()
+	if err != nil {
+		return nil, fmt.Errorf("Codec: unexpected error while decoding future: %v", err)
+	}
+	fn, ok := v.(Callable)
+	if !ok {
+		return nil, fmt.Errorf("Codec: unexpected %s while decoding future", v.Type())
+	}
+	f.fn = fn
+	if f.args, err = dec.DecodeTuple(); err != nil {
+		return nil, fmt.Errorf("Codec: unexpected error while decoding future: %v", err)
+	}
+	n, err := dec.decodeLength()
+	if err != nil {
+		return nil, fmt.Errorf("Codec: unexpected error while decoding future: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		kv, err := dec.DecodeTuple()
+		if err != nil {
+			return nil, fmt.Errorf("Codec: unexpected error while decoding future: %v", err)
+		}
+		f.kwargs = append(f.kwargs, kv)
+	}
+	resolved, err := dec.DecodeBool()
+	if err != nil {
+		return nil, fmt.Errorf("Codec: unexpected error while decoding future: %v", err)
+	}
+	if resolved {
+		if f.result, err = dec.DecodeValue(); err != nil {
+			return nil, fmt.Errorf("Codec: unexpected error while decoding future: %v", err)
+		}
+	}
+	return f, nil
+}
+
 func (enc *Encoder) EncodeList(l *List) {
 	if r, ok := enc.lists[l]; ok {
 		enc.EncodeRef(T_List, r)
@@ -780,13 +1175,13 @@ func (dec *Decoder) DecodeList() (*List, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Codec: unexpected error while decoding list: %v", err)
 	}
-	var size uint64
-	size, err = dec.DecodeUvarint()
+	var size int
+	size, err = dec.decodeLength()
 	if err != nil {
 		return nil, fmt.Errorf("Codec: unexpected error while decoding list: %v", err)
 	}
 	elems := make([]Value, size)
-	for i := uint64(0); i < size; i++ {
+	for i := 0; i < size; i++ {
 		elems[i], err = dec.DecodeValue()
 		if err != nil {
 			return nil, fmt.Errorf("Codec: unexpected error while decoding list: %v", err)
@@ -796,7 +1191,9 @@ func (dec *Decoder) DecodeList() (*List, error) {
 	if frozen {
 		l.Freeze()
 	}
-	dec.values = append(dec.values, l)
+	if err = dec.addRef(l); err != nil {
+		return nil, err
+	}
 	return l, nil
 }
 
@@ -843,12 +1240,12 @@ func (dec *Decoder) DecodeDict() (*Dict, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Codec: unexpected error while decoding dict: %v", err)
 	}
-	size, err := dec.DecodeUvarint()
+	size, err := dec.decodeLength()
 	if err != nil {
 		return nil, fmt.Errorf("Codec: unexpected error while decoding dict: %v", err)
 	}
 	d := &Dict{}
-	for i := uint64(0); i < size; i++ {
+	for i := 0; i < size; i++ {
 		var k Value
 		k, err = dec.DecodeValue()
 		if err != nil {
@@ -866,7 +1263,9 @@ func (dec *Decoder) DecodeDict() (*Dict, error) {
 	if frozen {
 		d.Freeze()
 	}
-	dec.values = append(dec.values, d)
+	if err = dec.addRef(d); err != nil {
+		return nil, err
+	}
 	return d, nil
 }
 
@@ -912,13 +1311,13 @@ func (dec *Decoder) DecodeSet() (*Set, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Codec: unexpected error while decoding set: %v", err)
 	}
-	var size uint64
-	size, err = dec.DecodeUvarint()
+	var size int
+	size, err = dec.decodeLength()
 	if err != nil {
 		return nil, fmt.Errorf("Codec: unexpected error while decoding set: %v", err)
 	}
 	s := &Set{}
-	for i := uint64(0); i < size; i++ {
+	for i := 0; i < size; i++ {
 		var v Value
 		v, err = dec.DecodeValue()
 		if err != nil {
@@ -931,7 +1330,9 @@ func (dec *Decoder) DecodeSet() (*Set, error) {
 	if frozen {
 		s.Freeze()
 	}
-	dec.values = append(dec.values, s)
+	if err = dec.addRef(s); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -972,12 +1373,12 @@ func (dec *Decoder) DecodeTuple() (Tuple, error) {
 	if tag != T_Tuple {
 		return nil, fmt.Errorf("Codec: unexpected tag (%v) while decoding tuple", tag)
 	}
-	size, err := dec.DecodeUvarint()
+	size, err := dec.decodeLength()
 	if err != nil {
 		return nil, fmt.Errorf("Codec: unexpected error while decoding tuple: %v", err)
 	}
 	t := make(Tuple, size)
-	for i := uint64(0); i < size; i++ {
+	for i := 0; i < size; i++ {
 		var v Value
 		v, err = dec.DecodeValue()
 		if err != nil {
@@ -985,7 +1386,9 @@ func (dec *Decoder) DecodeTuple() (Tuple, error) {
 		}
 		t[i] = v
 	}
-	dec.values = append(dec.values, t)
+	if err = dec.addRef(t); err != nil {
+		return nil, err
+	}
 	return t, nil
 }
 
@@ -1017,6 +1420,11 @@ func (dec *Decoder) DecodeBuiltin() (*Builtin, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Codec: unexpected error while decoding builtin: %v", err)
 	}
+	return dec.builtin(name, recv)
+}
+
+// builtin returns the built-in function or method with the given name, which is bound to recv unless it is None.
+func (dec *Decoder) builtin(name String, recv Value) (*Builtin, error) {
 	if recv == nil || recv == None {
 		if v, ok := Universe[string(name)]; ok {
 			if builtin, ok2 := v.(*Builtin); ok2 {
@@ -1030,6 +1438,9 @@ func (dec *Decoder) DecodeBuiltin() (*Builtin, error) {
 			}
 			return nil, fmt.Errorf("Codec: invalid builtin retrieved; name=%s", string(name))
 		}
+		if string(name) == interruptBuiltin.Name() {
+			return interruptBuiltin, nil // the frame of an interrupted thread
+		}
 		return nil, fmt.Errorf("Codec: builtin not found; name=%s", string(name))
 	}
 	method := builtinMethodOf(recv, string(name))
@@ -1079,9 +1490,163 @@ func (dec *Decoder) DecodeRange() (rangeValue, error) {
 		return r, fmt.Errorf("Codec: unexpected error while decoding range length: %v", err)
 	}
 	r.len = int(length)
+	if r.step == 0 || r.len < 0 {
+		return r, fmt.Errorf("Codec: invalid range while decoding (step %d, length %d)", r.step, r.len)
+	}
 	return r, nil
 }
 
+// exceptionTags holds the tags of the exceptions of the built-in Go types, by their class.
+var exceptionTags = map[*ExceptionClass]byte{
+	TypeErrorClass:         T_TypeError,
+	ValueErrorClass:        T_ValueError,
+	IOErrorClass:           T_IOError,
+	MemoryErrorClass:       T_MemoryError,
+	KeyErrorClass:          T_KeyError,
+	IndexErrorClass:        T_IndexError,
+	ZeroDivisionErrorClass: T_ZeroDivisionError,
+	AttributeErrorClass:    T_AttributeError,
+	NameErrorClass:         T_NameError,
+	OverflowErrorClass:     T_OverflowError,
+	RecursionErrorClass:    T_RecursionError,
+}
+
+// encodeException encodes an exception of a built-in Go type, or an ExceptionInstance and
+// its class, by its message, the arguments it was created with, if any, and its traceback.
+func (enc *Encoder) encodeException(x classException) {
+	if instance, ok := x.(ExceptionInstance); ok {
+		enc.WriteTag(T_ExceptionInstance)
+		enc.EncodeExceptionClass(instance.class)
+	} else {
+		enc.WriteTag(exceptionTags[x.Class()])
+	}
+	err, traceback := untraced(x.Unwrap())
+	enc.EncodeString(String(x.Error()))
+	args, ok := err.(exceptionArgs)
+	enc.EncodeBool(Bool(ok))
+	if ok {
+		enc.EncodeTuple(args.args)
+	}
+	enc.EncodeString(String(traceback))
+}
+
+func (dec *Decoder) decodeException() (Exception, error) {
+	if dec.Remaining() < 4 {
+		return nil, ErrShortBuffer
+	}
+	tag := dec.Data[0]
+	dec.Data = dec.Data[1:]
+	var class *ExceptionClass
+	if tag == T_ExceptionInstance {
+		var err error
+		if class, err = dec.DecodeExceptionClass(); err != nil {
+			return nil, fmt.Errorf("Codec: unexpected error while decoding exception: %v", err)
+		}
+	} else {
+		for c, t := range exceptionTags {
+			if t == tag {
+				class = c
+			}
+		}
+		if class == nil {
+			return nil, fmt.Errorf("Codec: unexpected tag (%v) while decoding exception", tag)
+		}
+	}
+	msg, err := dec.DecodeString()
+	if err != nil {
+		return nil, fmt.Errorf("Codec: unexpected error while decoding %s: %v", tagNames[tag], err)
+	}
+	hasArgs, err := dec.DecodeBool()
+	if err != nil {
+		return nil, fmt.Errorf("Codec: unexpected error while decoding %s: %v", tagNames[tag], err)
+	}
+	cause := errors.New(string(msg))
+	if hasArgs {
+		args, err := dec.DecodeTuple()
+		if err != nil {
+			return nil, fmt.Errorf("Codec: unexpected error while decoding %s: %v", tagNames[tag], err)
+		}
+		cause = exceptionArgs{args}
+	}
+	traceback, err := dec.DecodeString()
+	if err != nil {
+		return nil, fmt.Errorf("Codec: unexpected error while decoding %s: %v", tagNames[tag], err)
+	}
+	return class.newException(traced(cause, string(traceback))), nil
+}
+
+// EncodeExceptionClass encodes a class of exceptions by its name and those of its bases.
+func (enc *Encoder) EncodeExceptionClass(c *ExceptionClass) {
+	enc.WriteTag(T_ExceptionClass)
+	enc.EncodeString(String(c.name))
+	enc.EncodeBool(Bool(c.base != nil))
+	if c.base != nil {
+		enc.EncodeExceptionClass(c.base)
+	}
+}
+
+// DecodeExceptionClass decodes a class of exceptions. The classes of the built-in exceptions
+// are decoded by their names, and the other classes are decoded as the class predeclared under
+// their name, if its base matches, or else are created again by NewExceptionClass once per decoder.
+func (dec *Decoder) DecodeExceptionClass() (*ExceptionClass, error) {
+	if dec.Remaining() < 3 {
+		return nil, ErrShortBuffer
+	}
+	if err := dec.enter(); err != nil {
+		return nil, err
+	}
+	defer dec.leave()
+	tag := dec.Data[0]
+	dec.Data = dec.Data[1:]
+	if tag != T_ExceptionClass {
+		return nil, fmt.Errorf("Codec: unexpected tag (%v) while decoding exception class", tag)
+	}
+	name, err := dec.DecodeString()
+	if err != nil {
+		return nil, fmt.Errorf("Codec: unexpected error while decoding exception class: %v", err)
+	}
+	hasBase, err := dec.DecodeBool()
+	if err != nil {
+		return nil, fmt.Errorf("Codec: unexpected error while decoding exception class: %v", err)
+	}
+	var base *ExceptionClass
+	if hasBase {
+		if base, err = dec.DecodeExceptionClass(); err != nil {
+			return nil, err
+		}
+	}
+	return dec.exceptionClass(string(name), base), nil
+}
+
+// decodedClasses holds the classes of exceptions created by a decoder, by their name and base.
+type decodedClasses map[exceptionClassKey]*ExceptionClass
+
+// An exceptionClassKey identifies a decoded class of exceptions by its name and base.
+type exceptionClassKey struct {
+	name string
+	base *ExceptionClass
+}
+
+// exceptionClass returns the class of exceptions with the given name and base (see DecodeExceptionClass).
+func (dec *Decoder) exceptionClass(name string, base *ExceptionClass) *ExceptionClass {
+	if c := builtinExceptionClass(name); c != nil {
+		return c
+	}
+	if c, ok := dec.predeclared[name].(*ExceptionClass); ok && c.name == name && c.base == base {
+		return c
+	}
+	key := exceptionClassKey{name, base}
+	if c := dec.classes[key]; c != nil {
+		return c
+	}
+	if dec.classes == nil {
+		dec.classes = make(decodedClasses)
+	}
+	c := NewExceptionClass(name, base)
+	dec.classes[key] = c
+	return c
+}
+
 func (enc *Encoder) EncodeStringIterable(it stringIterable) {
 	enc.WriteTag(T_StringIterable)
 	enc.EncodeString(it.s)
@@ -1118,9 +1683,6 @@ func (dec *Decoder) DecodeStringIterable() (stringIterable, error) {
 }
 
 func (enc *Encoder) EncodeIterator(it Iterator) {
-	if it == nil {
-		enc.WriteTag(T_None)
-	}
 	switch t := it.(type) {
 	case *stringIterator:
 		enc.WriteTag(T_StringIterator)
@@ -1146,14 +1708,21 @@ func (enc *Encoder) EncodeIterator(it Iterator) {
 		enc.WriteTag(T_RangeIterator)
 		enc.EncodeRange(t.r)
 		enc.WriteVarint(int64(t.i))
+	case *Generator:
+		enc.EncodeGenerator(t)
 	case Codable:
+		typeName := encodedTypeName(t)
+		if enc.types.iteratorDecoder(typeName) == nil {
+			enc.unencodable(it)
+			return
+		}
 		enc.WriteTag(T_CustomIterator)
-		enc.EncodeString(String(t.Type()))
+		enc.EncodeString(String(typeName))
 		t.Encode(enc)
 	case nil:
 		enc.WriteTag(T_None)
 	default:
-		enc.WriteTag(T_None)
+		enc.unencodable(it)
 	}
 }
 
@@ -1162,7 +1731,19 @@ func (dec *Decoder) DecodeIterator() (Iterator, error) {
 		return nil, ErrShortBuffer
 	}
 	var err error
+	if err = dec.enter(); err != nil {
+		return nil, err
+	}
+	defer dec.leave()
 	tag := dec.Data[0]
+	// Generators are iterators of their own, which may be referred to:
+	if tag == T_Generator || tag == T_Ref && dec.Remaining() > 1 && dec.Data[1] == T_Generator {
+		g, err := dec.DecodeGenerator()
+		if err != nil {
+			return nil, err
+		}
+		return g, nil
+	}
 	dec.Data = dec.Data[1:]
 	switch tag {
 	case T_None:
@@ -1178,6 +1759,9 @@ func (dec *Decoder) DecodeIterator() (Iterator, error) {
 		if err != nil {
 			return &it, fmt.Errorf("Codec: unexpected error while decoding string iterator: %v", err)
 		}
+		if i < 0 || i > int64(len(it.si.s)) {
+			return &it, fmt.Errorf("Codec: out of bounds index (%d) while decoding string iterator", i)
+		}
 		it.i = int(i)
 		return &it, nil
 	case T_ListIterator:
@@ -1191,10 +1775,20 @@ func (dec *Decoder) DecodeIterator() (Iterator, error) {
 		if err != nil {
 			return &it, fmt.Errorf("Codec: unexpected error while decoding list iterator: %v", err)
 		}
+		if i < 0 {
+			return &it, fmt.Errorf("Codec: out of bounds index (%d) while decoding list iterator", i)
+		}
 		it.i = int(i)
+		// Like the encoded iterator, the decoded one prevents the list from being modified until it is done:
+		if !it.l.frozen {
+			it.l.itercount++
+		}
 		return &it, nil
 	case T_KeyIterator:
 		it := keyIterator{}
+		if dec.Remaining() < 1 {
+			return &it, ErrShortBuffer
+		}
 		switch dec.Data[0] {
 		case T_Dict:
 			var d *Dict
@@ -1215,6 +1809,9 @@ func (dec *Decoder) DecodeIterator() (Iterator, error) {
 			it.owner = d
 			it.ht = &d.ht
 			it.offset = uint(offset)
+			if !it.ht.frozen {
+				it.ht.itercount++
+			}
 			return &it, nil
 		case T_Set:
 			var s *Set
@@ -1235,6 +1832,9 @@ func (dec *Decoder) DecodeIterator() (Iterator, error) {
 			it.owner = s
 			it.ht = &s.ht
 			it.offset = uint(offset)
+			if !it.ht.frozen {
+				it.ht.itercount++
+			}
 			return &it, nil
 		default:
 			return &it, fmt.Errorf("Codec: unexpected error while decoding key iterator: %v", ErrBadTag)
@@ -1242,7 +1842,10 @@ func (dec *Decoder) DecodeIterator() (Iterator, error) {
 	case T_TupleIterator:
 		it := tupleIterator{}
 		it.elems, err = dec.DecodeTuple()
-		return &it, fmt.Errorf("Codec: unexpected error while decoding tuple iterator: %v", err)
+		if err != nil {
+			return &it, fmt.Errorf("Codec: unexpected error while decoding tuple iterator: %v", err)
+		}
+		return &it, nil
 	case T_RangeIterator:
 		it := rangeIterator{}
 		it.r, err = dec.DecodeRange()
@@ -1254,14 +1857,17 @@ func (dec *Decoder) DecodeIterator() (Iterator, error) {
 		if err != nil {
 			return &it, fmt.Errorf("Codec: unexpected error while decoding range iterator: %v", err)
 		}
+		if i < 0 {
+			return &it, fmt.Errorf("Codec: out of bounds index (%d) while decoding range iterator", i)
+		}
 		it.i = int(i)
-		return &it, err
+		return &it, nil
 	case T_CustomIterator:
 		typeName, err := dec.DecodeString()
 		if err != nil {
 			return nil, fmt.Errorf("Codec: missing type name while decoding custom iterator: %v", err)
 		}
-		if custom := CustomIteratorDecoders[string(typeName)]; custom != nil {
+		if custom := dec.types.iteratorDecoder(string(typeName)); custom != nil {
 			return custom(dec)
 		}
 		return nil, fmt.Errorf("Codec: missing custom iterator decoder for type %s", string(typeName))
@@ -0,0 +1,1667 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylark
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/skylark/internal/compile"
+	"github.com/google/skylark/syntax"
+)
+
+// CodecJSONFormat is the format identifier of the JSON rendering of the state of a Skylark thread.
+//
+// The JSON rendering holds the same sections as the binary encoding of a state:
+//
+//	{
+//	  "format": "sky@json",
+//	  "version": {"codec": n, "compiler": n, "opcodes": n, "tags": n},
+//	  "signature": "base64",
+//	  "metadata": {"key": "value", ...},
+//	  "steps": 1234,
+//	  "allocs": 5678,
+//	  "program": {
+//	    "loads": [ident, ...],
+//	    "names": ["name", ...],
+//	    "constants": [value, ...],
+//	    "globals": [ident, ...],
+//	    "functions": [funcode, ...],
+//	    "toplevel": funcode
+//	  },
+//	  "predeclared": {"name": value, ...},
+//	  "globals": [{"name": "x", "value": value}, ...],
+//	  "constants": [value, ...],
+//	  "frames": [frame, ...]
+//	}
+//
+// The version is that of the interpreter which rendered the state (see CurrentSnapshotVersion).
+// Positions are rendered as "file:line:col", and identifiers as {"name": "x", "pos": "f.sky:1:1"}.
+// A funcode holds the name, position, parameters and locals of a compiled function, along with
+// its bytecode in base64. Functions refer to their funcode by its index in the program's functions,
+// where the index following the last function refers to the toplevel.
+//
+// Frames are listed from the bottom of the call stack up to the frame which suspended the thread:
+//
+//	{
+//	  "callable": value,
+//	  "pos": "f.sky:3:12", "callpc": 21, "pc": 24, "sp": 1,
+//	  "locals": [{"name": "x", "value": value}, ...],
+//	  "stack": [value, ...],
+//	  "iterators": [iterator, ...],
+//	  "handlers": [{"pc": 30, "sp": 0}, ...],
+//	  "args": [value, ...],
+//	  "kwargs": [[name, value], ...],
+//	  "state": value
+//	}
+//
+// Values are rendered as follows:
+//
+//	None          null
+//	bool          true, false
+//	int           {"int": "123"}
+//	float         {"float": "1.5"}
+//	string        "text", or {"bytes": "base64"} if it isn't valid UTF-8
+//	list          {"list": [value, ...], "frozen": true}
+//	dict          {"dict": [[key, value], ...], "frozen": true}
+//	set           {"set": [value, ...], "frozen": true}
+//	tuple         {"tuple": [value, ...]}
+//	function      {"function": 2, "name": "f", "defaults": [value, ...], "freevars": [value, ...]}
+//	generator     {"generator": function, "frame": frame}, without a frame once it is finished
+//	future        {"future": value, "args": [value, ...], "kwargs": [[name, value], ...], "result": value},
+//	              without a result until it is resolved
+//	built-in      {"builtin": "name", "recv": value}
+//	range         {"range": {"start": 0, "stop": 10, "step": 1, "len": 10}}
+//	exceptions    {"base_exception": true}, {"type_error": "msg"}, {"value_error": "msg"}, {"io_error": "msg"},
+//	              {"memory_error": "msg"}, {"key_error": "msg"}, {"index_error": "msg"},
+//	              {"zero_division_error": "msg"}, {"attribute_error": "msg"}, {"name_error": "msg"},
+//	              {"overflow_error": "msg"}, {"recursion_error": "msg"},
+//	              {"exception_instance": "msg", "class": class}, each with "args": [value, ...]
+//	              if it was created by a call, and "traceback": "..." once it was raised
+//	classes       {"exception_class": "name", "base": class}, without a base for Exception
+//	custom        {"custom": "type", "data": "base64"}
+//
+// and iterators as follows:
+//
+//	{"string_iterator": {"string_iterable": value, "codepoints": true, "ords": true}, "index": 3}
+//	{"list_iterator": list, "index": 3}
+//	{"key_iterator": dict or set, "offset": 3}
+//	{"tuple_iterator": tuple}
+//	{"range_iterator": range, "index": 3}
+//	{"custom_iterator": "type", "data": "base64"}
+//
+// where generators are rendered as values.
+//
+// Lists, dicts, sets, tuples, functions, generators and futures which occur more than once within the
+// state are given an "id" where they first occur, and are rendered as {"ref": id} elsewhere, such
+// that shared and cyclic values are preserved. Fields which are false or empty are omitted.
+// Names of functions and variables are informational, and are ignored when decoding.
+//
+// The data of custom values and iterators is their binary encoding by Codable.Encode,
+// within which values are not shared with the rest of the state.
+//
+// The signature is only present if the rendering was signed. It covers the canonical form of the
+// rest of the document, i.e. without whitespace and with the keys of all objects sorted, such that
+// it remains valid if the document is reformatted, but not if any of its contents are edited.
+const CodecJSONFormat = "sky@json"
+
+// jsonBytes is the key of the rendering of strings which aren't valid UTF-8.
+const jsonBytes = "bytes"
+
+// EncodeStateJSON renders the re-entrant state of the given Skylark thread as JSON.
+func EncodeStateJSON(thread *Thread) ([]byte, error) {
+	return NewEncoder().EncodeStateJSON(thread)
+}
+
+// DecodeStateJSON decodes the JSON rendering of a re-entrant state into a resumable Skylark thread.
+func DecodeStateJSON(data []byte, predeclared StringDict) (*Thread, error) {
+	return NewDecoder(nil, predeclared).DecodeStateJSON(data)
+}
+
+type jsonState struct {
+	Format      string                 `json:"format"`
+	Version     SnapshotVersion        `json:"version"`
+	Signature   string                 `json:"signature,omitempty"`
+	Metadata    map[string]string      `json:"metadata,omitempty"`
+	Steps       uint64                 `json:"steps,omitempty"`
+	Allocs      uint64                 `json:"allocs,omitempty"`
+	Program     *jsonProgram           `json:"program"`
+	Predeclared map[string]interface{} `json:"predeclared"`
+	Globals     []jsonVariable         `json:"globals"`
+	Constants   []interface{}          `json:"constants"`
+	Frames      []*jsonFrame           `json:"frames"`
+}
+
+type jsonProgram struct {
+	Loads     []jsonIdent    `json:"loads"`
+	Names     []string       `json:"names"`
+	Constants []interface{}  `json:"constants"`
+	Globals   []jsonIdent    `json:"globals"`
+	Functions []*jsonFuncode `json:"functions"`
+	Toplevel  *jsonFuncode   `json:"toplevel"`
+}
+
+type jsonFuncode struct {
+	Name       string      `json:"name"`
+	Pos        string      `json:"pos"`
+	Code       []byte      `json:"code"`
+	Pclinetab  []uint16    `json:"pclinetab"`
+	Locals     []jsonIdent `json:"locals,omitempty"`
+	Freevars   []jsonIdent `json:"freevars,omitempty"`
+	MaxStack   int         `json:"max_stack"`
+	NumParams  int         `json:"num_params"`
+	HasVarargs bool        `json:"has_varargs,omitempty"`
+	HasKwargs  bool        `json:"has_kwargs,omitempty"`
+	Generator  bool        `json:"generator,omitempty"`
+}
+
+type jsonIdent struct {
+	Name string `json:"name"`
+	Pos  string `json:"pos"`
+}
+
+type jsonVariable struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+type jsonFrame struct {
+	Callable  interface{}     `json:"callable"`
+	Pos       string          `json:"pos"`
+	CallPC    uint32          `json:"callpc"`
+	PC        uint32          `json:"pc"`
+	SP        uint32          `json:"sp"`
+	Locals    []jsonVariable  `json:"locals,omitempty"`
+	Stack     []interface{}   `json:"stack,omitempty"`
+	Iterators []interface{}   `json:"iterators,omitempty"`
+	Handlers  []jsonHandler   `json:"handlers,omitempty"`
+	Args      []interface{}   `json:"args,omitempty"`
+	Kwargs    [][]interface{} `json:"kwargs,omitempty"`
+	State     interface{}     `json:"state,omitempty"`
+}
+
+type jsonHandler struct {
+	PC uint32 `json:"pc"`
+	SP uint32 `json:"sp"`
+}
+
+// A jsonObject is the rendering of a value other than None, a bool or a string.
+type jsonObject map[string]interface{}
+
+// A jsonShared records the rendering of a value which may occur more than once.
+type jsonShared struct {
+	obj  jsonObject
+	refs int // number of other occurrences of the value
+	id   int // id of the value, if it is referred to
+}
+
+// A jsonRef renders an occurrence of a shared value, other than the first.
+type jsonRef struct {
+	target *jsonShared
+}
+
+func (r jsonRef) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`{"%s":%d}`, tagNames[T_Ref], r.target.id)), nil
+}
+
+// A jsonEncoder renders a state as JSON, reporting unencodable values to its Encoder.
+type jsonEncoder struct {
+	*Encoder
+	funcodes map[*compile.Funcode]int    // index of the funcodes of the program
+	shared   map[interface{}]*jsonShared // keyed like the maps of the Encoder
+	order    []*jsonShared               // shared values in the order they were rendered
+}
+
+// EncodeStateJSON renders the re-entrant state of the given Skylark thread as indented JSON.
+// Unlike EncodeState, the rendering isn't compressed, and always holds the program.
+// If the encoder has a signer, the rendering is signed in its "signature" field.
+func (enc *Encoder) EncodeStateJSON(thread *Thread) ([]byte, error) {
+	if thread.SuspendedFrame() != nil {
+		thread.Resumable()
+	}
+	je := &jsonEncoder{
+		Encoder:  enc,
+		funcodes: make(map[*compile.Funcode]int),
+		shared:   make(map[interface{}]*jsonShared),
+	}
+	state, err := je.state(thread.frame)
+	if err != nil {
+		return nil, err
+	}
+	state.Metadata, state.Steps, state.Allocs = thread.Metadata, thread.steps, thread.allocs
+	if len(enc.errors) > 0 && !enc.lossy {
+		return nil, enc.errors[0]
+	}
+	// Only the values which are referred to are given an id, in the order of their first occurrence:
+	id := 0
+	for _, s := range je.order {
+		if s.refs > 0 {
+			id++
+			s.id, s.obj["id"] = id, id
+		}
+	}
+	out, err := renderJSON(state, "  ")
+	if err != nil || enc.signer == nil {
+		return out, err
+	}
+	payload, err := canonicalJSON(out)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := enc.signer.Sign(payload)
+	if err != nil {
+		return nil, fmt.Errorf("Codec: error while signing state: %v", err)
+	}
+	state.Signature = base64.StdEncoding.EncodeToString(signature)
+	return renderJSON(state, "  ")
+}
+
+// renderJSON renders a value as JSON, indented by the given string unless it is empty.
+func renderJSON(v interface{}, indent string) ([]byte, error) {
+	var out bytes.Buffer
+	e := json.NewEncoder(&out)
+	e.SetEscapeHTML(false)
+	if indent != "" {
+		e.SetIndent("", indent)
+	}
+	if err := e.Encode(v); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// canonicalJSON returns the canonical form of a JSON state without its signature, which is
+// the payload signed by the signature. Numbers are kept as they were written.
+func canonicalJSON(data []byte) ([]byte, error) {
+	var doc map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("Codec: invalid JSON state: %v", err)
+	}
+	delete(doc, "signature")
+	return renderJSON(doc, "")
+}
+
+func (je *jsonEncoder) state(top *Frame) (*jsonState, error) {
+	var frames []*Frame
+	var anyFn *Function
+	for fr := top; fr != nil; fr = fr.parent {
+		// The leaf function is assumed to have suspended the thread, and all other functions within
+		// the current call-stack must be resumable.
+		if fr != top && !fr.isResumable() {
+			return nil, fmt.Errorf("Codec: suspended thread has non-resumable function on call-stack: %s", fr.callable.Name())
+		}
+		if fn, ok := fr.callable.(*Function); ok && anyFn == nil {
+			anyFn = fn
+		}
+		frames = append(frames, fr)
+	}
+	if anyFn == nil {
+		return nil, errors.New("Codec: missing Skylark function on call-stack of suspended thread")
+	}
+
+	state := &jsonState{
+		Format:      CodecJSONFormat,
+		Version:     currentVersion,
+		Program:     je.program(anyFn.funcode.Prog),
+		Predeclared: make(map[string]interface{}, len(anyFn.predeclared)),
+		Globals:     make([]jsonVariable, len(anyFn.globals)),
+		Constants:   make([]interface{}, len(anyFn.constants)),
+	}
+	// Shared values are rendered in the order they are decoded, hence predeclared values are sorted:
+	names := make([]string, 0, len(anyFn.predeclared))
+	for name := range anyFn.predeclared {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// Predeclared values are supplied again to the decoder, hence those which cannot be
+		// rendered are rendered as null rather than reported (see EncodeFnShared):
+		je.location = codecLocation{kind: "predeclared variable", name: name}
+		errors := len(je.errors)
+		state.Predeclared[name] = je.value(anyFn.predeclared[name])
+		je.errors = je.errors[:errors]
+	}
+	for i, v := range anyFn.globals {
+		je.location = codecLocation{kind: "global variable", index: i}
+		if i < len(anyFn.funcode.Prog.Globals) {
+			je.location.name = anyFn.funcode.Prog.Globals[i].Name
+		}
+		state.Globals[i] = jsonVariable{Name: je.location.name, Value: je.value(v)}
+	}
+	for i, v := range anyFn.constants {
+		je.location = codecLocation{kind: "constant", index: i}
+		state.Constants[i] = je.value(v)
+	}
+	for i := len(frames) - 1; i >= 0; i-- {
+		state.Frames = append(state.Frames, je.frame(frames[i]))
+	}
+	je.location = codecLocation{}
+	return state, nil
+}
+
+func (je *jsonEncoder) program(p *compile.Program) *jsonProgram {
+	jp := &jsonProgram{
+		Loads:     jsonIdents(p.Loads),
+		Names:     p.Names,
+		Constants: make([]interface{}, len(p.Constants)),
+		Globals:   jsonIdents(p.Globals),
+		Functions: make([]*jsonFuncode, len(p.Functions)),
+		Toplevel:  jsonFuncodeOf(p.Toplevel),
+	}
+	for i, c := range p.Constants {
+		switch t := c.(type) {
+		case string:
+			jp.Constants[i] = je.value(String(t))
+		case int64:
+			jp.Constants[i] = je.value(MakeInt64(t))
+		case *big.Int:
+			jp.Constants[i] = je.value(Int{bigint: t})
+		case float64:
+			jp.Constants[i] = je.value(Float(t))
+		}
+	}
+	for i, fc := range p.Functions {
+		je.funcodes[fc] = i
+		jp.Functions[i] = jsonFuncodeOf(fc)
+	}
+	je.funcodes[p.Toplevel] = len(p.Functions)
+	return jp
+}
+
+func jsonFuncodeOf(fc *compile.Funcode) *jsonFuncode {
+	return &jsonFuncode{
+		Name:       fc.Name,
+		Pos:        jsonPosition(fc.Pos),
+		Code:       fc.Code,
+		Pclinetab:  fc.Pclinetab,
+		Locals:     jsonIdents(fc.Locals),
+		Freevars:   jsonIdents(fc.Freevars),
+		MaxStack:   fc.MaxStack,
+		NumParams:  fc.NumParams,
+		HasVarargs: fc.HasVarargs,
+		HasKwargs:  fc.HasKwargs,
+		Generator:  fc.Generator,
+	}
+}
+
+func jsonIdents(ids []compile.Ident) []jsonIdent {
+	out := make([]jsonIdent, len(ids))
+	for i, id := range ids {
+		out[i] = jsonIdent{Name: id.Name, Pos: jsonPosition(id.Pos)}
+	}
+	return out
+}
+
+func jsonPosition(pos syntax.Position) string {
+	return fmt.Sprintf("%s:%d:%d", pos.Filename(), pos.Line, pos.Col)
+}
+
+func (je *jsonEncoder) frame(fr *Frame) *jsonFrame {
+	name := fr.Callable().Name()
+	je.location = codecLocation{kind: "frame", name: name}
+	f := &jsonFrame{
+		Callable: je.value(fr.Callable().(Value)),
+		Pos:      jsonPosition(fr.Position()),
+		CallPC:   fr.callpc,
+		PC:       fr.pc,
+		SP:       fr.sp,
+	}
+	var locals []compile.Ident
+	if fn, isFunction := fr.callable.(*Function); isFunction {
+		locals = fn.funcode.Locals
+	}
+	for i, v := range fr.stack[:len(locals)+int(fr.sp)] {
+		if i < len(locals) {
+			je.location = codecLocation{kind: "local variable", name: locals[i].Name, fn: name}
+			f.Locals = append(f.Locals, jsonVariable{Name: locals[i].Name, Value: je.value(v)})
+		} else {
+			je.location = codecLocation{kind: "stack slot", index: i - len(locals), fn: name}
+			f.Stack = append(f.Stack, je.value(v))
+		}
+	}
+	for i, it := range fr.iterstack {
+		je.location = codecLocation{kind: "iterator", index: i, fn: name}
+		f.Iterators = append(f.Iterators, je.iterator(it))
+	}
+	for _, h := range fr.exhandlers {
+		f.Handlers = append(f.Handlers, jsonHandler{PC: h.pc, SP: h.sp})
+	}
+	je.location = codecLocation{kind: "arguments", name: "*args", fn: name}
+	f.Args = je.values(fr.args)
+	je.location = codecLocation{kind: "arguments", name: "**kwargs", fn: name}
+	for _, kv := range fr.kwargs {
+		f.Kwargs = append(f.Kwargs, je.values(kv))
+	}
+	je.location = codecLocation{kind: "suspended state", index: -1, fn: name}
+	f.State = je.value(fr.state)
+	je.location = codecLocation{}
+	return f
+}
+
+// share returns a reference to a value which was rendered before, or else records
+// that the value is rendered by obj.
+func (je *jsonEncoder) share(key interface{}, obj jsonObject) (interface{}, bool) {
+	if s, ok := je.shared[key]; ok {
+		s.refs++
+		return jsonRef{s}, true
+	}
+	s := &jsonShared{obj: obj}
+	je.shared[key] = s
+	je.order = append(je.order, s)
+	return obj, false
+}
+
+func (je *jsonEncoder) values(vs []Value) []interface{} {
+	out := make([]interface{}, len(vs))
+	for i, v := range vs {
+		out[i] = je.value(v)
+	}
+	return out
+}
+
+// exception renders an exception of a built-in Go type, or an ExceptionInstance and its class.
+func (je *jsonEncoder) exception(x classException) interface{} {
+	var obj jsonObject
+	if instance, ok := x.(ExceptionInstance); ok {
+		obj = jsonObject{tagNames[T_ExceptionInstance]: jsonString(x.Error()), "class": je.exceptionClass(instance.class)}
+	} else {
+		obj = jsonObject{tagNames[exceptionTags[x.Class()]]: jsonString(x.Error())}
+	}
+	err, traceback := untraced(x.Unwrap())
+	if args, ok := err.(exceptionArgs); ok {
+		obj["args"] = je.values(args.args)
+	}
+	if traceback != "" {
+		obj["traceback"] = jsonString(traceback)
+	}
+	return obj
+}
+
+func (je *jsonEncoder) exceptionClass(c *ExceptionClass) interface{} {
+	obj := jsonObject{tagNames[T_ExceptionClass]: jsonString(c.name)}
+	if c.base != nil {
+		obj["base"] = je.exceptionClass(c.base)
+	}
+	return obj
+}
+
+func jsonString(s string) interface{} {
+	if utf8.ValidString(s) {
+		return s
+	}
+	return jsonObject{jsonBytes: []byte(s)}
+}
+
+func (je *jsonEncoder) value(v Value) interface{} {
+	switch t := v.(type) {
+	case nil, NoneType:
+		return nil
+	case Bool:
+		return bool(t)
+	case Int:
+		return jsonObject{tagNames[T_Int]: t.String()}
+	case Float:
+		return jsonObject{tagNames[T_Float]: strconv.FormatFloat(float64(t), 'g', -1, 64)}
+	case String:
+		return jsonString(string(t))
+	case *List:
+		obj := jsonObject{}
+		if r, ok := je.share(t, obj); ok {
+			return r
+		}
+		obj[tagNames[T_List]] = je.values(t.elems)
+		if t.frozen {
+			obj["frozen"] = true
+		}
+		return obj
+	case *Dict:
+		obj := jsonObject{}
+		if r, ok := je.share(&t.ht, obj); ok {
+			return r
+		}
+		items := t.Items()
+		pairs := make([]interface{}, len(items))
+		for i, item := range items {
+			pairs[i] = je.values(item)
+		}
+		obj[tagNames[T_Dict]] = pairs
+		if t.ht.frozen {
+			obj["frozen"] = true
+		}
+		return obj
+	case *Set:
+		obj := jsonObject{}
+		if r, ok := je.share(&t.ht, obj); ok {
+			return r
+		}
+		obj[tagNames[T_Set]] = je.values(t.elems())
+		if t.ht.frozen {
+			obj["frozen"] = true
+		}
+		return obj
+	case Tuple:
+		obj := jsonObject{}
+		// All empty tuples are alike:
+		if len(t) > 0 {
+			if r, ok := je.share(tupleKey{&t[0], len(t)}, obj); ok {
+				return r
+			}
+		}
+		obj[tagNames[T_Tuple]] = je.values(t)
+		return obj
+	case *Function:
+		index, ok := je.funcodes[t.funcode]
+		if !ok {
+			// Only the functions of the program of the suspended thread can be resumed.
+			je.reportUnencodable(v)
+			return nil
+		}
+		obj := jsonObject{}
+		if r, ok := je.share(t, obj); ok {
+			return r
+		}
+		obj[tagNames[T_Function]], obj["name"] = index, t.Name()
+		if len(t.defaults) > 0 {
+			obj["defaults"] = je.values(t.defaults)
+		}
+		if len(t.freevars) > 0 {
+			obj["freevars"] = je.values(t.freevars)
+		}
+		return obj
+	case *Generator:
+		obj := jsonObject{}
+		if r, ok := je.share(t, obj); ok {
+			return r
+		}
+		location := je.location
+		obj[tagNames[T_Generator]] = je.value(t.fn)
+		if t.frame != nil {
+			obj["frame"] = je.frame(t.frame)
+		}
+		je.location = location
+		return obj
+	case *Future:
+		obj := jsonObject{}
+		if r, ok := je.share(t, obj); ok {
+			return r
+		}
+		obj[tagNames[T_Future]] = je.value(t.fn)
+		if len(t.args) > 0 {
+			obj["args"] = je.values(t.args)
+		}
+		if len(t.kwargs) > 0 {
+			kwargs := make([]interface{}, len(t.kwargs))
+			for i, kv := range t.kwargs {
+				kwargs[i] = je.values(kv)
+			}
+			obj["kwargs"] = kwargs
+		}
+		if t.result != nil {
+			obj["result"] = je.value(t.result)
+		}
+		return obj
+	case *Builtin:
+		obj := jsonObject{tagNames[T_Builtin]: t.name}
+		if t.recv != nil {
+			obj["recv"] = je.value(t.recv)
+		}
+		return obj
+	case rangeValue:
+		return jsonObject{tagNames[T_Range]: jsonObject{"start": t.start, "stop": t.stop, "step": t.step, "len": t.len}}
+	case ExceptionKind:
+		return jsonObject{tagNames[T_BaseException]: true}
+	case TypeError, ValueError, IOError, MemoryError, KeyError, IndexError, ZeroDivisionError,
+		AttributeError, NameError, OverflowError, RecursionError, ExceptionInstance:
+		return je.exception(t.(classException))
+	case *ExceptionClass:
+		return je.exceptionClass(t)
+	case Codable:
+		typeName := encodedTypeName(t)
+		if !je.types.hasValueDecoder(typeName) {
+			je.reportUnencodable(v)
+			return nil
+		}
+		return jsonObject{tagNames[T_Custom]: typeName, "data": je.customData(t)}
+	default:
+		je.reportUnencodable(v)
+		return nil
+	}
+}
+
+func (je *jsonEncoder) iterator(it Iterator) interface{} {
+	switch t := it.(type) {
+	case nil:
+		return nil
+	case *stringIterator:
+		si := jsonObject{tagNames[T_StringIterable]: je.value(t.si.s)}
+		if t.si.codepoints {
+			si["codepoints"] = true
+		}
+		if t.si.ords {
+			si["ords"] = true
+		}
+		return jsonObject{tagNames[T_StringIterator]: si, "index": t.i}
+	case *listIterator:
+		return jsonObject{tagNames[T_ListIterator]: je.value(t.l), "index": t.i}
+	case *keyIterator:
+		owner, ok := t.owner.(Value)
+		if !ok {
+			je.reportUnencodable(it)
+			return nil
+		}
+		return jsonObject{tagNames[T_KeyIterator]: je.value(owner), "offset": t.offset}
+	case *tupleIterator:
+		return jsonObject{tagNames[T_TupleIterator]: je.value(t.elems)}
+	case *rangeIterator:
+		return jsonObject{tagNames[T_RangeIterator]: je.value(t.r), "index": t.i}
+	case *Generator:
+		return je.value(t)
+	case Codable:
+		typeName := encodedTypeName(t)
+		if je.types.iteratorDecoder(typeName) == nil {
+			je.reportUnencodable(it)
+			return nil
+		}
+		return jsonObject{tagNames[T_CustomIterator]: typeName, "data": je.customData(t)}
+	default:
+		je.reportUnencodable(it)
+		return nil
+	}
+}
+
+// customData returns the binary encoding of a custom value or iterator.
+func (je *jsonEncoder) customData(c Codable) []byte {
+	sub := je.types.orDefault().NewEncoder()
+	sub.location = je.location
+	c.Encode(sub)
+	je.errors = append(je.errors, sub.errors...)
+	return sub.Bytes()
+}
+
+// A jsonDecoder decodes the JSON rendering of a state, within the limits of its Decoder.
+type jsonDecoder struct {
+	*Decoder
+	program []*compile.Funcode // funcodes of the program, followed by its toplevel
+	ids     map[int64]Value    // shared values by their id
+}
+
+// DecodeStateJSON decodes the JSON rendering of a re-entrant state into a resumable thread.
+// If the rendering exceeds the decoder's limits, the error is a *DecodeLimitError.
+//
+// As with DecodeState, a decoder with a verifier rejects renderings which aren't signed by it with
+// ErrBadSignature, and renderings of other versions are upgraded by the migrations registered
+// using RegisterJSONMigration.
+func (dec *Decoder) DecodeStateJSON(data []byte) (*Thread, error) {
+	thread, err := dec.decodeStateJSON(data)
+	if err != nil && dec.limitErr != nil {
+		return nil, dec.limitErr
+	}
+	return thread, err
+}
+
+func (dec *Decoder) decodeStateJSON(data []byte) (*Thread, error) {
+	dec.depth, dec.limitErr = 0, nil
+	state, err := dec.parseStateJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	if dec.verifier != nil {
+		if err := dec.verifyJSON(data, state.Signature); err != nil {
+			return nil, err
+		}
+	}
+	if state.Version != currentVersion {
+		if data, err = migrate(&jsonMigrations, state.Version, data); err != nil {
+			return nil, err
+		}
+		// The version of the migrated rendering is that returned by its last migration:
+		if state, err = dec.parseStateJSON(data); err != nil {
+			return nil, err
+		}
+	}
+	if state.Program == nil {
+		return nil, errors.New("Codec: missing program in JSON state")
+	}
+
+	dec.metadata, dec.steps, dec.allocs = state.Metadata, state.Steps, state.Allocs
+	jd := &jsonDecoder{Decoder: dec, ids: make(map[int64]Value)}
+	if err := jd.decodeProgram(state.Program); err != nil {
+		return nil, err
+	}
+	if err := jd.decodeFnShared(state); err != nil {
+		return nil, err
+	}
+	var frame *Frame
+	for _, f := range state.Frames {
+		if f == nil {
+			return nil, errors.New("Codec: unexpected null frame in JSON state")
+		}
+		fr, err := jd.decodeFrame(f)
+		if err != nil {
+			return nil, err
+		}
+		fr.parent = frame
+		frame = fr
+	}
+	return dec.resumableThread(frame)
+}
+
+// parseStateJSON parses the JSON rendering of a state, and checks its format identifier.
+func (dec *Decoder) parseStateJSON(data []byte) (*jsonState, error) {
+	if max := dec.limits.orDefault().MaxStateSize; len(data) > max {
+		return nil, dec.exceeded("MaxStateSize", max)
+	}
+	state := new(jsonState)
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(state); err != nil {
+		return nil, fmt.Errorf("Codec: invalid JSON state: %v", err)
+	}
+	if d.More() {
+		return nil, errors.New("Codec: unexpected data after JSON state")
+	}
+	if state.Format != CodecJSONFormat {
+		return nil, fmt.Errorf("Codec: invalid format identifier %q of JSON state", state.Format)
+	}
+	return state, nil
+}
+
+// verifyJSON checks the signature of the JSON rendering of a state with the decoder's verifier.
+func (dec *Decoder) verifyJSON(data []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) == 0 || len(sig) > maxSignatureSize {
+		return ErrBadSignature
+	}
+	payload, err := canonicalJSON(data)
+	if err != nil || !dec.verifier.Verify(payload, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func (jd *jsonDecoder) decodeProgram(jp *jsonProgram) error {
+	prog := &compile.Program{Names: jp.Names}
+	var err error
+	if prog.Loads, err = parseJSONIdents(jp.Loads); err != nil {
+		return fmt.Errorf("Codec: unexpected error while decoding top level: %v", err)
+	}
+	if prog.Globals, err = parseJSONIdents(jp.Globals); err != nil {
+		return fmt.Errorf("Codec: unexpected error while decoding top level: %v", err)
+	}
+	prog.Constants = make([]interface{}, len(jp.Constants))
+	for i, x := range jp.Constants {
+		c, err := jd.decodeValue(x)
+		if err != nil {
+			return fmt.Errorf("Codec: unexpected error while decoding top level: %v", err)
+		}
+		if prog.Constants[i], err = programConstant(c); err != nil {
+			return err
+		}
+	}
+	if jp.Toplevel == nil {
+		return errors.New("Codec: missing toplevel while decoding top level")
+	}
+	for _, f := range append(jp.Functions, jp.Toplevel) {
+		fc, err := jd.decodeFuncode(f)
+		if err != nil {
+			return fmt.Errorf("Codec: unexpected error while decoding top level: %v", err)
+		}
+		jd.program = append(jd.program, fc)
+	}
+	prog.Functions, prog.Toplevel = jd.program[:len(jp.Functions)], jd.program[len(jp.Functions)]
+	jd.prog = prog
+	return nil
+}
+
+func (jd *jsonDecoder) decodeFuncode(f *jsonFuncode) (*compile.Funcode, error) {
+	if f == nil {
+		return nil, errors.New("Codec: unexpected null funcode")
+	}
+	max := jd.limits.orDefault()
+	if len(f.Code) > max.MaxLength || len(f.Pclinetab) > max.MaxLength {
+		return nil, jd.exceeded("MaxLength", max.MaxLength)
+	}
+	// The interpreter allocates the stack of a frame according to MaxStack:
+	if f.MaxStack < 0 || f.MaxStack > max.MaxLength {
+		return nil, jd.exceeded("MaxLength", max.MaxLength)
+	}
+	if f.NumParams < 0 || f.NumParams > len(f.Locals) {
+		return nil, fmt.Errorf("Codec: %d parameters exceed %d locals of funcode %s", f.NumParams, len(f.Locals), f.Name)
+	}
+	fc := &compile.Funcode{
+		Name:       f.Name,
+		Code:       f.Code,
+		Pclinetab:  f.Pclinetab,
+		MaxStack:   f.MaxStack,
+		NumParams:  f.NumParams,
+		HasVarargs: f.HasVarargs,
+		HasKwargs:  f.HasKwargs,
+		Generator:  f.Generator,
+	}
+	var err error
+	if fc.Pos, err = parseJSONPosition(f.Pos); err != nil {
+		return nil, err
+	}
+	if fc.Locals, err = parseJSONIdents(f.Locals); err != nil {
+		return nil, err
+	}
+	if fc.Freevars, err = parseJSONIdents(f.Freevars); err != nil {
+		return nil, err
+	}
+	if max := max.MaxRefs; len(jd.values)+len(jd.funcodes) >= max {
+		return nil, jd.exceeded("MaxRefs", max)
+	}
+	jd.funcodes = append(jd.funcodes, fc)
+	return fc, nil
+}
+
+func parseJSONIdents(ids []jsonIdent) ([]compile.Ident, error) {
+	out := make([]compile.Ident, len(ids))
+	for i, id := range ids {
+		pos, err := parseJSONPosition(id.Pos)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = compile.Ident{Name: id.Name, Pos: pos}
+	}
+	return out, nil
+}
+
+// parseJSONPosition parses a position rendered as "file:line:col", where the file may contain colons.
+func parseJSONPosition(s string) (syntax.Position, error) {
+	var line, col int64
+	var err error
+	i := strings.LastIndexByte(s, ':')
+	j := -1
+	if i > 0 {
+		j = strings.LastIndexByte(s[:i], ':')
+	}
+	if j >= 0 {
+		line, err = strconv.ParseInt(s[j+1:i], 10, 32)
+		if err == nil {
+			col, err = strconv.ParseInt(s[i+1:], 10, 32)
+		}
+	}
+	if j < 0 || err != nil {
+		return syntax.Position{}, fmt.Errorf("Codec: invalid position %q", s)
+	}
+	filename := s[:j]
+	return syntax.MakePosition(&filename, int32(line), int32(col)), nil
+}
+
+func (jd *jsonDecoder) decodeFnShared(state *jsonState) error {
+	predeclared := make(StringDict, len(state.Predeclared)+len(jd.predeclared))
+	for k, v := range jd.predeclared {
+		predeclared[k] = v
+	}
+	// Shared values are decoded in the order they were rendered:
+	names := make([]string, 0, len(state.Predeclared))
+	for name := range state.Predeclared {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v, err := jd.decodeValue(state.Predeclared[name])
+		if err != nil {
+			return fmt.Errorf("Codec: unexpected error while decoding predeclared variable %s: %v", name, err)
+		}
+		// The values supplied by the application take precedence:
+		if _, ok := jd.predeclared[name]; !ok {
+			predeclared[name] = v
+		}
+	}
+	jd.predeclared = predeclared
+	jd.globals = make([]Value, len(state.Globals))
+	for i, g := range state.Globals {
+		v, err := jd.decodeValue(g.Value)
+		if err != nil {
+			return fmt.Errorf("Codec: unexpected error while decoding global variable %s: %v", g.Name, err)
+		}
+		jd.globals[i] = v
+	}
+	jd.constants = make([]Value, len(state.Constants))
+	for i, x := range state.Constants {
+		v, err := jd.decodeValue(x)
+		if err != nil {
+			return fmt.Errorf("Codec: unexpected error while decoding constant #%d: %v", i, err)
+		}
+		jd.constants[i] = v
+	}
+	return nil
+}
+
+func (jd *jsonDecoder) decodeFrame(f *jsonFrame) (*Frame, error) {
+	frame := &Frame{callpc: f.CallPC, pc: f.PC, sp: f.SP}
+	var err error
+	if frame.posn, err = parseJSONPosition(f.Pos); err != nil {
+		return nil, fmt.Errorf("Codec: unexpected error while decoding frame: %v", err)
+	}
+	v, err := jd.decodeValue(f.Callable)
+	if err != nil {
+		return nil, fmt.Errorf("Codec: unexpected error while decoding frame: %v", err)
+	}
+	c, ok := v.(Callable)
+	if !ok {
+		return nil, fmt.Errorf("Codec: invalid callable while decoding frame, position: %s", frame.Position())
+	}
+	frame.callable = c
+	if fn, ok := c.(*Function); ok && len(f.Locals) != len(fn.funcode.Locals) {
+		return nil, fmt.Errorf("Codec: invalid frame of function %s with %d locals, expected %d", fn.Name(), len(f.Locals), len(fn.funcode.Locals))
+	}
+	if max := jd.limits.orDefault().MaxLength; len(f.Locals)+len(f.Stack) > max || len(f.Iterators) > max ||
+		len(f.Handlers) > max || len(f.Args) > max || len(f.Kwargs) > max {
+		return nil, jd.exceeded("MaxLength", max)
+	}
+	frame.stack = make([]Value, 0, len(f.Locals)+len(f.Stack))
+	for _, local := range f.Locals {
+		if v, err = jd.decodeValue(local.Value); err != nil {
+			return nil, fmt.Errorf("Codec: unexpected error while decoding local variable %s: %v", local.Name, err)
+		}
+		frame.stack = append(frame.stack, v)
+	}
+	for _, x := range f.Stack {
+		if v, err = jd.decodeValue(x); err != nil {
+			return nil, fmt.Errorf("Codec: unexpected error while decoding frame: %v", err)
+		}
+		frame.stack = append(frame.stack, v)
+	}
+	frame.iterstack = make([]Iterator, len(f.Iterators))
+	for i, x := range f.Iterators {
+		if frame.iterstack[i], err = jd.decodeIterator(x); err != nil {
+			return nil, fmt.Errorf("Codec: unexpected error while decoding frame: %v", err)
+		}
+	}
+	frame.exhandlers = make([]exceptionHandler, len(f.Handlers))
+	for i, h := range f.Handlers {
+		frame.exhandlers[i] = exceptionHandler{pc: h.PC, sp: h.SP}
+	}
+	if frame.args, err = jd.decodeValues(f.Args); err != nil {
+		return nil, fmt.Errorf("Codec: unexpected error while decoding frame: %v", err)
+	}
+	frame.kwargs = make([]Tuple, len(f.Kwargs))
+	for i, kv := range f.Kwargs {
+		if frame.kwargs[i], err = jd.decodeValues(kv); err != nil {
+			return nil, fmt.Errorf("Codec: unexpected error while decoding frame: %v", err)
+		}
+	}
+	if v, err = jd.decodeValue(f.State); err != nil {
+		return nil, fmt.Errorf("Codec: unexpected error while decoding frame: %v", err)
+	}
+	if v != None {
+		frame.state = v
+	}
+	return frame, nil
+}
+
+// jsonFrameOf returns the frame rendered by a decoded JSON object, e.g. the frame of a generator.
+func jsonFrameOf(x interface{}) (*jsonFrame, error) {
+	if _, ok := x.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("Codec: expected frame, found %s", jsonTypeName(x))
+	}
+	data, err := json.Marshal(x)
+	if err != nil {
+		return nil, err
+	}
+	var f jsonFrame
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&f); err != nil {
+		return nil, fmt.Errorf("Codec: invalid frame: %v", err)
+	}
+	return &f, nil
+}
+
+// define adds a decoded value to those which may be referred to, under the id of its rendering, if any.
+func (jd *jsonDecoder) define(obj jsonObject, v Value) error {
+	if err := jd.addRef(v); err != nil {
+		return err
+	}
+	x, ok := obj["id"]
+	if !ok {
+		return nil
+	}
+	id, err := jsonInt(x)
+	if err != nil {
+		return err
+	}
+	if _, dup := jd.ids[id]; dup {
+		return fmt.Errorf("Codec: duplicate id %d while decoding value", id)
+	}
+	jd.ids[id] = v
+	return nil
+}
+
+// array returns the elements of a rendered collection.
+func (jd *jsonDecoder) array(x interface{}) ([]interface{}, error) {
+	a, ok := x.([]interface{})
+	if !ok && x != nil {
+		return nil, fmt.Errorf("Codec: expected array, found %s", jsonTypeName(x))
+	}
+	if max := jd.limits.orDefault().MaxLength; len(a) > max {
+		return nil, jd.exceeded("MaxLength", max)
+	}
+	return a, nil
+}
+
+func (jd *jsonDecoder) decodeValues(xs []interface{}) (Tuple, error) {
+	t := make(Tuple, len(xs))
+	for i, x := range xs {
+		v, err := jd.decodeValue(x)
+		if err != nil {
+			return nil, err
+		}
+		t[i] = v
+	}
+	return t, nil
+}
+
+// exception decodes an exception of a built-in Go type, or an ExceptionInstance.
+func (jd *jsonDecoder) exception(obj jsonObject, tag byte, x interface{}) (Value, error) {
+	class, err := jd.exceptionClassOf(obj, tag)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := jd.decodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	cause := errors.New(string(msg))
+	if a, ok := obj["args"]; ok {
+		xs, err := jd.array(a)
+		if err != nil {
+			return nil, err
+		}
+		args, err := jd.decodeValues(xs)
+		if err != nil {
+			return nil, err
+		}
+		cause = exceptionArgs{args}
+	}
+	var traceback String
+	if tb, ok := obj["traceback"]; ok {
+		if traceback, err = jd.decodeString(tb); err != nil {
+			return nil, err
+		}
+	}
+	return class.newException(traced(cause, string(traceback))), nil
+}
+
+// exceptionClassOf decodes the class of an exception with the given tag.
+func (jd *jsonDecoder) exceptionClassOf(obj jsonObject, tag byte) (*ExceptionClass, error) {
+	if tag == T_ExceptionInstance {
+		x, ok := obj["class"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected exception class, found %s", jsonTypeName(obj["class"]))
+		}
+		return jd.exceptionClass(jsonObject(x), x[tagNames[T_ExceptionClass]])
+	}
+	for c, t := range exceptionTags {
+		if t == tag {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected tag %s", tagNames[tag])
+}
+
+// exceptionClass decodes a class of exceptions, named x (see DecodeExceptionClass).
+func (jd *jsonDecoder) exceptionClass(obj jsonObject, x interface{}) (*ExceptionClass, error) {
+	if err := jd.enter(); err != nil {
+		return nil, err
+	}
+	defer jd.leave()
+	name, err := jd.decodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	var base *ExceptionClass
+	if b, ok := obj["base"]; ok {
+		x, ok := b.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected exception class, found %s", jsonTypeName(b))
+		}
+		if base, err = jd.exceptionClass(jsonObject(x), x[tagNames[T_ExceptionClass]]); err != nil {
+			return nil, err
+		}
+	}
+	return jd.Decoder.exceptionClass(string(name), base), nil
+}
+
+// decodeElems decodes the elements of a rendered collection into vs, which must be as long as the collection.
+func (jd *jsonDecoder) decodeElems(xs []interface{}, vs []Value) error {
+	for i, x := range xs {
+		v, err := jd.decodeValue(x)
+		if err != nil {
+			return err
+		}
+		vs[i] = v
+	}
+	return nil
+}
+
+func (jd *jsonDecoder) decodeString(x interface{}) (String, error) {
+	var s string
+	switch t := x.(type) {
+	case string:
+		s = t
+	case map[string]interface{}:
+		b, ok := t[jsonBytes].(string)
+		if !ok {
+			return "", fmt.Errorf("Codec: expected string, found %s", jsonTypeName(x))
+		}
+		raw, err := base64.StdEncoding.DecodeString(b)
+		if err != nil {
+			return "", fmt.Errorf("Codec: unexpected error while decoding string: %v", err)
+		}
+		s = string(raw)
+	default:
+		return "", fmt.Errorf("Codec: expected string, found %s", jsonTypeName(x))
+	}
+	if max := jd.limits.orDefault().MaxLength; len(s) > max {
+		return "", jd.exceeded("MaxLength", max)
+	}
+	return String(s), nil
+}
+
+func (jd *jsonDecoder) decodeValue(x interface{}) (Value, error) {
+	if err := jd.enter(); err != nil {
+		return nil, err
+	}
+	defer jd.leave()
+	switch t := x.(type) {
+	case nil:
+		return None, nil
+	case bool:
+		return Bool(t), nil
+	case string:
+		return jd.decodeString(t)
+	case map[string]interface{}:
+		return jd.decodeObject(jsonObject(t))
+	default:
+		return nil, fmt.Errorf("Codec: unexpected %s while decoding value", jsonTypeName(x))
+	}
+}
+
+// jsonValueTags are the tags of the values which are rendered as objects, by their key.
+var jsonValueTags = []byte{
+	T_Ref, T_Int, T_Float, T_List, T_Dict, T_Set, T_Tuple, T_Function, T_Generator, T_Future, T_Builtin, T_Range,
+	T_StringIterable, T_BaseException, T_TypeError, T_ValueError, T_IOError, T_MemoryError, T_KeyError,
+	T_IndexError, T_ZeroDivisionError, T_AttributeError, T_NameError, T_OverflowError, T_RecursionError,
+	T_ExceptionClass, T_ExceptionInstance, T_Custom,
+}
+
+// jsonIteratorTags are the tags of the iterators, by their key.
+var jsonIteratorTags = []byte{
+	T_StringIterator, T_ListIterator, T_KeyIterator, T_TupleIterator, T_RangeIterator, T_CustomIterator,
+}
+
+// kind returns the tag of a rendered value or iterator, and the field which holds its contents.
+func (obj jsonObject) kind(tags []byte) (byte, interface{}) {
+	for _, tag := range tags {
+		if x, ok := obj[tagNames[tag]]; ok {
+			return tag, x
+		}
+	}
+	return 0, nil
+}
+
+func (jd *jsonDecoder) decodeObject(obj jsonObject) (Value, error) {
+	if _, ok := obj[jsonBytes]; ok {
+		return jd.decodeString(map[string]interface{}(obj))
+	}
+	tag, x := obj.kind(jsonValueTags)
+	v, err := jd.decodeKind(obj, tag, x)
+	if err != nil && tag != 0 {
+		return nil, fmt.Errorf("Codec: unexpected error while decoding %s: %v", tagNames[tag], err)
+	}
+	return v, err
+}
+
+func (jd *jsonDecoder) decodeKind(obj jsonObject, tag byte, x interface{}) (Value, error) {
+	switch tag {
+	case T_Ref:
+		id, err := jsonInt(x)
+		if err != nil {
+			return nil, err
+		}
+		v, ok := jd.ids[id]
+		if !ok {
+			return nil, ErrBadRef
+		}
+		return v, nil
+	case T_Int:
+		s, _ := x.(string)
+		if max := jd.limits.orDefault().MaxLength; len(s) > max {
+			return nil, jd.exceeded("MaxLength", max)
+		}
+		i, ok := new(big.Int).SetString(s, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid integer %q", s)
+		}
+		return Int{bigint: i}, nil
+	case T_Float:
+		s, _ := x.(string)
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		return Float(f), nil
+	case T_List:
+		elems, err := jd.array(x)
+		if err != nil {
+			return nil, err
+		}
+		// The list is defined before its elements, which may refer to it:
+		l := NewList(make([]Value, len(elems)))
+		if err = jd.define(obj, l); err != nil {
+			return nil, err
+		}
+		if err = jd.decodeElems(elems, l.elems); err != nil {
+			return nil, err
+		}
+		if obj["frozen"] == true {
+			l.Freeze()
+		}
+		return l, nil
+	case T_Dict:
+		items, err := jd.array(x)
+		if err != nil {
+			return nil, err
+		}
+		d := &Dict{}
+		if err = jd.define(obj, d); err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			pair, err := jd.array(item)
+			if err != nil {
+				return nil, err
+			}
+			if len(pair) != 2 {
+				return nil, fmt.Errorf("expected key and value, found %d elements", len(pair))
+			}
+			var kv [2]Value
+			if err = jd.decodeElems(pair, kv[:]); err != nil {
+				return nil, err
+			}
+			if err = d.Set(kv[0], kv[1]); err != nil {
+				return nil, err
+			}
+		}
+		if obj["frozen"] == true {
+			d.Freeze()
+		}
+		return d, nil
+	case T_Set:
+		elems, err := jd.array(x)
+		if err != nil {
+			return nil, err
+		}
+		s := &Set{}
+		if err = jd.define(obj, s); err != nil {
+			return nil, err
+		}
+		for _, elem := range elems {
+			v, err := jd.decodeValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			if err = s.Insert(v); err != nil {
+				return nil, err
+			}
+		}
+		if obj["frozen"] == true {
+			s.Freeze()
+		}
+		return s, nil
+	case T_Tuple:
+		elems, err := jd.array(x)
+		if err != nil {
+			return nil, err
+		}
+		t := make(Tuple, len(elems))
+		if err = jd.define(obj, t); err != nil {
+			return nil, err
+		}
+		if err = jd.decodeElems(elems, t); err != nil {
+			return nil, err
+		}
+		return t, nil
+	case T_Function:
+		index, err := jsonInt(x)
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || index >= int64(len(jd.program)) {
+			return nil, fmt.Errorf("out of bounds funcode index (%d)", index)
+		}
+		fn := &Function{funcode: jd.program[index]}
+		if err = jd.define(obj, fn); err != nil {
+			return nil, err
+		}
+		for _, field := range []struct {
+			name string
+			t    *Tuple
+		}{{"defaults", &fn.defaults}, {"freevars", &fn.freevars}} {
+			elems, err := jd.array(obj[field.name])
+			if err != nil {
+				return nil, err
+			}
+			*field.t = make(Tuple, len(elems))
+			if err = jd.decodeElems(elems, *field.t); err != nil {
+				return nil, err
+			}
+		}
+		return fn, nil
+	case T_Generator:
+		// The generator is defined before its frame, which may refer to it:
+		g := &Generator{}
+		if err := jd.define(obj, g); err != nil {
+			return nil, err
+		}
+		v, err := jd.decodeValue(x)
+		if err != nil {
+			return nil, err
+		}
+		fn, ok := v.(*Function)
+		if !ok {
+			return nil, fmt.Errorf("unexpected %s", v.Type())
+		}
+		g.fn = fn
+		if f := obj["frame"]; f != nil {
+			jf, err := jsonFrameOf(f)
+			if err != nil {
+				return nil, err
+			}
+			if g.frame, err = jd.decodeFrame(jf); err != nil {
+				return nil, err
+			}
+		}
+		return g, nil
+	case T_Future:
+		// The future is defined before its arguments, which may refer to it:
+		f := &Future{}
+		if err := jd.define(obj, f); err != nil {
+			return nil, err
+		}
+		v, err := jd.decodeValue(x)
+		if err != nil {
+			return nil, err
+		}
+		fn, ok := v.(Callable)
+		if !ok {
+			return nil, fmt.Errorf("unexpected %s", v.Type())
+		}
+		f.fn = fn
+		args, err := jd.array(obj["args"])
+		if err != nil {
+			return nil, err
+		}
+		if f.args, err = jd.decodeValues(args); err != nil {
+			return nil, err
+		}
+		kwargs, err := jd.array(obj["kwargs"])
+		if err != nil {
+			return nil, err
+		}
+		for _, x := range kwargs {
+			kv, err := jd.array(x)
+			if err != nil {
+				return nil, err
+			}
+			t, err := jd.decodeValues(kv)
+			if err != nil {
+				return nil, err
+			}
+			f.kwargs = append(f.kwargs, t)
+		}
+		if x, ok := obj["result"]; ok {
+			if f.result, err = jd.decodeValue(x); err != nil {
+				return nil, err
+			}
+		}
+		return f, nil
+	case T_Builtin:
+		name, ok := x.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected name, found %s", jsonTypeName(x))
+		}
+		recv, err := jd.decodeValue(obj["recv"])
+		if err != nil {
+			return nil, err
+		}
+		return jd.builtin(String(name), recv)
+	case T_Range:
+		fields, ok := x.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected object, found %s", jsonTypeName(x))
+		}
+		var r rangeValue
+		for _, field := range []struct {
+			name string
+			n    *int
+		}{{"start", &r.start}, {"stop", &r.stop}, {"step", &r.step}, {"len", &r.len}} {
+			n, err := jsonInt(fields[field.name])
+			if err != nil {
+				return nil, err
+			}
+			*field.n = int(n)
+		}
+		if r.step == 0 || r.len < 0 {
+			return nil, fmt.Errorf("invalid range (step %d, length %d)", r.step, r.len)
+		}
+		return r, nil
+	case T_StringIterable:
+		s, err := jd.decodeString(x)
+		if err != nil {
+			return nil, err
+		}
+		return stringIterable{s: s, codepoints: obj["codepoints"] == true, ords: obj["ords"] == true}, nil
+	case T_BaseException:
+		return BaseException, nil
+	case T_TypeError, T_ValueError, T_IOError, T_MemoryError, T_KeyError, T_IndexError, T_ZeroDivisionError,
+		T_AttributeError, T_NameError, T_OverflowError, T_RecursionError, T_ExceptionInstance:
+		return jd.exception(obj, tag, x)
+	case T_ExceptionClass:
+		return jd.exceptionClass(obj, x)
+	case T_Custom:
+		typeName, _ := x.(string)
+		sub, err := jd.customDecoder(obj)
+		if err != nil {
+			return nil, err
+		}
+		var v Value
+		if custom := jd.types.valueDecoder(typeName); custom != nil {
+			v, err = custom(sub)
+		} else if custom := jd.types.exceptionDecoder(typeName); custom != nil {
+			v, err = custom(sub)
+		} else {
+			return nil, fmt.Errorf("missing custom decoder for type %s", typeName)
+		}
+		if err == nil {
+			err = jd.endCustom(sub)
+		}
+		return v, err
+	default:
+		return nil, fmt.Errorf("Codec: unrecognized object while decoding value")
+	}
+}
+
+func (jd *jsonDecoder) decodeIterator(x interface{}) (Iterator, error) {
+	if x == nil {
+		return nil, nil
+	}
+	m, ok := x.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Codec: unexpected %s while decoding iterator", jsonTypeName(x))
+	}
+	obj := jsonObject(m)
+	tag, x := obj.kind(jsonIteratorTags)
+	it, err := jd.decodeIteratorKind(obj, tag, x)
+	if err != nil && tag != 0 {
+		return nil, fmt.Errorf("Codec: unexpected error while decoding %s: %v", tagNames[tag], err)
+	}
+	return it, err
+}
+
+func (jd *jsonDecoder) decodeIteratorKind(obj jsonObject, tag byte, x interface{}) (Iterator, error) {
+	if tag == T_CustomIterator {
+		typeName, _ := x.(string)
+		custom := jd.types.iteratorDecoder(typeName)
+		if custom == nil {
+			return nil, fmt.Errorf("missing custom iterator decoder for type %s", typeName)
+		}
+		sub, err := jd.customDecoder(obj)
+		if err != nil {
+			return nil, err
+		}
+		it, err := custom(sub)
+		if err == nil {
+			err = jd.endCustom(sub)
+		}
+		return it, err
+	}
+	if tag == 0 {
+		// Generators are iterators of their own, rendered as values:
+		if tag, _ := obj.kind(jsonValueTags); tag == T_Generator || tag == T_Ref {
+			v, err := jd.decodeValue(map[string]interface{}(obj))
+			if err != nil {
+				return nil, err
+			}
+			if g, ok := v.(*Generator); ok {
+				return g, nil
+			}
+			return nil, fmt.Errorf("Codec: unexpected %s while decoding iterator", v.Type())
+		}
+		return nil, fmt.Errorf("Codec: unrecognized object while decoding iterator")
+	}
+
+	v, err := jd.decodeValue(x)
+	if err != nil {
+		return nil, err
+	}
+	var index int64
+	if x, ok := obj["index"]; ok {
+		if index, err = jsonInt(x); err != nil {
+			return nil, err
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("out of bounds index (%d)", index)
+	}
+	switch tag {
+	case T_StringIterator:
+		si, ok := v.(stringIterable)
+		if !ok {
+			break
+		}
+		if index > int64(len(si.s)) {
+			return nil, fmt.Errorf("out of bounds index (%d)", index)
+		}
+		return &stringIterator{si: si, i: int(index)}, nil
+	case T_ListIterator:
+		if l, ok := v.(*List); ok {
+			// Like the encoded iterator, the decoded one prevents the list from being modified until it is done:
+			if !l.frozen {
+				l.itercount++
+			}
+			return &listIterator{l: l, i: int(index)}, nil
+		}
+	case T_KeyIterator:
+		offset, err := jsonInt(obj["offset"])
+		if err != nil {
+			return nil, err
+		}
+		var ht *hashtable
+		switch owner := v.(type) {
+		case *Dict:
+			ht = &owner.ht
+		case *Set:
+			ht = &owner.ht
+		default:
+			return nil, fmt.Errorf("unexpected %s", v.Type())
+		}
+		e := ht.head
+		for i := int64(0); i < offset && e != nil; i++ {
+			e = e.next
+		}
+		if !ht.frozen {
+			ht.itercount++
+		}
+		return &keyIterator{owner: v, ht: ht, e: e, offset: uint(offset)}, nil
+	case T_TupleIterator:
+		if t, ok := v.(Tuple); ok {
+			return &tupleIterator{elems: t}, nil
+		}
+	case T_RangeIterator:
+		if r, ok := v.(rangeValue); ok {
+			return &rangeIterator{r: r, i: int(index)}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s", v.Type())
+}
+
+// customDecoder returns a decoder of the binary encoding of a custom value or iterator.
+func (jd *jsonDecoder) customDecoder(obj jsonObject) (*Decoder, error) {
+	s, _ := obj["data"].(string)
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	sub := jd.types.orDefault().NewDecoder(data, jd.predeclared).SetLimits(jd.limits)
+	sub.depth = jd.depth
+	return sub, nil
+}
+
+// endCustom checks that a custom value or iterator was fully decoded, and adds the values which
+// were decoded along with it to those of the state, such that its functions may be resumed.
+func (jd *jsonDecoder) endCustom(sub *Decoder) error {
+	if sub.limitErr != nil && jd.limitErr == nil {
+		jd.limitErr = sub.limitErr
+	}
+	if sub.Remaining() > 0 {
+		return fmt.Errorf("%v bytes remaining after decoding custom data", sub.Remaining())
+	}
+	if max := jd.limits.orDefault().MaxRefs; len(jd.values)+len(jd.funcodes)+len(sub.values)+len(sub.funcodes) > max {
+		return jd.exceeded("MaxRefs", max)
+	}
+	jd.values = append(jd.values, sub.values...)
+	jd.funcodes = append(jd.funcodes, sub.funcodes...)
+	return nil
+}
+
+func jsonInt(x interface{}) (int64, error) {
+	n, ok := x.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("Codec: expected integer, found %s", jsonTypeName(x))
+	}
+	return n.Int64()
+}
+
+func jsonTypeName(x interface{}) string {
+	switch x.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylark
+
+import "fmt"
+
+// DecodeLimits bound the resources used by a Decoder, such that corrupt or malicious
+// encoded states fail to decode rather than exhausting memory.
+// Fields which are zero or negative take their value from DefaultDecodeLimits.
+type DecodeLimits struct {
+	MaxStateSize int // maximum size of an encoded state in bytes, both before and after decompression
+	MaxLength    int // maximum number of elements of a collection, or bytes of a string
+	MaxDepth     int // maximum nesting depth of values
+	MaxRefs      int // maximum number of values and compiled functions which may be referred to
+}
+
+// DefaultDecodeLimits are the limits of decoders for which no other limits were set.
+var DefaultDecodeLimits = DecodeLimits{
+	MaxStateSize: 64 << 20,
+	MaxLength:    1 << 20,
+	MaxDepth:     1000,
+	MaxRefs:      1 << 22,
+}
+
+func (l DecodeLimits) orDefault() DecodeLimits {
+	if l.MaxStateSize <= 0 {
+		l.MaxStateSize = DefaultDecodeLimits.MaxStateSize
+	}
+	if l.MaxLength <= 0 {
+		l.MaxLength = DefaultDecodeLimits.MaxLength
+	}
+	if l.MaxDepth <= 0 {
+		l.MaxDepth = DefaultDecodeLimits.MaxDepth
+	}
+	if l.MaxRefs <= 0 {
+		l.MaxRefs = DefaultDecodeLimits.MaxRefs
+	}
+	return l
+}
+
+// A DecodeLimitError is returned when an encoded state exceeds one of the decoder's limits.
+type DecodeLimitError struct {
+	Limit string // name of the exceeded field of DecodeLimits
+	Max   int
+}
+
+func (e *DecodeLimitError) Error() string {
+	return fmt.Sprintf("Codec: encoded state exceeds decoder limit %s=%d", e.Limit, e.Max)
+}
+
+// SetLimits sets the limits of the resources used while decoding.
+func (dec *Decoder) SetLimits(limits DecodeLimits) *Decoder {
+	dec.limits = limits
+	return dec
+}
+
+// exceeded records that a limit was exceeded, such that DecodeState reports it as such,
+// even when the error is wrapped by the decoding of enclosing values.
+func (dec *Decoder) exceeded(limit string, max int) error {
+	err := &DecodeLimitError{Limit: limit, Max: max}
+	if dec.limitErr == nil {
+		dec.limitErr = err
+	}
+	return err
+}
+
+// decodeLength decodes the length of a collection, or of a sequence of bytes.
+// Every element takes at least one byte, hence lengths beyond the remaining data are invalid.
+// The data of a streamed state is read ahead accordingly.
+func (dec *Decoder) decodeLength() (int, error) {
+	n, err := dec.DecodeUvarint()
+	if err != nil {
+		return 0, err
+	}
+	if max := dec.limits.orDefault().MaxLength; n > uint64(max) {
+		return 0, dec.exceeded("MaxLength", max)
+	}
+	if dec.fill(int(n)); n > uint64(dec.Remaining()) {
+		return 0, ErrShortBuffer
+	}
+	return int(n), nil
+}
+
+// addRef adds a decoded value to those which may be referred to.
+func (dec *Decoder) addRef(v Value) error {
+	if max := dec.limits.orDefault().MaxRefs; len(dec.values)+len(dec.funcodes) >= max {
+		return dec.exceeded("MaxRefs", max)
+	}
+	dec.values = append(dec.values, v)
+	return nil
+}
+
+// enter is called before decoding a nested value, and must be followed by a call to leave.
+func (dec *Decoder) enter() error {
+	if max := dec.limits.orDefault().MaxDepth; dec.depth >= max {
+		return dec.exceeded("MaxDepth", max)
+	}
+	dec.depth++
+	return nil
+}
+
+func (dec *Decoder) leave() {
+	dec.depth--
+}
+
+// validateState checks the consistency of a decoded call stack, and of the decoded functions,
+// such that resuming the thread cannot index beyond the bounds of their code or state.
+func (dec *Decoder) validateState(top *Frame) error {
+	if top == nil {
+		return fmt.Errorf("Codec: missing frames while decoding state")
+	}
+	if len(dec.globals) != len(dec.prog.Globals) || len(dec.constants) != len(dec.prog.Constants) {
+		return fmt.Errorf("Codec: shared sections do not match the globals and constants of the program")
+	}
+	for _, v := range dec.values {
+		switch v := v.(type) {
+		case *Function:
+			if len(v.freevars) != len(v.funcode.Freevars) || len(v.defaults) > v.funcode.NumParams {
+				return fmt.Errorf("Codec: invalid closure while decoding function %s", v.Name())
+			}
+		case *Generator:
+			if !v.fn.funcode.Generator || v.frame != nil && v.frame.callable != Callable(v.fn) {
+				return fmt.Errorf("Codec: invalid generator of function %s", v.fn.Name())
+			}
+			if v.frame != nil {
+				if err := validateFrame(v.frame, v.fn); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for fr := top; fr != nil; fr = fr.parent {
+		fn, ok := fr.callable.(*Function)
+		if !ok {
+			// Built-in functions may only call functions which suspend the thread if they are resumable:
+			if fr != top && !fr.isResumable() {
+				return fmt.Errorf("Codec: invalid caller %s while decoding frame", fr.callable.Name())
+			}
+			continue
+		}
+		if fn.funcode.Generator {
+			// The frames of generators are not on the call stack:
+			return fmt.Errorf("Codec: invalid frame of generator function %s", fn.Name())
+		}
+		if err := validateFrame(fr, fn); err != nil {
+			return err
+		}
+		// The result of the call in which a caller is suspended is stored on top of its stack:
+		if fr != top && fr.sp == 0 {
+			return fmt.Errorf("Codec: invalid frame of caller %s", fn.Name())
+		}
+	}
+	return nil
+}
+
+// validateFrame checks the consistency of a decoded frame of a compiled function,
+// whose program counters must be at the start of an instruction of its code.
+func validateFrame(fr *Frame, fn *Function) error {
+	fc := fn.funcode
+	if !fc.IsInstructionStart(fr.pc) || !fc.IsInstructionStart(fr.callpc) || int(fr.sp) > fc.MaxStack ||
+		len(fr.stack) > len(fc.Locals)+fc.MaxStack {
+		return fmt.Errorf("Codec: invalid frame of function %s", fn.Name())
+	}
+	// The values on the stack are popped by the instructions which follow:
+	nlocals := len(fc.Locals)
+	if len(fr.stack) < nlocals+int(fr.sp) {
+		return fmt.Errorf("Codec: invalid stack in frame of function %s", fn.Name())
+	}
+	for _, v := range fr.stack[nlocals : nlocals+int(fr.sp)] {
+		if v == nil {
+			return fmt.Errorf("Codec: invalid stack in frame of function %s", fn.Name())
+		}
+	}
+	for _, h := range fr.exhandlers {
+		if !fc.IsInstructionStart(h.pc) || int(h.sp) > fc.MaxStack {
+			return fmt.Errorf("Codec: invalid exception handler in frame of function %s", fn.Name())
+		}
+	}
+	return nil
+}
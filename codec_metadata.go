@@ -0,0 +1,129 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylark
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// maxMetadataSize is the maximum total size of the keys and values of the metadata of an encoded state.
+const maxMetadataSize = 64 << 10
+
+// writeMetadata writes the metadata section of an encoded state, which follows its version header.
+// The section is omitted if there is no metadata. Keys are written in order, such that the
+// encoding of a state does not depend on the iteration order of the map.
+func writeMetadata(w io.Writer, metadata map[string]string) error {
+	if len(metadata) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(metadata))
+	size := 0
+	for k, v := range metadata {
+		keys = append(keys, k)
+		size += len(k) + len(v)
+	}
+	if size > maxMetadataSize {
+		return fmt.Errorf("Codec: metadata of %d bytes exceeds the maximum of %d bytes", size, maxMetadataSize)
+	}
+	sort.Strings(keys)
+	section := []byte{T_Metadata}
+	var b [binary.MaxVarintLen64]byte
+	section = append(section, b[:binary.PutUvarint(b[:], uint64(len(keys)))]...)
+	for _, k := range keys {
+		for _, s := range []string{k, metadata[k]} {
+			section = append(section, b[:binary.PutUvarint(b[:], uint64(len(s)))]...)
+			section = append(section, s...)
+		}
+	}
+	_, err := w.Write(section)
+	return err
+}
+
+// readMetadata reads the metadata section of an encoded state, if present.
+func readMetadata(r *stateReader) (map[string]string, error) {
+	if r.peekTag() != T_Metadata {
+		return nil, nil
+	}
+	r.ReadByte()
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("Codec: unexpected error while decoding metadata: %v", err)
+	}
+	if n > maxMetadataSize {
+		return nil, fmt.Errorf("Codec: invalid length of metadata (%d)", n)
+	}
+	metadata := make(map[string]string, n)
+	size := uint64(0)
+	for i := uint64(0); i < n; i++ {
+		var kv [2]string
+		for j := range kv {
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, fmt.Errorf("Codec: unexpected error while decoding metadata: %v", err)
+			}
+			if size += length; size > maxMetadataSize {
+				return nil, fmt.Errorf("Codec: metadata exceeds the maximum of %d bytes", maxMetadataSize)
+			}
+			s, err := r.readFull(int(length))
+			if err != nil {
+				return nil, ErrShortBuffer
+			}
+			kv[j] = string(s)
+		}
+		metadata[kv[0]] = kv[1]
+	}
+	return metadata, nil
+}
+
+// writeCount writes a section of the header of an encoded state which holds a count of the
+// thread, such as the steps it executed or the bytes it allocated. The section is omitted if the count is zero.
+func writeCount(w io.Writer, tag byte, n uint64) error {
+	if n == 0 {
+		return nil
+	}
+	var b [1 + binary.MaxVarintLen64]byte
+	b[0] = tag
+	_, err := w.Write(b[:1+binary.PutUvarint(b[1:], n)])
+	return err
+}
+
+// readCount reads the section of the header of an encoded state with the given tag, if present,
+// and returns the count which it holds, or zero.
+func readCount(r *stateReader, tag byte) (uint64, error) {
+	if r.peekTag() != tag {
+		return 0, nil
+	}
+	r.ReadByte()
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, fmt.Errorf("Codec: unexpected error while decoding %s: %v", tagNames[tag], err)
+	}
+	return n, nil
+}
+
+// ReadSnapshotMetadata returns the metadata of an encoded state (see Thread.Metadata), without
+// decompressing or decoding the rest of the state. The metadata of a signed state is covered by
+// its signature, but isn't verified by ReadSnapshotMetadata.
+func ReadSnapshotMetadata(snapshot []byte) (map[string]string, error) {
+	return ReadSnapshotMetadataFrom(bytes.NewReader(snapshot))
+}
+
+// ReadSnapshotMetadataFrom reads the header of an encoded state from r, and returns its metadata.
+func ReadSnapshotMetadataFrom(r io.Reader) (map[string]string, error) {
+	sr := &stateReader{Reader: bufio.NewReader(r)}
+	magic, err := sr.readFull(len(CodecMagic))
+	if err != nil || string(magic) != CodecMagic {
+		return nil, fmt.Errorf("Codec: invalid format identifier at start of bytecode")
+	}
+	if _, err := readVersion(sr); err != nil {
+		return nil, err
+	}
+	return readMetadata(sr)
+}
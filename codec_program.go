@@ -0,0 +1,244 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylark
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/skylark/internal/compile"
+)
+
+// A ProgramRegistry stores encoded programs by their content hash, such that encoded states
+// may refer to their program by its hash rather than embedding its bytecode.
+// Implementations must be safe for concurrent use.
+type ProgramRegistry interface {
+	// LoadProgram returns the encoded program with the given hash, or nil if the hash is unknown.
+	LoadProgram(hash string) ([]byte, error)
+	// StoreProgram stores an encoded program under its hash.
+	StoreProgram(hash string, program []byte) error
+}
+
+// An UnknownProgramError is returned when decoding a state which refers to a program
+// by a hash which is unknown to the decoder's registry, and which doesn't embed the program.
+type UnknownProgramError struct {
+	Hash string
+}
+
+func (e *UnknownProgramError) Error() string {
+	return fmt.Sprintf("Codec: unknown program with hash %s", e.Hash)
+}
+
+type memoryProgramRegistry struct {
+	mu       sync.RWMutex
+	programs map[string][]byte
+}
+
+// NewMemoryProgramRegistry returns a ProgramRegistry which holds programs in memory.
+func NewMemoryProgramRegistry() ProgramRegistry {
+	return &memoryProgramRegistry{programs: make(map[string][]byte)}
+}
+
+func (r *memoryProgramRegistry) LoadProgram(hash string) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.programs[hash], nil
+}
+
+func (r *memoryProgramRegistry) StoreProgram(hash string, program []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.programs[hash] = program
+	return nil
+}
+
+type dirProgramRegistry struct {
+	dir string
+}
+
+// NewDirProgramRegistry returns a ProgramRegistry which holds programs as files in the given directory.
+func NewDirProgramRegistry(dir string) ProgramRegistry {
+	return &dirProgramRegistry{dir: dir}
+}
+
+func (r *dirProgramRegistry) path(hash string) (string, error) {
+	// Only well-formed hashes are accepted, as they are used as file names:
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("Codec: invalid program hash %q", hash)
+	}
+	return filepath.Join(r.dir, hash+".skyprog"), nil
+}
+
+func (r *dirProgramRegistry) LoadProgram(hash string) ([]byte, error) {
+	path, err := r.path(hash)
+	if err != nil {
+		return nil, err
+	}
+	program, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return program, err
+}
+
+func (r *dirProgramRegistry) StoreProgram(hash string, program []byte) error {
+	path, err := r.path(hash)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that concurrent loads never observe a partial program:
+	f, err := ioutil.TempFile(r.dir, hash+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(program); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// programHash returns the content hash of an encoded program.
+func programHash(program []byte) string {
+	sum := sha256.Sum256(program)
+	return hex.EncodeToString(sum[:])
+}
+
+// UseProgramRegistry causes EncodeState to refer to programs by their content hash, storing
+// them in the given registry. A program is only embedded in the first encoded state which
+// stores it in the registry, so that decoders with a different registry may still learn it.
+func (enc *Encoder) UseProgramRegistry(programs ProgramRegistry) *Encoder {
+	enc.programs = programs
+	return enc
+}
+
+// UseProgramRegistry causes DecodeState to resolve programs referred to by their content hash
+// using the given registry. Programs embedded in encoded states are added to the registry.
+func (dec *Decoder) UseProgramRegistry(programs ProgramRegistry) *Decoder {
+	dec.programs = programs
+	return dec
+}
+
+// EncodeProgramRef encodes the content hash of a program, in place of its top level.
+func (enc *Encoder) EncodeProgramRef(p *compile.Program) error {
+	var embedded []byte
+	hash, known := enc.programHashes[p]
+	if !known {
+		program := enc.types.orDefault().NewEncoder()
+		program.EncodeToplevel(p)
+		hash = programHash(program.Bytes())
+		stored, err := enc.programs.LoadProgram(hash)
+		if err != nil {
+			return fmt.Errorf("Codec: error while loading program %s: %v", hash, err)
+		}
+		// A stored program which does not match its hash is replaced:
+		if stored == nil || programHash(stored) != hash {
+			if err = enc.programs.StoreProgram(hash, program.Bytes()); err != nil {
+				return fmt.Errorf("Codec: error while storing program %s: %v", hash, err)
+			}
+			embedded = program.Bytes()
+		}
+		if enc.programHashes == nil {
+			enc.programHashes = make(map[*compile.Program]string)
+		}
+		enc.programHashes[p] = hash
+	}
+	enc.WriteTag(T_ProgramRef)
+	enc.WriteUvarint(uint64(len(hash)))
+	enc.buf.WriteString(hash)
+	enc.WriteUvarint(uint64(len(embedded)))
+	enc.buf.Write(embedded)
+
+	// Refer to the compiled functions of the program in the order they would be encoded by EncodeToplevel:
+	if enc.funcodes == nil {
+		enc.funcodes = make(map[*compile.Funcode]ref)
+	}
+	for _, fc := range p.Functions {
+		if _, ok := enc.funcodes[fc]; !ok {
+			enc.funcodes[fc] = ref(len(enc.funcodes))
+		}
+	}
+	if _, ok := enc.funcodes[p.Toplevel]; !ok {
+		enc.funcodes[p.Toplevel] = ref(len(enc.funcodes))
+	}
+	return nil
+}
+
+// DecodeProgramRef decodes the content hash of a program, and resolves the program using the
+// decoder's registry, or its embedded encoding. A program of the registry which does not match
+// its hash is replaced by the embedded program, if any, since the registry may be shared storage.
+func (dec *Decoder) DecodeProgramRef() error {
+	if dec.Remaining() < 1 || dec.Data[0] != T_ProgramRef {
+		return fmt.Errorf("Codec: unexpected tag while decoding program ref")
+	}
+	dec.Data = dec.Data[1:]
+	var fields [2][]byte
+	for i := range fields {
+		size, err := dec.DecodeUvarint()
+		if err != nil {
+			return fmt.Errorf("Codec: unexpected error while decoding program ref: %v", err)
+		}
+		if max := dec.limits.orDefault().MaxStateSize; size > uint64(max) {
+			return dec.exceeded("MaxStateSize", max)
+		}
+		if dec.fill(int(size)); uint64(dec.Remaining()) < size {
+			return ErrShortBuffer
+		}
+		fields[i], dec.Data = dec.Data[:size], dec.Data[size:]
+	}
+	hash, embedded := string(fields[0]), fields[1]
+
+	var program []byte
+	if dec.programs != nil {
+		var err error
+		if program, err = dec.programs.LoadProgram(hash); err != nil {
+			return fmt.Errorf("Codec: error while loading program %s: %v", hash, err)
+		}
+		if program != nil && programHash(program) != hash {
+			if len(embedded) == 0 {
+				return fmt.Errorf("Codec: program %s of the registry does not match its hash", hash)
+			}
+			program = nil
+		}
+	}
+	if program == nil {
+		if len(embedded) == 0 {
+			return &UnknownProgramError{Hash: hash}
+		}
+		if programHash(embedded) != hash {
+			return fmt.Errorf("Codec: embedded program does not match its hash %s", hash)
+		}
+		program = append([]byte(nil), embedded...)
+		if dec.programs != nil {
+			if err := dec.programs.StoreProgram(hash, program); err != nil {
+				return fmt.Errorf("Codec: error while storing program %s: %v", hash, err)
+			}
+		}
+	}
+
+	sub := dec.types.orDefault().NewDecoder(program, nil).SetLimits(dec.limits)
+	if err := sub.DecodeToplevel(); err != nil {
+		return fmt.Errorf("Codec: invalid program %s: %v", hash, err)
+	}
+	if sub.Remaining() > 0 {
+		return fmt.Errorf("Codec: %v bytes remaining after decoding program %s", sub.Remaining(), hash)
+	}
+	if sub.limitErr != nil {
+		dec.limitErr = sub.limitErr
+	}
+	dec.prog = sub.prog
+	dec.funcodes = append(dec.funcodes, sub.funcodes...)
+	return nil
+}
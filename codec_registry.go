@@ -0,0 +1,149 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylark
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// A TypeRegistry holds the decoders of custom types, by their encoded type name.
+// Encoders and decoders created by a registry only encode and decode the custom types
+// registered with it, such that independent parts of a program may register different
+// decoders for the same type name. A TypeRegistry is safe for concurrent use.
+type TypeRegistry struct {
+	mu         sync.RWMutex
+	values     map[string]CustomDecoder
+	iterators  map[string]CustomIteratorDecoder
+	exceptions map[string]CustomExceptionDecoder
+}
+
+// DefaultTypes is the registry of the encoders and decoders returned by NewEncoder and NewDecoder.
+var DefaultTypes = NewTypeRegistry()
+
+// NewTypeRegistry returns an empty registry of custom types.
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{
+		values:     make(map[string]CustomDecoder),
+		iterators:  make(map[string]CustomIteratorDecoder),
+		exceptions: make(map[string]CustomExceptionDecoder),
+	}
+}
+
+// NewEncoder returns an encoder of the custom types registered with r.
+// Values of other custom types are reported as unencodable.
+func (r *TypeRegistry) NewEncoder() *Encoder {
+	return &Encoder{compression: T_HuffmanCompressed, types: r}
+}
+
+// NewDecoder returns a decoder of the custom types registered with r.
+func (r *TypeRegistry) NewDecoder(data []byte, predeclared StringDict) *Decoder {
+	return &Decoder{Data: data, predeclared: predeclared, types: r}
+}
+
+// VersionedTypeName returns the name under which a version of the encoding of a custom type is
+// encoded and registered. The first version of a type is encoded under its plain type name,
+// such that types may become versioned without breaking the states encoded so far.
+func VersionedTypeName(typeName string, version int) string {
+	if version <= 1 {
+		return typeName
+	}
+	return typeName + "@" + strconv.Itoa(version)
+}
+
+// encodedTypeName returns the name under which a custom type is encoded.
+func encodedTypeName(c Codable) string {
+	if v, ok := c.(VersionedCodable); ok {
+		return VersionedTypeName(c.Type(), v.EncodingVersion())
+	}
+	return c.Type()
+}
+
+// RegisterDecoder registers the decoder of a custom value type, whose name may be versioned.
+func (r *TypeRegistry) RegisterDecoder(typeName string, dec CustomDecoder) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.values[typeName] != nil {
+		return fmt.Errorf("Codec: decoder for type %s is already registered", typeName)
+	}
+	r.values[typeName] = dec
+	return nil
+}
+
+// RegisterIteratorDecoder registers the decoder of a custom iterator type, whose name may be versioned.
+func (r *TypeRegistry) RegisterIteratorDecoder(typeName string, dec CustomIteratorDecoder) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.iterators[typeName] != nil {
+		return fmt.Errorf("Codec: iterator decoder for type %s is already registered", typeName)
+	}
+	r.iterators[typeName] = dec
+	return nil
+}
+
+// RegisterExceptionDecoder registers the decoder of a custom exception type, whose name may be versioned.
+func (r *TypeRegistry) RegisterExceptionDecoder(typeName string, dec CustomExceptionDecoder) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.exceptions[typeName] != nil {
+		return fmt.Errorf("Codec: exception decoder for type %s is already registered", typeName)
+	}
+	r.exceptions[typeName] = dec
+	return nil
+}
+
+// RegisterDecoder registers the decoder of a custom value type with DefaultTypes.
+func RegisterDecoder(typeName string, dec CustomDecoder) error {
+	return DefaultTypes.RegisterDecoder(typeName, dec)
+}
+
+// RegisterIteratorDecoder registers the decoder of a custom iterator type with DefaultTypes.
+func RegisterIteratorDecoder(typeName string, dec CustomIteratorDecoder) error {
+	return DefaultTypes.RegisterIteratorDecoder(typeName, dec)
+}
+
+// RegisterExceptionDecoder registers the decoder of a custom exception type with DefaultTypes.
+func RegisterExceptionDecoder(typeName string, dec CustomExceptionDecoder) error {
+	return DefaultTypes.RegisterExceptionDecoder(typeName, dec)
+}
+
+// orDefault returns r, or DefaultTypes for the encoders and decoders which weren't created by a registry.
+func (r *TypeRegistry) orDefault() *TypeRegistry {
+	if r == nil {
+		return DefaultTypes
+	}
+	return r
+}
+
+func (r *TypeRegistry) valueDecoder(typeName string) CustomDecoder {
+	r = r.orDefault()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.values[typeName]
+}
+
+func (r *TypeRegistry) iteratorDecoder(typeName string) CustomIteratorDecoder {
+	r = r.orDefault()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.iterators[typeName]
+}
+
+func (r *TypeRegistry) exceptionDecoder(typeName string) CustomExceptionDecoder {
+	r = r.orDefault()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.exceptions[typeName]
+}
+
+// hasValueDecoder reports whether values encoded under the given type name can be decoded,
+// either as plain values or as exceptions.
+func (r *TypeRegistry) hasValueDecoder(typeName string) bool {
+	r = r.orDefault()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.values[typeName] != nil || r.exceptions[typeName] != nil
+}
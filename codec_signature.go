@@ -0,0 +1,119 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylark
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrBadSignature is returned when decoding an encoded state whose signature is missing,
+// or does not match its contents.
+var ErrBadSignature = errors.New("Codec: invalid signature of encoded state")
+
+// A Signer signs encoded states, and verifies the signatures of encoded states before they are decoded.
+type Signer interface {
+	// Sign returns the signature of the given encoded state.
+	Sign(payload []byte) ([]byte, error)
+	// Verify reports whether the signature matches the given encoded state.
+	Verify(payload, signature []byte) bool
+}
+
+type hmacSigner struct {
+	key []byte
+}
+
+// NewHMACSigner returns a Signer which authenticates encoded states using HMAC-SHA256 with the given key.
+func NewHMACSigner(key []byte) Signer {
+	return &hmacSigner{key: append([]byte(nil), key...)}
+}
+
+func (s *hmacSigner) Sign(payload []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(payload)
+	return mac.Sum(nil), nil
+}
+
+func (s *hmacSigner) Verify(payload, signature []byte) bool {
+	expected, _ := s.Sign(payload)
+	return hmac.Equal(expected, signature)
+}
+
+// SignWith causes EncodeState to sign encoded states with the given signer.
+func (enc *Encoder) SignWith(signer Signer) *Encoder {
+	enc.signer = signer
+	return enc
+}
+
+// VerifyWith causes DecodeState to reject encoded states which aren't signed by the given signer.
+func (dec *Decoder) VerifyWith(verifier Signer) *Decoder {
+	dec.verifier = verifier
+	return dec
+}
+
+// signState inserts the signature of an encoded state after its header.
+// The signature covers the header as well as the rest of the encoded state.
+func signState(signer Signer, snapshot []byte, headerSize int) ([]byte, error) {
+	signature, err := signer.Sign(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("Codec: error while signing state: %v", err)
+	}
+	var length [binary.MaxVarintLen64]byte
+	sz := binary.PutUvarint(length[:], uint64(len(signature)))
+	signed := make([]byte, 0, len(snapshot)+1+sz+len(signature))
+	signed = append(signed, snapshot[:headerSize]...)
+	signed = append(signed, T_Signature)
+	signed = append(signed, length[:sz]...)
+	signed = append(signed, signature...)
+	return append(signed, snapshot[headerSize:]...), nil
+}
+
+// maxSignatureSize is the maximum size of the signature of an encoded state.
+const maxSignatureSize = 4096
+
+// readSignature reads the signature following the header of an encoded state, if any,
+// and checks it with the decoder's verifier. It returns a reader of the remaining state.
+func (dec *Decoder) readSignature(r *stateReader) (*bufio.Reader, error) {
+	if r.peekTag() != T_Signature {
+		if dec.verifier != nil {
+			return nil, ErrBadSignature
+		}
+		return r.Reader, nil
+	}
+	// The signature itself isn't part of the signed header, hence it is read from the underlying reader:
+	r.Reader.ReadByte()
+	length, err := binary.ReadUvarint(r.Reader)
+	if err != nil || length > maxSignatureSize {
+		return nil, ErrBadSignature
+	}
+	signature := make([]byte, length)
+	if _, err = io.ReadFull(r.Reader, signature); err != nil {
+		return nil, ErrBadSignature
+	}
+	if dec.verifier == nil {
+		return r.Reader, nil
+	}
+	var rest bytes.Buffer
+	max := dec.limits.orDefault().MaxStateSize
+	if _, err = rest.ReadFrom(io.LimitReader(r.Reader, int64(max)+1)); err != nil {
+		return nil, fmt.Errorf("Codec: error while reading state: %v", err)
+	}
+	if rest.Len() > max {
+		return nil, dec.exceeded("MaxStateSize", max)
+	}
+	payload := make([]byte, 0, len(r.header)+rest.Len())
+	payload = append(payload, r.header...)
+	payload = append(payload, rest.Bytes()...)
+	if !dec.verifier.Verify(payload, signature) {
+		return nil, ErrBadSignature
+	}
+	return bufio.NewReader(&rest), nil
+}
@@ -5,12 +5,16 @@
 package skylark
 
 import (
+	"bufio"
 	"bytes"
 	"compress/flate"
+	"compress/gzip"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"math/big"
 
 	"github.com/google/skylark/internal/compile"
@@ -25,46 +29,139 @@ func EncodeState(thread *Thread) ([]byte, error) {
 }
 
 // EncodeState decodes a re-entrant state into a resumable Skylark thread.
+// The given predeclared values take precedence over those encoded with the state.
 func DecodeState(snapshot []byte, predeclared StringDict) (*Thread, error) {
 	return NewDecoder(snapshot, predeclared).DecodeState()
 }
 
+// EncodeStateTo writes the encoded re-entrant state of the given Skylark thread to w.
+// See Encoder.EncodeStateTo for its use of memory.
+func EncodeStateTo(w io.Writer, thread *Thread) error {
+	return NewEncoder().EncodeStateTo(w, thread)
+}
+
+// DecodeStateFrom reads an encoded re-entrant state from r, and decodes it into a resumable Skylark thread.
+// See Decoder.DecodeStateFrom for its use of memory.
+func DecodeStateFrom(r io.Reader, predeclared StringDict) (*Thread, error) {
+	return NewDecoder(nil, predeclared).DecodeStateFrom(r)
+}
+
 // EncodeState encodes the re-entrant state of the given Skylark thread.
 func (enc *Encoder) EncodeState(thread *Thread) ([]byte, error) {
+	var out bytes.Buffer
+	if err := enc.EncodeStateTo(&out, thread); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// EncodeStateTo writes the encoded re-entrant state of the given Skylark thread to w.
+// The metadata of the thread is written uncompressed in the header of the state,
+// such that it may be read by ReadSnapshotMetadata without decoding the state,
+// followed by the steps executed and the bytes allocated by the thread (see Thread.Steps
+// and Thread.Allocs).
+//
+// Uncompressed states, and those compressed with deflate or gzip, are streamed: the
+// state is written to w, through its compressor, while it is encoded, such that at most
+// a chunk of it is held in memory. Huffman-compressed states, which are prefixed with
+// their length, and signed states, whose signature precedes them, are buffered.
+// Since a streamed state is written as it is encoded, w may have received part of it
+// when EncodeStateTo fails.
+func (enc *Encoder) EncodeStateTo(w io.Writer, thread *Thread) error {
 	if thread.SuspendedFrame() != nil {
 		thread.Resumable()
 	}
 
-	enc.buf.WriteString(CodecMagic)
+	if enc.signer != nil {
+		// The signature precedes the compressed state, which must therefore be buffered:
+		var out bytes.Buffer
+		out.WriteString(CodecMagic)
+		writeVersion(&out, currentVersion)
+		if err := writeMetadata(&out, thread.Metadata); err != nil {
+			return err
+		}
+		writeCount(&out, T_Steps, thread.steps)
+		writeCount(&out, T_Allocs, thread.allocs)
+		headerSize := out.Len()
+		if err := enc.encodeCompressed(&out, thread.frame); err != nil {
+			return err
+		}
+		signed, err := signState(enc.signer, out.Bytes(), headerSize)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(signed)
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(CodecMagic)
+	writeVersion(bw, currentVersion)
+	if err := writeMetadata(bw, thread.Metadata); err != nil {
+		return err
+	}
+	writeCount(bw, T_Steps, thread.steps)
+	writeCount(bw, T_Allocs, thread.allocs)
+	if err := enc.encodeCompressed(bw, thread.frame); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
 
-	useHuffman := enc.compression == T_HuffmanCompressed
-	if !useHuffman {
-		enc.WriteTag(T_Uncompressed)
+// encodeCompressed writes the compression tag of the state, followed by the state encoded
+// from the given frame, and compressed accordingly. Huffman-compressed states are prefixed
+// with their uncompressed length; the others are streamed to w while they are encoded.
+func (enc *Encoder) encodeCompressed(w io.Writer, frame *Frame) error {
+	if _, err := w.Write([]byte{enc.compression}); err != nil {
+		return err
+	}
+	var zw io.WriteCloser
+	var err error
+	switch enc.compression {
+	case T_Uncompressed:
+		enc.out = w
+	case T_HuffmanCompressed:
+		// The state is buffered, since it is prefixed with its length.
+	case T_DeflateCompressed:
+		zw, err = flate.NewWriter(w, enc.level)
+		enc.out = zw
+	case T_GzipCompressed:
+		zw, err = gzip.NewWriterLevel(w, enc.level)
+		enc.out = zw
+	default:
+		err = fmt.Errorf("Codec: unrecognized compression tag (%v)", enc.compression)
 	}
-	err := enc.encodeState(thread.frame, 1, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if !useHuffman {
-		return enc.Bytes(), nil
+	defer func() { enc.out = nil }()
+
+	if err := enc.encodeState(frame, 1, nil); err != nil {
+		return err
+	}
+	if len(enc.errors) > 0 && !enc.lossy {
+		return enc.errors[0]
+	}
+	if enc.out != nil {
+		enc.flush()
+		if zw != nil && enc.outErr == nil {
+			enc.outErr = zw.Close()
+		}
+		return enc.outErr
 	}
 
-	var compressed bytes.Buffer
-	compressed.WriteByte(T_HuffmanCompressed)
-	var length [8]byte
-	sz := binary.PutUvarint(length[:8], uint64(enc.buf.Len()))
-	compressed.Write(length[:sz])
-	var wr *flate.Writer
-	if wr, err = flate.NewWriter(&compressed, flate.HuffmanOnly); err != nil {
-		return nil, err
+	var length [binary.MaxVarintLen64]byte
+	sz := binary.PutUvarint(length[:], uint64(enc.buf.Len()))
+	if _, err := w.Write(length[:sz]); err != nil {
+		return err
 	}
-	if _, err = wr.Write(enc.Bytes()); err != nil {
-		return nil, err
+	if zw, err = flate.NewWriter(w, flate.HuffmanOnly); err != nil {
+		return err
 	}
-	if err = wr.Close(); err != nil {
-		return nil, err
+	if _, err = zw.Write(enc.Bytes()); err != nil {
+		return err
 	}
-	return compressed.Bytes(), nil
+	return zw.Close()
 }
 
 func (enc *Encoder) encodeState(frame *Frame, count uint, anyFn *Function) error {
@@ -74,10 +171,8 @@ func (enc *Encoder) encodeState(frame *Frame, count uint, anyFn *Function) error
 	// The count parameter is greater than 1 for non-leaf functions within the current call-stack.
 	// The leaf function is assumed to have suspended the thread, and all other functions within
 	// the current call-stack must be resumable.
-	if count > 1 {
-		if _, isFunction := frame.callable.(*Function); !isFunction {
-			return fmt.Errorf("Codec: suspended thread has non-resumable function on call-stack: %s", frame.callable.Name())
-		}
+	if count > 1 && !frame.isResumable() {
+		return fmt.Errorf("Codec: suspended thread has non-resumable function on call-stack: %s", frame.callable.Name())
 	}
 	// Walk the call-stack until the bottom frame is reached, to determine the frame count:
 	if frame.parent != nil {
@@ -86,11 +181,18 @@ func (enc *Encoder) encodeState(frame *Frame, count uint, anyFn *Function) error
 		}
 	} else {
 		// When the bottom frame is reached, encode the toplevel, followed by all frames from the bottom up:
-		enc.EncodeToplevel(anyFn.funcode.Prog)
+		if enc.programs != nil {
+			if err := enc.EncodeProgramRef(anyFn.funcode.Prog); err != nil {
+				return err
+			}
+		} else {
+			enc.EncodeToplevel(anyFn.funcode.Prog)
+		}
 		enc.EncodeFnShared(anyFn)
 		enc.WriteUvarint(uint64(count))
 	}
 	enc.EncodeFrame(frame)
+	enc.spill()
 	return nil
 }
 
@@ -99,45 +201,88 @@ func (dec *Decoder) DecodeState() (*Thread, error) {
 	if dec.Remaining() < 6 {
 		return nil, ErrShortBuffer
 	}
+	return dec.DecodeStateFrom(bytes.NewReader(dec.Data))
+}
+
+// DecodeStateFrom reads an encoded re-entrant state from r, and decodes it into a resumable thread.
+// If the state exceeds the decoder's limits, the error is a *DecodeLimitError.
+//
+// The state is streamed: it is decompressed and decoded while it is read, such that only a
+// window of it is held in memory, besides the values decoded from it. At most the MaxStateSize
+// limit of the decoder is read (see SetLimits). Signed states which are verified (see VerifyWith),
+// and states which are migrated from other versions, are read into memory before they are decoded.
+func (dec *Decoder) DecodeStateFrom(r io.Reader) (*Thread, error) {
+	thread, err := dec.decodeStateFrom(r)
+	dec.src = nil
+	if err == nil && dec.srcErr != nil {
+		err = dec.srcErr // e.g. the checksum of a gzip stream, which is read last
+	}
+	if err != nil && dec.limitErr != nil {
+		return nil, dec.limitErr
+	} else if err != nil && dec.srcErr != nil {
+		return nil, fmt.Errorf("Codec: error while reading state: %v", dec.srcErr)
+	}
+	return thread, err
+}
 
-	if string(dec.Data[:4]) != CodecMagic {
+func (dec *Decoder) decodeStateFrom(r io.Reader) (*Thread, error) {
+	dec.depth, dec.limitErr = 0, nil
+	sr := &stateReader{Reader: bufio.NewReader(r)}
+	magic, err := sr.readFull(len(CodecMagic))
+	if err != nil {
+		return nil, ErrShortBuffer
+	}
+	if string(magic) != CodecMagic {
 		return nil, fmt.Errorf("Codec: invalid format identifier at start of bytecode")
 	}
+	version, err := readVersion(sr)
+	if err != nil {
+		return nil, err
+	}
+	if dec.metadata, err = readMetadata(sr); err != nil {
+		return nil, err
+	}
+	if dec.steps, err = readCount(sr, T_Steps); err != nil {
+		return nil, err
+	}
+	if dec.allocs, err = readCount(sr, T_Allocs); err != nil {
+		return nil, err
+	}
+	// Authenticate the encoded state before decoding any of its contents:
+	body, err := dec.readSignature(sr)
+	if err != nil {
+		return nil, err
+	}
+	if dec.src, err = dec.readCompressed(body, version); err != nil {
+		return nil, err
+	}
+	dec.Data, dec.srcErr = nil, nil
 
-	tag := dec.Data[4]
-	dec.Data = dec.Data[5:]
-
-	// Decompress the encoded state, when applicable:
-	if tag == T_HuffmanCompressed {
-		length, err := dec.DecodeUvarint()
+	// Upgrade states encoded by other versions of the interpreter, when possible:
+	if version != currentVersion {
+		data, err := ioutil.ReadAll(dec.src)
 		if err != nil {
-			return nil, fmt.Errorf("Codec: error decoding length of compressed state: %v", err)
+			return nil, fmt.Errorf("Codec: error while reading state: %v", err)
 		}
-		r := flate.NewReader(bytes.NewReader(dec.Data))
-		// length+1 ensures the first read returns EOF for valid lengths:
-		decompressed := make([]byte, length+1)
-		var nr int
-		nr, err = r.Read(decompressed)
-		r.Close()
-		if err != nil && err != io.EOF {
-			return nil, fmt.Errorf("Codec: error while decompressing state: %v", err)
-		}
-		if err != io.EOF || nr != int(length) {
-			return nil, errors.New("Codec: invalid length-prefix for compressed state")
+		dec.src = nil
+		if dec.Data, err = migrate(&migrations, version, data); err != nil {
+			return nil, err
 		}
-		dec.Data = decompressed[:int(length)]
-	} else if tag != T_Uncompressed {
-		return nil, fmt.Errorf("Codec: unrecognized compression tag (%v) in compressed state", tag)
 	}
 
-	if err := dec.DecodeToplevel(); err != nil {
+	if dec.Remaining() > 0 && dec.Data[0] == T_ProgramRef {
+		err = dec.DecodeProgramRef()
+	} else {
+		err = dec.DecodeToplevel()
+	}
+	if err != nil {
 		return nil, err
 	}
 	if err := dec.DecodeFnShared(); err != nil {
 		return nil, err
 	}
 	var frameCount uint64
-	frameCount, err := dec.DecodeUvarint()
+	frameCount, err = dec.DecodeUvarint()
 	if err != nil {
 		return nil, err
 	}
@@ -151,24 +296,128 @@ func (dec *Decoder) DecodeState() (*Thread, error) {
 		frame.parent = parent
 		parent = frame
 	}
+	if dec.Remaining() > 0 {
+		return nil, fmt.Errorf("Codec: %v bytes remaining after fully decoding state", dec.Remaining())
+	}
+	return dec.resumableThread(frame)
+}
+
+// resumableThread returns a thread suspended in the given decoded frame, after linking
+// the decoded functions to the decoded program, and checking their consistency.
+func (dec *Decoder) resumableThread(frame *Frame) (*Thread, error) {
 	for _, fc := range dec.funcodes {
 		fc.Prog = dec.prog
+		if err := fc.Validate(dec.predeclared.Has, Universe.Has); err != nil {
+			return nil, fmt.Errorf("Codec: invalid code while decoding function %s: %v", fc.Name, err)
+		}
 	}
-	thread := &Thread{frame: frame}
 	for _, v := range dec.values {
 		if fn, isFunction := v.(*Function); isFunction {
-			fn.predeclared, fn.globals, fn.constants, fn.funcode.Prog = dec.predeclared, dec.globals, dec.constants, dec.prog
-			if err = fn.funcode.Validate(fn.predeclared.Has, Universe.Has); err != nil {
-				return thread, fmt.Errorf("Codec: invalid code while decoding function %s: %v", fn.Name(), err)
-			}
+			fn.predeclared, fn.globals, fn.constants = dec.predeclared, dec.globals, dec.constants
 		}
 	}
-	if dec.Remaining() > 0 {
-		return thread, fmt.Errorf("Codec: %v bytes remaining after fully decoding state", dec.Remaining())
+	if err := dec.validateState(frame); err != nil {
+		return nil, err
+	}
+	thread := &Thread{frame: frame, Metadata: dec.metadata, steps: dec.steps, allocs: dec.allocs}
+	for _, v := range dec.values {
+		if g, isGenerator := v.(*Generator); isGenerator {
+			g.thread = thread
+		}
 	}
 	return thread, nil
 }
 
+// A stateReader reads the header of an encoded state, retaining the bytes read so far.
+type stateReader struct {
+	*bufio.Reader
+	header []byte // header bytes read so far
+}
+
+func (r *stateReader) ReadByte() (byte, error) {
+	b, err := r.Reader.ReadByte()
+	if err == nil {
+		r.header = append(r.header, b)
+	}
+	return b, err
+}
+
+func (r *stateReader) readFull(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.Reader, b); err != nil {
+		return nil, err
+	}
+	r.header = append(r.header, b...)
+	return b, nil
+}
+
+// peekTag returns the next tag of the encoded state without consuming it, or 0 at the end of the state.
+func (r *stateReader) peekTag() byte {
+	b, err := r.Peek(1)
+	if err != nil {
+		return 0
+	}
+	return b[0]
+}
+
+// readCompressed reads the compression tag of an encoded state, and returns a reader of the
+// state decompressed accordingly, which fails once the state exceeds the MaxStateSize limit.
+// Huffman-compressed states are prefixed with their length, as are the states compressed
+// otherwise by versions of the codec before 8.
+func (dec *Decoder) readCompressed(r *bufio.Reader, version SnapshotVersion) (io.Reader, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, ErrShortBuffer
+	}
+	max := dec.limits.orDefault().MaxStateSize
+	length := uint64(max) + 1
+	if tag == T_HuffmanCompressed || tag != T_Uncompressed && version.Codec < 8 {
+		if length, err = binary.ReadUvarint(r); err != nil {
+			return nil, fmt.Errorf("Codec: error decoding length of compressed state: %v", err)
+		}
+		if length >= math.MaxInt64 {
+			return nil, errors.New("Codec: invalid length-prefix for compressed state")
+		}
+		// A compressed state is rejected by its length-prefix, before it is decompressed:
+		if length > uint64(max) {
+			return nil, dec.exceeded("MaxStateSize", max)
+		}
+	}
+	var zr io.Reader
+	switch tag {
+	case T_Uncompressed:
+		zr = r
+	case T_HuffmanCompressed, T_DeflateCompressed:
+		zr = flate.NewReader(r)
+	case T_GzipCompressed:
+		var gr *gzip.Reader
+		if gr, err = gzip.NewReader(r); err != nil {
+			return nil, fmt.Errorf("Codec: error while decompressing state: %v", err)
+		}
+		gr.Multistream(false)
+		zr = gr
+	default:
+		return nil, fmt.Errorf("Codec: unrecognized compression tag (%v) in compressed state", tag)
+	}
+	return &stateLimitReader{dec: dec, r: io.LimitReader(zr, int64(length)), max: max}, nil
+}
+
+// A stateLimitReader reads a decompressed state, failing once it exceeds the MaxStateSize limit.
+type stateLimitReader struct {
+	dec *Decoder
+	r   io.Reader
+	n   int // bytes read so far
+	max int
+}
+
+func (l *stateLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if l.n += n; l.n > l.max {
+		return n, l.dec.exceeded("MaxStateSize", l.max)
+	}
+	return n, err
+}
+
 func (enc *Encoder) EncodeToplevel(p *compile.Program) {
 	enc.WriteTag(T_Toplevel)
 	enc.WriteUvarint(uint64(len(p.Loads)))
@@ -214,26 +463,26 @@ func (dec *Decoder) DecodeToplevel() error {
 	dec.Data = dec.Data[1:]
 	dec.prog = &compile.Program{}
 
-	var count uint64
+	var count int
 	var err error
-	count, err = dec.DecodeUvarint()
+	count, err = dec.decodeLength()
 	if err != nil {
 		return fmt.Errorf("Codec: unexpected error while decoding top level: %v", err)
 	}
 	dec.prog.Loads = make([]compile.Ident, count)
-	for i := uint64(0); i < count; i++ {
+	for i := 0; i < count; i++ {
 		dec.prog.Loads[i], err = dec.DecodeIdent()
 		if err != nil {
 			return fmt.Errorf("Codec: unexpected error while decoding top level: %v", err)
 		}
 	}
 
-	count, err = dec.DecodeUvarint()
+	count, err = dec.decodeLength()
 	if err != nil {
 		return fmt.Errorf("Codec: unexpected error while decoding top level: %v", err)
 	}
 	dec.prog.Names = make([]string, count)
-	for i := uint64(0); i < count; i++ {
+	for i := 0; i < count; i++ {
 		var name String
 		name, err = dec.DecodeString()
 		if err != nil {
@@ -242,49 +491,40 @@ func (dec *Decoder) DecodeToplevel() error {
 		dec.prog.Names[i] = string(name)
 	}
 
-	count, err = dec.DecodeUvarint()
+	count, err = dec.decodeLength()
 	if err != nil {
 		return fmt.Errorf("Codec: unexpected error while decoding top level: %v", err)
 	}
 	dec.prog.Constants = make([]interface{}, count)
-	for i := uint64(0); i < count; i++ {
+	for i := 0; i < count; i++ {
 		var c Value
 		c, err = dec.DecodeValue()
 		if err != nil {
 			return fmt.Errorf("Codec: unexpected error while decoding top level: %v", err)
 		}
-		switch t := c.(type) {
-		case String:
-			dec.prog.Constants[i] = string(t)
-		case Int:
-			if i64, ok := t.Int64(); ok {
-				dec.prog.Constants[i] = i64
-			} else {
-				dec.prog.Constants[i] = t.bigint
-			}
-		case Float:
-			dec.prog.Constants[i] = float64(t)
+		if dec.prog.Constants[i], err = programConstant(c); err != nil {
+			return err
 		}
 	}
 
-	count, err = dec.DecodeUvarint()
+	count, err = dec.decodeLength()
 	if err != nil {
 		return fmt.Errorf("Codec: unexpected error while decoding top level: %v", err)
 	}
 	dec.prog.Functions = make([]*compile.Funcode, count)
-	for i := uint64(0); i < count; i++ {
+	for i := 0; i < count; i++ {
 		dec.prog.Functions[i], err = dec.DecodeFuncode()
 		if err != nil {
 			return fmt.Errorf("Codec: unexpected error while decoding top level: %v", err)
 		}
 	}
 
-	count, err = dec.DecodeUvarint()
+	count, err = dec.decodeLength()
 	if err != nil {
 		return fmt.Errorf("Codec: unexpected error while decoding top level: %v", err)
 	}
 	dec.prog.Globals = make([]compile.Ident, count)
-	for i := uint64(0); i < count; i++ {
+	for i := 0; i < count; i++ {
 		dec.prog.Globals[i], err = dec.DecodeIdent()
 		if err != nil {
 			return fmt.Errorf("Codec: unexpected error while decoding top level: %v", err)
@@ -307,19 +547,42 @@ func (dec *Decoder) DecodeToplevel() error {
 	return nil
 }
 
+// programConstant returns the constant of a compiled program which is represented by a decoded value.
+func programConstant(c Value) (interface{}, error) {
+	switch t := c.(type) {
+	case String:
+		return string(t), nil
+	case Int:
+		if i64, ok := t.Int64(); ok {
+			return i64, nil
+		}
+		return t.bigint, nil
+	case Float:
+		return float64(t), nil
+	default:
+		return nil, fmt.Errorf("Codec: unexpected constant of type %s while decoding top level", c.Type())
+	}
+}
+
+// EncodeFnShared encodes the values shared by the functions of a program. Since the application
+// supplies its predeclared values again to the decoder, which prefers them to the decoded ones,
+// predeclared values which cannot be encoded are encoded as None rather than reported.
 func (enc *Encoder) EncodeFnShared(fn *Function) {
 	enc.WriteTag(T_FnShared)
 	enc.WriteUvarint(uint64(len(fn.predeclared)))
 	for k, v := range fn.predeclared {
+		enc.location = codecLocation{kind: "predeclared variable", name: k}
 		enc.EncodeString(String(k))
-		if v == nil {
-			enc.WriteTag(T_None)
-			continue
-		}
+		errors := len(enc.errors)
 		enc.EncodeValue(v)
+		enc.errors = enc.errors[:errors]
 	}
 	enc.WriteUvarint(uint64(len(fn.globals)))
-	for _, v := range fn.globals {
+	for i, v := range fn.globals {
+		enc.location = codecLocation{kind: "global variable", index: i}
+		if i < len(fn.funcode.Prog.Globals) {
+			enc.location.name = fn.funcode.Prog.Globals[i].Name
+		}
 		if v == nil {
 			enc.WriteTag(T_None)
 			continue
@@ -327,13 +590,15 @@ func (enc *Encoder) EncodeFnShared(fn *Function) {
 		enc.EncodeValue(v)
 	}
 	enc.WriteUvarint(uint64(len(fn.constants)))
-	for _, v := range fn.constants {
+	for i, v := range fn.constants {
+		enc.location = codecLocation{kind: "constant", index: i}
 		if v == nil {
 			enc.WriteTag(T_None)
 			continue
 		}
 		enc.EncodeValue(v)
 	}
+	enc.location = codecLocation{}
 	enc.WriteTag(T_FnShared_End)
 }
 
@@ -345,20 +610,20 @@ func (dec *Decoder) DecodeFnShared() error {
 		return fmt.Errorf("Codec: unexpected tag (%v) while decoding shared sections", dec.Data[0])
 	}
 	dec.Data = dec.Data[1:]
-	size, err := dec.DecodeUvarint()
+	size, err := dec.decodeLength()
 	if err != nil {
 		return fmt.Errorf("Codec: unexpected error while decoding shared sections: %v", err)
 	}
 	if len(dec.predeclared) == 0 {
 		dec.predeclared = make(StringDict, size)
 	} else {
-		predeclared := make(StringDict, int(size)+len(dec.predeclared))
+		predeclared := make(StringDict, size+len(dec.predeclared))
 		for k, v := range dec.predeclared {
 			predeclared[k] = v
 		}
 		dec.predeclared = predeclared
 	}
-	for i := uint64(0); i < size; i++ {
+	for i := 0; i < size; i++ {
 		var k String
 		k, err = dec.DecodeString()
 		if err != nil {
@@ -369,25 +634,28 @@ func (dec *Decoder) DecodeFnShared() error {
 		if err != nil {
 			return fmt.Errorf("Codec: unexpected error while decoding shared sections: %v", err)
 		}
-		dec.predeclared[string(k)] = v
+		// The values supplied by the application take precedence:
+		if _, ok := dec.predeclared[string(k)]; !ok {
+			dec.predeclared[string(k)] = v
+		}
 	}
-	size, err = dec.DecodeUvarint()
+	size, err = dec.decodeLength()
 	if err != nil {
 		return fmt.Errorf("Codec: unexpected error while decoding shared sections: %v", err)
 	}
 	dec.globals = make([]Value, size)
-	for i := uint64(0); i < size; i++ {
+	for i := 0; i < size; i++ {
 		dec.globals[i], err = dec.DecodeValue()
 		if err != nil {
 			return fmt.Errorf("Codec: unexpected error while decoding shared sections: %v", err)
 		}
 	}
-	size, err = dec.DecodeUvarint()
+	size, err = dec.decodeLength()
 	if err != nil {
 		return fmt.Errorf("Codec: unexpected error while decoding shared sections: %v", err)
 	}
 	dec.constants = make([]Value, size)
-	for i := uint64(0); i < size; i++ {
+	for i := 0; i < size; i++ {
 		dec.constants[i], err = dec.DecodeValue()
 		if err != nil {
 			return fmt.Errorf("Codec: unexpected error while decoding shared sections: %v", err)
@@ -409,13 +677,22 @@ func (enc *Encoder) EncodeFrame(frame *Frame) {
 	enc.WriteUvarint(uint64(frame.sp))
 	enc.WriteUvarint(uint64(frame.pc))
 	enc.EncodePosition(frame.Position())
+	name := frame.Callable().Name()
+	enc.location = codecLocation{kind: "frame", name: name}
 	enc.EncodeValue(frame.Callable().(Value))
 	stackSize := int(frame.sp)
+	var locals []compile.Ident
 	if fn, isFunction := frame.Callable().(*Function); isFunction {
-		stackSize += len(fn.funcode.Locals)
+		locals = fn.funcode.Locals
+		stackSize += len(locals)
 	}
 	enc.WriteUvarint(uint64(stackSize))
-	for _, v := range frame.stack[:stackSize] {
+	for i, v := range frame.stack[:stackSize] {
+		if i < len(locals) {
+			enc.location = codecLocation{kind: "local variable", name: locals[i].Name, fn: name}
+		} else {
+			enc.location = codecLocation{kind: "stack slot", index: i - len(locals), fn: name}
+		}
 		if v == nil {
 			enc.WriteTag(T_None)
 			continue
@@ -423,7 +700,8 @@ func (enc *Encoder) EncodeFrame(frame *Frame) {
 		enc.EncodeValue(v)
 	}
 	enc.WriteUvarint(uint64(len(frame.iterstack)))
-	for _, v := range frame.iterstack {
+	for i, v := range frame.iterstack {
+		enc.location = codecLocation{kind: "iterator", index: i, fn: name}
 		if v == nil {
 			enc.WriteTag(T_None)
 			continue
@@ -435,11 +713,20 @@ func (enc *Encoder) EncodeFrame(frame *Frame) {
 		enc.WriteUvarint(uint64(h.pc))
 		enc.WriteUvarint(uint64(h.sp))
 	}
+	enc.location = codecLocation{kind: "arguments", name: "*args", fn: name}
 	enc.EncodeTuple(frame.args)
+	enc.location = codecLocation{kind: "arguments", name: "**kwargs", fn: name}
 	enc.WriteUvarint(uint64(len(frame.kwargs)))
 	for _, v := range frame.kwargs {
 		enc.EncodeTuple(v)
 	}
+	enc.location = codecLocation{kind: "suspended state", index: -1, fn: name}
+	if frame.state != nil {
+		enc.EncodeValue(frame.state)
+	} else {
+		enc.WriteTag(T_None)
+	}
+	enc.location = codecLocation{}
 	enc.WriteTag(T_Frame_End)
 }
 
@@ -490,12 +777,13 @@ func (dec *Decoder) DecodeFrame() (*Frame, error) {
 	}
 	frame.callable = c
 	// stack
-	x, err = dec.DecodeUvarint()
+	var n int
+	n, err = dec.decodeLength()
 	if err != nil {
 		return frame, fmt.Errorf("Codec: unexpected error while decoding frame: %v", err)
 	}
-	frame.stack = make([]Value, x)
-	for i := uint64(0); i < x; i++ {
+	frame.stack = make([]Value, n)
+	for i := 0; i < n; i++ {
 		v, err = dec.DecodeValue()
 		if err != nil {
 			return frame, fmt.Errorf("Codec: unexpected error while decoding frame: %v", err)
@@ -503,12 +791,12 @@ func (dec *Decoder) DecodeFrame() (*Frame, error) {
 		frame.stack[i] = v
 	}
 	// iterstack
-	x, err = dec.DecodeUvarint()
+	n, err = dec.decodeLength()
 	if err != nil {
 		return frame, fmt.Errorf("Codec: unexpected error while decoding frame: %v", err)
 	}
-	frame.iterstack = make([]Iterator, x)
-	for i := uint64(0); i < x; i++ {
+	frame.iterstack = make([]Iterator, n)
+	for i := 0; i < n; i++ {
 		it, err := dec.DecodeIterator()
 		if err != nil {
 			return frame, fmt.Errorf("Codec: unexpected error while decoding frame: %v", err)
@@ -516,12 +804,12 @@ func (dec *Decoder) DecodeFrame() (*Frame, error) {
 		frame.iterstack[i] = it
 	}
 	// exhandlers
-	x, err = dec.DecodeUvarint()
+	n, err = dec.decodeLength()
 	if err != nil {
 		return frame, fmt.Errorf("Codec: unexpected error while decoding frame: %v", err)
 	}
-	frame.exhandlers = make([]exceptionHandler, x)
-	for i := uint64(0); i < x; i++ {
+	frame.exhandlers = make([]exceptionHandler, n)
+	for i := 0; i < n; i++ {
 		x, err = dec.DecodeUvarint()
 		if err != nil {
 			return frame, fmt.Errorf("Codec: unexpected error while decoding frame: %v", err)
@@ -539,18 +827,26 @@ func (dec *Decoder) DecodeFrame() (*Frame, error) {
 		return frame, fmt.Errorf("Codec: unexpected error while decoding frame: %v", err)
 	}
 	// kwargs
-	x, err = dec.DecodeUvarint()
+	n, err = dec.decodeLength()
 	if err != nil {
 		return frame, fmt.Errorf("Codec: unexpected error while decoding frame: %v", err)
 	}
-	frame.kwargs = make([]Tuple, x)
-	for i := uint64(0); i < x; i++ {
+	frame.kwargs = make([]Tuple, n)
+	for i := 0; i < n; i++ {
 		t, err := dec.DecodeTuple()
 		if err != nil {
 			return frame, fmt.Errorf("Codec: unexpected error while decoding frame: %v", err)
 		}
 		frame.kwargs[i] = t
 	}
+	// state
+	v, err = dec.DecodeValue()
+	if err != nil {
+		return frame, fmt.Errorf("Codec: unexpected error while decoding frame: %v", err)
+	}
+	if v != None {
+		frame.state = v
+	}
 
 	if dec.Remaining() < 1 {
 		return frame, errors.New("Codec: missing end tag while decoding frame")
@@ -0,0 +1,192 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylark
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sync"
+
+	"github.com/google/skylark/internal/compile"
+)
+
+// CodecVersion is the version of the encoded state format.
+// Increment this whenever the encoding of sections, frames or values changes.
+const CodecVersion = 10
+
+// A SnapshotVersion identifies the interpreter build which encoded the state of a thread.
+// An encoded state is only decoded by a build of the same version, unless migrations
+// from the encoded version have been registered using RegisterMigration, or
+// RegisterJSONMigration for JSON renderings.
+//
+// States encoded before the version header was introduced have the zero SnapshotVersion.
+type SnapshotVersion struct {
+	Codec    uint64 `json:"codec"`    // version of the encoded state format
+	Compiler uint64 `json:"compiler"` // version of the bytecode compiler
+	Opcodes  uint32 `json:"opcodes"`  // fingerprint of the opcode table
+	Tags     uint32 `json:"tags"`     // fingerprint of the codec tag table
+}
+
+func (v SnapshotVersion) String() string {
+	return fmt.Sprintf("codec %d, compiler %d, opcodes %08x, tags %08x", v.Codec, v.Compiler, v.Opcodes, v.Tags)
+}
+
+var currentVersion = SnapshotVersion{
+	Codec:    CodecVersion,
+	Compiler: compile.Version,
+	Opcodes:  opcodeFingerprint(),
+	Tags:     tagFingerprint(),
+}
+
+// CurrentSnapshotVersion returns the version of the states encoded by this interpreter.
+func CurrentSnapshotVersion() SnapshotVersion {
+	return currentVersion
+}
+
+// opcodeFingerprint returns a hash of the names and numbers of all opcodes.
+func opcodeFingerprint() uint32 {
+	h := fnv.New32a()
+	for op := compile.Opcode(0); op <= compile.OpcodeMax; op++ {
+		fmt.Fprintf(h, "%d:%s;", op, op)
+	}
+	fmt.Fprintf(h, "argmin:%d", compile.OpcodeArgMin)
+	return h.Sum32()
+}
+
+// tagFingerprint returns a hash of the names and numbers of all codec tags.
+func tagFingerprint() uint32 {
+	h := fnv.New32a()
+	for tag, name := range tagNames {
+		if name != "" {
+			fmt.Fprintf(h, "%d:%s;", tag, name)
+		}
+	}
+	return h.Sum32()
+}
+
+// A VersionMismatchError is returned when decoding a state which was encoded by a different
+// version of the interpreter, and which cannot be migrated to the current version.
+type VersionMismatchError struct {
+	Found    SnapshotVersion // version of the encoded state, or of its last migration
+	Expected SnapshotVersion // version of this interpreter
+}
+
+func (e *VersionMismatchError) Error() string {
+	return fmt.Sprintf("Codec: cannot decode state of version (%v) with interpreter of version (%v)", e.Found, e.Expected)
+}
+
+// A Migration upgrades the uncompressed body of an encoded state, i.e. the sections which follow
+// the header, from the version it was registered for. It returns the upgraded body along with its
+// new version, which may be upgraded further by other migrations.
+//
+// Migrations of JSON renderings, registered using RegisterJSONMigration, upgrade the whole
+// JSON document instead.
+type Migration func(body []byte) (SnapshotVersion, []byte, error)
+
+// A migrationTable holds the registered migrations of one format by the version they upgrade from.
+type migrationTable struct {
+	mu sync.RWMutex
+	m  map[SnapshotVersion]Migration
+}
+
+// migrations and jsonMigrations are the registered migrations of encoded states,
+// and of their JSON renderings.
+var migrations, jsonMigrations migrationTable
+
+// RegisterMigration registers a migration of encoded states from the given version.
+// It may be called concurrently with the decoding of states.
+func RegisterMigration(from SnapshotVersion, m Migration) error {
+	return migrations.register(from, m)
+}
+
+// RegisterJSONMigration registers a migration of the JSON renderings of states from the given version.
+// It may be called concurrently with the decoding of states.
+func RegisterJSONMigration(from SnapshotVersion, m Migration) error {
+	return jsonMigrations.register(from, m)
+}
+
+func (t *migrationTable) register(from SnapshotVersion, m Migration) error {
+	if from == currentVersion {
+		return fmt.Errorf("Codec: cannot register migration from the current version (%v)", from)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.m == nil {
+		t.m = make(map[SnapshotVersion]Migration)
+	}
+	if t.m[from] != nil {
+		return fmt.Errorf("Codec: migration from version (%v) is already registered", from)
+	}
+	t.m[from] = m
+	return nil
+}
+
+// migrate applies the registered migrations to the body of an encoded state,
+// until it has reached the current version.
+func migrate(table *migrationTable, version SnapshotVersion, body []byte) ([]byte, error) {
+	// Each migration is applied at most once, to guard against cycles:
+	for applied := 0; version != currentVersion; applied++ {
+		m, registered := table.lookup(version)
+		if m == nil || applied >= registered {
+			return nil, &VersionMismatchError{Found: version, Expected: currentVersion}
+		}
+		from := version
+		var err error
+		if version, body, err = m(body); err != nil {
+			return nil, fmt.Errorf("Codec: error while migrating state from version (%v): %v", from, err)
+		}
+	}
+	return body, nil
+}
+
+// lookup returns the migration from the given version, if any,
+// and the number of registered migrations.
+func (t *migrationTable) lookup(from SnapshotVersion) (Migration, int) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.m[from], len(t.m)
+}
+
+// writeVersion writes the version header of an encoded state.
+func writeVersion(w io.Writer, v SnapshotVersion) {
+	header := []byte{T_Version}
+	var b [binary.MaxVarintLen64]byte
+	for _, n := range []uint64{v.Codec, v.Compiler, uint64(v.Opcodes), uint64(v.Tags)} {
+		header = append(header, b[:binary.PutUvarint(b[:], n)]...)
+	}
+	w.Write(header)
+}
+
+// readVersion reads the version header of an encoded state, if present.
+func readVersion(r *stateReader) (SnapshotVersion, error) {
+	var v SnapshotVersion
+	if r.peekTag() != T_Version {
+		return v, nil
+	}
+	r.ReadByte()
+	var fields [4]uint64
+	for i := range fields {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return v, fmt.Errorf("Codec: unexpected error while decoding version: %v", err)
+		}
+		fields[i] = n
+	}
+	v.Codec, v.Compiler, v.Opcodes, v.Tags = fields[0], fields[1], uint32(fields[2]), uint32(fields[3])
+	return v, nil
+}
+
+// ReadSnapshotVersion returns the version of an encoded state, without decoding the state.
+func ReadSnapshotVersion(snapshot []byte) (SnapshotVersion, error) {
+	if len(snapshot) < len(CodecMagic) || string(snapshot[:len(CodecMagic)]) != CodecMagic {
+		return SnapshotVersion{}, fmt.Errorf("Codec: invalid format identifier at start of bytecode")
+	}
+	r := bytes.NewReader(snapshot[len(CodecMagic):])
+	return readVersion(&stateReader{Reader: bufio.NewReader(r)})
+}
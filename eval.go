@@ -16,6 +16,7 @@ import (
 	"strings"
 	"unicode"
 	"unicode/utf8"
+	"unsafe"
 
 	"github.com/google/skylark/internal/compile"
 	"github.com/google/skylark/resolve"
@@ -32,6 +33,14 @@ type Thread struct {
 	frame *Frame
 	// suspended is non nil after a Thread is suspended.
 	suspended *Frame
+	// yielded is set when the frame of a generator is suspended by a yield statement.
+	yielded bool
+	// iterErr is an error raised by a generator while it was iterated by Generator.Next,
+	// which is raised by the interpreter after the operation which iterated it.
+	// It is discarded when the outermost call of the thread returns.
+	iterErr error
+	// calls is the number of calls in progress in the thread, by Call or by the interpreter.
+	calls int
 
 	// Print is the client-supplied implementation of the Skylark
 	// 'print' function. If nil, fmt.Fprintln(os.Stderr, msg) is
@@ -46,6 +55,53 @@ type Thread struct {
 	// See example_test.go for some example implementations of Load.
 	Load func(thread *Thread, module string) (StringDict, error)
 
+	// Journal, if non-nil, records the calls of the built-in functions
+	// supplied by the client, or replays the results of previously
+	// recorded calls. See Journal.
+	Journal *Journal
+
+	// Metadata holds client-supplied annotations of the thread, such as a
+	// deadline or a correlation ID. Unlike thread-local values, metadata is
+	// encoded with the state of a suspended thread, in a header which may be
+	// read without decoding the state (see ReadSnapshotMetadata).
+	Metadata map[string]string
+
+	// MaxSteps, if nonzero, is the budget of steps of the bytecode interpreter
+	// for the thread. A thread which has executed MaxSteps steps is interrupted
+	// (see Interrupt). The budget of a suspended thread may be raised before
+	// it is resumed.
+	//
+	// The steps executed (see Steps) are encoded with the state of a suspended
+	// thread, and a decoded thread keeps counting from them, such that the budget
+	// applies to the whole execution of the thread. The budget itself is not
+	// encoded, and must be set again on the decoded thread.
+	MaxSteps uint64
+
+	// SuspendOnInterrupt causes a thread which is interrupted to be suspended,
+	// rather than to fail, unless a function on its call stack is not resumable.
+	// The thread is suspended before an instruction at which a value is on the
+	// stack, possibly a few steps after it was interrupted. Resuming the thread
+	// continues its execution; the value with which it is resumed is ignored.
+	SuspendOnInterrupt bool
+
+	// MaxAlloc, if nonzero, is the approximate number of bytes which the thread
+	// may allocate for values, such as strings, lists and dicts. An operation
+	// which would exceed it raises a MemoryError, which may be caught by an
+	// except clause. Memory which is no longer referenced is still accounted
+	// for: the limit bounds the total allocations of the thread.
+	//
+	// Like the steps of MaxSteps, the bytes allocated (see Allocs) are encoded
+	// with the state of a suspended thread, such that the limit applies to the
+	// whole execution of a decoded thread.
+	MaxAlloc uint64
+
+	// steps is the number of steps executed by the interpreter.
+	steps uint64
+	// cancelReason is the *string passed to Cancel, or nil.
+	cancelReason unsafe.Pointer
+	// allocs is the approximate number of bytes allocated by the thread.
+	allocs uint64
+
 	// locals holds arbitrary "thread-local" Go values belonging to the client.
 	// They are accessible to the client but not to any Skylark program.
 	locals map[string]interface{}
@@ -95,6 +151,82 @@ func (thread *Thread) Suspendable(args Tuple, kwargs []Tuple) {
 	thread.suspended.args, thread.suspended.kwargs = args, kwargs
 }
 
+// A Suspension describes the suspension of a thread by the 'suspend' built-in.
+type Suspension struct {
+	Tag     string     // tag passed to suspend
+	Payload StringDict // keyword arguments passed to suspend
+}
+
+// Pending returns the tag and payload with which a suspended thread was suspended by the
+// 'suspend' built-in, or nil if the thread was not suspended by it. The value returned by
+// suspend is the value with which the thread is resumed.
+func (thread *Thread) Pending() *Suspension {
+	frame := thread.suspended
+	if frame == nil {
+		frame = thread.frame // e.g. a decoded thread
+	}
+	if frame == nil || len(frame.args) != 1 {
+		return nil
+	}
+	if b, ok := frame.callable.(*Builtin); !ok || b != Universe["suspend"] {
+		return nil
+	}
+	tag, ok := frame.args[0].(String)
+	if !ok {
+		return nil
+	}
+	s := &Suspension{Tag: string(tag), Payload: make(StringDict, len(frame.kwargs))}
+	for _, kv := range frame.kwargs {
+		if len(kv) != 2 {
+			continue
+		}
+		if name, ok := kv[0].(String); ok {
+			s.Payload[string(name)] = kv[1]
+		}
+	}
+	return s
+}
+
+// Awaited returns the unresolved futures for which a suspended thread was suspended by the
+// 'await_all' built-in, or nil if the thread was not suspended by it. The thread must be
+// resumed with a list of the results of their calls, in the same order, where a call
+// which failed has the exception with which it failed as its result.
+func (thread *Thread) Awaited() []*Future {
+	frame := thread.suspended
+	if frame == nil {
+		frame = thread.frame // e.g. a decoded thread
+	}
+	if frame == nil {
+		return nil
+	}
+	if b, ok := frame.callable.(*Builtin); !ok || b != Universe["await_all"] {
+		return nil
+	}
+	_, pending, _, ok := awaitState(frame.state)
+	if !ok {
+		return nil
+	}
+	futures := make([]*Future, len(pending))
+	for i, f := range pending {
+		futures[i] = f.(*Future)
+	}
+	return futures
+}
+
+// SuspendCall records the continuation state of the built-in function in the current
+// stack frame, after a Skylark function which it called has suspended the thread.
+// The built-in must return immediately afterwards; upon resumption of the thread,
+// the state is passed to its ResumeCall method (see ResumableBuiltin).
+//
+// A resumable built-in may also record its state after suspending the thread itself
+// (see Suspendable), in which case ResumeCall completes its call with the value with
+// which the thread is resumed, e.g. as 'await_all' does.
+//
+// The state must be encodable by the codec if the thread's state is to be encoded.
+func (thread *Thread) SuspendCall(state Value) {
+	thread.frame.state = state
+}
+
 // Resumable restores the suspended state of a thread as the current stack frame and
 // dissociates the suspended state.
 func (thread *Thread) Resumable() {
@@ -190,6 +322,10 @@ type Frame struct {
 	// args and kwargs are non-nil when a builtin function (the current function) is suspended.
 	args   Tuple
 	kwargs []Tuple
+
+	// state is non-nil when a resumable builtin function on the call-stack of a
+	// suspended thread has recorded its continuation state (see Thread.SuspendCall).
+	state Value
 }
 
 // The Frames of a thread are structured as a spaghetti stack, not a
@@ -229,10 +365,63 @@ func (fr *Frame) Args() Tuple { return fr.args }
 // An empty slice will be returned if the current frame was not directly suspended.
 func (fr *Frame) Kwargs() []Tuple { return fr.kwargs }
 
+// State returns the continuation state recorded by a resumable built-in function
+// in the current frame, or nil if no state was recorded.
+func (fr *Frame) State() Value { return fr.state }
+
+// PC returns the program counter of the active call in a compiled function's frame.
+func (fr *Frame) PC() uint32 { return fr.callpc }
+
+// Locals returns the names and values of the local variables of a compiled function's frame.
+// The value of a local variable which is not yet bound is nil.
+func (fr *Frame) Locals() (names []string, values []Value) {
+	fn, ok := fr.callable.(*Function)
+	if !ok {
+		return nil, nil
+	}
+	for i, local := range fn.funcode.Locals {
+		names = append(names, local.Name)
+		if i < len(fr.stack) {
+			values = append(values, fr.stack[i])
+		} else {
+			values = append(values, nil)
+		}
+	}
+	return names, values
+}
+
+// Iterators returns the stack of active iterators of a compiled function's frame, innermost last.
+func (fr *Frame) Iterators() []Iterator { return fr.iterstack }
+
+// ExceptionHandlers returns the program counters of the active exception handlers
+// of a compiled function's frame, innermost last.
+func (fr *Frame) ExceptionHandlers() []uint32 {
+	pcs := make([]uint32, len(fr.exhandlers))
+	for i, h := range fr.exhandlers {
+		pcs[i] = h.pc
+	}
+	return pcs
+}
+
+// isResumable reports whether the frame can be resumed after the thread is
+// suspended by a function which it (transitively) called.
+func (fr *Frame) isResumable() bool {
+	switch fr.callable.(type) {
+	case *Function:
+		return true
+	case ResumableBuiltin:
+		return fr.state != nil
+	}
+	return false
+}
+
 // An EvalError is a Skylark evaluation error and its associated call stack.
 type EvalError struct {
 	Msg   string
 	Frame *Frame
+
+	// Interrupt is non-nil if the thread was interrupted (see Thread.Cancel).
+	Interrupt *Interrupt
 }
 
 func (e *EvalError) Error() string { return e.Msg }
@@ -435,34 +624,89 @@ func Eval(thread *Thread, filename string, src interface{}, env StringDict) (Val
 // The top frame will be popped before resumption, assuming the thread
 // was suspended by a non-resumable (builtin) function.
 func Resume(thread *Thread, retval Value) (StringDict, error) {
+	if retval == nil {
+		retval = None
+	}
+	return resume(thread, retval, nil)
+}
+
+// ResumeWithError resumes a suspended thread by raising the given exception at the
+// point of suspension, as if the function which originally suspended the thread had
+// returned the exception as its error.
+//
+// The exception may be caught by the exception handlers which were active in the
+// calling function when the thread was suspended. An uncaught exception is returned
+// as an *EvalError.
+func ResumeWithError(thread *Thread, exception Exception) (StringDict, error) {
+	if exception == nil {
+		return nil, errors.New("resumed thread requires a non-nil exception to raise")
+	}
+	return resume(thread, None, exception)
+}
+
+func resume(thread *Thread, retval Value, raised error) (StringDict, error) {
 	if thread.SuspendedFrame() != nil {
 		thread.Resumable()
 	}
-	thread.PopFrame()
-	frame := thread.frame
-	if frame == nil {
+	// The call which suspended the thread is complete, unless it is that of a resumable
+	// built-in which recorded its state (see SuspendCall):
+	if top := thread.frame; top == nil || top.state == nil {
+		thread.journalReturn(top, retval, raised)
+		thread.PopFrame()
+	}
+	if thread.frame == nil {
 		return nil, errors.New("resumed thread contains no resumable functions in call-stack")
 	}
-	// Check for non-resumable (built-in) functions in the call-stack:
-	for frame != nil {
-		if _, isFunction := frame.Callable().(*Function); !isFunction {
+	// Check for non-resumable functions in the call-stack:
+	for frame := thread.frame; frame != nil; frame = frame.parent {
+		if !frame.isResumable() {
 			return nil, fmt.Errorf("resumed thread contains non-resumable function in call-stack: %s", frame.Callable().Name())
 		}
-		frame = frame.parent
+		// The position of a decoded frame is that of its call when it was encoded:
+		frame.posn = syntax.Position{}
 	}
-	if retval == nil {
-		retval = None
-	}
-	frame = thread.frame
-	fc := frame.Callable().(*Function).funcode
-	if len(frame.stack) < len(fc.Locals)+fc.MaxStack {
-		stack := make([]Value, len(fc.Locals)+fc.MaxStack)
-		copy(stack, frame.stack)
-		frame.stack = stack
+	// Resume each run of compiled functions and each resumable builtin in turn,
+	// passing the result (or error) of each to its caller:
+	for {
+		frame := thread.frame
+		caller := frame.parent
+		switch callable := frame.Callable().(type) {
+		case *Function:
+			// Compiled functions return directly to compiled callers,
+			// so continue to the nearest non-compiled caller:
+			for caller != nil {
+				if _, isFunction := caller.Callable().(*Function); !isFunction {
+					break
+				}
+				caller = caller.parent
+			}
+			fc := callable.funcode
+			if len(frame.stack) < len(fc.Locals)+fc.MaxStack {
+				stack := make([]Value, len(fc.Locals)+fc.MaxStack)
+				copy(stack, frame.stack)
+				frame.stack = stack
+			}
+			frame.stack[len(fc.Locals)+int(frame.sp)-1] = retval
+			retval, raised = interpret(thread, nil, nil, true, raised)
+		case ResumableBuiltin:
+			// An error raised by a callee propagates through the builtin to its caller.
+			if raised == nil {
+				retval, raised = callable.ResumeCall(thread, frame.state, retval)
+				if raised == nil && retval == nil {
+					raised = fmt.Errorf("internal error: nil (not None) returned from %s", callable.Name())
+				}
+			}
+			if thread.SuspendedFrame() == nil {
+				thread.journalReturn(frame, retval, raised)
+			}
+		}
+		if thread.SuspendedFrame() != nil || caller == nil {
+			break
+		}
+		thread.frame = caller
 	}
-	frame.stack[len(fc.Locals)+int(frame.sp)-1] = retval
-	if _, err := interpret(thread, nil, nil, true); err != nil {
-		return nil, err
+	if raised != nil {
+		return nil, raised
 	}
 	return thread.Globals(), nil
 }
@@ -493,7 +737,7 @@ func getAttr(fr *Frame, x Value, name string) (Value, error) {
 		}
 	}
 
-	return nil, TypeErrorf("%s has no .%s field or method", x.Type(), name)
+	return nil, AttributeErrorf("%s has no .%s field or method", x.Type(), name)
 }
 
 // setField implements x.name = y.
@@ -502,7 +746,7 @@ func setField(fr *Frame, x Value, name string, y Value) error {
 		err := x.SetField(name, y)
 		return err
 	}
-	return TypeErrorf("can't assign to .%s field of %s", name, x.Type())
+	return AttributeErrorf("can't assign to .%s field of %s", name, x.Type())
 }
 
 // getIndex implements x[y].
@@ -514,7 +758,7 @@ func getIndex(fr *Frame, x, y Value) (Value, error) {
 			return nil, err
 		}
 		if !found {
-			return nil, ValueErrorf("key %v not in %s", y, x.Type())
+			return nil, KeyErrorf("key %v not in %s", y, x.Type())
 		}
 		return z, nil
 
@@ -528,7 +772,7 @@ func getIndex(fr *Frame, x, y Value) (Value, error) {
 			i += n
 		}
 		if i < 0 || i >= n {
-			return nil, ValueErrorf("%s index %d out of range [0:%d]",
+			return nil, IndexErrorf("%s index %d out of range [0:%d]",
 				x.Type(), i, n)
 		}
 		return x.Index(i), nil
@@ -553,7 +797,7 @@ func setIndex(fr *Frame, x, y, z Value) error {
 			i += x.Len()
 		}
 		if i < 0 || i >= x.Len() {
-			return ValueErrorf("%s index %d out of range [0:%d]", x.Type(), i, x.Len())
+			return IndexErrorf("%s index %d out of range [0:%d]", x.Type(), i, x.Len())
 		}
 		return x.SetIndex(i, z)
 
@@ -723,12 +967,12 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			case Int:
 				yf := y.Float()
 				if yf == 0.0 {
-					return nil, ValueErrorf("real division by zero")
+					return nil, ZeroDivisionErrorf("real division by zero")
 				}
 				return x.Float() / yf, nil
 			case Float:
 				if y == 0.0 {
-					return nil, ValueErrorf("real division by zero")
+					return nil, ZeroDivisionErrorf("real division by zero")
 				}
 				return x.Float() / y, nil
 			}
@@ -736,13 +980,13 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			switch y := y.(type) {
 			case Float:
 				if y == 0.0 {
-					return nil, ValueErrorf("real division by zero")
+					return nil, ZeroDivisionErrorf("real division by zero")
 				}
 				return x / y, nil
 			case Int:
 				yf := y.Float()
 				if yf == 0.0 {
-					return nil, ValueErrorf("real division by zero")
+					return nil, ZeroDivisionErrorf("real division by zero")
 				}
 				return x / yf, nil
 			}
@@ -754,12 +998,12 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			switch y := y.(type) {
 			case Int:
 				if y.Sign() == 0 {
-					return nil, ValueErrorf("floored division by zero")
+					return nil, ZeroDivisionErrorf("floored division by zero")
 				}
 				return x.Div(y), nil
 			case Float:
 				if y == 0.0 {
-					return nil, ValueErrorf("floored division by zero")
+					return nil, ZeroDivisionErrorf("floored division by zero")
 				}
 				return floor((x.Float() / y)), nil
 			}
@@ -767,13 +1011,13 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			switch y := y.(type) {
 			case Float:
 				if y == 0.0 {
-					return nil, ValueErrorf("floored division by zero")
+					return nil, ZeroDivisionErrorf("floored division by zero")
 				}
 				return floor(x / y), nil
 			case Int:
 				yf := y.Float()
 				if yf == 0.0 {
-					return nil, ValueErrorf("floored division by zero")
+					return nil, ZeroDivisionErrorf("floored division by zero")
 				}
 				return floor(x / yf), nil
 			}
@@ -785,12 +1029,12 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			switch y := y.(type) {
 			case Int:
 				if y.Sign() == 0 {
-					return nil, ValueErrorf("integer modulo by zero")
+					return nil, ZeroDivisionErrorf("integer modulo by zero")
 				}
 				return x.Mod(y), nil
 			case Float:
 				if y == 0 {
-					return nil, ValueErrorf("float modulo by zero")
+					return nil, ZeroDivisionErrorf("float modulo by zero")
 				}
 				return x.Float().Mod(y), nil
 			}
@@ -798,12 +1042,12 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			switch y := y.(type) {
 			case Float:
 				if y == 0.0 {
-					return nil, ValueErrorf("float modulo by zero")
+					return nil, ZeroDivisionErrorf("float modulo by zero")
 				}
 				return Float(math.Mod(float64(x), float64(y))), nil
 			case Int:
 				if y.Sign() == 0 {
-					return nil, ValueErrorf("float modulo by zero")
+					return nil, ZeroDivisionErrorf("float modulo by zero")
 				}
 				return x.Mod(y.Float()), nil
 			}
@@ -921,16 +1165,20 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 
 	case syntax.LTLT, syntax.GTGT:
 		if x, ok := x.(Int); ok {
-			y, err := AsInt32(y)
-			if err != nil {
-				return nil, err
+			yint, ok := y.(Int)
+			if !ok {
+				return nil, TypeErrorf("shift count: got %s, want int", y.Type())
 			}
-			if y < 0 {
+			if yint.Sign() < 0 {
 				return nil, ValueErrorf("negative shift count: %v", y)
 			}
+			y, err := AsInt32(y)
+			if err != nil {
+				return nil, OverflowErrorf("shift count too large: %v", yint)
+			}
 			if op == syntax.LTLT {
 				if y >= 512 {
-					return nil, ValueErrorf("shift count too large: %v", y)
+					return nil, OverflowErrorf("shift count too large: %v", y)
 				}
 				return x.Lsh(uint(y)), nil
 			} else {
@@ -972,13 +1220,30 @@ func repeat(elems []Value, n int) (res []Value) {
 	return res
 }
 
+// exit ends a call of the interpreter in the thread. When the outermost call returns,
+// the error of a generator which was not raised by any call is discarded.
+func (thread *Thread) exit() {
+	if thread.calls--; thread.calls == 0 {
+		thread.iterErr = nil
+	}
+}
+
 // Call calls the function fn with the specified positional and keyword arguments.
 func Call(thread *Thread, fn Value, args Tuple, kwargs []Tuple) (Value, error) {
 	c, ok := fn.(Callable)
 	if !ok {
 		return nil, TypeErrorf("invalid call of non-function (%s)", fn.Type())
 	}
+	thread.calls++
 	res, err := c.Call(thread, args, kwargs)
+	thread.calls--
+	if thread.iterErr != nil {
+		// A generator which the callee iterated has failed:
+		if err == nil {
+			res, err = nil, thread.iterErr
+		}
+		thread.iterErr = nil
+	}
 	// Sanity check: nil is not a valid Skylark value.
 	if err == nil && res == nil {
 		return nil, fmt.Errorf("internal error: nil (not None) returned from %s", fn)
@@ -1296,7 +1561,7 @@ func interpolate(format string, x Value) (Value, error) {
 			} else if v, found, _ := dict.Get(String(key)); found {
 				arg = v
 			} else {
-				return nil, ValueErrorf("key not found: %s", key)
+				return nil, KeyErrorf("key not found: %s", key)
 			}
 			format = format[j+1:]
 		} else {
@@ -27,6 +27,8 @@ func init() {
 	resolve.AllowSet = true
 	resolve.AllowBitwise = true
 	resolve.AllowTryExcept = true
+	resolve.AllowGenerators = true
+	resolve.AllowWhile = true
 }
 
 func TestEvalExpr(t *testing.T) {
@@ -103,8 +105,10 @@ func TestExecFile(t *testing.T) {
 		"testdata/builtins.sky",
 		"testdata/control.sky",
 		"testdata/dict.sky",
+		"testdata/exception.sky",
 		"testdata/float.sky",
 		"testdata/function.sky",
+		"testdata/generator.sky",
 		"testdata/int.sky",
 		"testdata/list.sky",
 		"testdata/misc.sky",
@@ -114,10 +118,11 @@ func TestExecFile(t *testing.T) {
 	} {
 		filename := filepath.Join(testdata, file)
 		for _, chunk := range chunkedfile.Read(filename, t) {
-			predeclared := skylark.StringDict{
-				"hasfields": skylark.NewBuiltin("hasfields", newHasFields),
-				"fibonacci": fib{},
-			}
+			predeclared := skylark.ExceptionClasses()
+			predeclared["hasfields"] = skylark.NewBuiltin("hasfields", newHasFields)
+			predeclared["fibonacci"] = fib{}
+			predeclared["TimeoutError"] = skylark.NewExceptionClass("TimeoutError", skylark.RuntimeErrorClass)
+			predeclared["OtherTimeoutError"] = skylark.NewExceptionClass("TimeoutError", skylark.RuntimeErrorClass)
 			_, err := skylark.ExecFile(thread, filename, chunk.Source, predeclared)
 			switch err := err.(type) {
 			case *skylark.EvalError:
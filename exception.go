@@ -0,0 +1,339 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylark
+
+// This file defines the classes of exceptions, which form the hierarchy matched by
+// except clauses, and the attributes of exceptions.
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/google/skylark/syntax"
+)
+
+// An ExceptionClass is a class of Skylark exceptions. The classes form a hierarchy
+// rooted at BaseExceptionClass, the class of the catch-all Exception: an except clause
+// naming a class handles the exceptions of the class and of its subclasses.
+// Classes are identified by their pointers, rather than their names, such that classes
+// of the same name created by different calls of NewExceptionClass are distinct.
+//
+// An ExceptionClass is a Skylark value which the application may predeclare under its
+// name. Calling it creates an exception of the class, whose args are the arguments of
+// the call, e.g. LookupError("no such key", k).
+type ExceptionClass struct {
+	name string
+	base *ExceptionClass
+	new  func(err error) Exception // creates an exception of a built-in Go type, if any
+}
+
+var (
+	_ Callable   = (*ExceptionClass)(nil)
+	_ Comparable = (*ExceptionClass)(nil)
+	_ Exception  = ExceptionInstance{}
+	_ HasAttrs   = ExceptionInstance{}
+)
+
+// The classes of the built-in exceptions.
+var (
+	BaseExceptionClass   = &ExceptionClass{name: "Exception"}
+	ArithmeticErrorClass = NewExceptionClass("ArithmeticError", BaseExceptionClass)
+	LookupErrorClass     = NewExceptionClass("LookupError", BaseExceptionClass)
+	RuntimeErrorClass    = NewExceptionClass("RuntimeError", BaseExceptionClass)
+
+	TypeErrorClass = &ExceptionClass{name: "TypeError", base: BaseExceptionClass,
+		new: func(err error) Exception { return NewTypeError(err) }}
+	ValueErrorClass = &ExceptionClass{name: "ValueError", base: BaseExceptionClass,
+		new: func(err error) Exception { return NewValueError(err) }}
+	IOErrorClass = &ExceptionClass{name: "IOError", base: BaseExceptionClass,
+		new: func(err error) Exception { return NewIOError(err) }}
+	MemoryErrorClass = &ExceptionClass{name: "MemoryError", base: BaseExceptionClass,
+		new: func(err error) Exception { return NewMemoryError(err) }}
+	KeyErrorClass = &ExceptionClass{name: "KeyError", base: LookupErrorClass,
+		new: func(err error) Exception { return NewKeyError(err) }}
+	IndexErrorClass = &ExceptionClass{name: "IndexError", base: LookupErrorClass,
+		new: func(err error) Exception { return NewIndexError(err) }}
+	ZeroDivisionErrorClass = &ExceptionClass{name: "ZeroDivisionError", base: ArithmeticErrorClass,
+		new: func(err error) Exception { return NewZeroDivisionError(err) }}
+	AttributeErrorClass = &ExceptionClass{name: "AttributeError", base: BaseExceptionClass,
+		new: func(err error) Exception { return NewAttributeError(err) }}
+	NameErrorClass = &ExceptionClass{name: "NameError", base: BaseExceptionClass,
+		new: func(err error) Exception { return NewNameError(err) }}
+	OverflowErrorClass = &ExceptionClass{name: "OverflowError", base: ArithmeticErrorClass,
+		new: func(err error) Exception { return NewOverflowError(err) }}
+	RecursionErrorClass = &ExceptionClass{name: "RecursionError", base: RuntimeErrorClass,
+		new: func(err error) Exception { return NewRecursionError(err) }}
+)
+
+// exceptionClasses are the classes of the built-in exceptions.
+var exceptionClasses = []*ExceptionClass{
+	BaseExceptionClass, ArithmeticErrorClass, LookupErrorClass, RuntimeErrorClass,
+	TypeErrorClass, ValueErrorClass, IOErrorClass, MemoryErrorClass, KeyErrorClass, IndexErrorClass,
+	ZeroDivisionErrorClass, AttributeErrorClass, NameErrorClass, OverflowErrorClass, RecursionErrorClass,
+}
+
+// ExceptionClasses returns the classes of the built-in exceptions by name, for the
+// application to predeclare.
+func ExceptionClasses() StringDict {
+	classes := make(StringDict, len(exceptionClasses))
+	for _, c := range exceptionClasses {
+		classes[c.name] = c
+	}
+	return classes
+}
+
+// builtinExceptionClass returns the class of the built-in exceptions with the given name, if any.
+func builtinExceptionClass(name string) *ExceptionClass {
+	for _, c := range exceptionClasses {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// NewExceptionClass returns a new class of exceptions with the given name, derived
+// from base, or from BaseExceptionClass if base is nil. The exceptions of the class
+// are ExceptionInstances.
+func NewExceptionClass(name string, base *ExceptionClass) *ExceptionClass {
+	if base == nil {
+		base = BaseExceptionClass
+	}
+	return &ExceptionClass{name: name, base: base}
+}
+
+// ExceptionClassOf returns the class of the exception x. An exception of an
+// application-defined Go type may report its class by a method
+//
+//	Class() *ExceptionClass
+//
+// otherwise its class is named after its type, and derived from BaseExceptionClass.
+func ExceptionClassOf(x Exception) *ExceptionClass {
+	if x, ok := x.(interface{ Class() *ExceptionClass }); ok {
+		return x.Class()
+	}
+	// The class of the exceptions of each such type is created once:
+	c, _ := typeExceptionClasses.LoadOrStore(x.Type(), &ExceptionClass{name: x.Type(), base: BaseExceptionClass})
+	return c.(*ExceptionClass)
+}
+
+// typeExceptionClasses holds the classes of the exceptions of application-defined Go types
+// without a Class method, by the names of their types.
+var typeExceptionClasses sync.Map
+
+func (c *ExceptionClass) Name() string          { return c.name }
+func (c *ExceptionClass) String() string        { return "<exception class " + c.name + ">" }
+func (c *ExceptionClass) Type() string          { return "exception_class" }
+func (c *ExceptionClass) Freeze()               {} // immutable
+func (c *ExceptionClass) Truth() Bool           { return true }
+func (c *ExceptionClass) Hash() (uint32, error) { return hashString(c.name), nil }
+func (c *ExceptionClass) CompareSameType(op syntax.Token, y Value, depth int) (bool, error) {
+	yc := y.(*ExceptionClass)
+	switch op {
+	case syntax.EQL:
+		return c == yc, nil
+	case syntax.NEQ:
+		return c != yc, nil
+	}
+	return false, TypeErrorf("%s %s %s not implemented", c.Type(), op, yc.Type())
+}
+
+// Base returns the class from which c is derived, or nil for BaseExceptionClass.
+func (c *ExceptionClass) Base() *ExceptionClass { return c.base }
+
+// IsSubclass reports whether c is the class base, or is derived from it.
+func (c *ExceptionClass) IsSubclass(base *ExceptionClass) bool {
+	for ; c != nil; c = c.base {
+		if c == base {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ExceptionClass) Call(thread *Thread, args Tuple, kwargs []Tuple) (Value, error) {
+	if len(kwargs) > 0 {
+		return nil, TypeErrorf("%s does not accept keyword arguments", c.name)
+	}
+	return c.newException(exceptionArgs{args}), nil
+}
+
+// newException returns an exception of the class c with the given error.
+func (c *ExceptionClass) newException(err error) Exception {
+	if c.new != nil {
+		return c.new(err)
+	}
+	return ExceptionInstance{class: c, error: err}
+}
+
+// An ExceptionInstance is an exception of a class created by NewExceptionClass,
+// or of a built-in class without a Go type of its own, such as LookupError.
+type ExceptionInstance struct {
+	class *ExceptionClass
+	error
+}
+
+func (e ExceptionInstance) String() string         { return e.Type() + ": " + e.Error() }
+func (e ExceptionInstance) Type() string           { return e.class.name }
+func (e ExceptionInstance) Name() string           { return e.Type() }
+func (e ExceptionInstance) Class() *ExceptionClass { return e.class }
+func (e ExceptionInstance) Unwrap() error          { return e.error }
+func (e ExceptionInstance) Freeze()                {} // immutable
+func (e ExceptionInstance) Truth() Bool            { return true }
+func (e ExceptionInstance) Hash() (uint32, error)  { return String(e.String()).Hash() }
+func (e ExceptionInstance) CompareSameType(op syntax.Token, y Value, depth int) (bool, error) {
+	ye := y.(ExceptionInstance)
+	eq := e.class == ye.class && e.Error() == ye.Error()
+	return (op == syntax.EQL && eq) || (op == syntax.NEQ && !eq), nil
+}
+func (e ExceptionInstance) Attr(name string) (Value, error) { return exceptionAttr(e.error, name) }
+func (e ExceptionInstance) AttrNames() []string             { return exceptionAttrNames }
+
+// A classException is an exception of a built-in type, or an ExceptionInstance, whose
+// class may create a copy of it with another error (see ExceptionClass.newException).
+type classException interface {
+	Exception
+	Class() *ExceptionClass
+	Unwrap() error
+}
+
+// exceptionArgs is the error of an exception created by calling its class,
+// which retains the arguments of the call.
+type exceptionArgs struct {
+	args Tuple
+}
+
+func (e exceptionArgs) Error() string {
+	switch len(e.args) {
+	case 0:
+		return ""
+	case 1:
+		if s, ok := AsString(e.args[0]); ok {
+			return s
+		}
+		return e.args[0].String()
+	}
+	return e.args.String()
+}
+
+// tracebackError is the error of an exception which was raised within a compiled
+// function, along with the traceback of the call stack at that point.
+type tracebackError struct {
+	error
+	traceback string
+}
+
+// exceptionAttrNames are the names of the attributes of exceptions, in order.
+var exceptionAttrNames = []string{"args", "message", "traceback"}
+
+// exceptionAttr returns the attribute of an exception with the given error.
+func exceptionAttr(err error, name string) (Value, error) {
+	args, traceback := exceptionDetails(err)
+	switch name {
+	case "args":
+		return args, nil
+	case "message":
+		if err == nil {
+			return String(""), nil
+		}
+		return String(err.Error()), nil
+	case "traceback":
+		return String(traceback), nil
+	}
+	return nil, nil
+}
+
+// exceptionDetails returns the arguments of an exception with the given error, which
+// are those it was created with, or else its message, and its traceback, if any.
+func exceptionDetails(err error) (args Tuple, traceback string) {
+	err, traceback = untraced(err)
+	switch err := err.(type) {
+	case nil:
+		return Tuple{}, traceback
+	case exceptionArgs:
+		return err.args, traceback
+	}
+	return Tuple{String(err.Error())}, traceback
+}
+
+// untraced returns the error of an exception without its traceback, and the traceback.
+func untraced(err error) (error, string) {
+	if tb, ok := err.(tracebackError); ok {
+		return tb.error, tb.traceback
+	}
+	return err, ""
+}
+
+// withTraceback returns the exception x, raised at the given position of the frame fr,
+// with the traceback of the call stack at that point, unless it already has one.
+func withTraceback(x Exception, fr *Frame, posn syntax.Position) Exception {
+	e, ok := x.(classException)
+	if !ok {
+		return x
+	}
+	err := e.Unwrap()
+	if _, ok := err.(tracebackError); ok || err == nil {
+		return x
+	}
+	var buf bytes.Buffer
+	if fr.parent != nil {
+		fr.parent.WriteBacktrace(&buf)
+	} else {
+		buf.WriteString("Traceback (most recent call last):\n")
+	}
+	fmt.Fprintf(&buf, "  %s: in %s", posn, fr.Callable().Name())
+	return e.Class().newException(tracebackError{err, buf.String()})
+}
+
+// cloneException returns a copy of the exception x, whose arguments are copied by copy.
+func cloneException(x Exception, copy func(Value) Value) Exception {
+	e, ok := x.(classException)
+	if !ok {
+		return x
+	}
+	err, traceback := untraced(e.Unwrap())
+	args, ok := err.(exceptionArgs)
+	if !ok || len(args.args) == 0 {
+		return x
+	}
+	clone := exceptionArgs{make(Tuple, len(args.args))}
+	for i, arg := range args.args {
+		clone.args[i] = copy(arg)
+	}
+	return e.Class().newException(traced(clone, traceback))
+}
+
+// traced returns the error of an exception with the given traceback, if any.
+func traced(err error, traceback string) error {
+	if traceback == "" {
+		return err
+	}
+	return tracebackError{err, traceback}
+}
+
+// exceptionMatches reports whether the exception x matches the expected type of an
+// except clause: an exception class of which x is an instance, or the class of an
+// exception value, or a tuple of expected types.
+func exceptionMatches(x, expected Value) (Bool, error) {
+	exception, ok := x.(Exception)
+	if !ok {
+		return False, fmt.Errorf("internal error: got %s, want exception", x.Type())
+	}
+	switch expected := expected.(type) {
+	case *ExceptionClass:
+		return Bool(ExceptionClassOf(exception).IsSubclass(expected)), nil
+	case Tuple:
+		for _, elem := range expected {
+			if ok, err := exceptionMatches(x, elem); ok || err != nil {
+				return ok, err
+			}
+		}
+		return False, nil
+	case Exception:
+		return Bool(ExceptionClassOf(exception).IsSubclass(ExceptionClassOf(expected))), nil
+	}
+	return False, TypeErrorf("expected exception type, found %s", expected.Type())
+}
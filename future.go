@@ -0,0 +1,77 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylark
+
+// This file defines futures, the deferred calls created by the 'defer'
+// built-in and awaited in batches by 'await_all' (see resolve.AllowFutures).
+
+import "fmt"
+
+// A Future is a call of a function which is deferred until the future is awaited.
+//
+// The 'defer' built-in creates a future without calling the function. The 'await_all'
+// built-in suspends the thread once for all the unresolved futures which it awaits,
+// such that the application may make their calls, e.g. concurrently, and resume the
+// thread with all their results at once (see Thread.Awaited). A future is resolved
+// by its result, which is kept: awaiting the future again does not suspend the thread.
+type Future struct {
+	fn     Callable
+	args   Tuple
+	kwargs []Tuple
+	result Value // result of the call, or the exception with which it failed; nil until resolved
+}
+
+func (f *Future) String() string        { return fmt.Sprintf("<future %s>", f.fn.Name()) }
+func (f *Future) Type() string          { return "future" }
+func (f *Future) Freeze()               {} // a future is resolved by the application
+func (f *Future) Truth() Bool           { return True }
+func (f *Future) Hash() (uint32, error) { return 0, TypeErrorf("unhashable type: future") }
+
+// Callable returns the function whose call is deferred.
+func (f *Future) Callable() Callable { return f.fn }
+
+// Args returns the positional arguments of the deferred call.
+func (f *Future) Args() Tuple { return f.args }
+
+// Kwargs returns the keyword arguments of the deferred call, as (name, value) pairs.
+func (f *Future) Kwargs() []Tuple { return f.kwargs }
+
+// Result returns the result of the call, or the exception with which it failed, and
+// reports whether the future is resolved.
+func (f *Future) Result() (Value, bool) { return f.result, f.result != nil }
+
+// awaitResults returns the list of the results of the given resolved futures. Unless
+// exceptions are returned as results, the first exception among them is raised.
+func awaitResults(futures Tuple, returnExceptions bool) (Value, error) {
+	elems := make([]Value, len(futures))
+	for i, f := range futures {
+		result := f.(*Future).result
+		if exception, ok := result.(Exception); ok && !returnExceptions {
+			return nil, exception
+		}
+		elems[i] = result
+	}
+	return NewList(elems), nil
+}
+
+// awaitState returns the futures awaited by a call of 'await_all', as recorded in its
+// continuation state, along with the unresolved futures for which the thread is suspended.
+func awaitState(state Value) (futures, pending Tuple, returnExceptions bool, ok bool) {
+	t, ok := state.(Tuple)
+	if !ok || len(t) != 3 {
+		return nil, nil, false, false
+	}
+	futures, ok1 := t[0].(Tuple)
+	pending, ok2 := t[2].(Tuple)
+	if !ok1 || !ok2 {
+		return nil, nil, false, false
+	}
+	for _, f := range append(futures[:len(futures):len(futures)], pending...) {
+		if _, ok := f.(*Future); !ok {
+			return nil, nil, false, false
+		}
+	}
+	return futures, pending, t[1] == True, true
+}
@@ -0,0 +1,135 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylark
+
+// This file defines generators, the values returned by calls of
+// functions which contain a yield statement (see resolve.AllowGenerators).
+
+import (
+	"fmt"
+
+	"github.com/google/skylark/syntax"
+)
+
+// A Generator is the iterator returned by a call of a generator function.
+//
+// The body of the function runs in the frame of the generator each time
+// the next element is requested, until it yields a value or returns.
+// While the generator is idle, its frame is suspended at the yield statement,
+// in the same manner as the frame of a suspended thread.
+//
+// A generator is an iterator of its own: iterating over it again continues
+// from where the previous iteration left off. A generator is closed when an
+// iteration over it is done, e.g. when a for loop over it ends or is broken;
+// it yields no further elements after being closed.
+type Generator struct {
+	fn      *Function
+	frame   *Frame  // suspended frame of the function, or nil once the generator is finished
+	thread  *Thread // thread in which the generator last ran
+	running bool    // whether the body of the function is executing
+	err     error   // error raised by the body of the function, if any
+}
+
+var (
+	_ Iterable = (*Generator)(nil)
+	_ Iterator = (*Generator)(nil)
+)
+
+// newGenerator binds the arguments of a call of a generator function to the
+// parameters of a new frame, which is run when the first element is requested.
+func newGenerator(thread *Thread, fn *Function, args Tuple, kwargs []Tuple) (*Generator, error) {
+	fc := fn.funcode
+	nlocals := len(fc.Locals)
+	frame := &Frame{parent: thread.frame, callable: fn}
+	frame.stack = make([]Value, nlocals+fc.MaxStack)
+	if err := setArgs(frame.stack[:nlocals:nlocals], fn, args, kwargs); err != nil {
+		return nil, frame.errorf(frame.Position(), "%v", err)
+	}
+	frame.parent = nil
+	return &Generator{fn: fn, frame: frame, thread: thread}, nil
+}
+
+func (g *Generator) String() string        { return fmt.Sprintf("<generator %s>", g.fn.Name()) }
+func (g *Generator) Type() string          { return "generator" }
+func (g *Generator) Freeze()               {} // a generator is consumed by iteration
+func (g *Generator) Truth() Bool           { return True }
+func (g *Generator) Hash() (uint32, error) { return 0, TypeErrorf("unhashable type: generator") }
+
+// Function returns the generator function which created the generator.
+func (g *Generator) Function() *Function { return g.fn }
+
+// Frame returns the suspended frame of the generator's function, or nil if the
+// generator is finished.
+func (g *Generator) Frame() *Frame { return g.frame }
+
+func (g *Generator) Iterate() Iterator { return g }
+
+// Next runs the generator in the thread in which it last ran. An error raised by the
+// body of the function ends the iterations of the generator (see Err). While a call
+// is in progress in the thread, the error is also raised by the interpreter after the
+// current operation, or returned by the enclosing Call.
+func (g *Generator) Next(p *Value) bool {
+	more, err := g.next(g.thread, p)
+	if err != nil && g.thread.calls > 0 && g.thread.iterErr == nil {
+		g.thread.iterErr = err
+	}
+	return more
+}
+
+// Err returns the error raised by the body of the generator's function, which ended
+// its iterations, if any. Client code which iterates a generator, e.g. one returned
+// by a call, checks Err once Next returns false.
+func (g *Generator) Err() error { return g.err }
+
+// Done closes the generator, ending the iterations of its function's frame.
+func (g *Generator) Done() {
+	if g.frame == nil || g.running {
+		return
+	}
+	for _, it := range g.frame.iterstack {
+		it.Done()
+	}
+	g.frame = nil
+}
+
+// next runs the body of the generator's function in the given thread until it yields
+// the next element, which is stored in *p, or until it returns.
+func (g *Generator) next(thread *Thread, p *Value) (bool, error) {
+	if g.frame == nil {
+		return false, nil
+	}
+	if g.running {
+		return false, fmt.Errorf("generator %s is already running", g.fn.Name())
+	}
+	if g.fn.isRecursive(thread.frame) {
+		return false, RecursionErrorf("function %s called recursively", g.fn.Name())
+	}
+	g.thread = thread
+	caller := thread.frame
+	frame := g.frame
+	frame.parent, frame.posn = caller, syntax.Position{}
+	thread.frame = frame
+	thread.yielded = false
+	g.running = true
+	resuming := true
+	v, err := interpret(thread, nil, nil, resuming, nil)
+	g.running = false
+	yielded := thread.yielded
+	thread.frame, thread.yielded = caller, false
+
+	if thread.suspended != nil {
+		// The frames of the generator cannot be resumed by the thread:
+		thread.suspended = nil
+		g.Done()
+		return false, fmt.Errorf("cannot suspend thread within generator %s", g.fn.Name())
+	}
+	if err != nil || !yielded {
+		g.frame, g.err = nil, err
+		return false, err
+	}
+	frame.parent = nil
+	*p = v
+	return true, nil
+}
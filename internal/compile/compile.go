@@ -37,7 +37,7 @@ import (
 const debug = false // TODO(adonovan): use a bitmap of options; and regexp to match files
 
 // Increment this to force recompilation of saved bytecode files.
-const Version = 3
+const Version = 6
 
 type Opcode uint8
 
@@ -103,9 +103,10 @@ const (
 	MAKEDICT    //              - MAKEDICT dict
 	MAKESET     //              - MAKESET set    (if sets are enabled)
 
-	EXCEPTPOP //          eh EXCEPTPOP -  [pops the exception handler stack]
-	ERROR     // extype <err>ERROR err    [pops the expected exception type;
-	//									   pushes the current error (handled exception) onto the value stack]
+	EXCEPTPOP   //                - EXCEPTPOP -       [pops the exception handler stack]
+	EXCEPTMATCH //     exc extype EXCEPTMATCH bool    [whether exc matches the type of an except clause]
+	YIELD       //            value YIELD -           [suspends the generator frame]
+	RAISE       //        exception RAISE -           [raises the exception]
 
 	// --- opcodes with an argument must go below this line ---
 
@@ -131,7 +132,9 @@ const (
 	SETFIELD    //              x y SETFIELD<name>      -           x.name = y
 	UNPACK      //         iterable UNPACK<n>           vn ... v1
 
-	EXCEPTPUSH // - EXCEPTPUSH<addr> -     [pushes the exception handler stack]
+	EXCEPTPUSH // - EXCEPTPUSH<addr> -     [pushes the exception handler stack;
+	//                                      an exception pops it and is pushed onto the value stack
+	//                                      before the jump to the handler]
 
 	// n>>8 is #positional args and n&0xff is #named args (pairs).
 	CALL        // fn positional named                CALL<n>        result
@@ -157,7 +160,7 @@ var opcodeNames = [...]string{
 	DUP2:        "dup2",
 	DUP:         "dup",
 	EQL:         "eql",
-	ERROR:       "error",
+	EXCEPTMATCH: "exceptmatch",
 	EXCEPTPOP:   "exceptpop",
 	EXCEPTPUSH:  "exceptpush",
 	EXCH:        "exch",
@@ -194,6 +197,7 @@ var opcodeNames = [...]string{
 	PLUS:        "plus",
 	POP:         "pop",
 	PREDECLARED: "predeclared",
+	RAISE:       "raise",
 	RETURN:      "return",
 	SETDICT:     "setdict",
 	SETDICTUNIQ: "setdictuniq",
@@ -211,6 +215,7 @@ var opcodeNames = [...]string{
 	UNIVERSAL:   "universal",
 	UNPACK:      "unpack",
 	UPLUS:       "uplus",
+	YIELD:       "yield",
 }
 
 // StackEffect returns the number of stack pops and pushes executed during op.
@@ -268,13 +273,13 @@ func init() {
 	stackEffect[DUP2] = poppush(2, 4)
 	stackEffect[DUP] = poppush(1, 2)
 	stackEffect[EQL] = poppush(2, 1)
-	stackEffect[ERROR] = poppush(1, 1)
+	stackEffect[EXCEPTMATCH] = poppush(2, 1)
 	stackEffect[EXCEPTPOP] = poppush(0, 0)
 	stackEffect[EXCEPTPUSH] = poppush(0, 0)
 	stackEffect[EXCH] = poppush(2, 2)
 	stackEffect[FALSE] = poppush(0, 1)
 	stackEffect[FREE] = poppush(0, 1)
-	stackEffect[GE] = poppush(1, 0)
+	stackEffect[GE] = poppush(2, 1)
 	stackEffect[GLOBAL] = poppush(0, 1)
 	stackEffect[GT] = poppush(2, 1)
 	stackEffect[GTGT] = poppush(2, 1)
@@ -305,6 +310,7 @@ func init() {
 	stackEffect[PLUS] = poppush(2, 1)
 	stackEffect[POP] = poppush(1, 0)
 	stackEffect[PREDECLARED] = poppush(0, 1)
+	stackEffect[RAISE] = poppush(1, 0)
 	stackEffect[RETURN] = poppush(1, 0)
 	stackEffect[SETDICT] = poppush(3, 0)
 	stackEffect[SETDICTUNIQ] = poppush(3, 0)
@@ -321,6 +327,7 @@ func init() {
 	stackEffect[UMINUS] = poppush(1, 1)
 	stackEffect[UNIVERSAL] = poppush(0, 1)
 	stackEffect[UNPACK] = variableStackEffect
+	stackEffect[YIELD] = poppush(1, 0)
 	stackEffect[UPLUS] = poppush(1, 1)
 
 	for i, v := range stackEffect {
@@ -370,7 +377,7 @@ func DecodeOpUnsafe(code []byte, pc uint32) (op Opcode, arg uint32, nextpc uint3
 }
 
 func (op Opcode) String() string {
-	if op < OpcodeMax {
+	if op <= OpcodeMax {
 		return opcodeNames[op]
 	}
 	return fmt.Sprintf("illegal op (%d)", op)
@@ -404,6 +411,7 @@ type Funcode struct {
 	MaxStack              int
 	NumParams             int
 	HasVarargs, HasKwargs bool
+	Generator             bool // body contains a yield statement
 }
 
 // An Ident is the name and position of an identifier.
@@ -425,17 +433,27 @@ type pcomp struct {
 type fcomp struct {
 	fn *Funcode // what we're building
 
-	pcomp      *pcomp
-	pos        syntax.Position // current position of generated code
-	loops      []loop
-	exhandlers []int // loop-stack index of enclosing loop for each active try/except statement
-	block      *block
+	pcomp   *pcomp
+	pos     syntax.Position // current position of generated code
+	loops   []loop
+	regions []region // active regions of try statements, innermost last
+	block   *block
 }
 
 type loop struct {
 	break_, continue_ *block
 }
 
+// A region is a part of a try statement, whose effects upon the exception handler
+// stack and the value stack are undone by a break, continue or return statement
+// which leaves it.
+type region struct {
+	loop      int           // loop-stack index of enclosing loop
+	handler   bool          // whether the region has an active exception handler
+	exception bool          // whether the handled exception is on the value stack
+	finally   []syntax.Stmt // finally clause to execute when leaving the region
+}
+
 type block struct {
 	insns []insn
 
@@ -492,6 +510,10 @@ func (fn *Funcode) Position(pc uint32) syntax.Position {
 	return pos
 }
 
+// Validate checks that the code of a function consists of valid instructions, whose
+// arguments are within the bounds of the function and its program, and whose jumps
+// target the start of an instruction. The code must end with an instruction which
+// doesn't continue with the next one, optionally followed by NOPs of padding.
 func (fc *Funcode) Validate(isPredeclared, isUniversal func(name string) bool) error {
 	if isPredeclared == nil {
 		isPredeclared = func(name string) bool { return true }
@@ -500,27 +522,31 @@ func (fc *Funcode) Validate(isPredeclared, isUniversal func(name string) bool) e
 		isUniversal = func(name string) bool { return true }
 	}
 	code := fc.Code
-	pc := uint32(0)
-	for {
+	if len(code) == 0 {
+		return fmt.Errorf("missing code")
+	}
+	starts := make([]bool, len(code)) // whether each pc is the start of an instruction
+	var targets []uint32              // pcs of the jumps, followed by their targets
+	var last Opcode                   // last instruction other than a NOP
+	var end uint32                    // pc following the last instruction other than a NOP
+	for pc := uint32(0); int(pc) < len(code); {
 		op, arg, nextpc, opInBounds := DecodeOp(code, pc)
+		if op > OpcodeMax {
+			return fmt.Errorf("illegal op (%d)", op)
+		}
 		if !opInBounds {
 			return fmt.Errorf("program counter %v for op %s is out of bounds for code of length %v", pc, op.String(), len(code))
 		}
-		if int(nextpc) > len(code) {
-			return fmt.Errorf("program counter %v after op %s is out of bounds for code of length %v", pc, op.String(), len(code))
-		}
-		if int(nextpc) == len(code) {
-			return nil
-		}
-		if op > OpcodeMax {
-			return fmt.Errorf("illegal op (%d)", op)
+		starts[pc] = true
+		if op != NOP {
+			last, end = op, nextpc
 		}
 
 		// See resolve/resolve.go:
 		const doesnt = "this Skylark dialect does not "
 
 		switch op {
-		case ERROR, EXCEPTPUSH, EXCEPTPOP:
+		case EXCEPTMATCH, EXCEPTPUSH, EXCEPTPOP, RAISE:
 			if !resolve.AllowTryExcept {
 				return fmt.Errorf(doesnt + "support try/except")
 			}
@@ -532,6 +558,13 @@ func (fc *Funcode) Validate(isPredeclared, isUniversal func(name string) bool) e
 			if !resolve.AllowSet {
 				return fmt.Errorf(doesnt + "support sets")
 			}
+		case YIELD:
+			if !resolve.AllowGenerators {
+				return fmt.Errorf(doesnt + "support generators")
+			}
+			if !fc.Generator {
+				return fmt.Errorf("op %s in non-generator function", op.String())
+			}
 		}
 
 		if op < OpcodeArgMin {
@@ -578,6 +611,7 @@ func (fc *Funcode) Validate(isPredeclared, isUniversal func(name string) bool) e
 			if int(arg) >= len(code) {
 				return fmt.Errorf("program counter target %v for op %s is out of bounds for code of length %v", arg, op.String(), len(code))
 			}
+			targets = append(targets, pc, arg)
 		case LOAD, MAKELIST, MAKETUPLE, UNPACK:
 			if op == LOAD {
 				arg++
@@ -588,9 +622,34 @@ func (fc *Funcode) Validate(isPredeclared, isUniversal func(name string) bool) e
 		}
 		pc = nextpc
 	}
+	switch last {
+	case RETURN, JMP, RAISE:
+	default:
+		return fmt.Errorf("code ends with op %s", last.String())
+	}
+	for i := 0; i < len(targets); i += 2 {
+		if !starts[targets[i+1]] || targets[i+1] >= end {
+			return fmt.Errorf("program counter target %v for op at %v is not the start of an instruction", targets[i+1], targets[i])
+		}
+	}
 	return nil
 }
 
+// IsInstructionStart reports whether pc is the start of an instruction in the code of a function,
+// other than the NOPs of padding at its end. The code is assumed to be valid (see Validate).
+func (fc *Funcode) IsInstructionStart(pc uint32) bool {
+	found := false
+	for start := uint32(0); int(start) < len(fc.Code); {
+		op, _, next := DecodeOpUnsafe(fc.Code, start)
+		found = found || start == pc
+		if found && op != NOP {
+			return true
+		}
+		start = next
+	}
+	return false
+}
+
 // idents convert syntactic identifiers to compiled form.
 func idents(ids []*syntax.Ident) []Ident {
 	res := make([]Ident, len(ids))
@@ -682,6 +741,9 @@ func (pcomp *pcomp) function(name string, pos syntax.Position, stmts []syntax.St
 		blocks = append(blocks, b)
 
 		stack := b.initialstack
+		if stack > maxstack {
+			maxstack = stack // e.g. the exception of a handler
+		}
 		if debug {
 			fmt.Fprintf(os.Stderr, "%s block %d: (stack = %d)\n", name, b.index, stack)
 		}
@@ -779,7 +841,8 @@ func (pcomp *pcomp) function(name string, pos syntax.Position, stmts []syntax.St
 				b.except = b.except.jmp
 			}
 
-			setinitialstack(b.except, stack)
+			// The handler starts with the exception on the stack:
+			setinitialstack(b.except, stack+1)
 			visit(b.except)
 
 			// Patch the EXCEPTPUSH, if present.
@@ -1036,6 +1099,38 @@ func (fcomp *fcomp) jump(b *block) {
 	fcomp.block = nil
 }
 
+// exceptPush emits an EXCEPTPUSH of the specified exception handler,
+// and starts the block of the statements which it handles.
+func (fcomp *fcomp) exceptPush(handler *block) {
+	fcomp.block.except = handler
+	fcomp.emit1(EXCEPTPUSH, 0) // the exception-handler address is filled in later
+	body := fcomp.newBlock()
+	fcomp.jump(body)
+	fcomp.block = body
+}
+
+// unwind emits the instructions which leave each region within the loop of the
+// specified loop-stack index, or each region of the function if the index is -1,
+// before a branch out of them. A return statement, whose result is on top of the
+// stack, leaves the exceptions of except clauses on the stack.
+func (fcomp *fcomp) unwind(loop int, returning bool) {
+	regions := fcomp.regions
+	for i := len(regions) - 1; i >= 0 && regions[i].loop >= loop; i-- {
+		if regions[i].handler {
+			fcomp.emit(EXCEPTPOP)
+		}
+		if regions[i].exception && !returning {
+			fcomp.emit(POP)
+		}
+		if regions[i].finally != nil {
+			// Resolver invariant: the finally clause has no branch out of it.
+			fcomp.regions = regions[:i]
+			fcomp.stmts(regions[i].finally)
+		}
+	}
+	fcomp.regions = regions
+}
+
 // condjump emits a conditional jump (CJMP or ITERJMP)
 // to the specified true/false blocks.
 // (For ITERJMP, the cases are jmp/f/ok and cjmp/t/exhausted.)
@@ -1155,21 +1250,13 @@ func (fcomp *fcomp) stmt(stmt syntax.Stmt) {
 		case syntax.BREAK:
 			innerLoop := len(fcomp.loops) - 1
 			b := fcomp.loops[innerLoop].break_
-			for _, enclosingLoop := range fcomp.exhandlers {
-				if enclosingLoop >= innerLoop {
-					fcomp.emit(EXCEPTPOP)
-				}
-			}
+			fcomp.unwind(innerLoop, false)
 			fcomp.jump(b)
 			fcomp.block = fcomp.newBlock() // dead code
 		case syntax.CONTINUE:
 			innerLoop := len(fcomp.loops) - 1
 			b := fcomp.loops[innerLoop].continue_
-			for _, enclosingLoop := range fcomp.exhandlers {
-				if enclosingLoop >= innerLoop {
-					fcomp.emit(EXCEPTPOP)
-				}
-			}
+			fcomp.unwind(innerLoop, false)
 			fcomp.jump(b)
 			fcomp.block = fcomp.newBlock() // dead code
 		}
@@ -1291,38 +1378,99 @@ func (fcomp *fcomp) stmt(stmt syntax.Stmt) {
 		fcomp.block = tail
 		fcomp.emit(ITERPOP)
 
+	case *syntax.WhileStmt:
+		head := fcomp.newBlock()
+		body := fcomp.newBlock()
+		tail := fcomp.newBlock()
+
+		fcomp.jump(head)
+
+		fcomp.block = head
+		fcomp.ifelse(stmt.Cond, body, tail)
+
+		fcomp.block = body
+		fcomp.loops = append(fcomp.loops, loop{break_: tail, continue_: head})
+		fcomp.stmts(stmt.Body)
+		fcomp.loops = fcomp.loops[:len(fcomp.loops)-1]
+		fcomp.jump(head)
+
+		fcomp.block = tail
+
 	case *syntax.TryStmt:
-		fallback := fcomp.newBlock()
+		innerLoop := len(fcomp.loops) - 1
 		done := fcomp.newBlock()
 
-		if fcomp.block != nil && fcomp.block.except != nil {
-			body := fcomp.newBlock()
-			fcomp.jump(body)
-			fcomp.block = body
+		// The finally clause is executed upon leaving the rest of the statement,
+		// either normally, by a branch (see unwind), or by an exception:
+		normal := done
+		var finally *block // the finally clause upon an exception
+		if stmt.Finally != nil {
+			normal = fcomp.newBlock()
+			finally = fcomp.newBlock()
+			fcomp.exceptPush(finally)
+			fcomp.regions = append(fcomp.regions, region{loop: innerLoop, handler: true, finally: stmt.Finally})
 		}
-		fcomp.exhandlers = append(fcomp.exhandlers, len(fcomp.loops)-1)
-		fcomp.block.except = fallback
-		fcomp.emit1(EXCEPTPUSH, 0) // the exception-handler address is filled in later
-		fcomp.stmts(stmt.Body)
-		fcomp.emit(EXCEPTPOP)
-		fcomp.jump(done)
 
-		if stmt.ExceptionType != nil && stmt.ExceptionName != nil {
+		if stmt.Excepts != nil {
+			fallback := fcomp.newBlock()
+			fcomp.exceptPush(fallback)
+			fcomp.regions = append(fcomp.regions, region{loop: innerLoop, handler: true})
+			fcomp.stmts(stmt.Body)
+			fcomp.regions = fcomp.regions[:len(fcomp.regions)-1]
+			fcomp.emit(EXCEPTPOP)
+			fcomp.stmts(stmt.Else)
+			fcomp.jump(normal)
+
+			// The handled exception remains on the stack during each except clause,
+			// so that a bare raise statement may re-raise it.
 			fcomp.block = fallback
-			fcomp.lookup(stmt.ExceptionType)
-			fcomp.emit(ERROR)
-			fcomp.exhandlers = fcomp.exhandlers[:len(fcomp.exhandlers)-1]
-			fcomp.assign(stmt.ExceptionName.NamePos, stmt.ExceptionName)
-			fcomp.stmts(stmt.Fallback)
-			fcomp.emit(NONE)
-			fcomp.assign(stmt.ExceptionName.NamePos, stmt.ExceptionName)
-			fcomp.jump(done)
+			for _, except := range stmt.Excepts {
+				var next *block // the next except clause
+				if except.Type != nil {
+					body := fcomp.newBlock()
+					next = fcomp.newBlock()
+					fcomp.emit(DUP)
+					fcomp.expr(except.Type)
+					fcomp.emit(EXCEPTMATCH)
+					fcomp.condjump(CJMP, body, next)
+					fcomp.block = body
+				}
+				if except.Name != nil {
+					fcomp.emit(DUP)
+					fcomp.assign(except.Name.NamePos, except.Name)
+				}
+				fcomp.regions = append(fcomp.regions, region{loop: innerLoop, exception: true})
+				fcomp.stmts(except.Body)
+				fcomp.regions = fcomp.regions[:len(fcomp.regions)-1]
+				fcomp.emit(POP)
+				if except.Name != nil {
+					fcomp.emit(NONE)
+					fcomp.assign(except.Name.NamePos, except.Name)
+				}
+				fcomp.jump(normal)
+				fcomp.block = next
+			}
+			if fcomp.block != nil {
+				// No except clause handles the exception:
+				fcomp.emit(RAISE)
+			}
 		} else {
-			fcomp.block = fallback
+			fcomp.stmts(stmt.Body)
+			fcomp.jump(normal)
+		}
+
+		if stmt.Finally != nil {
+			fcomp.regions = fcomp.regions[:len(fcomp.regions)-1]
+			fcomp.block = normal
 			fcomp.emit(EXCEPTPOP)
-			fcomp.exhandlers = fcomp.exhandlers[:len(fcomp.exhandlers)-1]
-			fcomp.stmts(stmt.Fallback)
+			fcomp.stmts(stmt.Finally)
 			fcomp.jump(done)
+
+			fcomp.block = finally
+			fcomp.regions = append(fcomp.regions, region{loop: innerLoop, exception: true})
+			fcomp.stmts(stmt.Finally)
+			fcomp.regions = fcomp.regions[:len(fcomp.regions)-1]
+			fcomp.emit(RAISE)
 		}
 
 		fcomp.block = done
@@ -1333,9 +1481,29 @@ func (fcomp *fcomp) stmt(stmt syntax.Stmt) {
 		} else {
 			fcomp.emit(NONE)
 		}
+		fcomp.unwind(-1, true)
 		fcomp.emit(RETURN)
 		fcomp.block = fcomp.newBlock() // dead code
 
+	case *syntax.YieldStmt:
+		if stmt.Result != nil {
+			fcomp.expr(stmt.Result)
+		} else {
+			fcomp.emit(NONE)
+		}
+		fcomp.emit(YIELD)
+
+	case *syntax.RaiseStmt:
+		if stmt.X != nil {
+			fcomp.expr(stmt.X)
+		} else {
+			// Resolver invariant: a bare raise appears only within an except clause,
+			// whose handled exception is on top of the stack.
+			fcomp.emit(DUP)
+		}
+		fcomp.emit(RAISE)
+		fcomp.block = fcomp.newBlock() // dead code
+
 	case *syntax.LoadStmt:
 		for i := range stmt.From {
 			fcomp.string(stmt.From[i].Name)
@@ -1942,6 +2110,7 @@ func (fcomp *fcomp) function(pos syntax.Position, name string, f *syntax.Functio
 	funcode.NumParams = len(f.Params)
 	funcode.HasVarargs = f.HasVarargs
 	funcode.HasKwargs = f.HasKwargs
+	funcode.Generator = f.Generator
 	fcomp.emit1(MAKEFUNC, fcomp.pcomp.functionIndex(funcode))
 }
 
@@ -38,6 +38,7 @@ type gobFunction struct {
 	MaxStack              int
 	NumParams             int
 	HasVarargs, HasKwargs bool
+	Generator             bool
 }
 
 type gobIdent struct {
@@ -74,6 +75,7 @@ func (prog *Program) Write(out io.Writer) error {
 			NumParams:  fn.NumParams,
 			HasVarargs: fn.HasVarargs,
 			HasKwargs:  fn.HasKwargs,
+			Generator:  fn.Generator,
 		}
 	}
 
@@ -153,6 +155,7 @@ func ReadProgram(in io.Reader) (*Program, error) {
 			NumParams:  gf.NumParams,
 			HasVarargs: gf.HasVarargs,
 			HasKwargs:  gf.HasKwargs,
+			Generator:  gf.Generator,
 		}
 	}
 
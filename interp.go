@@ -20,15 +20,19 @@ func (fn *Function) Call(thread *Thread, args Tuple, kwargs []Tuple) (Value, err
 		fmt.Printf("call of %s %v %v\n", fn.Name(), args, kwargs)
 	}
 
+	if fn.funcode.Generator {
+		return newGenerator(thread, fn, args, kwargs)
+	}
 	if fn.isRecursive(thread.frame) {
-		return nil, TypeErrorf("function %s called recursively", fn.Name())
+		return nil, RecursionErrorf("function %s called recursively", fn.Name())
 	}
 	// push a new stack frame and jump to the function's entry-point
-	thread.frame = &Frame{parent: thread.frame, callable: fn}
+	caller := thread.frame
+	thread.frame = &Frame{parent: caller, callable: fn}
 	resuming := false
-	result, err := interpret(thread, args, kwargs, resuming)
-	// pop the used stack frame
-	thread.frame = thread.frame.parent
+	result, err := interpret(thread, args, kwargs, resuming, nil)
+	// pop the used stack frame, and any frames of functions called directly from it
+	thread.frame = caller
 	return result, err
 }
 
@@ -47,11 +51,21 @@ func (fn *Function) isRecursive(frame *Frame) bool {
 // frameStack contains values for a frame's stack, addressable by offsets from the stack-pointer (sp).
 type frameStack []Value
 
-func (stack frameStack) check(op compile.Opcode, sp, pops, pushes int) error {
+// check reports whether op may pop and push the given numbers of values at sp, without popping
+// values below the saved sp of the inner-most enclosing exception handler, if any.
+func (stack frameStack) check(op compile.Opcode, sp int, exhandlers []exceptionHandler, pops, pushes int) error {
 	if !checkstackops {
 		return nil
 	}
 	size := len(stack)
+	if len(exhandlers) > 0 {
+		// sp is checked as an offset from the saved sp of the handler:
+		guard := int(exhandlers[len(exhandlers)-1].sp)
+		if guard > sp || guard > size {
+			return fmt.Errorf("internal error: stack position %v is below exception handler at position %v for op %s", sp, guard, op.String())
+		}
+		sp, size = sp-guard, size-guard
+	}
 	if pops > 0 {
 		hi, lo := sp-1, sp-pops
 		if hi < 0 || hi > size-1 || lo < 0 || lo > size-1 {
@@ -72,16 +86,25 @@ type exceptionHandler struct {
 	pc, sp uint32
 }
 
-// guardsp returns sp as an offset from the saved sp of the inner-most enclosing
-// exception handler, or returns sp if no exception handlers are active.
-func guardsp(sp int, exhandlers []exceptionHandler) int {
-	if !checkstackops {
-		return 0
+// callerHandles reports whether err, raised in the frame of a compiled function which has
+// no active exception handlers, is an exception that may be handled by a compiled caller
+// to which the function would return directly (see compile.RETURN).
+func (fr *Frame) callerHandles(err error) bool {
+	if exception, ok := err.(Exception); !ok || exception == nil {
+		return false
 	}
-	if len(exhandlers) > 0 {
-		return sp - int(exhandlers[len(exhandlers)-1].sp)
+	for ; fr.parent != nil; fr = fr.parent {
+		if fr.callable.(*Function).funcode.Generator {
+			return false
+		}
+		if _, ok := fr.parent.callable.(*Function); !ok {
+			return false
+		}
+		if len(fr.parent.exhandlers) > 0 {
+			return true
+		}
 	}
-	return sp
+	return false
 }
 
 // TODO(adonovan):
@@ -90,7 +113,13 @@ func guardsp(sp int, exhandlers []exceptionHandler) int {
 //   in the thread, and slicing it.
 // - opt: record MaxIterStack during compilation and preallocate the stack.
 
-func interpret(thread *Thread, args Tuple, kwargs []Tuple, resuming bool) (Value, error) {
+// interpret executes the function of the thread's current frame.
+// When resuming, execution continues from the frame's saved pc and sp; a non-nil
+// raised error is then treated as the error of the call which suspended the thread.
+func interpret(thread *Thread, args Tuple, kwargs []Tuple, resuming bool, raised error) (Value, error) {
+	thread.calls++
+	defer thread.exit()
+
 	fr := thread.frame
 	fn := fr.callable.(*Function)
 	fc := fn.funcode
@@ -111,18 +140,21 @@ func interpret(thread *Thread, args Tuple, kwargs []Tuple, resuming bool) (Value
 
 	code, savedpc, pc, sp := fc.Code, uint32(0), uint32(0), 0
 	if resuming {
-		code, pc, sp = fc.Code, fr.pc, int(fr.sp)
+		code, savedpc, pc, sp = fc.Code, fr.callpc, fr.pc, int(fr.sp)
 	}
 
 	var result Value
 	var err error
-	var exception Exception
+	yielded := false
 
 	if !resuming {
 		err = setArgs(locals, fn, args, kwargs)
 		if err != nil {
 			return nil, fr.errorf(fr.Position(), "%v", err)
 		}
+	} else if raised != nil {
+		// The next iteration dispatches to the active exception handler, if any:
+		err = raised
 	}
 
 	if vmdebug {
@@ -137,30 +169,72 @@ func interpret(thread *Thread, args Tuple, kwargs []Tuple, resuming bool) (Value
 
 loop:
 	for {
-		savedpc = pc
-
+		if thread.iterErr != nil && err == nil {
+			// A generator iterated by the previous instruction has failed:
+			err, thread.iterErr = thread.iterErr, nil
+		}
 		if err != nil {
+			if exception, ok := err.(Exception); ok && exception != nil && (len(exhandlers) > 0 || fr.callerHandles(err)) {
+				// The exception is handled: record where it was raised by the previous instruction.
+				err = withTraceback(exception, fr, fc.Position(savedpc))
+			}
+			if len(exhandlers) == 0 && fr.callerHandles(err) {
+				// Unwind to the nearest compiled caller with an active exception handler:
+				for len(exhandlers) == 0 {
+					for _, iter := range iterstack {
+						iter.Done()
+					}
+					fr = fr.parent
+					fn = fr.callable.(*Function)
+					fc = fn.funcode
+					nlocals = len(fc.Locals)
+					if len(fr.stack) < nlocals+fc.MaxStack {
+						stack = make([]Value, nlocals+fc.MaxStack)
+						copy(stack, fr.stack)
+						fr.stack = stack
+					}
+					code, stack, locals, iterstack, exhandlers = fc.Code, frameStack(fr.stack[nlocals:]), fr.stack[:nlocals:nlocals], fr.iterstack, fr.exhandlers
+				}
+				thread.frame = fr
+			}
 			if len(exhandlers) == 0 {
 				break loop
 			}
-			var isException bool
-			exception, isException = err.(Exception)
-			if isException && exception != nil {
-				// jump to the exception-handler block:
+			if exception, ok := err.(Exception); ok && exception != nil {
+				// jump to the exception-handler block, with the exception on the stack:
 				handler := exhandlers[len(exhandlers)-1]
+				exhandlers = exhandlers[:len(exhandlers)-1]
 				pc, sp = handler.pc, int(handler.sp)
+				stack[sp] = exception
+				sp++
 				err = nil
 			} else {
 				// unrecoverable:
 				break loop
 			}
 		}
+		savedpc = pc
+		if interrupt := thread.step(); interrupt != nil {
+			if !thread.SuspendOnInterrupt || !fr.interruptible() {
+				evalErr := fr.errorf(fc.Position(savedpc), "%s", interrupt)
+				evalErr.Interrupt = interrupt
+				err = evalErr
+				break loop
+			}
+			// The thread is suspended before an instruction which has a value on the
+			// stack, which is displaced upon resumption (see interruptBuiltin):
+			if sp > 0 {
+				fr.iterstack, fr.exhandlers, fr.callpc, fr.pc, fr.sp = iterstack, exhandlers, savedpc, savedpc, uint32(sp)
+				thread.suspendInterrupted(interrupt, stack[sp-1])
+				break loop
+			}
+		}
 		var op compile.Opcode
 		var arg uint32
 		op, arg, pc = compile.DecodeOpUnsafe(code, pc)
 		if checkstackops && !compile.IsVariableStackEffect(op) {
 			stackPops, stackPushes := compile.StackEffect(op)
-			if stackErr := stack.check(op, guardsp(sp, exhandlers), stackPops, stackPushes); stackErr != nil {
+			if stackErr := stack.check(op, sp, exhandlers, stackPops, stackPushes); stackErr != nil {
 				err = stackErr
 				break loop
 			}
@@ -172,35 +246,27 @@ loop:
 
 		switch op {
 
-		case compile.ERROR:
-			if len(exhandlers) <= 0 {
-				err = fmt.Errorf("internal error: empty exception handler stack during %s", op.String())
-				break loop
+		case compile.EXCEPTMATCH:
+			ok, err2 := exceptionMatches(stack[sp-2], stack[sp-1])
+			if err2 != nil {
+				// The next iteration dispatches to an outer exception handler, if any:
+				err = err2
+				continue loop
 			}
-			exhandlers = exhandlers[:len(exhandlers)-1]
-			// Match against the expected exception type:
-			if _, isCatchall := stack[sp-1].(ExceptionKind); isCatchall {
-				// Push the exception; the next instruction will assign it to its identifier:
-				stack[sp-1] = exception
-				exception = nil
-				continue loop
-			} else if expected, ok := stack[sp-1].(Exception); !ok || expected == nil {
-				etype := "<nil>"
-				if stack[sp-1] != nil {
-					etype = stack[sp-1].Type()
-				}
-				// Set the top-level error; the next iteration will trigger an outer exception-handler if one is present:
-				err = TypeErrorf("expected exception type, found %s", etype)
-				stack[sp-1] = None
-			} else if expected.Type() == exception.Type() {
-				// Push the exception; the next instruction will assign it to its identifier:
-				stack[sp-1] = exception
-				exception = nil
-			} else {
-				// Restore the top-level error; the next iteration will trigger an outer exception-handler if one is present:
+			stack[sp-2] = ok
+			sp--
+
+		case compile.RAISE:
+			x := stack[sp-1]
+			sp--
+			if exception, ok := x.(Exception); ok && exception != nil {
 				err = exception
-				stack[sp-1] = None
+			} else if class, ok := x.(*ExceptionClass); ok {
+				err = class.newException(exceptionArgs{})
+			} else {
+				err = TypeErrorf("raise: got %s, want exception", x.Type())
 			}
+			continue loop
 
 		case compile.EXCEPTPUSH:
 			exhandlers = append(exhandlers, exceptionHandler{pc: arg, sp: uint32(sp)})
@@ -211,7 +277,6 @@ loop:
 				break loop
 			}
 			exhandlers = exhandlers[:len(exhandlers)-1]
-			exception = nil
 
 		case compile.NOP:
 			// nop
@@ -263,11 +328,17 @@ loop:
 			y := stack[sp-1]
 			x := stack[sp-2]
 			sp -= 2
+			if err = thread.CheckAllocs(binarySize(binop, x, y)); err != nil {
+				continue loop
+			}
 			z, err2 := Binary(binop, x, y)
 			if err2 != nil {
 				err = err2
 				continue loop
 			}
+			if err = thread.AddAllocs(sizeOf(z)); err != nil {
+				continue loop
+			}
 			stack[sp] = z
 			sp++
 
@@ -300,15 +371,28 @@ loop:
 					if err = xlist.checkMutable("apply += to", true); err != nil {
 						continue loop
 					}
+					if err = thread.checkElems(Len(yiter), valueSize); err != nil {
+						continue loop
+					}
+					n := xlist.Len()
 					listExtend(xlist, yiter)
+					if err = thread.AddAllocs(int64(xlist.Len()-n) * valueSize); err != nil {
+						continue loop
+					}
 					z = xlist
 				}
 			}
 			if z == nil {
+				if err = thread.CheckAllocs(binarySize(syntax.PLUS, x, y)); err != nil {
+					continue loop
+				}
 				z, err = Binary(syntax.PLUS, x, y)
 				if err != nil {
 					continue loop
 				}
+				if err = thread.AddAllocs(sizeOf(z)); err != nil {
+					continue loop
+				}
 			}
 
 			stack[sp] = z
@@ -333,7 +417,7 @@ loop:
 			// VARIABLE STACK EFFECT
 			var fnkwargs Value
 			if op == compile.CALL_KW || op == compile.CALL_VAR_KW {
-				if err = stack.check(op, guardsp(sp, exhandlers), 1, 0); err != nil {
+				if err = stack.check(op, sp, exhandlers, 1, 0); err != nil {
 					continue loop
 				}
 				fnkwargs = stack[sp-1]
@@ -342,7 +426,7 @@ loop:
 
 			var fnargs Value
 			if op == compile.CALL_VAR || op == compile.CALL_VAR_KW {
-				if err = stack.check(op, guardsp(sp, exhandlers), 1, 0); err != nil {
+				if err = stack.check(op, sp, exhandlers, 1, 0); err != nil {
 					continue loop
 				}
 				fnargs = stack[sp-1]
@@ -352,7 +436,7 @@ loop:
 			// named args (pairs)
 			var kvpairs []Tuple
 			if nkvpairs := int(arg & 0xff); nkvpairs > 0 {
-				if err = stack.check(op, guardsp(sp, exhandlers), 2*nkvpairs, 0); err != nil {
+				if err = stack.check(op, sp, exhandlers, 2*nkvpairs, 0); err != nil {
 					continue loop
 				}
 				kvpairs = make([]Tuple, 0, nkvpairs)
@@ -390,7 +474,7 @@ loop:
 			// positional args
 			var positional Tuple
 			if npos := int(arg >> 8); npos > 0 {
-				if err = stack.check(op, guardsp(sp, exhandlers), npos, 0); err != nil {
+				if err = stack.check(op, sp, exhandlers, npos, 0); err != nil {
 					continue loop
 				}
 				positional = make(Tuple, npos)
@@ -411,7 +495,7 @@ loop:
 				iter.Done()
 			}
 
-			if err = stack.check(op, guardsp(sp, exhandlers), 1, 1); err != nil {
+			if err = stack.check(op, sp, exhandlers, 1, 1); err != nil {
 				continue loop
 			}
 
@@ -424,10 +508,11 @@ loop:
 
 			fr.iterstack, fr.exhandlers, fr.callpc, fr.pc, fr.sp = iterstack, exhandlers, savedpc, pc, uint32(sp)
 
-			// If the callable is a compiled function, jump directly to its entry-point:
-			if function, ok := callable.(*Function); ok {
+			// If the callable is a compiled function, jump directly to its entry-point
+			// (a generator function instead returns a generator, see Function.Call):
+			if function, ok := callable.(*Function); ok && !function.funcode.Generator {
 				if function.isRecursive(fr) {
-					err = TypeErrorf("function %s called recursively", function.Name())
+					err = RecursionErrorf("function %s called recursively", function.Name())
 					continue loop
 				}
 				fr = &Frame{parent: fr, callable: function}
@@ -465,7 +550,7 @@ loop:
 			retval := stack[sp-1]
 			parent := fr.parent
 			returnToCaller := false
-			if parent == nil || thread.SuspendedFrame() != nil {
+			if parent == nil || fc.Generator || thread.SuspendedFrame() != nil {
 				returnToCaller = true
 			}
 			var parentFn *Function
@@ -477,7 +562,8 @@ loop:
 				}
 			}
 			thread.frame = fr
-			// If the caller is not a compiled function, return to it directly:
+			// If the caller is not a compiled function, or this is the frame of a generator,
+			// return to it directly:
 			if returnToCaller {
 				if vmdebug {
 					fmt.Printf("Returning from %s @ %s\n", fc.Name, fc.Position(0))
@@ -487,6 +573,7 @@ loop:
 			}
 			// If the caller is a compiled function, jump to its frame's next instruction (PC):
 			fr = parent
+			thread.frame = fr
 			fn = parentFn
 			fc = fn.funcode
 			nlocals = len(fc.Locals)
@@ -502,6 +589,14 @@ loop:
 				fmt.Printf("Resuming %s @ %s\n", fc.Name, fc.Position(0))
 			}
 
+		case compile.YIELD:
+			// Suspend the frame of the generator, which is resumed by Generator.next:
+			result = stack[sp-1]
+			sp--
+			fr.iterstack, fr.exhandlers, fr.callpc, fr.pc, fr.sp = iterstack, exhandlers, savedpc, pc, uint32(sp)
+			thread.yielded, yielded = true, true
+			break loop
+
 		case compile.ITERPUSH:
 			x := stack[sp-1]
 			sp--
@@ -514,7 +609,7 @@ loop:
 
 		case compile.ITERJMP:
 			// VARIABLE STACK EFFECT
-			if err = stack.check(op, guardsp(sp, exhandlers), 0, 1); err != nil {
+			if err = stack.check(op, sp, exhandlers, 0, 1); err != nil {
 				continue loop
 			}
 			if len(iterstack) == 0 {
@@ -522,7 +617,17 @@ loop:
 				continue loop
 			}
 			iter := iterstack[len(iterstack)-1]
-			if iter.Next(&stack[sp]) {
+			more := false
+			if g, ok := iter.(*Generator); ok {
+				// Run the generator in this thread, raising its errors here:
+				fr.callpc = savedpc
+				if more, err = g.next(thread, &stack[sp]); err != nil {
+					continue loop
+				}
+			} else {
+				more = iter.Next(&stack[sp])
+			}
+			if more {
 				sp++
 			} else {
 				pc = arg
@@ -583,10 +688,16 @@ loop:
 			}
 
 		case compile.MAKEDICT:
+			if err = thread.AddAllocs(listSize); err != nil {
+				continue loop
+			}
 			stack[sp] = new(Dict)
 			sp++
 
 		case compile.MAKESET:
+			if err = thread.AddAllocs(listSize); err != nil {
+				continue loop
+			}
 			stack[sp] = new(Set)
 			sp++
 
@@ -612,12 +723,23 @@ loop:
 				err = ValueErrorf("duplicate key: %v", k)
 				continue loop
 			}
+			if err = thread.AddAllocs(int64(dict.Len()-oldlen) * entrySize); err != nil {
+				continue loop
+			}
 
 		case compile.APPEND:
 			elem := stack[sp-1]
 			if list, isList := stack[sp-2].(*List); isList {
+				if err = thread.AddAllocs(valueSize); err != nil {
+					sp -= 2
+					continue loop
+				}
 				list.elems = append(list.elems, elem)
 			} else if s, isSet := stack[sp-2].(*Set); isSet {
+				if err = thread.AddAllocs(entrySize); err != nil {
+					sp -= 2
+					continue loop
+				}
 				err = s.Insert(elem)
 			} else {
 				argType := "<nil>"
@@ -641,13 +763,16 @@ loop:
 				err = err2
 				continue loop
 			}
+			if err = thread.AddAllocs(sizeOf(res)); err != nil {
+				continue loop
+			}
 			stack[sp] = res
 			sp++
 
 		case compile.UNPACK:
 			// VARIABLE STACK EFFECT
 			n := int(arg)
-			if err = stack.check(op, guardsp(sp, exhandlers), 1, n); err != nil {
+			if err = stack.check(op, sp, exhandlers, 1, n); err != nil {
 				continue loop
 			}
 			iterable := stack[sp-1]
@@ -687,7 +812,10 @@ loop:
 		case compile.MAKETUPLE:
 			// VARIABLE STACK EFFECT
 			n := int(arg)
-			if err = stack.check(op, guardsp(sp, exhandlers), n, 1); err != nil {
+			if err = stack.check(op, sp, exhandlers, n, 1); err != nil {
+				continue loop
+			}
+			if err = thread.AddAllocs(listSize + int64(n)*valueSize); err != nil {
 				continue loop
 			}
 			tuple := make(Tuple, n)
@@ -699,7 +827,10 @@ loop:
 		case compile.MAKELIST:
 			// VARIABLE STACK EFFECT
 			n := int(arg)
-			if err = stack.check(op, guardsp(sp, exhandlers), n, 1); err != nil {
+			if err = stack.check(op, sp, exhandlers, n, 1); err != nil {
+				continue loop
+			}
+			if err = thread.AddAllocs(listSize + int64(n)*valueSize); err != nil {
 				continue loop
 			}
 			elems := make([]Value, n)
@@ -745,7 +876,7 @@ loop:
 		case compile.LOAD:
 			// VARIABLE STACK EFFECT (for stack checking), but the net result is 1 pop
 			n := int(arg)
-			if err = stack.check(op, guardsp(sp, exhandlers), 1+n, n); err != nil {
+			if err = stack.check(op, sp, exhandlers, 1+n, n); err != nil {
 				continue loop
 			}
 			moduleString, ok := stack[sp-1].(String)
@@ -802,7 +933,7 @@ loop:
 		case compile.LOCAL:
 			x := locals[arg]
 			if x == nil {
-				err = fmt.Errorf("local variable %s referenced before assignment", fc.Locals[arg].Name)
+				err = NameErrorf("local variable %s referenced before assignment", fc.Locals[arg].Name)
 				continue loop
 			}
 			stack[sp] = x
@@ -815,7 +946,7 @@ loop:
 		case compile.GLOBAL:
 			x := fn.globals[arg]
 			if x == nil {
-				err = fmt.Errorf("global variable %s referenced before assignment", fc.Prog.Globals[arg].Name)
+				err = NameErrorf("global variable %s referenced before assignment", fc.Prog.Globals[arg].Name)
 				continue loop
 			}
 			stack[sp] = x
@@ -841,9 +972,12 @@ loop:
 		}
 	}
 
-	// ITERPOP the rest of the iterator stack.
-	for _, iter := range iterstack {
-		iter.Done()
+	// ITERPOP the rest of the iterator stack, unless the frame is suspended
+	// and its iterations may be resumed.
+	if !yielded && thread.SuspendedFrame() == nil {
+		for _, iter := range iterstack {
+			iter.Done()
+		}
 	}
 	if result == nil {
 		result = None
@@ -0,0 +1,126 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylark
+
+// This file defines the interruption of threads which exceed their budget
+// of steps (see Thread.MaxSteps) or which are cancelled (see Thread.Cancel).
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+// An Interrupt describes why the execution of a thread was interrupted: either it
+// exceeded its budget of steps (see Thread.MaxSteps), or it was cancelled (see
+// Thread.Cancel). A thread which is interrupted fails with an EvalError which holds
+// the Interrupt, unless it is suspended instead (see Thread.SuspendOnInterrupt).
+type Interrupt struct {
+	Cancelled bool   // whether the thread was cancelled, rather than exceeding its budget
+	Reason    string // reason passed to Thread.Cancel
+	Steps     uint64 // number of steps executed by the thread when it was interrupted
+}
+
+func (in *Interrupt) Error() string {
+	if in.Cancelled {
+		return fmt.Sprintf("Skylark computation cancelled: %s", in.Reason)
+	}
+	return fmt.Sprintf("Skylark computation exceeded its budget of %d steps", in.Steps)
+}
+
+// Steps returns the number of steps executed by the bytecode interpreter in the thread,
+// i.e. the number of instructions which it executed. It must not be called while the
+// thread is running in another goroutine.
+func (thread *Thread) Steps() uint64 { return thread.steps }
+
+// Cancel interrupts the thread before its next step. It may be called from any goroutine,
+// e.g. upon a deadline, while the thread is running. A thread which fails because it was
+// cancelled remains cancelled, whereas a thread which is suspended instead is resumed
+// as if it had not been cancelled.
+func (thread *Thread) Cancel(reason string) {
+	atomic.StorePointer(&thread.cancelReason, unsafe.Pointer(&reason))
+}
+
+// step counts a step of the interpreter, unless the thread has been cancelled or has
+// exhausted its budget, in which case it returns the interruption of the thread.
+func (thread *Thread) step() *Interrupt {
+	if reason := atomic.LoadPointer(&thread.cancelReason); reason != nil {
+		return &Interrupt{Cancelled: true, Reason: *(*string)(reason), Steps: thread.steps}
+	}
+	if thread.MaxSteps != 0 && thread.steps >= thread.MaxSteps {
+		return &Interrupt{Steps: thread.steps}
+	}
+	thread.steps++
+	return nil
+}
+
+// Interrupted returns the interruption for which a suspended thread was suspended,
+// or nil if the thread was not suspended by an interruption (see SuspendOnInterrupt).
+func (thread *Thread) Interrupted() *Interrupt {
+	frame := thread.suspended
+	if frame == nil {
+		frame = thread.frame // e.g. a decoded thread
+	}
+	if frame == nil || frame.callable != Callable(interruptBuiltin) || len(frame.args) != 3 {
+		return nil
+	}
+	cancelled, ok1 := frame.args[0].(Bool)
+	reason, ok2 := frame.args[1].(String)
+	steps, ok3 := frame.args[2].(Int)
+	if !ok1 || !ok2 || !ok3 {
+		return nil
+	}
+	in := &Interrupt{Cancelled: bool(cancelled), Reason: string(reason)}
+	in.Steps, _ = steps.Uint64()
+	return in
+}
+
+// interruptBuiltin is the callable of the frame which is pushed onto the call stack of a
+// thread which is suspended by an interruption. Its continuation state is the value on
+// top of the stack of the interrupted frame, which is displaced by the result of the
+// suspending call upon resumption, and which its ResumeCall method restores.
+//
+// Its name cannot be referred to by Skylark programs.
+var interruptBuiltin = NewResumableBuiltin("<interrupt>", interrupt, interrupt_resume)
+
+func interrupt(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	return nil, fmt.Errorf("%s: cannot be called", b.Name())
+}
+
+func interrupt_resume(thread *Thread, _ *Builtin, state Value, retval Value) (Value, error) {
+	return state, nil
+}
+
+// interruptible reports whether the thread may be suspended when it is interrupted
+// in the given frame of a compiled function, i.e. whether the frame and its callers
+// may be resumed, as opposed to e.g. the frame of a generator.
+func (fr *Frame) interruptible() bool {
+	for ; fr != nil; fr = fr.parent {
+		switch callable := fr.callable.(type) {
+		case *Function:
+			if callable.funcode.Generator {
+				return false
+			}
+		case *Builtin:
+			if callable.resume == nil {
+				return false
+			}
+		case ResumableBuiltin:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// suspendInterrupted suspends the thread, which was interrupted before the instruction
+// at the saved pc of its current frame, with the given value on top of its stack.
+func (thread *Thread) suspendInterrupted(in *Interrupt, top Value) {
+	thread.PushFrame(&Frame{callable: interruptBuiltin, state: top})
+	thread.Suspendable(Tuple{Bool(in.Cancelled), String(in.Reason), MakeUint64(in.Steps)}, nil)
+	if in.Cancelled {
+		atomic.StorePointer(&thread.cancelReason, nil)
+	}
+}
@@ -0,0 +1,396 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylark
+
+// This file defines journals, which record the calls of the built-ins
+// supplied by the client so that a thread may later be re-run with the
+// same results (see Thread.Journal).
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/google/skylark/syntax"
+)
+
+// A Journal records the calls of built-in functions made by a thread, or replays
+// a previously recorded sequence of calls.
+//
+// The calls recorded are those of the built-ins supplied by the client, including
+// methods of client-defined types, and of the 'suspend' built-in, whose result is
+// supplied by the client. The deferred calls of the futures awaited by 'await_all'
+// are recorded as the client resolves them. Calls of the other universal built-ins
+// and of the methods of built-in types are deterministic, and are not recorded. Nor
+// are the calls made by a recorded built-in, e.g. by a built-in which calls a Skylark
+// function: the result of the outer call accounts for them.
+//
+// A call which suspends the thread is recorded as pending, and completed when the
+// thread is resumed with the value (or exception) with which it was resumed. Since
+// a decoded thread does not carry the journal of the original thread, the client
+// must set the Journal of the decoded thread before resuming it: either the journal
+// of the original thread, or one with the same Calls, e.g. &Journal{Calls: calls}
+// for calls saved by the client in another process.
+//
+// A journal is not encoded with the state of its thread, and the codec does not
+// encode the Err of a JournalCall, which is a Go error: a client which saves the
+// Calls of a journal must save their errors itself.
+//
+// While replaying, a call of a recorded built-in is not made: its result is that
+// of the next recorded call, which must be a call of a built-in with the same name
+// and equal arguments. A call which does not match, or which is made once all the
+// calls have been replayed, fails with an error describing its position.
+type Journal struct {
+	Calls  []*JournalCall
+	replay bool
+	next   int // index of the next call to replay
+}
+
+// A JournalCall describes a call recorded by a Journal.
+//
+// The arguments and result are copies of those of the call, such that their later
+// mutation does not affect the record. Lists, dicts, sets and tuples are copied;
+// other values are shared.
+type JournalCall struct {
+	Pos    syntax.Position // position of the call
+	Name   string          // name of the built-in
+	Args   Tuple
+	Kwargs []Tuple
+	Result Value // result of the call, or nil if it failed
+	Err    error // error of the call, if it failed
+	// Pending reports whether the call suspended the thread and has not yet been completed,
+	// in which case it is the last call of the journal, and has neither result nor error.
+	Pending bool
+}
+
+// NewJournal returns an empty journal, which records the calls of a thread.
+func NewJournal() *Journal { return &Journal{} }
+
+// NewReplayJournal returns a journal which replays the given calls, e.g. the Calls of a
+// journal which recorded a previous run of the same program.
+func NewReplayJournal(calls []*JournalCall) *Journal {
+	return &Journal{Calls: calls, replay: true}
+}
+
+// Replaying reports whether the journal replays its calls, rather than recording them.
+func (j *Journal) Replaying() bool { return j.replay }
+
+// Remaining returns the calls of a replayed journal which have not yet been replayed.
+// A thread which completes with remaining calls has diverged from the recorded run.
+func (j *Journal) Remaining() []*JournalCall {
+	if !j.replay {
+		return nil
+	}
+	return j.Calls[j.next:]
+}
+
+func (c *JournalCall) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s: ", c.Pos)
+	writeCall(&buf, c.Name, c.Args, c.Kwargs)
+	if c.Pending {
+		buf.WriteString(" pending")
+	} else if c.Err != nil {
+		fmt.Fprintf(&buf, " failed: %v", c.Err)
+	} else {
+		fmt.Fprintf(&buf, " = %s", c.Result)
+	}
+	return buf.String()
+}
+
+// clone returns a copy of the journal, whose calls are shared.
+func (j *Journal) clone() *Journal {
+	if j == nil {
+		return nil
+	}
+	clone := *j
+	clone.Calls = append([]*JournalCall(nil), j.Calls...)
+	return &clone
+}
+
+// call calls the built-in in the top frame of the thread, recording the call or
+// replaying its result.
+func (j *Journal) call(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	frame := thread.frame
+	if j.replay {
+		c, err := j.replayCall(callPosition(frame), b.name, args, kwargs)
+		if err != nil {
+			return nil, err
+		}
+		if c.Err != nil {
+			return nil, c.Err
+		}
+		// The result is copied, since the thread may mutate it:
+		var copies journalCopier
+		return copies.value(c.Result), nil
+	}
+	c := newJournalCall(callPosition(frame), b.name, args, kwargs)
+	result, err := b.fn(thread, b, args, kwargs)
+	if thread.suspended != nil {
+		// The call is completed upon resumption of the thread:
+		c.Pending = true
+		j.Calls = append(j.Calls, c)
+	} else {
+		j.complete(c, result, err)
+	}
+	return result, err
+}
+
+// journalReturn records the completion of the call in the given frame upon the
+// resumption of the thread, if the call is recorded by the thread's journal.
+func (thread *Thread) journalReturn(frame *Frame, result Value, err error) {
+	if j := thread.Journal; j != nil && !j.replay && frame != nil && journaled(frame) {
+		// Recorded calls are not nested, hence the pending call is the last one, that of the frame:
+		if n := len(j.Calls); n > 0 && j.Calls[n-1].Pending {
+			// The call is copied, since the calls of a cloned journal are shared:
+			c := *j.Calls[n-1]
+			c.Pending = false
+			j.Calls = j.Calls[:n-1]
+			j.complete(&c, result, err)
+		}
+	}
+}
+
+// recordFutures records the deferred calls of the given futures, which were resolved
+// upon the resumption of the call of 'await_all' in the given frame.
+func (j *Journal) recordFutures(frame *Frame, futures Tuple) {
+	pos := callPosition(frame)
+	for _, f := range futures {
+		f := f.(*Future)
+		if exception, ok := f.result.(Exception); ok {
+			j.record(pos, f.fn.Name(), f.args, f.kwargs, nil, exception)
+		} else {
+			j.record(pos, f.fn.Name(), f.args, f.kwargs, f.result, nil)
+		}
+	}
+}
+
+// replayFutures resolves the given futures, awaited by the call of 'await_all' in the
+// given frame, by the results of the next recorded calls.
+func (j *Journal) replayFutures(frame *Frame, futures Tuple) error {
+	pos := callPosition(frame)
+	for _, f := range futures {
+		f := f.(*Future)
+		c, err := j.replayCall(pos, f.fn.Name(), f.args, f.kwargs)
+		if err != nil {
+			return err
+		}
+		if c.Err != nil {
+			exception, ok := c.Err.(Exception)
+			if !ok {
+				return c.Err
+			}
+			f.result = exception
+		} else {
+			var copies journalCopier
+			f.result = copies.value(c.Result)
+		}
+	}
+	return nil
+}
+
+func (j *Journal) record(pos syntax.Position, name string, args Tuple, kwargs []Tuple, result Value, err error) {
+	j.complete(newJournalCall(pos, name, args, kwargs), result, err)
+}
+
+// newJournalCall returns a call of the named built-in, with copies of its arguments.
+func newJournalCall(pos syntax.Position, name string, args Tuple, kwargs []Tuple) *JournalCall {
+	var copies journalCopier
+	c := &JournalCall{
+		Pos:  pos,
+		Name: name,
+		Args: copies.tuple(args),
+	}
+	for _, kv := range kwargs {
+		c.Kwargs = append(c.Kwargs, copies.tuple(kv))
+	}
+	return c
+}
+
+// complete records the call with the given result or error.
+func (j *Journal) complete(c *JournalCall, result Value, err error) {
+	if err != nil {
+		c.Err = err
+	} else {
+		var copies journalCopier
+		c.Result = copies.value(result)
+	}
+	j.Calls = append(j.Calls, c)
+}
+
+// replayCall returns the next recorded call, which must match the given call.
+func (j *Journal) replayCall(pos syntax.Position, name string, args Tuple, kwargs []Tuple) (*JournalCall, error) {
+	var buf bytes.Buffer
+	writeCall(&buf, name, args, kwargs)
+	if j.next >= len(j.Calls) {
+		return nil, fmt.Errorf("journal replay diverged at %s: unexpected call %s after the last recorded call", pos, buf.String())
+	}
+	c := j.Calls[j.next]
+	if c.Pending {
+		return nil, fmt.Errorf("journal replay diverged at %s: call %s recorded at %s is pending", pos, buf.String(), c.Pos)
+	}
+	if same, err := c.matches(name, args, kwargs); err != nil {
+		return nil, fmt.Errorf("journal replay diverged at %s: %v", pos, err)
+	} else if !same {
+		var want bytes.Buffer
+		writeCall(&want, c.Name, c.Args, c.Kwargs)
+		return nil, fmt.Errorf("journal replay diverged at %s: call %s does not match the call %s recorded at %s",
+			pos, buf.String(), want.String(), c.Pos)
+	}
+	j.next++
+	return c, nil
+}
+
+// matches reports whether the recorded call is a call of the named built-in with
+// equal arguments.
+func (c *JournalCall) matches(name string, args Tuple, kwargs []Tuple) (bool, error) {
+	if c.Name != name || len(c.Args) != len(args) || len(c.Kwargs) != len(kwargs) {
+		return false, nil
+	}
+	for i, arg := range args {
+		if eq, err := Equal(c.Args[i], arg); err != nil || !eq {
+			return false, err
+		}
+	}
+	for i, kv := range kwargs {
+		if len(c.Kwargs[i]) != len(kv) {
+			return false, nil
+		}
+		for k := range kv {
+			if eq, err := Equal(c.Kwargs[i][k], kv[k]); err != nil || !eq {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// journaled reports whether the call of the built-in in the given frame is recorded
+// by a journal, i.e. it is a call of a recorded built-in which was not made by another.
+func journaled(frame *Frame) bool {
+	b, ok := frame.callable.(*Builtin)
+	return ok && b.journaled() && !journalCaller(frame)
+}
+
+// journalCaller reports whether the call in the given frame was made by a call of a
+// recorded built-in, whose recorded result accounts for it.
+func journalCaller(frame *Frame) bool {
+	for fr := frame.parent; fr != nil; fr = fr.parent {
+		if b, ok := fr.callable.(*Builtin); ok && b.journaled() {
+			return true
+		}
+	}
+	return false
+}
+
+// journaled reports whether the calls of the built-in are recorded by a journal.
+func (b *Builtin) journaled() bool {
+	switch b.recv.(type) {
+	case nil:
+		if b == interruptBuiltin {
+			return false // an interruption is not a call
+		}
+		return Universe[b.name] != Value(b) || b.name == "suspend"
+	case String, *List, *Dict, *Set:
+		return false // a method of a built-in type
+	}
+	return true
+}
+
+// callPosition returns the position of the call of the built-in in the given frame.
+func callPosition(frame *Frame) syntax.Position {
+	if frame.parent == nil {
+		return syntax.Position{}
+	}
+	return frame.parent.Position()
+}
+
+func writeCall(buf *bytes.Buffer, name string, args Tuple, kwargs []Tuple) {
+	buf.WriteString(name)
+	buf.WriteByte('(')
+	sep := ""
+	for _, arg := range args {
+		buf.WriteString(sep)
+		writeValue(buf, arg, nil)
+		sep = ", "
+	}
+	for _, kv := range kwargs {
+		buf.WriteString(sep)
+		if name, ok := kv[0].(String); ok && len(kv) == 2 {
+			buf.WriteString(string(name))
+			buf.WriteByte('=')
+			writeValue(buf, kv[1], nil)
+		} else {
+			writeValue(buf, kv, nil)
+		}
+		sep = ", "
+	}
+	buf.WriteByte(')')
+}
+
+// A journalCopier copies the lists, dicts, sets and tuples of recorded values,
+// preserving their aliasing.
+type journalCopier map[Value]Value
+
+func (m *journalCopier) value(v Value) Value {
+	switch v := v.(type) {
+	case Tuple:
+		return m.tuple(v)
+	case *List:
+		if clone, ok := m.lookup(v); ok {
+			return clone
+		}
+		clone := &List{elems: make([]Value, len(v.elems)), frozen: v.frozen}
+		(*m)[v] = clone
+		for i, elem := range v.elems {
+			clone.elems[i] = m.value(elem)
+		}
+		return clone
+	case *Dict:
+		if clone, ok := m.lookup(v); ok {
+			return clone
+		}
+		clone := &Dict{}
+		(*m)[v] = clone
+		m.hashtable(&clone.ht, &v.ht)
+		return clone
+	case *Set:
+		if clone, ok := m.lookup(v); ok {
+			return clone
+		}
+		clone := &Set{}
+		(*m)[v] = clone
+		m.hashtable(&clone.ht, &v.ht)
+		return clone
+	default:
+		return v
+	}
+}
+
+func (m *journalCopier) lookup(v Value) (Value, bool) {
+	if *m == nil {
+		*m = make(journalCopier)
+	}
+	clone, ok := (*m)[v]
+	return clone, ok
+}
+
+func (m *journalCopier) hashtable(clone, ht *hashtable) {
+	// Keys are hashable, hence they need not be copied:
+	for e := ht.head; e != nil; e = e.next {
+		clone.insert(e.key, m.value(e.value))
+	}
+	clone.frozen = ht.frozen
+}
+
+func (m *journalCopier) tuple(t Tuple) Tuple {
+	if len(t) == 0 {
+		return t
+	}
+	clone := make(Tuple, len(t))
+	for i, elem := range t {
+		clone[i] = m.value(elem)
+	}
+	return clone
+}
@@ -13,6 +13,7 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"math"
 	"math/big"
 	"os"
 	"reflect"
@@ -41,8 +42,10 @@ func init() {
 		"False":     False,
 		"any":       NewBuiltin("any", any),
 		"all":       NewBuiltin("all", all),
+		"await_all": NewResumableBuiltin("await_all", await_all, await_all_resume), // requires resolve.AllowFutures
 		"bool":      NewBuiltin("bool", bool_),
 		"chr":       NewBuiltin("chr", chr),
+		"defer":     NewBuiltin("defer", defer_), // requires resolve.AllowFutures
 		"dict":      NewBuiltin("dict", dict),
 		"dir":       NewBuiltin("dir", dir),
 		"enumerate": NewBuiltin("enumerate", enumerate),
@@ -53,16 +56,17 @@ func init() {
 		"int":       NewBuiltin("int", int_),
 		"len":       NewBuiltin("len", len_),
 		"list":      NewBuiltin("list", list),
-		"max":       NewBuiltin("max", minmax),
-		"min":       NewBuiltin("min", minmax),
+		"max":       NewResumableBuiltin("max", minmax, minmax_resume),
+		"min":       NewResumableBuiltin("min", minmax, minmax_resume),
 		"ord":       NewBuiltin("ord", ord),
 		"print":     NewBuiltin("print", print),
 		"range":     NewBuiltin("range", range_),
 		"repr":      NewBuiltin("repr", repr),
 		"reversed":  NewBuiltin("reversed", reversed),
 		"set":       NewBuiltin("set", set), // requires resolve.AllowSet
-		"sorted":    NewBuiltin("sorted", sorted),
+		"sorted":    NewResumableBuiltin("sorted", sorted, sorted_resume),
 		"str":       NewBuiltin("str", str),
+		"suspend":   NewBuiltin("suspend", suspend), // requires resolve.AllowSuspend
 		"tuple":     NewBuiltin("tuple", tuple),
 		"type":      NewBuiltin("type", type_),
 		"zip":       NewBuiltin("zip", zip),
@@ -71,6 +75,11 @@ func init() {
 
 type builtinMethod func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 
+// A builtinResumeMethod completes a call of a builtin which was interrupted by the
+// suspension of the thread, given the state recorded by Thread.SuspendCall and the
+// value returned by the callee which suspended the thread.
+type builtinResumeMethod func(thread *Thread, fn *Builtin, state Value, retval Value) (Value, error)
+
 // methods of built-in types
 // https://github.com/google/skylark/blob/master/doc/spec.md#built-in-methods
 var (
@@ -384,6 +393,73 @@ func any(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	return False, nil
 }
 
+// https://github.com/google/skylark/blob/master/doc/spec.md#await_all
+func await_all(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var iterable Iterable
+	var returnExceptions bool
+	if err := UnpackArgs("await_all", args, kwargs, "futures", &iterable, "return_exceptions?", &returnExceptions); err != nil {
+		return nil, err
+	}
+	var futures, pending Tuple
+	iter := iterable.Iterate()
+	defer iter.Done()
+	var x Value
+	for iter.Next(&x) {
+		f, ok := x.(*Future)
+		if !ok {
+			return nil, TypeErrorf("await_all: got %s, want future", x.Type())
+		}
+		futures = append(futures, f)
+		if f.result == nil && !futureIn(f, pending) {
+			pending = append(pending, f)
+		}
+	}
+	if len(pending) > 0 {
+		if j := thread.Journal; j != nil && j.replay && !journalCaller(thread.frame) {
+			if err := j.replayFutures(thread.frame, pending); err != nil {
+				return nil, err
+			}
+		} else {
+			// The thread is suspended once for all the unresolved futures:
+			thread.Suspendable(args, kwargs)
+			thread.SuspendCall(Tuple{futures, Bool(returnExceptions), pending})
+			return None, nil
+		}
+	}
+	return awaitResults(futures, returnExceptions)
+}
+
+// await_all_resume completes a call of await_all with the results of its unresolved futures.
+func await_all_resume(thread *Thread, _ *Builtin, state Value, retval Value) (Value, error) {
+	futures, pending, returnExceptions, ok := awaitState(state)
+	if !ok {
+		return nil, fmt.Errorf("await_all: invalid continuation state")
+	}
+	results, ok := retval.(Indexable)
+	if !ok {
+		return nil, fmt.Errorf("await_all: resumed with %s, want a list of %d results", retval.Type(), len(pending))
+	}
+	if results.Len() != len(pending) {
+		return nil, fmt.Errorf("await_all: resumed with %d results, want %d", results.Len(), len(pending))
+	}
+	for i, f := range pending {
+		f.(*Future).result = results.Index(i)
+	}
+	if j := thread.Journal; j != nil && !j.replay && !journalCaller(thread.frame) {
+		j.recordFutures(thread.frame, pending)
+	}
+	return awaitResults(futures, returnExceptions)
+}
+
+func futureIn(f *Future, futures Tuple) bool {
+	for _, x := range futures {
+		if x == Value(f) {
+			return true
+		}
+	}
+	return false
+}
+
 // https://github.com/google/skylark/blob/master/doc/spec.md#bool
 func bool_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var x Value = False
@@ -414,16 +490,33 @@ func chr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	return String(string(i)), nil
 }
 
+// https://github.com/google/skylark/blob/master/doc/spec.md#defer
+func defer_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if len(args) < 1 {
+		return nil, TypeErrorf("defer: got %d arguments, want at least 1", len(args))
+	}
+	fn, ok := args[0].(Callable)
+	if !ok {
+		return nil, TypeErrorf("defer: got %s, want callable", args[0].Type())
+	}
+	return &Future{fn: fn, args: args[1:], kwargs: kwargs}, nil
+}
+
 // https://github.com/google/skylark/blob/master/doc/spec.md#dict
 func dict(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	if len(args) > 1 {
 		return nil, TypeErrorf("dict: got %d arguments, want at most 1", len(args))
 	}
+	if len(args) == 1 {
+		if err := thread.checkElems(Len(args[0]), entrySize); err != nil {
+			return nil, err
+		}
+	}
 	dict := new(Dict)
 	if err := updateDict(dict, args, kwargs); err != nil {
 		return nil, ValueErrorf("dict: %v", err.Error())
 	}
-	return dict, nil
+	return thread.allocated(dict)
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#dir
@@ -463,6 +556,10 @@ func enumerate(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, e
 	var pairs []Value
 	var x Value
 
+	const pairSize = valueSize + listSize + 2*valueSize // an element of the list, and its tuple
+	if err := thread.checkElems(Len(iterable), pairSize); err != nil {
+		return nil, err
+	}
 	if n := Len(iterable); n >= 0 {
 		// common case: known length
 		pairs = make([]Value, 0, n)
@@ -482,7 +579,7 @@ func enumerate(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, e
 		}
 	}
 
-	return NewList(pairs), nil
+	return NewList(pairs), thread.AddAllocs(listSize + int64(len(pairs))*pairSize)
 }
 
 func float(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
@@ -509,7 +606,10 @@ func float(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error
 	case String:
 		f, err := strconv.ParseFloat(string(x), 64)
 		if err != nil {
-			return nil, err
+			if err.(*strconv.NumError).Err == strconv.ErrRange {
+				return nil, NewOverflowError(err)
+			}
+			return nil, NewValueError(err)
 		}
 		return Float(f), nil
 	default:
@@ -542,7 +642,7 @@ func getattr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, err
 	if dflt != nil {
 		return dflt, nil
 	}
-	return nil, TypeErrorf("%s has no .%s field or method", object.Type(), name)
+	return nil, AttributeErrorf("%s has no .%s field or method", object.Type(), name)
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#hasattr
@@ -676,6 +776,9 @@ func int_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 
 	i, err := NumberToInt(x)
 	if err != nil {
+		if f, ok := x.(Float); ok && math.IsInf(float64(f), 0) {
+			return nil, OverflowErrorf("int: %s", err.Error())
+		}
 		return nil, ValueErrorf("int: %s", err.Error())
 	}
 	return i, nil
@@ -702,6 +805,9 @@ func list(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	}
 	var elems []Value
 	if iterable != nil {
+		if err := thread.checkElems(Len(iterable), valueSize); err != nil {
+			return nil, err
+		}
 		iter := iterable.Iterate()
 		defer iter.Done()
 		if n := Len(iterable); n > 0 {
@@ -712,7 +818,7 @@ func list(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 			elems = append(elems, x)
 		}
 	}
-	return NewList(elems), nil
+	return thread.allocated(NewList(elems))
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#min
@@ -724,12 +830,6 @@ func minmax(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, err
 	if err := UnpackArgs(fn.Name(), nil, kwargs, "key?", &keyFunc); err != nil {
 		return nil, err
 	}
-	var op syntax.Token
-	if fn.Name() == "max" {
-		op = syntax.GT
-	} else {
-		op = syntax.LT
-	}
 	var iterable Value
 	if len(args) == 1 {
 		iterable = args[0]
@@ -741,39 +841,61 @@ func minmax(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, err
 		return nil, TypeErrorf("%s: %s value is not iterable", fn.Name(), iterable.Type())
 	}
 	defer iter.Done()
-	var extremum Value
-	if !iter.Next(&extremum) {
+	var values []Value
+	var x Value
+	for iter.Next(&x) {
+		values = append(values, x)
+	}
+	if len(values) == 0 {
 		return nil, ValueErrorf("%s: argument is an empty sequence", fn.Name())
 	}
+	return minmaxKeys(thread, fn, keyFunc, values, 0, None, None, nil)
+}
 
-	var extremeKey Value
-	var keyargs Tuple
-	if keyFunc == nil {
-		extremeKey = extremum
-	} else {
-		keyargs = Tuple{extremum}
-		res, err := Call(thread, keyFunc, keyargs, nil)
-		if err != nil {
-			return nil, err
-		}
-		extremeKey = res
+// minmax_resume continues a call of min or max after the key function suspended the thread.
+func minmax_resume(thread *Thread, fn *Builtin, state Value, retval Value) (Value, error) {
+	var keyFunc Callable
+	var values *List
+	var i int
+	var extremum, extremeKey Value
+	args, _ := state.(Tuple)
+	if err := UnpackPositionalArgs(fn.Name(), args, nil, 5, &keyFunc, &values, &i, &extremum, &extremeKey); err != nil {
+		return nil, err
 	}
+	if i < 0 || i >= values.Len() {
+		return nil, fmt.Errorf("%s: invalid continuation state", fn.Name())
+	}
+	return minmaxKeys(thread, fn, keyFunc, values.elems, i, extremum, extremeKey, retval)
+}
 
-	var x Value
-	for iter.Next(&x) {
-		var key Value
+// minmaxKeys returns the extremum of values, given the extremum of values[:i]
+// and its key (when i > 0), and the key of values[i] (or nil if not yet derived).
+func minmaxKeys(thread *Thread, fn *Builtin, keyFunc Callable, values []Value, i int, extremum, extremeKey, key Value) (Value, error) {
+	var op syntax.Token
+	if fn.Name() == "max" {
+		op = syntax.GT
+	} else {
+		op = syntax.LT
+	}
+	for ; i < len(values); i++ {
+		x := values[i]
 		if keyFunc == nil {
 			key = x
-		} else {
-			keyargs[0] = x
-			res, err := Call(thread, keyFunc, keyargs, nil)
+		} else if key == nil {
+			res, err := Call(thread, keyFunc, Tuple{x}, nil)
 			if err != nil {
 				return nil, err
 			}
+			if thread.SuspendedFrame() != nil {
+				thread.SuspendCall(Tuple{keyFunc, NewList(values), MakeInt(i), extremum, extremeKey})
+				return None, nil
+			}
 			key = res
 		}
 
-		if ok, err := Compare(op, key, extremeKey); err != nil {
+		if i == 0 {
+			extremum, extremeKey = x, key
+		} else if ok, err := Compare(op, key, extremeKey); err != nil {
 			if exception, ok := err.(Exception); ok {
 				return nil, exception
 			}
@@ -782,6 +904,7 @@ func minmax(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, err
 			extremum = x
 			extremeKey = key
 		}
+		key = nil
 	}
 	return extremum, nil
 }
@@ -977,7 +1100,7 @@ func repr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	if err := UnpackPositionalArgs("repr", args, kwargs, 1, &x); err != nil {
 		return nil, err
 	}
-	return String(x.String()), nil
+	return thread.allocated(String(x.String()))
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#reversed
@@ -986,6 +1109,9 @@ func reversed(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, er
 	if err := UnpackPositionalArgs("reversed", args, kwargs, 1, &iterable); err != nil {
 		return nil, err
 	}
+	if err := thread.checkElems(Len(iterable), valueSize); err != nil {
+		return nil, err
+	}
 	iter := iterable.Iterate()
 	defer iter.Done()
 	var elems []Value
@@ -1000,7 +1126,7 @@ func reversed(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, er
 	for i := 0; i < n>>1; i++ {
 		elems[i], elems[n-1-i] = elems[n-1-i], elems[i]
 	}
-	return NewList(elems), nil
+	return thread.allocated(NewList(elems))
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#set
@@ -1011,6 +1137,9 @@ func set(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	}
 	set := new(Set)
 	if iterable != nil {
+		if err := thread.checkElems(Len(iterable), entrySize); err != nil {
+			return nil, err
+		}
 		iter := iterable.Iterate()
 		defer iter.Done()
 		var x Value
@@ -1023,7 +1152,7 @@ func set(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 			}
 		}
 	}
-	return set, nil
+	return thread.allocated(set)
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#sorted
@@ -1039,6 +1168,9 @@ func sorted(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 		return nil, err
 	}
 
+	if err := thread.checkElems(Len(iterable), 2*valueSize); err != nil {
+		return nil, err
+	}
 	iter := iterable.Iterate()
 	defer iter.Done()
 	var values []Value
@@ -1050,21 +1182,45 @@ func sorted(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 		values = append(values, x)
 	}
 
-	// Derive keys from values by applying key function.
 	var keys []Value
 	if key != nil {
-		keys = make([]Value, len(values))
-		for i, v := range values {
-			k, err := Call(thread, key, Tuple{v}, nil)
-			if err != nil {
-				if exception, ok := err.(Exception); ok {
-					return nil, exception
-				}
-				return nil, NewValueError(err)
-				//return nil, err // to preserve backtrace, don't modify error
+		keys = make([]Value, 0, len(values))
+	}
+	return sortedKeys(thread, key, reverse, values, keys)
+}
+
+// sorted_resume continues a call of sorted after the key function suspended the thread.
+func sorted_resume(thread *Thread, _ *Builtin, state Value, retval Value) (Value, error) {
+	var key Callable
+	var reverse bool
+	var values, keys *List
+	args, _ := state.(Tuple)
+	if err := UnpackPositionalArgs("sorted", args, nil, 4, &key, &reverse, &values, &keys); err != nil {
+		return nil, err
+	}
+	if keys.Len() >= values.Len() {
+		return nil, fmt.Errorf("sorted: invalid continuation state")
+	}
+	return sortedKeys(thread, key, reverse, values.elems, append(keys.elems, retval))
+}
+
+// sortedKeys derives the remaining keys from values by applying the key function,
+// then sorts the values.
+func sortedKeys(thread *Thread, key Callable, reverse bool, values, keys []Value) (Value, error) {
+	for i := len(keys); key != nil && i < len(values); i++ {
+		k, err := Call(thread, key, Tuple{values[i]}, nil)
+		if err != nil {
+			if exception, ok := err.(Exception); ok {
+				return nil, exception
 			}
-			keys[i] = k
+			return nil, NewValueError(err)
+			//return nil, err // to preserve backtrace, don't modify error
 		}
+		if thread.SuspendedFrame() != nil {
+			thread.SuspendCall(Tuple{key, Bool(reverse), NewList(values), NewList(keys)})
+			return None, nil
+		}
+		keys = append(keys, k)
 	}
 
 	slice := &sortSlice{keys: keys, values: values}
@@ -1080,7 +1236,7 @@ func sorted(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 			return NewList(slice.values), NewValueError(slice.err)
 		}
 	}
-	return NewList(slice.values), nil
+	return thread.allocated(NewList(slice.values))
 }
 
 type sortSlice struct {
@@ -1118,11 +1274,23 @@ func str(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	}
 	x := args[0]
 	if _, ok := AsString(x); !ok {
-		x = String(x.String())
+		return thread.allocated(String(x.String()))
 	}
 	return x, nil
 }
 
+// https://github.com/google/skylark/blob/master/doc/spec.md#suspend
+func suspend(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if len(args) != 1 {
+		return nil, TypeErrorf("suspend: got %d arguments, want exactly 1", len(args))
+	}
+	if _, ok := args[0].(String); !ok {
+		return nil, TypeErrorf("suspend: got %s tag, want string", args[0].Type())
+	}
+	thread.Suspendable(args, kwargs)
+	return None, nil
+}
+
 // https://github.com/google/skylark/blob/master/doc/spec.md#tuple
 func tuple(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var iterable Iterable
@@ -1132,6 +1300,9 @@ func tuple(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error
 	if len(args) == 0 {
 		return Tuple(nil), nil
 	}
+	if err := thread.checkElems(Len(iterable), valueSize); err != nil {
+		return nil, err
+	}
 	iter := iterable.Iterate()
 	defer iter.Done()
 	var elems Tuple
@@ -1142,7 +1313,7 @@ func tuple(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error
 	for iter.Next(&x) {
 		elems = append(elems, x)
 	}
-	return elems, nil
+	return thread.allocated(elems)
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#type
@@ -1181,6 +1352,10 @@ func zip(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 			rows = n // possibly -1
 		}
 	}
+	rowSize := valueSize + listSize + int64(cols)*valueSize // an element of the list, and its tuple
+	if err := thread.checkElems(rows, rowSize); err != nil {
+		return nil, err
+	}
 	var result []Value
 	if rows >= 0 {
 		// length known
@@ -1207,7 +1382,7 @@ func zip(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 			result = append(result, tuple)
 		}
 	}
-	return NewList(result), nil
+	return NewList(result), thread.AddAllocs(listSize + int64(len(result))*rowSize)
 }
 
 // ---- methods of built-in types ---
@@ -1246,7 +1421,7 @@ func dict_items(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value,
 	for i, item := range items {
 		res[i] = item // convert [2]Value to Value
 	}
-	return NewList(res), nil
+	return thread.allocated(NewList(res))
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#dict·keys
@@ -1254,7 +1429,7 @@ func dict_keys(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value,
 	if err := UnpackPositionalArgs(fn.name, args, kwargs, 0); err != nil {
 		return nil, err
 	}
-	return NewList(fn.recv.(*Dict).Keys()), nil
+	return thread.allocated(NewList(fn.recv.(*Dict).Keys()))
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#dict·pop
@@ -1271,7 +1446,7 @@ func dict_pop(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, e
 	} else if d != nil {
 		return d, nil
 	}
-	return nil, ValueErrorf("pop: missing key")
+	return nil, KeyErrorf("pop: missing key")
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#dict·popitem
@@ -1282,7 +1457,7 @@ func dict_popitem(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Valu
 	recv := fn.recv.(*Dict)
 	k, ok := recv.ht.first()
 	if !ok {
-		return nil, ValueErrorf("popitem: empty dict")
+		return nil, KeyErrorf("popitem: empty dict")
 	}
 	v, _, err := recv.Delete(k)
 	if err != nil {
@@ -1302,6 +1477,8 @@ func dict_setdefault(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (V
 		return nil, err
 	} else if ok {
 		return v, nil
+	} else if err := thread.AddAllocs(entrySize); err != nil {
+		return nil, err
 	} else {
 		return dflt, dict.Set(key, dflt)
 	}
@@ -1312,10 +1489,17 @@ func dict_update(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value
 	if len(args) > 1 {
 		return nil, TypeErrorf("update: got %d arguments, want at most 1", len(args))
 	}
-	if err := updateDict(fn.recv.(*Dict), args, kwargs); err != nil {
+	dict := fn.recv.(*Dict)
+	if len(args) == 1 {
+		if err := thread.checkElems(Len(args[0]), entrySize); err != nil {
+			return nil, err
+		}
+	}
+	n := dict.Len()
+	if err := updateDict(dict, args, kwargs); err != nil {
 		return nil, ValueErrorf("update: %v", err.Error())
 	}
-	return None, nil
+	return None, thread.AddAllocs(int64(dict.Len()-n) * entrySize)
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#dict·update
@@ -1328,7 +1512,7 @@ func dict_values(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value
 	for i, item := range items {
 		res[i] = item[1]
 	}
-	return NewList(res), nil
+	return thread.allocated(NewList(res))
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#list·append
@@ -1344,6 +1528,9 @@ func list_append(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value
 		}
 		return nil, NewValueError(err)
 	}
+	if err := thread.AddAllocs(valueSize); err != nil {
+		return nil, err
+	}
 	recv.elems = append(recv.elems, object)
 	return None, nil
 }
@@ -1369,8 +1556,12 @@ func list_extend(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value
 		}
 		return nil, NewValueError(err)
 	}
+	if err := thread.checkElems(Len(iterable), valueSize); err != nil {
+		return nil, err
+	}
+	n := recv.Len()
 	listExtend(recv, iterable)
-	return None, nil
+	return None, thread.AddAllocs(int64(recv.Len()-n) * valueSize)
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#list·index
@@ -1410,6 +1601,9 @@ func list_insert(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value
 		}
 		return nil, NewValueError(err)
 	}
+	if err := thread.AddAllocs(valueSize); err != nil {
+		return nil, err
+	}
 
 	if index < 0 {
 		index += recv.Len()
@@ -1461,7 +1655,7 @@ func list_pop(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, e
 		return nil, err
 	}
 	if index < 0 || index >= list.Len() {
-		return nil, ValueErrorf("pop: index %d is out of range [0:%d]", index, list.Len())
+		return nil, IndexErrorf("pop: index %d is out of range [0:%d]", index, list.Len())
 	}
 	if err := list.checkMutable("pop from", true); err != nil {
 		if exception, ok := err.(Exception); ok {
@@ -1479,7 +1673,7 @@ func string_capitalize(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple)
 	if err := UnpackPositionalArgs(fn.name, args, kwargs, 0); err != nil {
 		return nil, err
 	}
-	return String(strings.Title(string(fn.recv.(String)))), nil
+	return thread.allocated(String(strings.Title(string(fn.recv.(String)))))
 }
 
 // string_iterable returns an unspecified iterable value whose iterator yields:
@@ -1721,7 +1915,7 @@ func string_format(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Val
 			}
 			auto = true
 			if index >= len(args) {
-				return nil, ValueErrorf("tuple index out of range")
+				return nil, IndexErrorf("tuple index out of range")
 			}
 			arg = args[index]
 			index++
@@ -1732,7 +1926,7 @@ func string_format(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Val
 			}
 			manual = true
 			if num >= len(args) {
-				return nil, ValueErrorf("tuple index out of range")
+				return nil, IndexErrorf("tuple index out of range")
 			} else {
 				arg = args[num]
 			}
@@ -1756,7 +1950,7 @@ func string_format(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Val
 				if strings.Contains(name, "{") {
 					return nil, ValueErrorf("nested replacement fields not supported")
 				}
-				return nil, ValueErrorf("keyword %s not found", name)
+				return nil, KeyErrorf("keyword %s not found", name)
 			}
 		}
 
@@ -1778,7 +1972,7 @@ func string_format(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Val
 			return nil, ValueErrorf("unknown conversion %q", conv)
 		}
 	}
-	return String(buf.String()), nil
+	return thread.allocated(String(buf.String()))
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·index
@@ -1793,6 +1987,10 @@ func string_join(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value
 	if err := UnpackPositionalArgs(fn.name, args, kwargs, 1, &iterable); err != nil {
 		return nil, err
 	}
+	// The separators may be much larger than the joined strings:
+	if err := thread.checkElems(Len(iterable), int64(len(recv))); err != nil {
+		return nil, err
+	}
 	iter := iterable.Iterate()
 	defer iter.Done()
 	var buf bytes.Buffer
@@ -1807,7 +2005,7 @@ func string_join(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value
 		}
 		buf.WriteString(s)
 	}
-	return String(buf.String()), nil
+	return thread.allocated(String(buf.String()))
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·lower
@@ -1815,7 +2013,7 @@ func string_lower(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Valu
 	if err := UnpackPositionalArgs(fn.name, args, kwargs, 0); err != nil {
 		return nil, err
 	}
-	return String(strings.ToLower(string(fn.recv.(String)))), nil
+	return thread.allocated(String(strings.ToLower(string(fn.recv.(String)))))
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·lstrip
@@ -1863,7 +2061,16 @@ func string_replace(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Va
 	if err := UnpackPositionalArgs(fn.name, args, kwargs, 2, &old, &new, &count); err != nil {
 		return nil, err
 	}
-	return String(strings.Replace(recv, old, new, count)), nil
+	if len(new) > len(old) {
+		n := strings.Count(recv, old)
+		if count >= 0 && count < n {
+			n = count
+		}
+		if err := thread.CheckAllocs(addSize(int64(len(recv)), mulSize(int64(n), int64(len(new)-len(old))))); err != nil {
+			return nil, err
+		}
+	}
+	return thread.allocated(String(strings.Replace(recv, old, new, count)))
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·rfind
@@ -1969,7 +2176,7 @@ func string_title(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Valu
 	if err := UnpackPositionalArgs(fn.name, args, kwargs, 0); err != nil {
 		return nil, err
 	}
-	return String(strings.Title(strings.ToLower(string(fn.recv.(String))))), nil
+	return thread.allocated(String(strings.Title(strings.ToLower(string(fn.recv.(String))))))
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·upper
@@ -1977,7 +2184,7 @@ func string_upper(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Valu
 	if err := UnpackPositionalArgs(fn.name, args, kwargs, 0); err != nil {
 		return nil, err
 	}
-	return String(strings.ToUpper(string(fn.recv.(String)))), nil
+	return thread.allocated(String(strings.ToUpper(string(fn.recv.(String)))))
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·split
@@ -2027,7 +2234,7 @@ func string_split(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Valu
 	for i, x := range res {
 		list[i] = String(x)
 	}
-	return NewList(list), nil
+	return thread.allocated(NewList(list))
 }
 
 // Precondition: max >= 0.
@@ -2105,7 +2312,7 @@ func string_splitlines(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple)
 	for i, x := range lines {
 		list[i] = String(x)
 	}
-	return NewList(list), nil
+	return thread.allocated(NewList(list))
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#set·union.
@@ -95,7 +95,11 @@ var (
 	AllowSet            = false // allow the 'set' built-in
 	AllowGlobalReassign = false // allow reassignment to globals declared in same file (deprecated)
 	AllowBitwise        = false // allow bitwise operations (&, |, ^, ~, <<, and >>)
-	AllowTryExcept      = false // allow try/catch exception handling
+	AllowTryExcept      = false // allow try/except exception handling and raise statements
+	AllowSuspend        = false // allow the 'suspend' built-in
+	AllowFutures        = false // allow the 'defer' and 'await_all' built-ins
+	AllowGenerators     = false // allow yield statements within function bodies
+	AllowWhile          = false // allow while loops
 )
 
 // File resolves the specified file.
@@ -210,7 +214,9 @@ type resolver struct {
 	// pre-declared, either in this module or universally.
 	isPredeclared, isUniversal func(name string) bool
 
-	loops int // number of enclosing for loops
+	loops    int   // number of enclosing for loops
+	excepts  int   // number of enclosing except clauses within the current function
+	finallys []int // number of enclosing for loops of each enclosing finally clause within the current function
 
 	errors ErrorList
 }
@@ -361,6 +367,12 @@ func (r *resolver) useGlobal(id *syntax.Ident) binding {
 		if !AllowSet && id.Name == "set" {
 			r.errorf(id.NamePos, doesnt+"support sets")
 		}
+		if !AllowSuspend && id.Name == "suspend" {
+			r.errorf(id.NamePos, doesnt+"support suspension")
+		}
+		if !AllowFutures && (id.Name == "defer" || id.Name == "await_all") {
+			r.errorf(id.NamePos, doesnt+"support futures")
+		}
 	} else {
 		scope = Undefined
 		r.errorf(id.NamePos, "undefined: %s", id.Name)
@@ -398,6 +410,8 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 	case *syntax.BranchStmt:
 		if r.loops == 0 && (stmt.Token == syntax.BREAK || stmt.Token == syntax.CONTINUE) {
 			r.errorf(stmt.TokenPos, "%s not in a loop", stmt.Token)
+		} else if n := len(r.finallys); n > 0 && r.finallys[n-1] == r.loops && stmt.Token != syntax.PASS {
+			r.errorf(stmt.TokenPos, "%s statement within a finally clause", stmt.Token)
 		}
 
 	case *syntax.IfStmt:
@@ -443,6 +457,18 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 		r.stmts(stmt.Body)
 		r.loops--
 
+	case *syntax.WhileStmt:
+		if !AllowWhile {
+			r.errorf(stmt.While, doesnt+"support while loops")
+		}
+		if r.container().function == nil {
+			r.errorf(stmt.While, "while loop not within a function")
+		}
+		r.expr(stmt.Cond)
+		r.loops++
+		r.stmts(stmt.Body)
+		r.loops--
+
 	case *syntax.TryStmt:
 		if !AllowTryExcept {
 			r.errorf(stmt.Try, doesnt+"support try/except")
@@ -451,28 +477,70 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 			r.errorf(stmt.Try, "try statement is not within a function")
 		}
 		r.stmts(stmt.Body)
-		if stmt.ExceptionType != nil || stmt.ExceptionName != nil {
-			if stmt.ExceptionType == nil || stmt.ExceptionName == nil {
-				r.errorf(stmt.Except, "except statement must have both a type and name if either is present")
+		for _, except := range stmt.Excepts {
+			if except.Type != nil {
+				r.expr(except.Type)
+			} else if except.Name != nil {
+				r.errorf(except.Except, "except clause must have a type if it has a name")
+			}
+			if except.Name == nil {
+				r.excepts++
+				r.stmts(except.Body)
+				r.excepts--
+				continue
 			}
-			r.expr(stmt.ExceptionType)
 			const allowRebind = false
 			// Shadow the variable previously bound by the exception name, if necessary:
-			prev, inuse := r.env.bindings[stmt.ExceptionName.Name]
-			r.bind(stmt.ExceptionName, allowRebind)
-			r.stmts(stmt.Fallback)
-			r.unbind(stmt.ExceptionName)
+			prev, inuse := r.env.bindings[except.Name.Name]
+			r.bind(except.Name, allowRebind)
+			r.excepts++
+			r.stmts(except.Body)
+			r.excepts--
+			r.unbind(except.Name)
 			if inuse {
-				r.env.bindings[stmt.ExceptionName.Name] = prev
+				r.env.bindings[except.Name.Name] = prev
 			}
+		}
+		r.stmts(stmt.Else)
+		if stmt.Finally != nil {
+			// A finally clause may not be left by a break, continue or return statement,
+			// and does not re-raise the exception handled by an enclosing except clause:
+			excepts := r.excepts
+			r.excepts = 0
+			r.finallys = append(r.finallys, r.loops)
+			r.stmts(stmt.Finally)
+			r.finallys = r.finallys[:len(r.finallys)-1]
+			r.excepts = excepts
+		}
 
-		} else {
-			r.stmts(stmt.Fallback)
+	case *syntax.RaiseStmt:
+		if !AllowTryExcept {
+			r.errorf(stmt.Raise, doesnt+"support raise statements")
+		}
+		if stmt.X != nil {
+			r.expr(stmt.X)
+		} else if r.excepts == 0 {
+			r.errorf(stmt.Raise, "bare raise statement not within an except clause")
 		}
 
 	case *syntax.ReturnStmt:
 		if r.container().function == nil {
 			r.errorf(stmt.Return, "return statement not within a function")
+		} else if len(r.finallys) > 0 {
+			r.errorf(stmt.Return, "return statement within a finally clause")
+		}
+		if stmt.Result != nil {
+			r.expr(stmt.Result)
+		}
+
+	case *syntax.YieldStmt:
+		if !AllowGenerators {
+			r.errorf(stmt.Yield, doesnt+"support generators")
+		}
+		if fn := r.container().function; fn == nil {
+			r.errorf(stmt.Yield, "yield statement not within a function")
+		} else {
+			fn.Generator = true
 		}
 		if stmt.Result != nil {
 			r.expr(stmt.Result)
@@ -775,7 +843,11 @@ func (r *resolver) function(pos syntax.Position, name string, function *syntax.F
 	}
 	function.HasVarargs = seenVarargs
 	function.HasKwargs = seenKwargs
+	excepts, finallys := r.excepts, r.finallys
+	r.excepts = 0 // a nested function cannot re-raise the exception handled by its enclosing function
+	r.finallys = nil
 	r.stmts(function.Body)
+	r.excepts, r.finallys = excepts, finallys
 
 	// Resolve all uses of this function's local vars,
 	// and keep just the remaining uses of free/global vars.
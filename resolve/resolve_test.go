@@ -29,6 +29,9 @@ func TestResolve(t *testing.T) {
 		resolve.AllowFloat = option(chunk.Source, "float")
 		resolve.AllowSet = option(chunk.Source, "set")
 		resolve.AllowGlobalReassign = option(chunk.Source, "global_reassign")
+		resolve.AllowGenerators = option(chunk.Source, "generators")
+		resolve.AllowTryExcept = option(chunk.Source, "tryexcept")
+		resolve.AllowWhile = option(chunk.Source, "while")
 
 		if err := resolve.File(f, isPredeclared, isUniversal); err != nil {
 			for _, err := range err.(resolve.ErrorList) {
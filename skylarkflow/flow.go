@@ -0,0 +1,299 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package skylarkflow runs durable workflows written in Skylark.
+//
+// A workflow is a Skylark script which calls built-in functions that suspend
+// the thread, such as those returned by ActionBuiltin, whenever it awaits the
+// result of an external action. The Runner persists the encoded state of the
+// suspended thread in a Store, and resumes it by workflow ID once the result
+// of the pending action arrives, possibly in another process.
+package skylarkflow
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/skylark"
+)
+
+// Status is the status of a workflow.
+type Status int
+
+const (
+	Suspended Status = iota + 1 // awaiting the result of its pending action
+	Completed                   // finished successfully
+	Failed                      // finished with an error
+)
+
+var statusNames = [...]string{
+	Suspended: "suspended",
+	Completed: "completed",
+	Failed:    "failed",
+}
+
+func (s Status) String() string {
+	if s > 0 && int(s) < len(statusNames) {
+		return statusNames[s]
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+var (
+	ErrExists       = errors.New("skylarkflow: workflow already exists")
+	ErrNotSuspended = errors.New("skylarkflow: workflow is not suspended")
+	ErrBusy         = errors.New("skylarkflow: workflow is being run")
+)
+
+// An Action is the call of a built-in function which suspended a workflow.
+type Action struct {
+	Name    string          // name of the built-in function
+	Args    skylark.Tuple   // positional arguments
+	Kwargs  []skylark.Tuple // keyword arguments, as (name, value) pairs
+	Attempt int             // number of the current attempt, starting from 1
+}
+
+// A Result describes the state of a workflow after it was run.
+type Result struct {
+	ID      string
+	Status  Status
+	Pending *Action            // pending action of a suspended workflow
+	Globals skylark.StringDict // globals of a workflow which completed during the run
+	Err     error              // error of a failed workflow
+}
+
+// ActionBuiltin returns a built-in function which suspends the workflow calling it.
+// The workflow is resumed with the result of the action as the function's return value.
+func ActionBuiltin(name string) *skylark.Builtin {
+	return skylark.NewBuiltin(name, func(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+		thread.Suspendable(args, kwargs)
+		return skylark.None, nil
+	})
+}
+
+// A Runner runs workflows, persisting their state in a Store.
+// A Runner is safe for concurrent use, provided its fields are not modified.
+//
+// A workflow is run by one call of a Runner at a time, but runners in other processes
+// may run it concurrently if they share the store. The records of workflows are saved
+// by compare-and-swap, hence only the first of such runs is saved, and the others fail
+// with ErrConflict; the actions they started are not undone.
+type Runner struct {
+	Store       Store              // persistent state of workflows (required)
+	Predeclared skylark.StringDict // predeclared values of workflow scripts
+
+	// Load and Print are assigned to the threads of workflows, see skylark.Thread.
+	Load  func(thread *skylark.Thread, module string) (skylark.StringDict, error)
+	Print func(thread *skylark.Thread, msg string)
+
+	// MaxAttempts is the number of times an action may fail before its error is raised
+	// within the workflow. Values below 1 are treated as a single attempt.
+	MaxAttempts int
+
+	// Signer, if non-nil, signs the encoded states of workflows, and verifies them before they are resumed.
+	Signer skylark.Signer
+
+	// Types holds the decoders of the custom types in the states of workflows.
+	// If nil, skylark.DefaultTypes is used.
+	Types *skylark.TypeRegistry
+
+	mu     sync.Mutex
+	active map[string]bool // IDs of the workflows being run
+}
+
+// Start runs a new workflow until it suspends or finishes.
+func (r *Runner) Start(id, filename string, src interface{}) (*Result, error) {
+	if err := r.acquire(id); err != nil {
+		return nil, err
+	}
+	defer r.release(id)
+	if _, err := r.Store.Load(id); err == nil {
+		return nil, ErrExists
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+	thread := r.newThread()
+	globals, err := skylark.ExecFile(thread, filename, src, r.Predeclared)
+	result, err := r.settle(&Record{ID: id}, thread, globals, err)
+	if err == ErrConflict {
+		// The workflow was started by another runner in the meantime:
+		return nil, ErrExists
+	}
+	return result, err
+}
+
+// Resume resumes a suspended workflow with the result of its pending action,
+// and runs it until it suspends again or finishes.
+func (r *Runner) Resume(id string, result skylark.Value) (*Result, error) {
+	if err := r.acquire(id); err != nil {
+		return nil, err
+	}
+	defer r.release(id)
+	record, thread, err := r.loadSuspended(id)
+	if err != nil {
+		return nil, err
+	}
+	record.Attempts = 0
+	globals, err := skylark.Resume(thread, result)
+	return r.settle(record, thread, globals, err)
+}
+
+// Fail reports the failure of the pending action of a suspended workflow.
+// The action remains pending, to be retried, until it has failed MaxAttempts times.
+// The error is then raised within the workflow, which runs until it suspends again
+// or finishes. Errors which are not Skylark exceptions are raised as IOErrors.
+func (r *Runner) Fail(id string, cause error) (*Result, error) {
+	if err := r.acquire(id); err != nil {
+		return nil, err
+	}
+	defer r.release(id)
+	record, thread, err := r.loadSuspended(id)
+	if err != nil {
+		return nil, err
+	}
+	if record.Attempts+1 < r.MaxAttempts {
+		record.Attempts++
+		if err := r.Store.Save(record); err != nil {
+			return nil, err
+		}
+		return &Result{ID: id, Status: Suspended, Pending: pendingAction(thread, record.Attempts)}, nil
+	}
+	exception, ok := cause.(skylark.Exception)
+	if !ok {
+		exception = skylark.NewIOError(cause)
+	}
+	record.Attempts = 0
+	globals, err := skylark.ResumeWithError(thread, exception)
+	return r.settle(record, thread, globals, err)
+}
+
+// Get returns the current state of a workflow.
+// The globals of completed workflows are only reported by the run which completes them.
+func (r *Runner) Get(id string) (*Result, error) {
+	record, err := r.Store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{ID: id, Status: record.Status}
+	switch record.Status {
+	case Suspended:
+		thread, err := r.decode(record)
+		if err != nil {
+			return nil, err
+		}
+		result.Pending = pendingAction(thread, record.Attempts)
+	case Failed:
+		result.Err = errors.New(record.Error)
+	}
+	return result, nil
+}
+
+// Delete removes a workflow which is not being run.
+func (r *Runner) Delete(id string) error {
+	if err := r.acquire(id); err != nil {
+		return err
+	}
+	defer r.release(id)
+	return r.Store.Delete(id)
+}
+
+func (r *Runner) types() *skylark.TypeRegistry {
+	if r.Types == nil {
+		return skylark.DefaultTypes
+	}
+	return r.Types
+}
+
+func (r *Runner) newThread() *skylark.Thread {
+	return &skylark.Thread{Load: r.Load, Print: r.Print}
+}
+
+// loadSuspended loads a suspended workflow and decodes its thread.
+func (r *Runner) loadSuspended(id string) (*Record, *skylark.Thread, error) {
+	record, err := r.Store.Load(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if record.Status != Suspended {
+		return nil, nil, ErrNotSuspended
+	}
+	thread, err := r.decode(record)
+	if err != nil {
+		return nil, nil, err
+	}
+	return record, thread, nil
+}
+
+func (r *Runner) decode(record *Record) (*skylark.Thread, error) {
+	dec := r.types().NewDecoder(record.Snapshot, r.Predeclared)
+	if r.Signer != nil {
+		dec.VerifyWith(r.Signer)
+	}
+	thread, err := dec.DecodeState()
+	if err != nil {
+		return nil, fmt.Errorf("skylarkflow: cannot decode workflow %s: %v", record.ID, err)
+	}
+	thread.Load, thread.Print = r.Load, r.Print
+	return thread, nil
+}
+
+// settle saves the record of a workflow after it was run, according to whether
+// its thread was suspended or it finished.
+func (r *Runner) settle(record *Record, thread *skylark.Thread, globals skylark.StringDict, err error) (*Result, error) {
+	result := &Result{ID: record.ID}
+	record.Snapshot, record.Error = nil, ""
+	switch {
+	case err != nil:
+		record.Status, result.Status, result.Err = Failed, Failed, err
+		record.Error = err.Error()
+	case thread.SuspendedFrame() != nil:
+		enc := r.types().NewEncoder()
+		if r.Signer != nil {
+			enc.SignWith(r.Signer)
+		}
+		if record.Snapshot, err = enc.EncodeState(thread); err != nil {
+			return nil, fmt.Errorf("skylarkflow: cannot encode workflow %s: %v", record.ID, err)
+		}
+		record.Status, result.Status = Suspended, Suspended
+		result.Pending = pendingAction(thread, record.Attempts)
+	default:
+		record.Status, result.Status, result.Globals = Completed, Completed, globals
+	}
+	if err := r.Store.Save(record); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// pendingAction returns the call which suspended the thread.
+func pendingAction(thread *skylark.Thread, attempts int) *Action {
+	thread.Resumable()
+	frame := thread.TopFrame()
+	return &Action{
+		Name:    frame.Callable().Name(),
+		Args:    frame.Args(),
+		Kwargs:  frame.Kwargs(),
+		Attempt: attempts + 1,
+	}
+}
+
+func (r *Runner) acquire(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active[id] {
+		return ErrBusy
+	}
+	if r.active == nil {
+		r.active = make(map[string]bool)
+	}
+	r.active[id] = true
+	return nil
+}
+
+func (r *Runner) release(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.active, id)
+}
@@ -0,0 +1,204 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylarkflow_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/skylark"
+	"github.com/google/skylark/resolve"
+	"github.com/google/skylark/skylarkflow"
+)
+
+func init() {
+	resolve.AllowTryExcept = true
+}
+
+const orders = `
+def order(item):
+	price = fetch_price(item)
+	try:
+		return charge(item, amount=price)
+	except IOError as e:
+		return "failed: " + str(e)
+
+a = order("book")
+b = order("pen")
+`
+
+func TestRunner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skylarkflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, store := range map[string]skylarkflow.Store{
+		"memory": skylarkflow.NewMemoryStore(),
+		"file":   skylarkflow.NewFileStore(dir),
+	} {
+		// Each step uses a new runner, as if the workflow was resumed by another process:
+		runner := func() *skylarkflow.Runner {
+			return &skylarkflow.Runner{
+				Store: store,
+				Predeclared: skylark.StringDict{
+					"fetch_price": skylarkflow.ActionBuiltin("fetch_price"),
+					"charge":      skylarkflow.ActionBuiltin("charge"),
+					"IOError":     skylark.IOErrorClass,
+				},
+				MaxAttempts: 2,
+				Signer:      skylark.NewHMACSigner([]byte("secret")),
+			}
+		}
+		expect := func(result *skylarkflow.Result, err error, action string, attempt int) {
+			t.Helper()
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if result.Status != skylarkflow.Suspended || result.Pending.Name != action || result.Pending.Attempt != attempt {
+				t.Fatalf("%s: expected workflow to await attempt %d of %s, found %s %+v", name, attempt, action, result.Status, result.Pending)
+			}
+		}
+
+		result, err := runner().Start("order-1", "orders.sky", orders)
+		expect(result, err, "fetch_price", 1)
+		if got := result.Pending.Args.String(); got != `("book",)` {
+			t.Errorf("%s: expected arguments of pending action, found %s", name, got)
+		}
+		if _, err = runner().Start("order-1", "orders.sky", orders); err != skylarkflow.ErrExists {
+			t.Errorf("%s: expected existing workflow not to be restarted, found %v", name, err)
+		}
+
+		result, err = runner().Resume("order-1", skylark.MakeInt(10))
+		expect(result, err, "charge", 1)
+		if kwargs := result.Pending.Kwargs; len(kwargs) != 1 || kwargs[0][1] != skylark.MakeInt(10) {
+			t.Errorf("%s: expected keyword arguments of pending action, found %v", name, kwargs)
+		}
+		// The action is retried once, before its error is raised within the workflow:
+		result, err = runner().Fail("order-1", errors.New("declined"))
+		expect(result, err, "charge", 2)
+		result, err = runner().Get("order-1")
+		expect(result, err, "charge", 2)
+		result, err = runner().Fail("order-1", errors.New("declined"))
+		expect(result, err, "fetch_price", 1)
+
+		result, err = runner().Resume("order-1", skylark.MakeInt(2))
+		expect(result, err, "charge", 1)
+		result, err = runner().Resume("order-1", skylark.String("receipt"))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if result.Status != skylarkflow.Completed {
+			t.Fatalf("%s: expected workflow to complete, found %s", name, result.Status)
+		}
+		if a, b := result.Globals["a"], result.Globals["b"]; a != skylark.String("failed: IOError: declined") || b != skylark.String("receipt") {
+			t.Errorf("%s: expected results of workflow, found a=%v b=%v", name, a, b)
+		}
+		if _, err = runner().Resume("order-1", skylark.None); err != skylarkflow.ErrNotSuspended {
+			t.Errorf("%s: expected completed workflow not to be resumed, found %v", name, err)
+		}
+
+		// Uncaught errors cause the workflow to fail:
+		result, err = runner().Start("order-2", "orders.sky", orders)
+		expect(result, err, "fetch_price", 1)
+		result, err = runner().Resume("order-2", skylark.None)
+		expect(result, err, "charge", 1)
+		result, err = runner().Fail("order-2", skylark.NewValueError(errors.New("invalid amount")))
+		expect(result, err, "charge", 2)
+		if result, err = runner().Fail("order-2", skylark.NewValueError(errors.New("invalid amount"))); err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != skylarkflow.Failed || result.Err == nil {
+			t.Fatalf("%s: expected workflow to fail, found %s", name, result.Status)
+		}
+		if result, err = runner().Get("order-2"); err != nil || result.Status != skylarkflow.Failed || result.Err.Error() != "invalid amount" {
+			t.Errorf("%s: expected failure of workflow to be persisted, found %+v, err=%v", name, result, err)
+		}
+		if err = runner().Delete("order-2"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = runner().Get("order-2"); err != skylarkflow.ErrNotFound {
+			t.Errorf("%s: expected deleted workflow not to be found, found %v", name, err)
+		}
+	}
+}
+
+func TestConcurrentRunners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skylarkflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const script = `
+def run():
+	first = fetch("first")
+	note(first)
+	return fetch("second")
+
+result = run()
+`
+	for name, store := range map[string]skylarkflow.Store{
+		"memory": skylarkflow.NewMemoryStore(),
+		"file":   skylarkflow.NewFileStore(dir),
+	} {
+		// Two runners share the store, as if they were in different processes. While the
+		// first one resumes the workflow, the second one resumes it too, and saves it first:
+		var first, second *skylarkflow.Runner
+		var secondErr error
+		runner := func() *skylarkflow.Runner {
+			return &skylarkflow.Runner{
+				Store: store,
+				Predeclared: skylark.StringDict{
+					"fetch": skylarkflow.ActionBuiltin("fetch"),
+					"note": skylark.NewBuiltin("note", func(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+						if args[0] == skylark.String("from first") {
+							_, secondErr = second.Resume("job", skylark.String("from second"))
+						}
+						return skylark.None, nil
+					}),
+				},
+			}
+		}
+		first, second = runner(), runner()
+
+		if _, err := first.Start("job", "job.sky", script); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := first.Resume("job", skylark.String("from first")); err != skylarkflow.ErrConflict {
+			t.Errorf("%s: expected conflicting run not to be saved, found %v", name, err)
+		}
+		if secondErr != nil {
+			t.Fatalf("%s: %v", name, secondErr)
+		}
+		// The workflow proceeds from the run which was saved:
+		result, err := first.Resume("job", skylark.String("done"))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := result.Globals["result"]; result.Status != skylarkflow.Completed || got != skylark.String("done") {
+			t.Errorf("%s: expected workflow to complete, found %s %v", name, result.Status, got)
+		}
+
+		// A stale record is not saved:
+		record, err := store.Load("job")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stale := *record
+		if err := store.Save(record); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := store.Save(&stale); err != skylarkflow.ErrConflict {
+			t.Errorf("%s: expected stale record not to be saved, found %v", name, err)
+		}
+		if err := store.Save(&skylarkflow.Record{ID: "job"}); err != skylarkflow.ErrConflict {
+			t.Errorf("%s: expected existing record not to be created, found %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylarkflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned by a Store when no workflow has the requested ID.
+	ErrNotFound = errors.New("skylarkflow: workflow not found")
+	// ErrConflict is returned by a Store when a record was saved by another writer
+	// since it was loaded.
+	ErrConflict = errors.New("skylarkflow: workflow was modified concurrently")
+)
+
+// A Record is the persistent state of a workflow.
+type Record struct {
+	ID       string `json:"id"`
+	Status   Status `json:"status"`
+	Snapshot []byte `json:"snapshot,omitempty"` // encoded state of the suspended thread
+	Attempts int    `json:"attempts,omitempty"` // failed attempts of the pending action
+	Error    string `json:"error,omitempty"`    // error of a failed workflow
+	Version  int64  `json:"version"`            // number of times the record was saved
+}
+
+// A Store persists the records of workflows.
+// Implementations must be safe for concurrent use, including by several processes
+// if the store is shared by them.
+type Store interface {
+	// Load returns the record of the workflow with the given ID, or ErrNotFound.
+	Load(id string) (*Record, error)
+	// Save creates or replaces the record of a workflow, provided its version is that
+	// of the stored record, or zero if there is none; otherwise it returns ErrConflict.
+	// The version of the saved record is then incremented.
+	Save(record *Record) error
+	// Delete removes the record of the workflow with the given ID, if any.
+	Delete(id string) error
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+// NewMemoryStore returns a Store which holds records in memory.
+func NewMemoryStore() Store {
+	return &memoryStore{records: make(map[string]Record)}
+}
+
+func (s *memoryStore) Load(id string) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &record, nil
+}
+
+func (s *memoryStore) Save(record *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record.Version != s.records[record.ID].Version {
+		return ErrConflict
+	}
+	record.Version++
+	s.records[record.ID] = *record
+	return nil
+}
+
+func (s *memoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, id)
+	return nil
+}
+
+type fileStore struct {
+	dir string
+}
+
+// Records are saved while holding a lock file, which is broken once it is older than
+// staleLock, as it was then left by a writer which crashed.
+const (
+	staleLock   = 10 * time.Second
+	lockTimeout = 2 * staleLock
+)
+
+// NewFileStore returns a Store which holds each record as a JSON file in the given directory.
+// The directory may be shared by several processes.
+func NewFileStore(dir string) Store {
+	return &fileStore{dir: dir}
+}
+
+func (s *fileStore) path(id string) string {
+	// Escaping the ID ensures it is a valid file name within the directory:
+	return filepath.Join(s.dir, url.PathEscape(id)+".json")
+}
+
+func (s *fileStore) Load(id string) (*Record, error) {
+	data, err := ioutil.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	record := &Record{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (s *fileStore) Save(record *Record) error {
+	unlock, err := s.lock(record.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	var version int64
+	if stored, err := s.Load(record.ID); err == nil {
+		version = stored.Version
+	} else if err != ErrNotFound {
+		return err
+	}
+	if record.Version != version {
+		return ErrConflict
+	}
+	saved := *record
+	saved.Version++
+	data, err := json.Marshal(&saved)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that a record is never partially written:
+	f, err := ioutil.TempFile(s.dir, url.PathEscape(record.ID)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err = os.Rename(f.Name(), s.path(record.ID)); err != nil {
+		return err
+	}
+	record.Version = saved.Version
+	return nil
+}
+
+func (s *fileStore) Delete(id string) error {
+	unlock, err := s.lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// lock acquires the lock file of the workflow with the given ID, and returns
+// the function which releases it.
+func (s *fileStore) lock(id string) (unlock func(), err error) {
+	path := filepath.Join(s.dir, url.PathEscape(id)+".lock")
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleLock {
+			os.Remove(path)
+		} else if time.Since(start) > lockTimeout {
+			return nil, fmt.Errorf("skylarkflow: cannot lock workflow %s: %s exists", id, path)
+		}
+	}
+}
@@ -254,7 +254,7 @@ func (s *Struct) Attr(name string) (skylark.Value, error) {
 	if s.constructor != Default {
 		ctor = s.constructor.String() + " "
 	}
-	return nil, fmt.Errorf("%sstruct has no .%s attribute", ctor, name)
+	return nil, skylark.AttributeErrorf("%sstruct has no .%s attribute", ctor, name)
 }
 
 func writeProtoStruct(out *bytes.Buffer, depth int, s *Struct) error {
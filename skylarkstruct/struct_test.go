@@ -48,7 +48,7 @@ func TestStructCodec(t *testing.T) {
 		"c": skylark.String("c"),
 	}))
 
-	dec := skylark.NewDecoder(enc.Bytes())
+	dec := skylark.NewDecoder(enc.Bytes(), nil)
 	v, err := dec.DecodeValue()
 	if err != nil {
 		t.Error(err)
@@ -5,10 +5,21 @@
 package skylark_test
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	. "github.com/google/skylark"
+	"github.com/google/skylark/internal/compile"
 	"github.com/google/skylark/resolve"
 	"github.com/google/skylark/skylarkstruct"
 	"github.com/google/skylark/skylarktest"
@@ -32,9 +43,6 @@ func TestSuspendResume(t *testing.T) {
 				thread.Suspendable(args, kwargs)
 				return None, nil
 			}),
-		"Exception":  BaseException,
-		"TypeError":  NewTypeError(fmt.Errorf("some type error")),
-		"ValueError": NewValueError(fmt.Errorf("some value error")),
 		"log_error": NewBuiltin("log_error",
 			func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 				if len(args) == 2 {
@@ -42,30 +50,24 @@ func TestSuspendResume(t *testing.T) {
 				}
 				return None, nil
 			}),
-		"raise_value_error": NewBuiltin("raise_value_error",
-			func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
-				var arg Value = String("")
-				if len(args) > 0 {
-					arg = args[0]
-				}
-				t.Logf("raising value error...%v", arg)
-				return None, NewValueError(fmt.Errorf("wrong value"))
-			}),
 	}
 
+	for name, class := range ExceptionClasses() {
+		predeclared[name] = class
+	}
 	script := `
 magic_index = 3
 def long_running(i):
 	try:
 		if i == magic_index:
-			raise_value_error(42)
+			raise ValueError("wrong value")
 	except ValueError as e:
 		return long_running_builtin("the_argument", the_key="the_value")
 	try:
 		try:
-			raise_value_error(i)
+			raise ValueError("wrong value: %d" % i)
 		except ValueError as e:
-			raise_value_error(-i)
+			raise ValueError("wrong value: %d" % -i)
 	except Exception as e:
 		log_error(-i, str(e))
 
@@ -79,13 +81,13 @@ def looptry():
 		except:
 			continue
 	if len(x) != 6:
-		raise_value_error()
+		raise ValueError("wrong length: %d" % len(x))
 
 	my_set = {x for x in range(0,3)}
 	if type(my_set) != "set":
-		raise_value_error(type(my_set))
+		raise ValueError("wrong type: " + type(my_set))
 	if len(my_set) != 3:
-		raise_value_error(len(my_set))
+		raise ValueError("wrong length: %d" % len(my_set))
 
 looptry()
 
@@ -132,6 +134,9 @@ struct_abc = struct_val.a + struct_val.b + struct_val.c
 	}
 	compressedSize := len(snapshot)
 	t.Logf("Encoded/compressed snapshot size: %dB", len(snapshot))
+	if _, err := DecodeState(snapshot, predeclared); err != nil {
+		t.Fatalf("Error decoding compressed snapshot: %v", err)
+	}
 
 	snapshot, err = NewEncoder().DisableCompression().EncodeState(thread)
 	if err != nil {
@@ -195,3 +200,2232 @@ struct_abc = struct_val.a + struct_val.b + struct_val.c
 		t.Fatalf("Expected injected return value to be returned from suspending function after resuming")
 	}
 }
+
+func TestResumeWithError(t *testing.T) {
+	filename := "suspend_error.sky"
+
+	predeclared := StringDict{
+		"fetch": NewBuiltin("fetch",
+			func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+				thread.Suspendable(args, kwargs)
+				return None, nil
+			}),
+	}
+	for name, class := range ExceptionClasses() {
+		predeclared[name] = class
+	}
+
+	script := `
+def guarded():
+	try:
+		return fetch("guarded")
+	except ValueError as e:
+		return "caught: " + str(e)
+
+response = guarded()
+`
+	suspend := func() *Thread {
+		thread := &Thread{Load: load}
+		skylarktest.SetReporter(thread, t)
+		if _, err := ExecFile(thread, filename, script, predeclared); err != nil {
+			t.Fatal(err)
+		}
+		if thread.SuspendedFrame() == nil {
+			t.Fatal("Expected thread to be suspended")
+		}
+		return thread
+	}
+	timeout := NewValueError(fmt.Errorf("timeout"))
+
+	// Resume directly without serialization/deserialization:
+	result, err := ResumeWithError(suspend(), timeout)
+	if err != nil {
+		t.Fatalf("Error after resuming suspended thread with an exception: %v", err)
+	}
+	if result["response"] != String("caught: ValueError: timeout") {
+		t.Fatalf("Expected injected exception to be caught by the suspended function, response=%v", result["response"])
+	}
+
+	// Resume after serialization/deserialization:
+	snapshot, err := EncodeState(suspend())
+	if err != nil {
+		t.Fatal(err)
+	}
+	thread, err := DecodeState(snapshot, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = ResumeWithError(thread, timeout)
+	if err != nil {
+		t.Fatalf("Error after resuming decoded thread with an exception: %v", err)
+	}
+	if result["response"] != String("caught: ValueError: timeout") {
+		t.Fatalf("Expected injected exception to be caught by the decoded function, response=%v", result["response"])
+	}
+
+	// An exception which doesn't match the handler is returned as an evaluation error:
+	_, err = ResumeWithError(suspend(), NewTypeError(fmt.Errorf("rejected")))
+	if _, ok := err.(*EvalError); !ok || err.Error() != "rejected" {
+		t.Fatalf("Expected uncaught exception to be returned as an evaluation error, found %v", err)
+	}
+}
+
+func TestSuspendResumeThroughBuiltins(t *testing.T) {
+	filename := "suspend_builtins.sky"
+
+	predeclared := StringDict{
+		"fetch": NewBuiltin("fetch",
+			func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+				thread.Suspendable(args, kwargs)
+				return None, nil
+			}),
+		"apply": NewResumableBuiltin("apply",
+			func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+				res, err := Call(thread, args[0], args[1:], nil)
+				if err != nil {
+					return nil, err
+				}
+				if thread.SuspendedFrame() != nil {
+					thread.SuspendCall(String("applied"))
+					return None, nil
+				}
+				return Tuple{res}, nil
+			},
+			func(thread *Thread, fn *Builtin, state Value, retval Value) (Value, error) {
+				if state != String("applied") {
+					return nil, fmt.Errorf("unexpected state %v", state)
+				}
+				return Tuple{retval}, nil
+			}),
+	}
+
+	script := `
+def rank(x):
+	return fetch(x)
+
+ordered = sorted(["b", "c", "a"], key=lambda x: rank(x))
+highest = max([1, 2, 3], key=rank)
+applied = apply(rank, "d")
+`
+	// Each suspension is answered by the rank of the argument, reversed:
+	ranks := map[Value]Value{
+		String("a"): MakeInt(3), String("b"): MakeInt(2), String("c"): MakeInt(1), String("d"): MakeInt(0),
+		MakeInt(1): MakeInt(3), MakeInt(2): MakeInt(1), MakeInt(3): MakeInt(2),
+	}
+	for _, roundtrip := range []bool{false, true} {
+		thread := &Thread{Load: load}
+		skylarktest.SetReporter(thread, t)
+		_, err := ExecFile(thread, filename, script, predeclared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result StringDict
+		for suspensions := 0; thread.SuspendedFrame() != nil; suspensions++ {
+			if suspensions > 10 {
+				t.Fatal("Expected thread to complete after resuming each suspension")
+			}
+			if roundtrip {
+				snapshot, err := EncodeState(thread)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if thread, err = DecodeState(snapshot, predeclared); err != nil {
+					t.Fatal(err)
+				}
+			}
+			thread.Resumable()
+			arg := thread.TopFrame().Args()[0]
+			if result, err = Resume(thread, ranks[arg]); err != nil {
+				t.Fatalf("Error after resuming suspended thread: %v", err)
+			}
+		}
+		if got := result["ordered"].String(); got != `["c", "b", "a"]` {
+			t.Errorf("Expected sorted values to be ordered by suspending key function, found %s", got)
+		}
+		if got := result["highest"].String(); got != "1" {
+			t.Errorf("Expected max value to be selected by suspending key function, found %s", got)
+		}
+		if got := result["applied"].String(); got != "(0,)" {
+			t.Errorf("Expected resumable builtin to complete after resumption, found %s", got)
+		}
+	}
+}
+
+// opaque is a Skylark value which cannot be encoded.
+type opaque struct{}
+
+func (*opaque) String() string        { return "opaque" }
+func (*opaque) Type() string          { return "opaque" }
+func (*opaque) Freeze()               {}
+func (*opaque) Truth() Bool           { return True }
+func (*opaque) Hash() (uint32, error) { return 0, nil }
+
+func TestEncodeUnencodableValue(t *testing.T) {
+	filename := "unencodable.sky"
+
+	predeclared := StringDict{
+		"fetch": NewBuiltin("fetch",
+			func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+				thread.Suspendable(args, kwargs)
+				return None, nil
+			}),
+		"open_handle": NewBuiltin("open_handle",
+			func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+				return &opaque{}, nil
+			}),
+	}
+
+	script := `
+def process():
+	handle = open_handle()
+	return fetch("data")
+
+result = process()
+`
+	suspend := func() *Thread {
+		thread := &Thread{Load: load}
+		skylarktest.SetReporter(thread, t)
+		if _, err := ExecFile(thread, filename, script, predeclared); err != nil {
+			t.Fatal(err)
+		}
+		if thread.SuspendedFrame() == nil {
+			t.Fatal("Expected thread to be suspended")
+		}
+		return thread
+	}
+
+	_, err := EncodeState(suspend())
+	uerr, ok := err.(*UnencodableValueError)
+	if !ok {
+		t.Fatalf("Expected an unencodable value error, found %v", err)
+	}
+	if uerr.GoType != "*skylark_test.opaque" || uerr.Location != "local variable handle of function process" {
+		t.Errorf("Expected error to name the type and location of the value, found %q", uerr.Error())
+	}
+
+	// In lossy mode, the value is replaced by None:
+	enc := NewEncoder().EnableLossyEncoding()
+	snapshot, err := enc.EncodeState(suspend())
+	if err != nil {
+		t.Fatalf("Expected lossy encoding to succeed, found %v", err)
+	}
+	if len(enc.Errors()) != 1 {
+		t.Errorf("Expected lossy encoding to report a single unencodable value, found %v", enc.Errors())
+	}
+	thread, err := DecodeState(snapshot, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := Resume(thread, String("done")); err != nil {
+		t.Fatal(err)
+	} else if result["result"] != String("done") {
+		t.Errorf("Expected decoded thread to complete, result=%v", result["result"])
+	}
+}
+
+func TestEncodeUnencodablePredeclared(t *testing.T) {
+	predeclared := StringDict{
+		"fetch": NewBuiltin("fetch",
+			func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+				thread.Suspendable(args, kwargs)
+				return None, nil
+			}),
+		"cfg":   &opaque{},
+		"limit": MakeInt(3),
+	}
+	script := `
+def process():
+	return (fetch("data"), str(cfg), limit)
+
+result = process()
+`
+	// The predeclared values supplied to the decoder take precedence over the encoded ones:
+	supplied := StringDict{"fetch": predeclared["fetch"], "cfg": predeclared["cfg"], "limit": MakeInt(4)}
+	forEachCodec(t, func(encode func(*Thread) ([]byte, error), decode func([]byte, StringDict) (*Thread, error)) {
+		thread := &Thread{Load: load}
+		if _, err := ExecFile(thread, "predeclared.sky", script, predeclared); err != nil {
+			t.Fatal(err)
+		}
+		snapshot, err := encode(thread)
+		if err != nil {
+			t.Fatalf("Expected unencodable predeclared value to be encoded, found %v", err)
+		}
+		if thread, err = decode(snapshot, supplied); err != nil {
+			t.Fatal(err)
+		}
+		if result, err := Resume(thread, String("done")); err != nil {
+			t.Fatal(err)
+		} else if got := result["result"].String(); got != `("done", "opaque", 4)` {
+			t.Errorf("Expected the supplied predeclared values, result=%s", got)
+		}
+	})
+}
+
+// versionHeader returns the version header of an encoded state.
+func versionHeader(v SnapshotVersion) []byte {
+	header := []byte{T_Version}
+	var b [binary.MaxVarintLen64]byte
+	for _, n := range []uint64{v.Codec, v.Compiler, uint64(v.Opcodes), uint64(v.Tags)} {
+		header = append(header, b[:binary.PutUvarint(b[:], n)]...)
+	}
+	return header
+}
+
+func TestSnapshotVersion(t *testing.T) {
+	predeclared := StringDict{
+		"fetch": NewBuiltin("fetch",
+			func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+				thread.Suspendable(args, kwargs)
+				return None, nil
+			}),
+	}
+	thread := &Thread{Load: load}
+	skylarktest.SetReporter(thread, t)
+	if _, err := ExecFile(thread, "version.sky", "result = fetch()\n", predeclared); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := EncodeState(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := CurrentSnapshotVersion()
+	if version, err := ReadSnapshotVersion(snapshot); err != nil || version != current {
+		t.Fatalf("Expected snapshot to be encoded with version (%v), found (%v), err=%v", current, version, err)
+	}
+
+	// Rewrite the header as if the state had been encoded by another compiler:
+	header := versionHeader(current)
+	older := current
+	older.Compiler += 1000
+	body := snapshot[len(CodecMagic)+len(header):]
+	outdated := append(append([]byte(CodecMagic), versionHeader(older)...), body...)
+	_, err = DecodeState(outdated, predeclared)
+	if verr, ok := err.(*VersionMismatchError); !ok || verr.Found != older || verr.Expected != current {
+		t.Fatalf("Expected version mismatch error while decoding outdated snapshot, found %v", err)
+	}
+
+	// A registered migration upgrades the outdated state:
+	migrated := false
+	err = RegisterMigration(older, func(body []byte) (SnapshotVersion, []byte, error) {
+		if !bytes.HasPrefix(body, []byte{T_Toplevel}) {
+			return older, nil, fmt.Errorf("unexpected body")
+		}
+		migrated = true
+		return current, body, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thread, err = DecodeState(outdated, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	if !migrated {
+		t.Error("Expected migration to be applied to outdated snapshot")
+	}
+	if result, err := Resume(thread, String("done")); err != nil || result["result"] != String("done") {
+		t.Errorf("Expected migrated thread to complete, result=%v, err=%v", result["result"], err)
+	}
+
+	// Migrations may be registered while other states are decoded:
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			other := current
+			other.Codec += uint64(1000 + i)
+			if err := RegisterMigration(other, func(body []byte) (SnapshotVersion, []byte, error) {
+				return current, body, nil
+			}); err != nil {
+				t.Error(err)
+			}
+			state := append(append([]byte(CodecMagic), versionHeader(other)...), body...)
+			if _, err := DecodeState(state, predeclared); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestSignedSnapshot(t *testing.T) {
+	predeclared := StringDict{
+		"fetch": NewBuiltin("fetch",
+			func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+				thread.Suspendable(args, kwargs)
+				return None, nil
+			}),
+	}
+	thread := &Thread{Load: load}
+	skylarktest.SetReporter(thread, t)
+	if _, err := ExecFile(thread, "signed.sky", "result = fetch()\n", predeclared); err != nil {
+		t.Fatal(err)
+	}
+	signer := NewHMACSigner([]byte("secret"))
+	snapshot, err := NewEncoder().SignWith(signer).EncodeState(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := EncodeState(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := NewDecoder(snapshot, predeclared).VerifyWith(signer).DecodeState()
+	if err != nil {
+		t.Fatalf("Expected signed snapshot to be verified, found %v", err)
+	}
+	if result, err := Resume(decoded, String("done")); err != nil || result["result"] != String("done") {
+		t.Errorf("Expected verified thread to complete, result=%v, err=%v", result["result"], err)
+	}
+	if _, err = DecodeState(snapshot, predeclared); err != nil {
+		t.Errorf("Expected signed snapshot to be decoded without verification, found %v", err)
+	}
+
+	tampered := append([]byte(nil), snapshot...)
+	tampered[len(tampered)-1] ^= 0xff
+	for name, test := range map[string]struct {
+		snapshot []byte
+		verifier Signer
+	}{
+		"tampered":  {tampered, signer},
+		"wrong key": {snapshot, NewHMACSigner([]byte("other"))},
+		"unsigned":  {unsigned, signer},
+	} {
+		if _, err = NewDecoder(test.snapshot, predeclared).VerifyWith(test.verifier).DecodeState(); err != ErrBadSignature {
+			t.Errorf("Expected %s snapshot to be rejected with a bad signature error, found %v", name, err)
+		}
+	}
+}
+
+func TestSnapshotStreaming(t *testing.T) {
+	predeclared := StringDict{
+		"fetch": NewBuiltin("fetch",
+			func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+				thread.Suspendable(args, kwargs)
+				return None, nil
+			}),
+	}
+	script := `
+items = ["item %d" % i for i in range(100)]
+result = fetch(items)
+`
+	signer := NewHMACSigner([]byte("secret"))
+	for name, test := range map[string]struct {
+		enc *Encoder
+		tag byte
+	}{
+		"none":    {NewEncoder().DisableCompression(), T_Uncompressed},
+		"huffman": {NewEncoder().EnableHuffmanCompression(), T_HuffmanCompressed},
+		"deflate": {NewEncoder().EnableDeflateCompression(9), T_DeflateCompressed},
+		"gzip":    {NewEncoder().EnableGzipCompression(1), T_GzipCompressed},
+		"signed":  {NewEncoder().EnableGzipCompression(5).SignWith(signer), T_GzipCompressed},
+	} {
+		thread := &Thread{Load: load}
+		skylarktest.SetReporter(thread, t)
+		if _, err := ExecFile(thread, "streaming.sky", script, predeclared); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := test.enc.EncodeStateTo(&buf, thread); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		header := append([]byte(CodecMagic), versionHeader(CurrentSnapshotVersion())...)
+		var b [binary.MaxVarintLen64]byte
+		header = append(append(header, T_Steps), b[:binary.PutUvarint(b[:], thread.Steps())]...)
+		header = append(append(header, T_Allocs), b[:binary.PutUvarint(b[:], thread.Allocs())]...)
+		if buf.Bytes()[len(header)] != test.tag && name != "signed" {
+			t.Errorf("%s: expected compression tag %d after header, found %d", name, test.tag, buf.Bytes()[len(header)])
+		}
+		dec := NewDecoder(nil, predeclared)
+		if name == "signed" {
+			dec.VerifyWith(signer)
+		}
+		decoded, err := dec.DecodeStateFrom(&buf)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if result, err := Resume(decoded, String("done")); err != nil || result["result"] != String("done") {
+			t.Errorf("%s: expected decoded thread to complete, result=%v, err=%v", name, result["result"], err)
+		}
+	}
+
+	// The encoder holds a chunk of a large state at a time, unless it is Huffman-compressed,
+	// and the decoder decodes the start of the state, including the predeclared point, before
+	// it has read the rest:
+	var read *countingReader
+	readAtOrigin := 0
+	types := NewTypeRegistry()
+	types.RegisterDecoder("point", func(dec *Decoder) (Value, error) {
+		readAtOrigin = read.n
+		return decodePoint(1)(dec)
+	})
+	predeclared["origin"] = &point{1, 2, 1}
+	large := `
+first = origin
+items = ["item %d" % i for i in range(100000)]
+result = fetch(items)
+`
+	thread := &Thread{Load: load}
+	if _, err := ExecFile(thread, "large.sky", large, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	for name, test := range map[string]struct {
+		enc      *Encoder
+		streamed bool
+	}{
+		"none":    {types.NewEncoder().DisableCompression(), true},
+		"huffman": {types.NewEncoder().EnableHuffmanCompression(), false},
+		"gzip":    {types.NewEncoder().EnableGzipCompression(1), true},
+	} {
+		var buf bytes.Buffer
+		if err := test.enc.EncodeStateTo(&buf, thread); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if streamed := test.enc.BufferSize() < 1<<17; streamed != test.streamed {
+			t.Errorf("%s: expected streamed=%t, found a buffer of %d bytes", name, test.streamed, test.enc.BufferSize())
+		}
+		size := buf.Len()
+		read = &countingReader{r: &buf}
+		decoded, err := types.NewDecoder(nil, predeclared).DecodeStateFrom(read)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if readAtOrigin > size/2 {
+			t.Errorf("%s: expected a streamed state, found the point decoded after reading %d of %d bytes", name, readAtOrigin, size)
+		}
+		if result, err := Resume(decoded, String("done")); err != nil || result["result"] != String("done") {
+			t.Errorf("%s: expected decoded thread to complete, result=%v, err=%v", name, result["result"], err)
+		}
+	}
+}
+
+// A countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestSuspendAfterReturn(t *testing.T) {
+	predeclared := StringDict{
+		"fetch": NewBuiltin("fetch",
+			func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+				thread.Suspendable(args, kwargs)
+				return None, nil
+			}),
+	}
+	script := `
+def key(i):
+	return "key %d" % i
+
+def run():
+	k = key(1)
+	return fetch(k)
+
+result = run()
+`
+	thread := &Thread{Load: load}
+	skylarktest.SetReporter(thread, t)
+	if _, err := ExecFile(thread, "return.sky", script, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := EncodeState(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeState(snapshot, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The builtin called after key has returned is called by run, not by key:
+	if caller := decoded.Caller().Callable().Name(); caller != "run" {
+		t.Fatalf("expected fetch to be called by run, found %s", caller)
+	}
+	if result, err := Resume(decoded, String("done")); err != nil || result["result"] != String("done") {
+		t.Errorf("expected decoded thread to complete, result=%v, err=%v", result["result"], err)
+	}
+}
+
+func TestProgramRegistry(t *testing.T) {
+	predeclared := StringDict{
+		"fetch": NewBuiltin("fetch",
+			func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+				thread.Suspendable(args, kwargs)
+				return None, nil
+			}),
+	}
+	script := `
+def double(x):
+	return 2 * x
+
+def workflow(n):
+	return [fetch(n)] + [double(x) for x in range(n)]
+
+result = workflow(3)
+`
+	suspend := func() *Thread {
+		thread := &Thread{Load: load}
+		skylarktest.SetReporter(thread, t)
+		if _, err := ExecFile(thread, "registry.sky", script, predeclared); err != nil {
+			t.Fatal(err)
+		}
+		return thread
+	}
+
+	dir, err := ioutil.TempDir("", "skylark-programs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, programs := range map[string]func() ProgramRegistry{
+		"memory": NewMemoryProgramRegistry,
+		"dir":    func() ProgramRegistry { return NewDirProgramRegistry(dir) },
+	} {
+		embedded, err := EncodeState(suspend())
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc := NewEncoder().DisableCompression().UseProgramRegistry(programs())
+		first, err := enc.EncodeState(suspend())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		second, err := enc.Reset().EncodeState(suspend())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(second) >= len(first) || len(second) >= len(embedded) {
+			t.Errorf("%s: expected program to be embedded only once, sizes: %d, %d, %d", name, len(embedded), len(first), len(second))
+		}
+
+		// The program is only known to the decoder once it has been embedded in a decoded state:
+		registry := NewMemoryProgramRegistry()
+		_, err = NewDecoder(second, predeclared).UseProgramRegistry(registry).DecodeState()
+		if _, ok := err.(*UnknownProgramError); !ok {
+			t.Errorf("%s: expected unknown program error, found %v", name, err)
+		}
+		for _, snapshot := range [][]byte{first, second} {
+			thread, err := NewDecoder(snapshot, predeclared).UseProgramRegistry(registry).DecodeState()
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if result, err := Resume(thread, String("done")); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			} else if got := result["result"].String(); got != `["done", 0, 2, 4]` {
+				t.Errorf("%s: expected decoded thread to complete, result=%s", name, got)
+			}
+		}
+	}
+
+	// A program of the directory, which may be written by others, is checked against its hash:
+	files, err := filepath.Glob(filepath.Join(dir, "*.skyprog"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one stored program, found %v, %v", files, err)
+	}
+	tamper := func() {
+		program, err := ioutil.ReadFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		program[len(program)-1] ^= 1
+		if err := ioutil.WriteFile(files[0], program, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ref, err := NewEncoder().UseProgramRegistry(NewDirProgramRegistry(dir)).EncodeState(suspend())
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedded, err := NewEncoder().UseProgramRegistry(NewMemoryProgramRegistry()).EncodeState(suspend())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamper()
+	_, err = NewDecoder(ref, predeclared).UseProgramRegistry(NewDirProgramRegistry(dir)).DecodeState()
+	if err == nil || !strings.Contains(err.Error(), "does not match its hash") {
+		t.Errorf("expected tampered program to be rejected, found %v", err)
+	}
+	// The embedded program replaces the tampered one:
+	for _, snapshot := range [][]byte{embedded, ref} {
+		thread, err := NewDecoder(snapshot, predeclared).UseProgramRegistry(NewDirProgramRegistry(dir)).DecodeState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result, err := Resume(thread, String("done")); err != nil {
+			t.Fatal(err)
+		} else if got := result["result"].String(); got != `["done", 0, 2, 4]` {
+			t.Errorf("expected decoded thread to complete, result=%s", got)
+		}
+	}
+	// So does the program of an encoded state:
+	tamper()
+	reembedded, err := NewEncoder().UseProgramRegistry(NewDirProgramRegistry(dir)).EncodeState(suspend())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDecoder(reembedded, predeclared).UseProgramRegistry(NewMemoryProgramRegistry()).DecodeState(); err != nil {
+		t.Errorf("expected the program to be embedded in place of the tampered one, found %v", err)
+	}
+}
+
+func TestSuspendedFrameInspection(t *testing.T) {
+	predeclared := StringDict{
+		"fetch": NewBuiltin("fetch",
+			func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+				thread.Suspendable(args, kwargs)
+				return None, nil
+			}),
+	}
+	script := `
+def process(items):
+	total = 0
+	for item in items:
+		try:
+			total += fetch(item)
+		except:
+			pass
+	return total
+
+result = process([1, 2])
+`
+	thread := &Thread{Load: load}
+	skylarktest.SetReporter(thread, t)
+	if _, err := ExecFile(thread, "inspect.sky", script, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	thread.Resumable()
+	frame := thread.TopFrame().Parent()
+	if frame.Callable().Name() != "process" {
+		t.Fatalf("Expected suspended function to be called by process, found %s", frame.Callable().Name())
+	}
+	names, values := frame.Locals()
+	if fmt.Sprint(names) != "[items total item]" || fmt.Sprint(values) != "[[1, 2] 0 1]" {
+		t.Errorf("Expected locals of suspended frame, found %v = %v", names, values)
+	}
+	if len(frame.Iterators()) != 1 || len(frame.ExceptionHandlers()) != 1 {
+		t.Errorf("Expected an active iterator and exception handler, found %v and %v", frame.Iterators(), frame.ExceptionHandlers())
+	}
+	if frame.Position().Line != 6 || frame.PC() == 0 {
+		t.Errorf("Expected suspended frame to be positioned at its active call, found %s (pc %d)", frame.Position(), frame.PC())
+	}
+}
+
+func TestCloneSuspendedThread(t *testing.T) {
+	predeclared := StringDict{
+		"fetch": NewBuiltin("fetch",
+			func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+				thread.Suspendable(args, kwargs)
+				return None, nil
+			}),
+	}
+	script := `
+def run(keys):
+	log = []
+	aliases = [log, log]
+	counts = {}
+	for key in keys:
+		value = fetch(key)
+		log.append(value)
+		counts[key] = value
+	aliases[0].append("end")
+	return (aliases[1], counts)
+
+result = run(["a", "b"])
+`
+	thread := &Thread{Load: load}
+	skylarktest.SetReporter(thread, t)
+	if _, err := ExecFile(thread, "clone.sky", script, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	clone := thread.Clone()
+	for i, test := range []struct {
+		thread *Thread
+		values []Value
+		want   string
+	}{
+		{thread, []Value{MakeInt(1), MakeInt(2)}, `([1, 2, "end"], {"a": 1, "b": 2})`},
+		{clone, []Value{String("x"), String("y")}, `(["x", "y", "end"], {"a": "x", "b": "y"})`},
+	} {
+		var result StringDict
+		var err error
+		for _, v := range test.values {
+			if result, err = Resume(test.thread, v); err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+		}
+		if got := result["result"].String(); got != test.want {
+			t.Errorf("#%d: expected result %s, found %s", i, test.want, got)
+		}
+	}
+}
+
+// point is a custom type whose encoding gained a field in its second version.
+type point struct{ x, y, version int }
+
+func (p *point) String() string        { return fmt.Sprintf("point(%d, %d)", p.x, p.y) }
+func (p *point) Type() string          { return "point" }
+func (p *point) Freeze()               {}
+func (p *point) Truth() Bool           { return True }
+func (p *point) Hash() (uint32, error) { return 0, nil }
+func (p *point) EncodingVersion() int  { return p.version }
+
+func (p *point) Encode(enc *Encoder) {
+	enc.WriteVarint(int64(p.x))
+	if p.version >= 2 {
+		enc.WriteVarint(int64(p.y))
+	}
+}
+
+func decodePoint(version int) CustomDecoder {
+	return func(dec *Decoder) (Value, error) {
+		p := &point{version: version}
+		x, err := dec.DecodeVarint()
+		if err != nil {
+			return nil, err
+		}
+		p.x = int(x)
+		if version >= 2 {
+			y, err := dec.DecodeVarint()
+			if err != nil {
+				return nil, err
+			}
+			p.y = int(y)
+		}
+		return p, nil
+	}
+}
+
+func TestTypeRegistry(t *testing.T) {
+	v1, v2 := NewTypeRegistry(), NewTypeRegistry()
+	v1.RegisterDecoder("point", decodePoint(1))
+	v2.RegisterDecoder("point", decodePoint(1))
+	v2.RegisterDecoder(VersionedTypeName("point", 2), decodePoint(2))
+	if err := v2.RegisterDecoder("point@2", decodePoint(2)); err == nil {
+		t.Errorf("expected duplicate registration to fail")
+	}
+
+	for _, test := range []struct {
+		types   *TypeRegistry
+		p       *point
+		want    string
+		encodes bool
+	}{
+		{v1, &point{1, 2, 1}, "point(1, 0)", true},
+		{v1, &point{1, 2, 2}, "", false},
+		{v2, &point{1, 2, 1}, "point(1, 0)", true},
+		{v2, &point{1, 2, 2}, "point(1, 2)", true},
+		{DefaultTypes, &point{1, 2, 1}, "", false},
+	} {
+		enc := test.types.NewEncoder()
+		enc.EncodeValue(test.p)
+		if encodes := len(enc.Errors()) == 0; encodes != test.encodes {
+			t.Errorf("version %d: expected encodable=%t, found errors %v", test.p.version, test.encodes, enc.Errors())
+			continue
+		}
+		if !test.encodes {
+			continue
+		}
+		v, err := test.types.NewDecoder(enc.Bytes(), nil).DecodeValue()
+		if err != nil {
+			t.Errorf("version %d: %v", test.p.version, err)
+		} else if v.String() != test.want {
+			t.Errorf("version %d: expected %s, found %s", test.p.version, test.want, v)
+		}
+		// Other registries don't know the type:
+		if _, err = NewDecoder(enc.Bytes(), nil).DecodeValue(); err == nil {
+			t.Errorf("version %d: expected default decoder to fail", test.p.version)
+		}
+	}
+
+	// Registration is safe while decoding:
+	enc := v2.NewEncoder()
+	enc.EncodeValue(&point{3, 4, 2})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			v2.RegisterDecoder(fmt.Sprintf("type%d", i), decodePoint(1))
+		}(i)
+		go func() {
+			defer wg.Done()
+			if _, err := v2.NewDecoder(enc.Bytes(), nil).DecodeValue(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// limitsScript is suspended while holding values of most encodable types.
+const limitsScript = `
+def process(items, scale=0.5):
+	seen = {}
+	for item in items:
+		try:
+			seen[item] = [fetch(item) * scale, (item, len(item))]
+		except:
+			pass
+	return seen
+
+nested = [[[[1]]]]
+result = process(["a", "bb"])
+`
+
+// encodedLimitsState returns the uncompressed encoded state of limitsScript.
+func encodedLimitsState(t testing.TB, predeclared StringDict) []byte {
+	thread := &Thread{Load: load}
+	if _, err := ExecFile(thread, "limits.sky", limitsScript, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := NewEncoder().DisableCompression().EncodeState(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+func suspendingFetch() StringDict {
+	return StringDict{
+		"fetch": NewBuiltin("fetch",
+			func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+				thread.Suspendable(args, kwargs)
+				return None, nil
+			}),
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	predeclared := suspendingFetch()
+	snapshot := encodedLimitsState(t, predeclared)
+
+	thread, err := NewDecoder(snapshot, predeclared).DecodeState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result StringDict
+	for _, v := range []Value{MakeInt(3), MakeInt(4)} {
+		if result, err = Resume(thread, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := result["result"].String(), `{"a": [1.5, ("a", 1)], "bb": [2, ("bb", 2)]}`; got != want {
+		t.Errorf("expected result %s, found %s", want, got)
+	}
+
+	for _, test := range []struct {
+		limits DecodeLimits
+		limit  string
+	}{
+		{DecodeLimits{MaxStateSize: 64}, "MaxStateSize"},
+		{DecodeLimits{MaxLength: 2}, "MaxLength"},
+		{DecodeLimits{MaxDepth: 3}, "MaxDepth"},
+		{DecodeLimits{MaxRefs: 10}, "MaxRefs"},
+	} {
+		_, err := NewDecoder(snapshot, predeclared).SetLimits(test.limits).DecodeState()
+		if err, ok := err.(*DecodeLimitError); !ok || err.Limit != test.limit {
+			t.Errorf("%s: expected limit to be exceeded, found %v", test.limit, err)
+		}
+	}
+
+	// A Huffman-compressed state is rejected by its length-prefix, before it is decompressed,
+	// and a gzip-compressed one while it is decompressed:
+	thread = &Thread{Load: load}
+	if _, err := ExecFile(thread, "limits.sky", limitsScript, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	for _, enc := range []*Encoder{NewEncoder().EnableHuffmanCompression(), NewEncoder().EnableGzipCompression(9)} {
+		compressed, err := enc.EncodeState(thread)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewDecoder(compressed, predeclared).SetLimits(DecodeLimits{MaxStateSize: len(snapshot) / 2}).DecodeState()
+		if err, ok := err.(*DecodeLimitError); !ok || err.Limit != "MaxStateSize" {
+			t.Errorf("expected compressed state to exceed its size limit, found %v", err)
+		}
+	}
+}
+
+func TestDecodeInvalidCode(t *testing.T) {
+	predeclared := suspendingFetch()
+	thread := &Thread{Load: load}
+	if _, err := ExecFile(thread, "limits.sky", limitsScript, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	data, err := EncodeStateJSON(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The frames of the rendering are those of the toplevel, of the function process and of fetch:
+	code := func(code ...byte) func(state map[string]interface{}) {
+		return func(state map[string]interface{}) {
+			fn := state["program"].(map[string]interface{})["functions"].([]interface{})[0]
+			fn.(map[string]interface{})["code"] = base64.StdEncoding.EncodeToString(code)
+		}
+	}
+	frame := func(edit func(frame map[string]interface{}, callpc float64)) func(state map[string]interface{}) {
+		return func(state map[string]interface{}) {
+			frame := state["frames"].([]interface{})[1].(map[string]interface{})
+			edit(frame, frame["callpc"].(float64))
+		}
+	}
+	// Each edit is rejected when decoding the state, rather than causing a panic when resuming it:
+	for _, test := range []struct {
+		edit func(state map[string]interface{})
+		want string
+	}{
+		{code(0xff), "illegal op"},
+		{code(byte(compile.CONSTANT), 99, byte(compile.RETURN)), "out of bounds for constants"},
+		{code(byte(compile.LOCAL), 99, byte(compile.RETURN)), "out of bounds for locals"},
+		{code(byte(compile.CONSTANT), 0, byte(compile.JMP), 1), "not the start of an instruction"},
+		{code(byte(compile.NONE)), "code ends with op"},
+		{frame(func(frame map[string]interface{}, callpc float64) {
+			frame["pc"] = callpc + 1
+		}), "invalid frame of function process"},
+		{frame(func(frame map[string]interface{}, callpc float64) {
+			frame["handlers"] = []interface{}{map[string]interface{}{"pc": callpc + 1, "sp": 0}}
+		}), "invalid exception handler"},
+		{frame(func(frame map[string]interface{}, callpc float64) {
+			frame["sp"] = 0
+		}), "invalid frame of caller process"},
+	} {
+		var state map[string]interface{}
+		if err := json.Unmarshal(data, &state); err != nil {
+			t.Fatal(err)
+		}
+		test.edit(state)
+		edited, err := json.Marshal(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DecodeStateJSON(edited, predeclared); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("expected error %q, found %v", test.want, err)
+		}
+	}
+}
+
+func TestSnapshotJSON(t *testing.T) {
+	predeclared := suspendingFetch()
+	script := `
+def run(keys):
+	cycle = []
+	cycle.append(cycle)
+	pair = [cycle, cycle]
+	counts = {}
+	for key in keys:
+		counts[key] = fetch(key, pair=pair)
+	cycle.append(counts)
+	return len(pair[1][0][0])
+
+result = run(["a", "b"])
+`
+	for _, test := range []struct {
+		filename, script string
+		values           []Value
+		want             string
+	}{
+		{"limits.sky", limitsScript, []Value{MakeInt(3), Float(4.5)}, `{"a": [1.5, ("a", 1)], "bb": [2.25, ("bb", 2)]}`},
+		{"cycle.sky", script, []Value{String("x\xff"), MakeInt(-1 << 40)}, "2"},
+	} {
+		thread := &Thread{Load: load}
+		skylarktest.SetReporter(thread, t)
+		if _, err := ExecFile(thread, test.filename, test.script, predeclared); err != nil {
+			t.Fatal(err)
+		}
+		var result StringDict
+		for i, v := range test.values {
+			data, err := EncodeStateJSON(thread)
+			if err != nil {
+				t.Fatalf("%s: %v", test.filename, err)
+			}
+			if thread, err = DecodeStateJSON(data, predeclared); err != nil {
+				t.Fatalf("%s: %v\n%s", test.filename, err, data)
+			}
+			// The rendering of a decoded state is identical:
+			again, err := EncodeStateJSON(thread)
+			if err != nil {
+				t.Fatalf("%s: %v", test.filename, err)
+			}
+			if !bytes.Equal(data, again) {
+				t.Errorf("%s #%d: expected stable rendering, found\n%s\nthen\n%s", test.filename, i, data, again)
+			}
+			if result, err = Resume(thread, v); err != nil {
+				t.Fatalf("%s: %v", test.filename, err)
+			}
+		}
+		if got := result["result"].String(); got != test.want {
+			t.Errorf("%s: expected result %s, found %s", test.filename, test.want, got)
+		}
+	}
+
+	// Custom values are decoded by the registry of the decoder:
+	types := NewTypeRegistry()
+	types.RegisterDecoder(VersionedTypeName("point", 2), decodePoint(2))
+	thread := &Thread{Load: load}
+	if _, err := ExecFile(thread, "point.sky", "result = fetch(p)", StringDict{"fetch": predeclared["fetch"], "p": &point{1, 2, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EncodeStateJSON(thread); err == nil {
+		t.Errorf("expected unregistered custom value to be unencodable")
+	}
+	data, err := types.NewEncoder().EncodeStateJSON(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thread, err = types.NewDecoder(nil, predeclared).DecodeStateJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := thread.TopFrame().Args()[0]; p.String() != "point(1, 2)" {
+		t.Errorf("expected decoded argument point(1, 2), found %s", p)
+	}
+
+	// States rendered by other versions are rejected:
+	edited := bytes.Replace(data, []byte(fmt.Sprintf(`"codec": %d,`, CodecVersion)), []byte(`"codec": 99,`), 1)
+	if _, err := types.NewDecoder(nil, predeclared).DecodeStateJSON(edited); err == nil {
+		t.Errorf("expected version mismatch, found no error")
+	} else if _, ok := err.(*VersionMismatchError); !ok {
+		t.Errorf("expected version mismatch, found %v", err)
+	}
+
+	// unless a migration of their JSON renderings has been registered:
+	older := CurrentSnapshotVersion()
+	older.Codec = 99
+	err = RegisterJSONMigration(older, func(doc []byte) (SnapshotVersion, []byte, error) {
+		return CurrentSnapshotVersion(), bytes.Replace(doc, []byte(`"codec": 99,`), []byte(fmt.Sprintf(`"codec": %d,`, CodecVersion)), 1), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := types.NewDecoder(nil, predeclared).DecodeStateJSON(edited); err != nil {
+		t.Errorf("expected migrated rendering to be decoded, found %v", err)
+	}
+
+	// Signed renderings are verified, regardless of their formatting:
+	signer := NewHMACSigner([]byte("secret"))
+	signed, err := types.NewEncoder().SignWith(signer).EncodeStateJSON(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, signed); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{signed, compact.Bytes()} {
+		if _, err := types.NewDecoder(nil, predeclared).VerifyWith(signer).DecodeStateJSON(data); err != nil {
+			t.Errorf("expected signed rendering to be verified, found %v", err)
+		}
+	}
+	tampered := bytes.Replace(signed, []byte(`"point.sky:1:`), []byte(`"point.sky:2:`), 1)
+	if bytes.Equal(tampered, signed) {
+		t.Fatal("expected a position in the rendering")
+	}
+	for name, test := range map[string]struct {
+		data     []byte
+		verifier Signer
+	}{
+		"tampered":  {tampered, signer},
+		"wrong key": {signed, NewHMACSigner([]byte("other"))},
+		"unsigned":  {data, signer},
+	} {
+		if _, err := types.NewDecoder(nil, predeclared).VerifyWith(test.verifier).DecodeStateJSON(test.data); err != ErrBadSignature {
+			t.Errorf("expected %s rendering to be rejected with a bad signature error, found %v", name, err)
+		}
+	}
+}
+
+func TestSuspendBuiltin(t *testing.T) {
+	script := `
+def approve(amount):
+	if amount > 10:
+		return suspend("approval", amount=amount, currency="EUR")
+	return True
+
+result = [approve(5), approve(50)]
+`
+	defer func(allow bool) { resolve.AllowSuspend = allow }(resolve.AllowSuspend)
+	resolve.AllowSuspend = false
+	if _, err := ExecFile(&Thread{Load: load}, "approve.sky", script, nil); err == nil {
+		t.Errorf("expected suspend to require resolve.AllowSuspend")
+	}
+
+	resolve.AllowSuspend = true
+	thread := &Thread{Load: load}
+	skylarktest.SetReporter(thread, t)
+	if _, err := ExecFile(thread, "approve.sky", script, nil); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := EncodeState(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeState(snapshot, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, thread := range []*Thread{thread, decoded} {
+		pending := thread.Pending()
+		if pending == nil {
+			t.Fatalf("expected thread to be suspended by suspend")
+		}
+		if got, want := fmt.Sprintf("%s %s", pending.Tag, pending.Payload), `approval {amount: 50, currency: "EUR"}`; got != want {
+			t.Errorf("expected pending %s, found %s", want, got)
+		}
+	}
+	result, err := Resume(decoded, False)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result["result"].String(); got != "[True, False]" {
+		t.Errorf("expected result [True, False], found %s", got)
+	}
+
+	// Threads suspended by other built-ins have no pending suspension:
+	thread = &Thread{Load: load}
+	if _, err := ExecFile(thread, "fetch.sky", "result = fetch(1)", suspendingFetch()); err != nil {
+		t.Fatal(err)
+	}
+	if pending := thread.Pending(); pending != nil {
+		t.Errorf("expected no pending suspension, found %s", pending.Tag)
+	}
+	if _, err := ExecFile(&Thread{Load: load}, "bad.sky", "suspend(1)", nil); err == nil {
+		t.Errorf("expected suspend to require a string tag")
+	}
+}
+
+func TestJournal(t *testing.T) {
+	script := `
+def total(keys):
+	n = 0
+	for k in keys:
+		n += lookup(k)["n"]
+	return n
+
+def run():
+	keys = ["a", "b"]
+	approved = suspend("approval", n=total(keys))
+	keys.append(str(approved))
+	return (total(keys), sorted(keys), now())
+
+result = run()
+`
+	defer func(allow bool) { resolve.AllowSuspend = allow }(resolve.AllowSuspend)
+	resolve.AllowSuspend = true
+
+	// The host built-ins return a different result each time they are called:
+	calls := 0
+	predeclared := StringDict{
+		"lookup": NewBuiltin("lookup", func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+			calls++
+			d := new(Dict)
+			d.Set(String("n"), MakeInt(calls))
+			return d, nil
+		}),
+		"now": NewBuiltin("now", func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+			calls++
+			if calls > 10 {
+				return nil, fmt.Errorf("clock failure")
+			}
+			return MakeInt(1000 + calls), nil
+		}),
+	}
+
+	// Record a run, which is suspended and resumed by a decoded thread:
+	thread := &Thread{Load: load, Journal: NewJournal()}
+	if _, err := ExecFile(thread, "journal.sky", script, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := EncodeState(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeState(snapshot, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded.Journal = thread.Journal
+	globals, err := Resume(decoded, True)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `(12, ["True", "a", "b"], 1006)`
+	if got := globals["result"].String(); got != want {
+		t.Fatalf("expected result %s, found %s", want, got)
+	}
+	var log []string
+	for _, c := range thread.Journal.Calls {
+		log = append(log, c.String())
+	}
+	wantLog := `journal.sky:5: lookup("a") = {"n": 1}
+journal.sky:5: lookup("b") = {"n": 2}
+journal.sky:10: suspend("approval", n=3) = True
+journal.sky:5: lookup("a") = {"n": 3}
+journal.sky:5: lookup("b") = {"n": 4}
+journal.sky:5: lookup("True") = {"n": 5}
+journal.sky:12: now() = 1006`
+	if got := strings.Join(log, "\n"); got != wantLog {
+		t.Errorf("expected journal:\n%s\nfound:\n%s", wantLog, got)
+	}
+
+	// The replayed run has the same result, without calling the host built-ins or suspending:
+	calls = 100
+	replay := &Thread{Load: load, Journal: NewReplayJournal(thread.Journal.Calls)}
+	globals, err = ExecFile(replay, "journal.sky", script, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replay.SuspendedFrame() != nil {
+		t.Fatalf("expected the replayed thread not to be suspended")
+	}
+	if got := globals["result"].String(); got != want {
+		t.Errorf("expected replayed result %s, found %s", want, got)
+	}
+	if calls != 100 || len(replay.Journal.Remaining()) != 0 {
+		t.Errorf("expected all calls to be replayed from the journal")
+	}
+
+	// Recorded errors are replayed:
+	thread = &Thread{Load: load, Journal: NewJournal()}
+	if _, err := ExecFile(thread, "now.sky", "x = now()", predeclared); err == nil || err.Error() != "clock failure" {
+		t.Fatalf("expected clock failure, found %v", err)
+	}
+	replay = &Thread{Load: load, Journal: NewReplayJournal(thread.Journal.Calls)}
+	if _, err := ExecFile(replay, "now.sky", "x = now()", predeclared); err == nil || err.Error() != "clock failure" {
+		t.Errorf("expected replayed clock failure, found %v", err)
+	}
+
+	// Divergent calls fail with their position:
+	for _, test := range []struct{ script, err string }{
+		{strings.Replace(script, `["a", "b"]`, `["a", "c"]`, 1),
+			`journal replay diverged at journal.sky:5: call lookup("c") does not match the call lookup("b") recorded at journal.sky:5`},
+		{script + "now()\n",
+			`journal replay diverged at journal.sky:15: unexpected call now() after the last recorded call`},
+	} {
+		replay := &Thread{Load: load, Journal: NewReplayJournal(decoded.Journal.Calls)}
+		if _, err := ExecFile(replay, "journal.sky", test.script, predeclared); err == nil || err.Error() != test.err {
+			t.Errorf("expected error %q, found %v", test.err, err)
+		}
+	}
+
+	// The call which suspended the thread is pending in the journal, whose calls may be saved
+	// and rebuilt by another process which resumes the decoded thread:
+	calls = 0
+	thread = &Thread{Load: load, Journal: NewJournal()}
+	if _, err := ExecFile(thread, "journal.sky", script, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	saved := make([]JournalCall, len(thread.Journal.Calls))
+	for i, c := range thread.Journal.Calls {
+		saved[i] = *c
+	}
+	if n := len(saved); n != 3 || !saved[n-1].Pending || saved[n-1].String() != `journal.sky:10: suspend("approval", n=3) pending` {
+		t.Fatalf("expected the call of suspend to be pending, found %v", thread.Journal.Calls)
+	}
+	snapshot, err = EncodeStateJSON(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err = DecodeStateJSON(snapshot, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt := &Journal{}
+	for i := range saved {
+		rebuilt.Calls = append(rebuilt.Calls, &saved[i])
+	}
+	decoded.Journal = rebuilt
+	if globals, err = Resume(decoded, True); err != nil {
+		t.Fatal(err)
+	} else if got := globals["result"].String(); got != want {
+		t.Fatalf("expected result %s, found %s", want, got)
+	}
+	if len(rebuilt.Calls) != 7 || rebuilt.Calls[2].String() != `journal.sky:10: suspend("approval", n=3) = True` {
+		t.Errorf("expected the pending call to be completed, found %v", rebuilt.Calls)
+	}
+	calls = 100
+	replay = &Thread{Load: load, Journal: NewReplayJournal(rebuilt.Calls)}
+	if globals, err = ExecFile(replay, "journal.sky", script, predeclared); err != nil {
+		t.Fatal(err)
+	} else if got := globals["result"].String(); got != want || len(replay.Journal.Remaining()) != 0 {
+		t.Errorf("expected replayed result %s, found %s", want, got)
+	}
+	// A pending call is not replayed:
+	replay = &Thread{Load: load, Journal: NewReplayJournal(thread.Journal.Calls)}
+	if _, err := ExecFile(replay, "journal.sky", script, predeclared); err == nil || !strings.Contains(err.Error(), "is pending") {
+		t.Errorf("expected replay of a pending call to fail, found %v", err)
+	}
+
+	// A call suspended by a function which it calls is recorded with its arguments,
+	// which are held by the journal rather than by its frame:
+	apply := NewResumableBuiltin("apply",
+		func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+			res, err := Call(thread, args[0], args[1:], nil)
+			if err != nil || thread.SuspendedFrame() != nil {
+				thread.SuspendCall(String("applied"))
+				return None, err
+			}
+			return Tuple{res}, nil
+		},
+		func(thread *Thread, fn *Builtin, state Value, retval Value) (Value, error) {
+			return Tuple{retval}, nil
+		})
+	thread = &Thread{Load: load, Journal: NewJournal()}
+	applyScript := `
+def approve(x):
+	return suspend("approval", x=x)
+
+result = apply(approve, "a")
+`
+	if _, err := ExecFile(thread, "apply.sky", applyScript, StringDict{"apply": apply}); err != nil {
+		t.Fatal(err)
+	}
+	for fr := thread.SuspendedFrame(); fr != nil; fr = fr.Parent() {
+		if fr.Callable() == Callable(apply) && len(fr.Args()) != 0 {
+			t.Errorf("expected no arguments in the frame of apply, found %s", fr.Args())
+		}
+	}
+	snapshot, err = EncodeState(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err = DecodeState(snapshot, StringDict{"apply": apply}); err != nil {
+		t.Fatal(err)
+	}
+	decoded.Journal = thread.Journal
+	if _, err := Resume(decoded, True); err != nil {
+		t.Fatal(err)
+	}
+	log = nil
+	for _, c := range thread.Journal.Calls {
+		log = append(log, c.String())
+	}
+	wantLog = `apply.sky:5: apply(<function approve>, "a") = (True,)`
+	if got := strings.Join(log, "\n"); got != wantLog {
+		t.Errorf("expected journal:\n%s\nfound:\n%s", wantLog, got)
+	}
+}
+
+func TestGeneratorSnapshot(t *testing.T) {
+	defer func(allow bool) { resolve.AllowGenerators = allow }(resolve.AllowGenerators)
+	resolve.AllowGenerators = true
+	predeclared := suspendingFetch()
+	script := `
+def squares(keys):
+	for i, key in enumerate(keys):
+		yield (key, i * i)
+	yield ("end", None)
+
+def run(keys):
+	gen = squares(keys)
+	seen = []
+	for key, square in gen:
+		seen.append((key, square, fetch(key)))
+	return seen
+
+result = run(["a", "b"])
+`
+	thread := &Thread{Load: load}
+	skylarktest.SetReporter(thread, t)
+	if _, err := ExecFile(thread, "generator.sky", script, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := EncodeState(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeState(snapshot, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := EncodeStateJSON(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedJSON, err := DecodeStateJSON(data, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The generator is rendered as an iterator of the frame of run, and as its local variable:
+	if !bytes.Contains(data, []byte(`"generator": {`)) || !bytes.Contains(data, []byte(`"ref": `)) {
+		t.Errorf("expected shared generator in JSON state:\n%s", data)
+	}
+
+	want := `[("a", 0, "a!"), ("b", 1, "b!"), ("end", None, "end!")]`
+	for i, thread := range []*Thread{thread.Clone(), thread, decoded, decodedJSON} {
+		var result StringDict
+		for _, key := range []string{"a", "b", "end"} {
+			frame := thread.SuspendedFrame()
+			if frame == nil {
+				frame = thread.TopFrame() // encoded or decoded
+			}
+			if got := frame.Args()[0]; got != String(key) {
+				t.Fatalf("#%d: expected fetch(%q), found fetch(%s)", i, key, got)
+			}
+			if result, err = Resume(thread, String(key+"!")); err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+		}
+		if got := result["result"].String(); got != want {
+			t.Errorf("#%d: expected result %s, found %s", i, want, got)
+		}
+	}
+
+	// A generator cannot suspend its thread:
+	script = `
+def fetched(keys):
+	for key in keys:
+		yield fetch(key)
+
+result = list(fetched(["a"]))
+`
+	_, err = ExecFile(&Thread{Load: load}, "generator.sky", script, predeclared)
+	if err == nil || !strings.Contains(err.Error(), "cannot suspend thread within generator fetched") {
+		t.Errorf("expected error suspending generator, found %v", err)
+	}
+
+	resolve.AllowGenerators = false
+	if _, err := ExecFile(&Thread{Load: load}, "generator.sky", script, predeclared); err == nil {
+		t.Errorf("expected yield to require resolve.AllowGenerators")
+	}
+}
+
+func TestGeneratorErr(t *testing.T) {
+	defer func(allow bool) { resolve.AllowGenerators = allow }(resolve.AllowGenerators)
+	resolve.AllowGenerators = true
+	script := `
+def divide(xs):
+	for x in xs:
+		yield 1 // x
+
+def count(xs):
+	return len([x for x in xs])
+
+gen = divide([1, 0, 2])
+`
+	thread := &Thread{Load: load}
+	globals, err := ExecFile(thread, "generator.sky", script, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The error of a generator iterated by the client is reported by Err:
+	gen := globals["gen"].(*Generator)
+	var x Value
+	var elems []Value
+	for it := gen.Iterate(); it.Next(&x); {
+		elems = append(elems, x)
+	}
+	if len(elems) != 1 || gen.Err() == nil || !strings.Contains(gen.Err().Error(), "division by zero") {
+		t.Fatalf("expected one element and division by zero, found %v and %v", elems, gen.Err())
+	}
+	// The error is not raised by later calls in the thread:
+	got, err := Call(thread, globals["count"], Tuple{NewList([]Value{MakeInt(1), MakeInt(2)})}, nil)
+	if err != nil || got != MakeInt(2) {
+		t.Errorf("expected 2, found %v, %v", got, err)
+	}
+	if _, err := ExecFile(thread, "other.sky", "y = 1", nil); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	// Whereas the error of a generator iterated by a call is raised by it:
+	gen2, err := Call(thread, globals["divide"], Tuple{NewList([]Value{MakeInt(0)})}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Call(thread, globals["count"], Tuple{gen2}, nil); err == nil || !strings.Contains(err.Error(), "division by zero") {
+		t.Errorf("expected division by zero, found %v", err)
+	}
+	if gen2.(*Generator).Err() == nil {
+		t.Errorf("expected the error of the generator to be reported by Err")
+	}
+}
+
+func TestAwaitAll(t *testing.T) {
+	script := `
+def run():
+	a, b = defer(fetch, "a"), defer(fetch, "b", retries=2)
+	x = await_all([a, b, a])
+	y = await_all([b])
+	z = await_all([defer(fetch, "c"), defer(fetch, "d")], return_exceptions=True)
+	try:
+		await_all([defer(fetch, "e")])
+		w = "unreachable"
+	except ValueError as e:
+		w = e
+	return (x, y, z[0], type(z[1]), w, type(a))
+
+result = run()
+`
+	defer func(allow bool) { resolve.AllowFutures = allow }(resolve.AllowFutures)
+	resolve.AllowFutures = false
+	if _, err := ExecFile(&Thread{Load: load}, "await.sky", script, nil); err == nil {
+		t.Errorf("expected defer and await_all to require resolve.AllowFutures")
+	}
+	resolve.AllowFutures = true
+
+	predeclared := suspendingFetch()
+	for name, class := range ExceptionClasses() {
+		predeclared[name] = class
+	}
+	journal := NewJournal()
+	thread := &Thread{Load: load, Journal: journal}
+	if _, err := ExecFile(thread, "await.sky", script, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	// Each batch is resumed in turn by a decoded copy of the thread:
+	var globals StringDict
+	for i, batch := range []struct {
+		awaited string
+		results *List
+		decode  func([]byte, StringDict) (*Thread, error)
+		encode  func(*Thread) ([]byte, error)
+	}{
+		{`[<future fetch>("a",) {}, <future fetch>("b",) {retries: 2}]`,
+			NewList([]Value{String("A"), String("B")}), DecodeState, EncodeState},
+		{`[<future fetch>("c",) {}, <future fetch>("d",) {}]`,
+			NewList([]Value{String("C"), NewValueError(fmt.Errorf("no d"))}), DecodeStateJSON, EncodeStateJSON},
+		{`[<future fetch>("e",) {}]`,
+			NewList([]Value{NewValueError(fmt.Errorf("no e"))}), DecodeState, EncodeState},
+	} {
+		var awaited []string
+		for _, f := range thread.Awaited() {
+			kwargs := make(StringDict)
+			for _, kv := range f.Kwargs() {
+				kwargs[string(kv[0].(String))] = kv[1]
+			}
+			awaited = append(awaited, fmt.Sprintf("%s%s %s", f, f.Args(), kwargs))
+		}
+		if got := "[" + strings.Join(awaited, ", ") + "]"; got != batch.awaited {
+			t.Fatalf("batch %d: expected awaited futures %s, found %s", i, batch.awaited, got)
+		}
+		if len(awaited) > 1 {
+			_, err := Resume(thread.Clone(), NewList([]Value{String("A")}))
+			if err == nil || !strings.Contains(err.Error(), "await_all: resumed with 1 results, want 2") {
+				t.Errorf("batch %d: expected an error for the wrong number of results, found %v", i, err)
+			}
+		}
+		snapshot, err := batch.encode(thread)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if thread, err = batch.decode(snapshot, predeclared); err != nil {
+			t.Fatal(err)
+		}
+		thread.Journal = journal
+		if globals, err = Resume(thread, batch.results); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if thread.SuspendedFrame() != nil {
+		t.Fatalf("expected the thread to be done")
+	}
+	want := `(["A", "B", "A"], ["B"], "C", "ValueError", ValueError: no e, "future")`
+	if got := globals["result"].String(); got != want {
+		t.Errorf("expected result %s, found %s", want, got)
+	}
+	if len(journal.Calls) != 5 {
+		t.Errorf("expected 5 recorded calls, found %d", len(journal.Calls))
+	}
+
+	// The replayed thread resolves the futures from the journal, without suspending:
+	replay := &Thread{Load: load, Journal: NewReplayJournal(journal.Calls)}
+	globals, err := ExecFile(replay, "await.sky", script, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := globals["result"].String(); got != want {
+		t.Errorf("expected replayed result %s, found %s", want, got)
+	}
+}
+
+func TestSnapshotMetadata(t *testing.T) {
+	predeclared := suspendingFetch()
+	thread := &Thread{Load: load, Metadata: map[string]string{
+		"deadline": "2018-01-02T15:04:05Z",
+		"tenant":   "acme",
+		"retries":  "2",
+	}}
+	if _, err := ExecFile(thread, "fetch.sky", "x = fetch(1)", predeclared); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprint(thread.Metadata)
+	signer := NewHMACSigner([]byte("key"))
+	snapshot, err := NewEncoder().SignWith(signer).EncodeState(thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The metadata is read from the header, without decoding the rest of the state:
+	for _, data := range [][]byte{snapshot, snapshot[:len(snapshot)/2]} {
+		metadata, err := ReadSnapshotMetadata(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(metadata); got != want {
+			t.Errorf("expected metadata %s, found %s", want, got)
+		}
+	}
+	decoded, err := NewDecoder(snapshot, predeclared).VerifyWith(signer).DecodeState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(decoded.Metadata); got != want {
+		t.Errorf("expected decoded metadata %s, found %s", want, got)
+	}
+	// The metadata is covered by the signature:
+	tampered := bytes.Replace(snapshot, []byte("acme"), []byte("evil"), 1)
+	if _, err := NewDecoder(tampered, predeclared).VerifyWith(signer).DecodeState(); err != ErrBadSignature {
+		t.Errorf("expected ErrBadSignature for tampered metadata, found %v", err)
+	}
+
+	// The metadata is preserved by the JSON rendering and by clones:
+	data, err := EncodeStateJSON(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err = DecodeStateJSON(data, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	clone := decoded.Clone()
+	clone.Metadata["retries"] = "3"
+	if got := fmt.Sprint(decoded.Metadata); got != want {
+		t.Errorf("expected metadata %s after JSON rendering and cloning, found %s", want, got)
+	}
+
+	// States without metadata have none:
+	var buf bytes.Buffer
+	thread.Metadata = nil
+	if err := EncodeStateTo(&buf, thread); err != nil {
+		t.Fatal(err)
+	}
+	if metadata, err := ReadSnapshotMetadataFrom(&buf); err != nil || metadata != nil {
+		t.Errorf("expected no metadata, found %v (%v)", metadata, err)
+	}
+	thread.Metadata = map[string]string{"big": strings.Repeat("x", 1<<20)}
+	if _, err := EncodeState(thread); err == nil || !strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Errorf("expected an error for oversized metadata, found %v", err)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	script := `
+def count(n):
+	total = 0
+	for i in range(n):
+		total += len([j for j in range(i)])
+	return total
+
+def neg(x):
+	return -len([i for i in range(x)])
+
+result = sorted([count(20), count(30)], key=neg)
+`
+	want := "[435, 190]"
+
+	// A thread which exceeds its budget fails:
+	thread := &Thread{Load: load, MaxSteps: 100}
+	_, err := ExecFile(thread, "interrupt.sky", script, nil)
+	evalErr, ok := err.(*EvalError)
+	if !ok || evalErr.Interrupt == nil || evalErr.Interrupt.Cancelled || evalErr.Interrupt.Steps != 100 {
+		t.Fatalf("expected an interrupt after 100 steps, found %v", err)
+	}
+	if got := evalErr.Backtrace(); !strings.Contains(got, "in count") ||
+		!strings.Contains(got, "Error: Skylark computation exceeded its budget of 100 steps") {
+		t.Errorf("unexpected backtrace %s", got)
+	}
+	if thread.Steps() != 100 {
+		t.Errorf("expected 100 steps, found %d", thread.Steps())
+	}
+
+	// A thread is cancelled from another goroutine:
+	started := make(chan struct{})
+	predeclared := StringDict{
+		"start": NewBuiltin("start", func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+			close(started)
+			return None, nil
+		}),
+	}
+	thread = &Thread{Load: load}
+	done := make(chan error)
+	go func() {
+		_, err := ExecFile(thread, "spin.sky", "def spin():\n\tstart()\n\tfor i in range(1 << 30):\n\t\tpass\nspin()", predeclared)
+		done <- err
+	}()
+	<-started
+	thread.Cancel("deadline")
+	err = <-done
+	if evalErr, ok := err.(*EvalError); !ok || evalErr.Interrupt == nil || !evalErr.Interrupt.Cancelled {
+		t.Fatalf("expected the thread to be cancelled, found %v", err)
+	} else if got := evalErr.Error(); got != "Skylark computation cancelled: deadline" {
+		t.Errorf("unexpected error %s", got)
+	}
+
+	// A thread which is suspended instead is resumed with a larger budget, or after
+	// being cancelled, by decoded copies of the thread, which keep counting its steps:
+	thread = &Thread{Load: load, MaxSteps: 50, SuspendOnInterrupt: true}
+	globals, err := ExecFile(thread, "interrupt.sky", script, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	suspensions := 0
+	for ; thread.SuspendedFrame() != nil; suspensions++ {
+		in := thread.Interrupted()
+		if in == nil || in.Cancelled != (suspensions == 3) {
+			t.Fatalf("suspension %d: unexpected interrupt %v", suspensions, in)
+		}
+		encode, decode := EncodeState, DecodeState
+		if suspensions%2 == 1 {
+			encode, decode = EncodeStateJSON, DecodeStateJSON
+		}
+		steps := thread.Steps()
+		snapshot, err := encode(thread)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if thread, err = decode(snapshot, nil); err != nil {
+			t.Fatal(err)
+		}
+		if in2 := thread.Interrupted(); in2 == nil || *in2 != *in {
+			t.Fatalf("suspension %d: expected decoded interrupt %v, found %v", suspensions, in, in2)
+		}
+		if thread.Steps() != steps {
+			t.Fatalf("suspension %d: expected %d decoded steps, found %d", suspensions, steps, thread.Steps())
+		}
+		thread.MaxSteps, thread.SuspendOnInterrupt = thread.Steps()+500, true
+		if suspensions == 2 {
+			thread.Cancel("pause")
+		}
+		if globals, err = Resume(thread, None); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if suspensions < 4 {
+		t.Errorf("expected at least 4 suspensions, found %d", suspensions)
+	}
+	if got := globals["result"].String(); got != want {
+		t.Errorf("expected result %s, found %s", want, got)
+	}
+}
+
+// forEachCodec calls f with the encoding and decoding functions of each codec.
+func forEachCodec(t *testing.T, f func(encode func(*Thread) ([]byte, error), decode func([]byte, StringDict) (*Thread, error))) {
+	t.Helper()
+	f(EncodeState, DecodeState)
+	f(EncodeStateJSON, DecodeStateJSON)
+}
+
+func TestMemoryLimit(t *testing.T) {
+	script := `
+def run():
+	caught = [None] * 4
+	try:
+		s = "x" * 100000000
+	except MemoryError as e:
+		caught[0] = e
+	try:
+		s = ("x" * 10000).join(["a"] * 1000)
+	except MemoryError as e:
+		caught[1] = e
+	try:
+		n = 1
+		for i in range(100000):
+			n = n << 500
+	except MemoryError as e:
+		caught[2] = e
+	# The allocations of the list exhaust the limit, even once they are garbage:
+	try:
+		s = []
+		for i in range(1000000):
+			s.append(i)
+	except MemoryError as e:
+		caught[3] = e
+	return caught
+
+caught = run()
+fetch(caught[0])
+`
+	predeclared := suspendingFetch()
+	predeclared["MemoryError"] = NewMemoryError(fmt.Errorf("some memory error"))
+	thread := &Thread{Load: load, MaxAlloc: 1 << 20}
+	if _, err := ExecFile(thread, "memory.sky", script, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	if thread.Allocs() > thread.MaxAlloc || thread.Allocs() < thread.MaxAlloc/2 {
+		t.Errorf("expected allocations of at most %d bytes, found %d", thread.MaxAlloc, thread.Allocs())
+	}
+	// The exception is encoded with the state of the thread, along with its allocations,
+	// which the decoded thread keeps counting:
+	want := "MemoryError: exceeded the allocation limit of 1048576 bytes"
+	forEachCodec(t, func(encode func(*Thread) ([]byte, error), decode func([]byte, StringDict) (*Thread, error)) {
+		snapshot, err := encode(thread)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decode(snapshot, predeclared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if args := decoded.TopFrame().Args(); len(args) != 1 || args[0].String() != want {
+			t.Errorf("expected the decoded argument %s, found %s", want, args)
+		}
+		if decoded.Allocs() != thread.Allocs() {
+			t.Errorf("expected %d decoded bytes of allocations, found %d", thread.Allocs(), decoded.Allocs())
+		}
+		decoded.MaxAlloc = thread.MaxAlloc
+		globals, err := Resume(decoded, None)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Allocs() < thread.Allocs() || decoded.Allocs() > decoded.MaxAlloc {
+			t.Errorf("expected allocations of %d to %d bytes, found %d", thread.Allocs(), decoded.MaxAlloc, decoded.Allocs())
+		}
+		if got, want := globals["caught"].String(), fmt.Sprintf("[%s, %s, %s, %s]", want, want, want, want); got != want {
+			t.Errorf("expected %s, found %s", want, got)
+		}
+	})
+
+	// An uncaught MemoryError fails the thread:
+	thread = &Thread{Load: load, MaxAlloc: 1 << 20}
+	_, err := ExecFile(thread, "memory.sky", "x = 'abc'.replace('b', 'b' * 1000).replace('b', 'b' * 2000)", nil)
+	if err == nil || !strings.Contains(err.Error(), "exceeded the allocation limit") {
+		t.Errorf("expected a MemoryError, found %v", err)
+	}
+	if thread.Allocs() > 10000 {
+		t.Errorf("expected the replacement not to be allocated, found %d bytes of allocations", thread.Allocs())
+	}
+}
+
+func TestRaise(t *testing.T) {
+	script := `
+def handle(i):
+	try:
+		if i > 0:
+			raise ValueError("bad value: %d" % i)
+	except ValueError as e:
+		# The thread is suspended while the exception is handled:
+		fetch(i)
+		raise
+	return i
+
+def run(i):
+	try:
+		return handle(i)
+	except ValueError as e:
+		return str(e)
+
+results = [run(0), run(1)]
+`
+	predeclared := suspendingFetch()
+	for name, class := range ExceptionClasses() {
+		predeclared[name] = class
+	}
+	thread := &Thread{Load: load}
+	if _, err := ExecFile(thread, "raise.sky", script, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	forEachCodec(t, func(encode func(*Thread) ([]byte, error), decode func([]byte, StringDict) (*Thread, error)) {
+		snapshot, err := encode(thread)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The handled exception is re-raised upon resumption, and caught by the caller:
+		decoded, err := decode(snapshot, predeclared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		globals, err := Resume(decoded, None)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := globals["results"].String(), `[0, "ValueError: bad value: 1"]`; got != want {
+			t.Errorf("expected %s, found %s", want, got)
+		}
+
+		// An exception raised by the suspending call is not caught by the caller:
+		decoded, err = decode(snapshot, predeclared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ResumeWithError(decoded, NewTypeError(fmt.Errorf("fetch failed")))
+		if err == nil || err.Error() != "fetch failed" {
+			t.Errorf("expected the error fetch failed, found %v", err)
+		}
+	})
+}
+
+func TestFinallySuspended(t *testing.T) {
+	script := `
+def cleanup(log):
+	for i in range(3):
+		try:
+			if i == 1:
+				raise ValueError("failed: %d" % i)
+		except TypeError:
+			log.append("not handled")
+		finally:
+			# The thread is suspended while the exception propagates:
+			log.append(fetch(i))
+
+def run():
+	log = []
+	try:
+		cleanup(log)
+	except ValueError as e:
+		log.append(str(e))
+	return log
+
+log = run()
+`
+	predeclared := suspendingFetch()
+	for name, class := range ExceptionClasses() {
+		predeclared[name] = class
+	}
+	forEachCodec(t, func(encode func(*Thread) ([]byte, error), decode func([]byte, StringDict) (*Thread, error)) {
+		thread := &Thread{Load: load}
+		if _, err := ExecFile(thread, "finally.sky", script, predeclared); err != nil {
+			t.Fatal(err)
+		}
+		var globals StringDict
+		for i := 0; i < 2; i++ {
+			snapshot, err := encode(thread)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if thread, err = decode(snapshot, predeclared); err != nil {
+				t.Fatal(err)
+			}
+			if globals, err = Resume(thread, MakeInt(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if thread.SuspendedFrame() != nil {
+			t.Fatal("expected the thread to complete")
+		}
+		if got, want := globals["log"].String(), `[0, 1, "ValueError: failed: 1"]`; got != want {
+			t.Errorf("expected %s, found %s", want, got)
+		}
+	})
+}
+
+func TestRuntimeErrorsSuspended(t *testing.T) {
+	script := `
+def catch(f):
+	try:
+		f()
+	except (KeyError, IndexError, ZeroDivisionError, AttributeError, NameError, OverflowError, RecursionError) as e:
+		return e
+
+def unbound():
+	if False:
+		x = 1
+	return x
+
+def recurse():
+	recurse()
+
+def run():
+	errors = [
+		catch(lambda: {}["k"]),
+		catch(lambda: [][0]),
+		catch(lambda: 1 // 0),
+		catch(lambda: None.f),
+		catch(unbound),
+		catch(lambda: 1 << 512),
+		catch(recurse),
+	]
+	# The caught exceptions are encoded with the suspended thread:
+	fetch()
+	return [type(e) for e in errors], errors[0] == KeyError('key "k" not in dict')
+
+result = run()
+`
+	predeclared := suspendingFetch()
+	for name, class := range ExceptionClasses() {
+		predeclared[name] = class
+	}
+	forEachCodec(t, func(encode func(*Thread) ([]byte, error), decode func([]byte, StringDict) (*Thread, error)) {
+		thread := &Thread{Load: load}
+		if _, err := ExecFile(thread, "errors.sky", script, predeclared); err != nil {
+			t.Fatal(err)
+		}
+		snapshot, err := encode(thread)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if thread, err = decode(snapshot, predeclared); err != nil {
+			t.Fatal(err)
+		}
+		globals, err := Resume(thread, None)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `(["KeyError", "IndexError", "ZeroDivisionError", "AttributeError", "NameError", "OverflowError", "RecursionError"], True)`
+		if got := globals["result"].String(); got != want {
+			t.Errorf("expected %s, found %s", want, got)
+		}
+	})
+}
+
+func TestExceptionClassesSuspended(t *testing.T) {
+	script := `
+def catch(f):
+	try:
+		f()
+	except Exception as e:
+		return e
+
+def timeout(n):
+	raise TimeoutError("slow", n)
+
+def run():
+	lookup = catch(lambda: {}["k"])
+	custom = catch(lambda: timeout(3))
+	created = LookupError("no such key", [1])
+	classes = [KeyError, LookupError, TimeoutError]
+	# The exceptions and their classes are encoded with the suspended thread:
+	fetch()
+	return [
+		type(custom), custom.args, custom.traceback.endswith(": in timeout"),
+		type(lookup), lookup.message, lookup.traceback.count("\n"),
+		created.args, [str(c) for c in classes],
+		catch(lambda: raise_(created)) != None,
+		classes[2] == TimeoutError, is_timeout(custom),
+	]
+
+def is_timeout(e):
+	try:
+		raise e
+	except TimeoutError:
+		return True
+	except Exception:
+		return False
+
+def raise_(x):
+	try:
+		raise x
+	except LookupError:
+		raise
+	except RuntimeError:
+		return "runtime"
+
+result = run()
+timeout_class = TimeoutError
+`
+	predeclared := suspendingFetch()
+	for name, class := range ExceptionClasses() {
+		predeclared[name] = class
+	}
+	predeclared["TimeoutError"] = NewExceptionClass("TimeoutError", RuntimeErrorClass)
+	forEachCodec(t, func(encode func(*Thread) ([]byte, error), decode func([]byte, StringDict) (*Thread, error)) {
+		thread := &Thread{Load: load}
+		if _, err := ExecFile(thread, "classes.sky", script, predeclared); err != nil {
+			t.Fatal(err)
+		}
+		snapshot, err := encode(thread)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if thread, err = decode(snapshot, predeclared); err != nil {
+			t.Fatal(err)
+		}
+		globals, err := Resume(thread, None)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `["TimeoutError", ("slow", 3), True, "KeyError", "key \"k\" not in dict", 4, ("no such key", [1]), ` +
+			`["<exception class KeyError>", "<exception class LookupError>", "<exception class TimeoutError>"], True, True, True]`
+		if got := globals["result"].String(); got != want {
+			t.Errorf("expected %s, found %s", want, got)
+		}
+		// The classes of the application are decoded as the predeclared classes of the same name:
+		if globals["timeout_class"] != predeclared["TimeoutError"] {
+			t.Errorf("expected decoded class to be the predeclared TimeoutError")
+		}
+	})
+}
+
+func TestWhileSuspended(t *testing.T) {
+	defer func(allow bool) { resolve.AllowWhile = allow }(resolve.AllowWhile)
+	resolve.AllowWhile = true
+	predeclared := suspendingFetch()
+	script := `
+def poll(job):
+	polls = []
+	done = False
+	while not done:
+		polls.append(len(polls))
+		if len(polls) > 10:
+			break
+		done = fetch(job)
+		if not done:
+			continue
+		polls.append("done")
+	return polls
+
+result = poll("job")
+`
+	forEachCodec(t, func(encode func(*Thread) ([]byte, error), decode func([]byte, StringDict) (*Thread, error)) {
+		thread := &Thread{Load: load}
+		if _, err := ExecFile(thread, "while.sky", script, predeclared); err != nil {
+			t.Fatal(err)
+		}
+		// The thread is suspended within the loop body at each poll:
+		var result StringDict
+		for _, done := range []Value{False, False, True} {
+			snapshot, err := encode(thread)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if thread, err = decode(snapshot, predeclared); err != nil {
+				t.Fatal(err)
+			}
+			if result, err = Resume(thread, done); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got, want := result["result"].String(), `[0, 1, 2, "done"]`; got != want {
+			t.Errorf("expected %s, found %s", want, got)
+		}
+	})
+
+	// A thread which loops forever exceeds its budget:
+	thread := &Thread{Load: load, MaxSteps: 1000}
+	_, err := ExecFile(thread, "spin.sky", "def spin():\n\twhile True:\n\t\tpass\nspin()", nil)
+	if evalErr, ok := err.(*EvalError); !ok || evalErr.Interrupt == nil {
+		t.Errorf("expected an interrupt, found %v", err)
+	}
+
+	resolve.AllowWhile = false
+	if _, err := ExecFile(&Thread{Load: load}, "while.sky", script, predeclared); err == nil {
+		t.Errorf("expected while loop to require resolve.AllowWhile")
+	}
+}
+
+func FuzzDecodeState(f *testing.F) {
+	predeclared := suspendingFetch()
+	snapshot := encodedLimitsState(f, predeclared)
+	f.Add(snapshot)
+	// Truncated and corrupted states are decoded as part of the test suite:
+	for i := len(CodecMagic); i < len(snapshot); i += 7 {
+		f.Add(snapshot[:i])
+		corrupt := append([]byte(nil), snapshot...)
+		corrupt[i] ^= 0xff
+		f.Add(corrupt)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		limits := DecodeLimits{MaxStateSize: 1 << 16, MaxLength: 1 << 10, MaxDepth: 64, MaxRefs: 1 << 12}
+		thread, err := NewDecoder(data, predeclared).SetLimits(limits).DecodeState()
+		if err != nil {
+			return
+		}
+		if thread.TopFrame() == nil {
+			t.Fatalf("expected decoded thread to be suspended")
+		}
+		// A decoded thread is resumed without panicking, within budgets of steps and
+		// allocations, which include those it has decoded:
+		thread.MaxSteps, thread.MaxAlloc = 1<<14, 1<<24
+		Resume(thread, MakeInt(3))
+	})
+}
@@ -111,6 +111,8 @@ func (p *parser) parseStmt(stmts []Stmt) []Stmt {
 		return append(stmts, p.parseIfStmt())
 	} else if p.tok == FOR {
 		return append(stmts, p.parseForStmt())
+	} else if p.tok == WHILE {
+		return append(stmts, p.parseWhileStmt())
 	} else if p.tok == TRY {
 		return append(stmts, p.parseTryStmt())
 	}
@@ -184,6 +186,19 @@ func (p *parser) parseForStmt() Stmt {
 	}
 }
 
+// while_stmt = WHILE test ':' suite
+func (p *parser) parseWhileStmt() Stmt {
+	whilepos := p.nextToken() // consume WHILE
+	cond := p.parseTest()
+	p.consume(COLON)
+	body := p.parseSuite()
+	return &WhileStmt{
+		While: whilepos,
+		Cond:  cond,
+		Body:  body,
+	}
+}
+
 // Equivalent to 'exprlist' production in Python grammar.
 //
 // loop_variables = primary_with_suffix (COMMA primary_with_suffix)* COMMA?
@@ -206,20 +221,40 @@ func (p *parser) parseForLoopVariables() Expr {
 	return &TupleExpr{List: list}
 }
 
+// try_stmt = TRY ':' suite (EXCEPT [test [AS IDENT]] ':' suite)* [ELSE ':' suite] [FINALLY ':' suite]
+//
+// A try statement has at least one except clause or a finally clause,
+// and an else clause only if it has an except clause.
 func (p *parser) parseTryStmt() Stmt {
 	stmt := &TryStmt{Try: p.nextToken()}
 	p.consume(COLON)
 	stmt.Body = p.parseSuite()
-	p.consume(EXCEPT)
-	if p.tok != COLON {
-		stmt.ExceptionType = p.parseIdent()
-		p.consume(AS)
-		stmt.ExceptionName = p.parseIdent()
+	for p.tok == EXCEPT {
+		if n := len(stmt.Excepts); n > 0 && stmt.Excepts[n-1].Type == nil {
+			p.in.errorf(p.in.pos, "default 'except:' must be last")
+		}
+		except := &ExceptClause{Except: p.nextToken()}
+		if p.tok != COLON {
+			except.Type = p.parseTest()
+			if p.tok == AS {
+				p.nextToken() // consume AS
+				except.Name = p.parseIdent()
+			}
+		}
 		p.consume(COLON)
-	} else {
+		except.Body = p.parseSuite()
+		stmt.Excepts = append(stmt.Excepts, except)
+	}
+	if stmt.Excepts != nil && p.tok == ELSE {
+		stmt.ElsePos = p.nextToken() // consume ELSE
+		p.consume(COLON)
+		stmt.Else = p.parseSuite()
+	}
+	if stmt.Excepts == nil || p.tok == FINALLY {
+		stmt.FinallyPos = p.consume(FINALLY)
 		p.consume(COLON)
+		stmt.Finally = p.parseSuite()
 	}
-	stmt.Fallback = p.parseSuite()
 	return stmt
 }
 
@@ -243,6 +278,8 @@ func (p *parser) parseSimpleStmt(stmts []Stmt) []Stmt {
 }
 
 // small_stmt = RETURN expr?
+//            | YIELD expr?
+//            | RAISE expr?
 //            | PASS | BREAK | CONTINUE
 //            | LOAD ...
 //            | expr ('=' | '+=' | '-=' | '*=' | '/=' | '%=' | '&=' | '|=' | '^=' | '<<=' | '>>=') expr   // assign
@@ -257,6 +294,22 @@ func (p *parser) parseSmallStmt() Stmt {
 		}
 		return &ReturnStmt{Return: pos, Result: result}
 
+	case YIELD:
+		pos := p.nextToken() // consume YIELD
+		var result Expr
+		if p.tok != EOF && p.tok != NEWLINE && p.tok != SEMI {
+			result = p.parseExpr(false)
+		}
+		return &YieldStmt{Yield: pos, Result: result}
+
+	case RAISE:
+		pos := p.nextToken() // consume RAISE
+		var x Expr
+		if p.tok != EOF && p.tok != NEWLINE && p.tok != SEMI {
+			x = p.parseExpr(false)
+		}
+		return &RaiseStmt{Raise: pos, X: x}
+
 	case BREAK, CONTINUE, PASS:
 		tok := p.tok
 		pos := p.nextToken() // consume it
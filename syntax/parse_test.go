@@ -175,6 +175,27 @@ else:
 def h():
 	pass`,
 			`(DefStmt Name=f Function=(Function Body=((DefStmt Name=g Function=(Function Body=((BranchStmt Token=pass)))) (BranchStmt Token=pass))))`},
+		{`try:
+	pass
+except (A, B) as e:
+	raise
+except C:
+	pass
+except:
+	pass
+else:
+	pass
+finally:
+	pass`,
+			`(TryStmt Body=((BranchStmt Token=pass)) Excepts=((ExceptClause Type=(ParenExpr X=(TupleExpr List=(A B))) Name=e Body=((RaiseStmt))) (ExceptClause Type=C Body=((BranchStmt Token=pass))) (ExceptClause Body=((BranchStmt Token=pass)))) Else=((BranchStmt Token=pass)) Finally=((BranchStmt Token=pass)))`},
+		{`try: pass
+finally: pass`,
+			`(TryStmt Body=((BranchStmt Token=pass)) Finally=((BranchStmt Token=pass)))`},
+		{`while x < 10:
+	x += 1
+	if x:
+		break`,
+			`(WhileStmt Cond=(BinaryExpr X=x Op=< Y=10) Body=((AssignStmt Op=+= LHS=x RHS=1) (IfStmt Cond=x True=((BranchStmt Token=break)))))`},
 	} {
 		f, err := syntax.Parse("foo.sky", test.input, 0)
 		if err != nil {
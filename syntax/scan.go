@@ -100,6 +100,10 @@ const (
 	TRY
 	EXCEPT
 	AS
+	YIELD
+	RAISE
+	FINALLY
+	WHILE
 
 	maxToken
 )
@@ -185,6 +189,10 @@ var tokenNames = [...]string{
 	TRY:           "try",
 	EXCEPT:        "except",
 	AS:            "as",
+	YIELD:         "yield",
+	RAISE:         "raise",
+	FINALLY:       "finally",
+	WHILE:         "while",
 }
 
 // A Position describes the location of a rune of input.
@@ -1007,22 +1015,22 @@ var keywordToken = map[string]Token{
 	"return":   RETURN,
 
 	// optionally enabled:
-	"try":    TRY,
-	"except": EXCEPT,
-	"as":     AS,
+	"try":     TRY,
+	"except":  EXCEPT,
+	"as":      AS,
+	"yield":   YIELD,
+	"raise":   RAISE,
+	"finally": FINALLY,
+	"while":   WHILE,
 
 	// reserved words:
 	// "assert":   ILLEGAL, // heavily used by our tests
 	"class":    ILLEGAL,
 	"del":      ILLEGAL,
-	"finally":  ILLEGAL,
 	"from":     ILLEGAL,
 	"global":   ILLEGAL,
 	"import":   ILLEGAL,
 	"is":       ILLEGAL,
 	"nonlocal": ILLEGAL,
-	"raise":    ILLEGAL,
-	"while":    ILLEGAL,
 	"with":     ILLEGAL,
-	"yield":    ILLEGAL,
 }
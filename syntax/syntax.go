@@ -95,10 +95,13 @@ func (*BranchStmt) stmt() {}
 func (*DefStmt) stmt()    {}
 func (*ExprStmt) stmt()   {}
 func (*ForStmt) stmt()    {}
+func (*WhileStmt) stmt()  {}
 func (*IfStmt) stmt()     {}
 func (*TryStmt) stmt()    {}
 func (*LoadStmt) stmt()   {}
 func (*ReturnStmt) stmt() {}
+func (*YieldStmt) stmt()  {}
+func (*RaiseStmt) stmt()  {}
 
 // An AssignStmt represents an assignment:
 //	x = 0
@@ -128,6 +131,7 @@ type Function struct {
 	// set by resolver:
 	HasVarargs bool     // whether params includes *args (convenience)
 	HasKwargs  bool     // whether params includes **kwargs (convenience)
+	Generator  bool     // whether the body contains a yield statement
 	Locals     []*Ident // this function's local variables, parameters first
 	FreeVars   []*Ident // enclosing local variables to capture in closure
 }
@@ -180,22 +184,47 @@ func (x *IfStmt) Span() (start, end Position) {
 	return x.If, end
 }
 
-// A TryStmt safely executes statements, or falls back to an exception handler.
+// A TryStmt safely executes statements, or falls back to the first of its except
+// clauses which handles the exception they raise:
+//	try: Body; except ...; else: Else; finally: Finally
 type TryStmt struct {
 	commentsRef
-	Try           Position
-	Body          []Stmt
-	Except        Position
-	ExceptionType *Ident
-	ExceptionName *Ident
-	Fallback      []Stmt
+	Try        Position
+	Body       []Stmt
+	Excepts    []*ExceptClause
+	ElsePos    Position
+	Else       []Stmt // optional
+	FinallyPos Position
+	Finally    []Stmt // optional
 }
 
 func (x *TryStmt) Span() (start, end Position) {
-	_, end = x.Fallback[len(x.Fallback)-1].Span()
+	body := x.Finally
+	if body == nil {
+		body = x.Else
+	}
+	if body == nil {
+		body = x.Excepts[len(x.Excepts)-1].Body
+	}
+	_, end = body[len(body)-1].Span()
 	return x.Try, end
 }
 
+// An ExceptClause handles the exceptions raised by the body of a try statement:
+//	except Type as Name: Body
+type ExceptClause struct {
+	commentsRef
+	Except Position
+	Type   Expr   // exception, or tuple of exceptions; nil for any exception
+	Name   *Ident // may be nil
+	Body   []Stmt
+}
+
+func (x *ExceptClause) Span() (start, end Position) {
+	_, end = x.Body[len(x.Body)-1].Span()
+	return x.Except, end
+}
+
 // A LoadStmt loads another module and binds names from it:
 // load(Module, "x", y="foo").
 //
@@ -246,6 +275,37 @@ func (x *ReturnStmt) Span() (start, end Position) {
 	return x.Return, end
 }
 
+// A YieldStmt produces the next value of a generator.
+type YieldStmt struct {
+	commentsRef
+	Yield  Position
+	Result Expr // may be nil
+}
+
+func (x *YieldStmt) Span() (start, end Position) {
+	if x.Result == nil {
+		return x.Yield, x.Yield.add("yield")
+	}
+	_, end = x.Result.Span()
+	return x.Yield, end
+}
+
+// A RaiseStmt raises an exception, or re-raises the exception
+// handled by the enclosing except clause if X is nil.
+type RaiseStmt struct {
+	commentsRef
+	Raise Position
+	X     Expr // may be nil
+}
+
+func (x *RaiseStmt) Span() (start, end Position) {
+	if x.X == nil {
+		return x.Raise, x.Raise.add("raise")
+	}
+	_, end = x.X.Span()
+	return x.Raise, end
+}
+
 // An Expr is a Skylark expression.
 type Expr interface {
 	Node
@@ -368,6 +428,19 @@ func (x *ForStmt) Span() (start, end Position) {
 	return x.For, end
 }
 
+// A WhileStmt represents a loop: while Cond: Body.
+type WhileStmt struct {
+	commentsRef
+	While Position
+	Cond  Expr
+	Body  []Stmt
+}
+
+func (x *WhileStmt) Span() (start, end Position) {
+	_, end = x.Body[len(x.Body)-1].Span()
+	return x.While, end
+}
+
 // A ForClause represents a for clause in a list comprehension: for Vars in X.
 type ForClause struct {
 	commentsRef
@@ -30,6 +30,23 @@ func Walk(n Node, f func(Node) bool) {
 		walkStmts(n.True, f)
 		walkStmts(n.False, f)
 
+	case *TryStmt:
+		walkStmts(n.Body, f)
+		for _, except := range n.Excepts {
+			Walk(except, f)
+		}
+		walkStmts(n.Else, f)
+		walkStmts(n.Finally, f)
+
+	case *ExceptClause:
+		if n.Type != nil {
+			Walk(n.Type, f)
+		}
+		if n.Name != nil {
+			Walk(n.Name, f)
+		}
+		walkStmts(n.Body, f)
+
 	case *AssignStmt:
 		Walk(n.RHS, f)
 		Walk(n.LHS, f)
@@ -46,11 +63,25 @@ func Walk(n Node, f func(Node) bool) {
 		Walk(n.X, f)
 		walkStmts(n.Body, f)
 
+	case *WhileStmt:
+		Walk(n.Cond, f)
+		walkStmts(n.Body, f)
+
 	case *ReturnStmt:
 		if n.Result != nil {
 			Walk(n.Result, f)
 		}
 
+	case *YieldStmt:
+		if n.Result != nil {
+			Walk(n.Result, f)
+		}
+
+	case *RaiseStmt:
+		if n.X != nil {
+			Walk(n.X, f)
+		}
+
 	case *LoadStmt:
 		Walk(n.Module, f)
 		for _, from := range n.From {
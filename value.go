@@ -151,6 +151,24 @@ var (
 	_ Callable = (*Function)(nil)
 )
 
+// A ResumableBuiltin is a Callable implemented in Go which may call back into
+// Skylark, and may therefore be on the call-stack of a suspended thread.
+//
+// When a Skylark function called by the builtin suspends the thread, the builtin
+// must record its continuation state using Thread.SuspendCall and return immediately.
+// When the thread is resumed, ResumeCall is called with the recorded state and the
+// value returned by the Skylark function, and completes the original call.
+// The current frame of the thread is the frame of the original call.
+//
+// If the resumed Skylark function fails, the error is returned to the caller of
+// the builtin without calling ResumeCall.
+type ResumableBuiltin interface {
+	Callable
+	ResumeCall(thread *Thread, state Value, retval Value) (Value, error)
+}
+
+var _ ResumableBuiltin = (*Builtin)(nil)
+
 // An Iterable abstracts a sequence of values.
 // An iterable value may be iterated over by a 'for' loop or used where
 // any other Skylark iterable is allowed.  Unlike a Sequence, the length
@@ -545,9 +563,10 @@ func (fn *Function) HasKwargs() bool  { return fn.funcode.HasKwargs }
 
 // A Builtin is a function implemented in Go.
 type Builtin struct {
-	name string
-	fn   builtinMethod
-	recv Value // for bound methods (e.g. "".startswith)
+	name   string
+	fn     builtinMethod
+	resume builtinResumeMethod // for resumable builtins (e.g. sorted)
+	recv   Value               // for bound methods (e.g. "".startswith)
 }
 
 func (b *Builtin) Name() string { return b.name }
@@ -567,19 +586,42 @@ func (b *Builtin) Receiver() Value { return b.recv }
 func (b *Builtin) String() string  { return toString(b) }
 func (b *Builtin) Type() string    { return "builtin_function_or_method" }
 func (b *Builtin) Call(thread *Thread, args Tuple, kwargs []Tuple) (Value, error) {
-	thread.frame = &Frame{parent: thread.frame, callable: b}
-	result, err := b.fn(thread, b, args, kwargs)
-	thread.frame = thread.frame.parent
+	caller := thread.frame
+	thread.frame = &Frame{parent: caller, callable: b}
+	var result Value
+	var err error
+	if thread.Journal != nil && journaled(thread.frame) {
+		result, err = thread.Journal.call(thread, b, args, kwargs)
+	} else {
+		result, err = b.fn(thread, b, args, kwargs)
+	}
+	thread.frame = caller
 	return result, err
 }
 func (b *Builtin) Truth() Bool { return true }
 
+// ResumeCall completes a call of a resumable builtin which was interrupted by the
+// suspension of the thread. It fails for builtins not created by NewResumableBuiltin.
+func (b *Builtin) ResumeCall(thread *Thread, state Value, retval Value) (Value, error) {
+	if b.resume == nil {
+		return nil, fmt.Errorf("builtin %s is not resumable", b.name)
+	}
+	return b.resume(thread, b, state, retval)
+}
+
 // NewBuiltin returns a new 'builtin_function_or_method' value with the specified name
 // and implementation.  It compares unequal with all other values.
 func NewBuiltin(name string, fn builtinMethod) *Builtin {
 	return &Builtin{name: name, fn: fn}
 }
 
+// NewResumableBuiltin returns a new 'builtin_function_or_method' value like NewBuiltin,
+// whose calls may be interrupted by the suspension of the thread in a Skylark function
+// called by fn, and later completed by resume. See ResumableBuiltin.
+func NewResumableBuiltin(name string, fn builtinMethod, resume builtinResumeMethod) *Builtin {
+	return &Builtin{name: name, fn: fn, resume: resume}
+}
+
 // BindReceiver returns a new Builtin value representing a method
 // closure, that is, a built-in function bound to a receiver value.
 //
@@ -594,7 +636,7 @@ func NewBuiltin(name string, fn builtinMethod) *Builtin {
 //     "abc".index("a")
 //
 func (b *Builtin) BindReceiver(recv Value) *Builtin {
-	return &Builtin{name: b.name, fn: b.fn, recv: recv}
+	return &Builtin{name: b.name, fn: b.fn, resume: b.resume, recv: recv}
 }
 
 // A *Dict represents a Skylark dictionary.
@@ -921,17 +963,39 @@ var (
 	_             Exception = TypeError{}
 	_             Exception = ValueError{}
 	_             Exception = IOError{}
+	_             Exception = MemoryError{}
+	_             Exception = KeyError{}
+	_             Exception = IndexError{}
+	_             Exception = ZeroDivisionError{}
+	_             Exception = AttributeError{}
+	_             Exception = NameError{}
+	_             Exception = OverflowError{}
+	_             Exception = RecursionError{}
+
+	// Exceptions have the attributes args, message and traceback.
+	_ HasAttrs = TypeError{}
+	_ HasAttrs = ValueError{}
+	_ HasAttrs = IOError{}
+	_ HasAttrs = MemoryError{}
+	_ HasAttrs = KeyError{}
+	_ HasAttrs = IndexError{}
+	_ HasAttrs = ZeroDivisionError{}
+	_ HasAttrs = AttributeError{}
+	_ HasAttrs = NameError{}
+	_ HasAttrs = OverflowError{}
+	_ HasAttrs = RecursionError{}
 )
 
 // ExceptionKind is the type of the catch-all Skylark exception, predeclared as Exception if try/except is enabled.
 type ExceptionKind struct{}
 
-func (e ExceptionKind) Error() string         { return "unknown reason" }
-func (e ExceptionKind) String() string        { return e.Type() + ": " + e.Error() }
-func (e ExceptionKind) Type() string          { return "Exception" }
-func (e ExceptionKind) Freeze()               {} // immutable
-func (e ExceptionKind) Hash() (uint32, error) { return 0, TypeErrorf("unhashable: %s", e.Type()) }
-func (e ExceptionKind) Truth() Bool           { return true }
+func (e ExceptionKind) Error() string          { return "unknown reason" }
+func (e ExceptionKind) String() string         { return e.Type() + ": " + e.Error() }
+func (e ExceptionKind) Type() string           { return "Exception" }
+func (e ExceptionKind) Freeze()                {} // immutable
+func (e ExceptionKind) Hash() (uint32, error)  { return 0, TypeErrorf("unhashable: %s", e.Type()) }
+func (e ExceptionKind) Truth() Bool            { return true }
+func (e ExceptionKind) Class() *ExceptionClass { return BaseExceptionClass }
 func (e ExceptionKind) CompareSameType(op syntax.Token, y Value, depth int) (bool, error) {
 	return op == syntax.EQL, nil
 }
@@ -947,6 +1011,7 @@ func TypeErrorf(format string, args ...interface{}) TypeError {
 }
 func (e TypeError) String() string        { return e.Type() + ": " + e.Error() }
 func (e TypeError) Type() string          { return "TypeError" }
+func (e TypeError) Name() string          { return e.Type() }
 func (e TypeError) Freeze()               {} // immutable
 func (e TypeError) Truth() Bool           { return true }
 func (e TypeError) Hash() (uint32, error) { return String(e.String()).Hash() }
@@ -957,6 +1022,10 @@ func (e TypeError) CompareSameType(op syntax.Token, y Value, depth int) (bool, e
 	}
 	return (op == syntax.EQL && e.Error() == ye.Error()) || (op == syntax.NEQ && e.Error() != ye.Error()), nil
 }
+func (e TypeError) Class() *ExceptionClass          { return TypeErrorClass }
+func (e TypeError) Unwrap() error                   { return e.error }
+func (e TypeError) Attr(name string) (Value, error) { return exceptionAttr(e.error, name) }
+func (e TypeError) AttrNames() []string             { return exceptionAttrNames }
 
 // ValueError is the type of a Skylark value-error exception.
 type ValueError struct {
@@ -969,6 +1038,7 @@ func ValueErrorf(format string, args ...interface{}) ValueError {
 }
 func (e ValueError) String() string        { return e.Type() + ": " + e.Error() }
 func (e ValueError) Type() string          { return "ValueError" }
+func (e ValueError) Name() string          { return e.Type() }
 func (e ValueError) Freeze()               {} // immutable
 func (e ValueError) Truth() Bool           { return true }
 func (e ValueError) Hash() (uint32, error) { return String(e.String()).Hash() }
@@ -979,6 +1049,10 @@ func (e ValueError) CompareSameType(op syntax.Token, y Value, depth int) (bool,
 	}
 	return (op == syntax.EQL && e.Error() == ye.Error()) || (op == syntax.NEQ && e.Error() != ye.Error()), nil
 }
+func (e ValueError) Class() *ExceptionClass          { return ValueErrorClass }
+func (e ValueError) Unwrap() error                   { return e.error }
+func (e ValueError) Attr(name string) (Value, error) { return exceptionAttr(e.error, name) }
+func (e ValueError) AttrNames() []string             { return exceptionAttrNames }
 
 // IOError is the type of a Skylark IO-error exception.
 type IOError struct {
@@ -991,6 +1065,7 @@ func IOErrorf(format string, args ...interface{}) IOError {
 }
 func (e IOError) String() string        { return e.Type() + ": " + e.Error() }
 func (e IOError) Type() string          { return "IOError" }
+func (e IOError) Name() string          { return e.Type() }
 func (e IOError) Freeze()               {} // immutable
 func (e IOError) Truth() Bool           { return true }
 func (e IOError) Hash() (uint32, error) { return String(e.String()).Hash() }
@@ -1001,6 +1076,235 @@ func (e IOError) CompareSameType(op syntax.Token, y Value, depth int) (bool, err
 	}
 	return (op == syntax.EQL && e.Error() == ye.Error()) || (op == syntax.NEQ && e.Error() != ye.Error()), nil
 }
+func (e IOError) Class() *ExceptionClass          { return IOErrorClass }
+func (e IOError) Unwrap() error                   { return e.error }
+func (e IOError) Attr(name string) (Value, error) { return exceptionAttr(e.error, name) }
+func (e IOError) AttrNames() []string             { return exceptionAttrNames }
+
+// MemoryError is the type of a Skylark memory-error exception,
+// raised when a thread exceeds its allocation limit (see Thread.MaxAlloc).
+type MemoryError struct {
+	error
+}
+
+func NewMemoryError(err error) MemoryError { return MemoryError{err} }
+func MemoryErrorf(format string, args ...interface{}) MemoryError {
+	return NewMemoryError(fmt.Errorf(format, args...))
+}
+func (e MemoryError) String() string        { return e.Type() + ": " + e.Error() }
+func (e MemoryError) Type() string          { return "MemoryError" }
+func (e MemoryError) Name() string          { return e.Type() }
+func (e MemoryError) Freeze()               {} // immutable
+func (e MemoryError) Truth() Bool           { return true }
+func (e MemoryError) Hash() (uint32, error) { return String(e.String()).Hash() }
+func (e MemoryError) CompareSameType(op syntax.Token, y Value, depth int) (bool, error) {
+	ye, _ := y.(MemoryError)
+	if ye.error == nil {
+		return (op == syntax.EQL && e.error == nil) || (op == syntax.NEQ && e.error != nil), nil
+	}
+	return (op == syntax.EQL && e.Error() == ye.Error()) || (op == syntax.NEQ && e.Error() != ye.Error()), nil
+}
+func (e MemoryError) Class() *ExceptionClass          { return MemoryErrorClass }
+func (e MemoryError) Unwrap() error                   { return e.error }
+func (e MemoryError) Attr(name string) (Value, error) { return exceptionAttr(e.error, name) }
+func (e MemoryError) AttrNames() []string             { return exceptionAttrNames }
+
+// KeyError is the type of a Skylark key-error exception,
+// raised when a key is not found in a mapping.
+type KeyError struct {
+	error
+}
+
+func NewKeyError(err error) KeyError { return KeyError{err} }
+func KeyErrorf(format string, args ...interface{}) KeyError {
+	return NewKeyError(fmt.Errorf(format, args...))
+}
+func (e KeyError) String() string        { return e.Type() + ": " + e.Error() }
+func (e KeyError) Type() string          { return "KeyError" }
+func (e KeyError) Name() string          { return e.Type() }
+func (e KeyError) Freeze()               {} // immutable
+func (e KeyError) Truth() Bool           { return true }
+func (e KeyError) Hash() (uint32, error) { return String(e.String()).Hash() }
+func (e KeyError) CompareSameType(op syntax.Token, y Value, depth int) (bool, error) {
+	ye, _ := y.(KeyError)
+	if ye.error == nil {
+		return (op == syntax.EQL && e.error == nil) || (op == syntax.NEQ && e.error != nil), nil
+	}
+	return (op == syntax.EQL && e.Error() == ye.Error()) || (op == syntax.NEQ && e.Error() != ye.Error()), nil
+}
+func (e KeyError) Class() *ExceptionClass          { return KeyErrorClass }
+func (e KeyError) Unwrap() error                   { return e.error }
+func (e KeyError) Attr(name string) (Value, error) { return exceptionAttr(e.error, name) }
+func (e KeyError) AttrNames() []string             { return exceptionAttrNames }
+
+// IndexError is the type of a Skylark index-error exception,
+// raised when an index is out of range.
+type IndexError struct {
+	error
+}
+
+func NewIndexError(err error) IndexError { return IndexError{err} }
+func IndexErrorf(format string, args ...interface{}) IndexError {
+	return NewIndexError(fmt.Errorf(format, args...))
+}
+func (e IndexError) String() string        { return e.Type() + ": " + e.Error() }
+func (e IndexError) Type() string          { return "IndexError" }
+func (e IndexError) Name() string          { return e.Type() }
+func (e IndexError) Freeze()               {} // immutable
+func (e IndexError) Truth() Bool           { return true }
+func (e IndexError) Hash() (uint32, error) { return String(e.String()).Hash() }
+func (e IndexError) CompareSameType(op syntax.Token, y Value, depth int) (bool, error) {
+	ye, _ := y.(IndexError)
+	if ye.error == nil {
+		return (op == syntax.EQL && e.error == nil) || (op == syntax.NEQ && e.error != nil), nil
+	}
+	return (op == syntax.EQL && e.Error() == ye.Error()) || (op == syntax.NEQ && e.Error() != ye.Error()), nil
+}
+func (e IndexError) Class() *ExceptionClass          { return IndexErrorClass }
+func (e IndexError) Unwrap() error                   { return e.error }
+func (e IndexError) Attr(name string) (Value, error) { return exceptionAttr(e.error, name) }
+func (e IndexError) AttrNames() []string             { return exceptionAttrNames }
+
+// ZeroDivisionError is the type of a Skylark zero-division-error exception,
+// raised by the division or modulo of a number by zero.
+type ZeroDivisionError struct {
+	error
+}
+
+func NewZeroDivisionError(err error) ZeroDivisionError { return ZeroDivisionError{err} }
+func ZeroDivisionErrorf(format string, args ...interface{}) ZeroDivisionError {
+	return NewZeroDivisionError(fmt.Errorf(format, args...))
+}
+func (e ZeroDivisionError) String() string        { return e.Type() + ": " + e.Error() }
+func (e ZeroDivisionError) Type() string          { return "ZeroDivisionError" }
+func (e ZeroDivisionError) Name() string          { return e.Type() }
+func (e ZeroDivisionError) Freeze()               {} // immutable
+func (e ZeroDivisionError) Truth() Bool           { return true }
+func (e ZeroDivisionError) Hash() (uint32, error) { return String(e.String()).Hash() }
+func (e ZeroDivisionError) CompareSameType(op syntax.Token, y Value, depth int) (bool, error) {
+	ye, _ := y.(ZeroDivisionError)
+	if ye.error == nil {
+		return (op == syntax.EQL && e.error == nil) || (op == syntax.NEQ && e.error != nil), nil
+	}
+	return (op == syntax.EQL && e.Error() == ye.Error()) || (op == syntax.NEQ && e.Error() != ye.Error()), nil
+}
+func (e ZeroDivisionError) Class() *ExceptionClass          { return ZeroDivisionErrorClass }
+func (e ZeroDivisionError) Unwrap() error                   { return e.error }
+func (e ZeroDivisionError) Attr(name string) (Value, error) { return exceptionAttr(e.error, name) }
+func (e ZeroDivisionError) AttrNames() []string             { return exceptionAttrNames }
+
+// AttributeError is the type of a Skylark attribute-error exception,
+// raised when a value has no such field or method.
+type AttributeError struct {
+	error
+}
+
+func NewAttributeError(err error) AttributeError { return AttributeError{err} }
+func AttributeErrorf(format string, args ...interface{}) AttributeError {
+	return NewAttributeError(fmt.Errorf(format, args...))
+}
+func (e AttributeError) String() string        { return e.Type() + ": " + e.Error() }
+func (e AttributeError) Type() string          { return "AttributeError" }
+func (e AttributeError) Name() string          { return e.Type() }
+func (e AttributeError) Freeze()               {} // immutable
+func (e AttributeError) Truth() Bool           { return true }
+func (e AttributeError) Hash() (uint32, error) { return String(e.String()).Hash() }
+func (e AttributeError) CompareSameType(op syntax.Token, y Value, depth int) (bool, error) {
+	ye, _ := y.(AttributeError)
+	if ye.error == nil {
+		return (op == syntax.EQL && e.error == nil) || (op == syntax.NEQ && e.error != nil), nil
+	}
+	return (op == syntax.EQL && e.Error() == ye.Error()) || (op == syntax.NEQ && e.Error() != ye.Error()), nil
+}
+func (e AttributeError) Class() *ExceptionClass          { return AttributeErrorClass }
+func (e AttributeError) Unwrap() error                   { return e.error }
+func (e AttributeError) Attr(name string) (Value, error) { return exceptionAttr(e.error, name) }
+func (e AttributeError) AttrNames() []string             { return exceptionAttrNames }
+
+// NameError is the type of a Skylark name-error exception,
+// raised when a variable is referenced before assignment.
+type NameError struct {
+	error
+}
+
+func NewNameError(err error) NameError { return NameError{err} }
+func NameErrorf(format string, args ...interface{}) NameError {
+	return NewNameError(fmt.Errorf(format, args...))
+}
+func (e NameError) String() string        { return e.Type() + ": " + e.Error() }
+func (e NameError) Type() string          { return "NameError" }
+func (e NameError) Name() string          { return e.Type() }
+func (e NameError) Freeze()               {} // immutable
+func (e NameError) Truth() Bool           { return true }
+func (e NameError) Hash() (uint32, error) { return String(e.String()).Hash() }
+func (e NameError) CompareSameType(op syntax.Token, y Value, depth int) (bool, error) {
+	ye, _ := y.(NameError)
+	if ye.error == nil {
+		return (op == syntax.EQL && e.error == nil) || (op == syntax.NEQ && e.error != nil), nil
+	}
+	return (op == syntax.EQL && e.Error() == ye.Error()) || (op == syntax.NEQ && e.Error() != ye.Error()), nil
+}
+func (e NameError) Class() *ExceptionClass          { return NameErrorClass }
+func (e NameError) Unwrap() error                   { return e.error }
+func (e NameError) Attr(name string) (Value, error) { return exceptionAttr(e.error, name) }
+func (e NameError) AttrNames() []string             { return exceptionAttrNames }
+
+// OverflowError is the type of a Skylark overflow-error exception,
+// raised when a number is too large for an operation.
+type OverflowError struct {
+	error
+}
+
+func NewOverflowError(err error) OverflowError { return OverflowError{err} }
+func OverflowErrorf(format string, args ...interface{}) OverflowError {
+	return NewOverflowError(fmt.Errorf(format, args...))
+}
+func (e OverflowError) String() string        { return e.Type() + ": " + e.Error() }
+func (e OverflowError) Type() string          { return "OverflowError" }
+func (e OverflowError) Name() string          { return e.Type() }
+func (e OverflowError) Freeze()               {} // immutable
+func (e OverflowError) Truth() Bool           { return true }
+func (e OverflowError) Hash() (uint32, error) { return String(e.String()).Hash() }
+func (e OverflowError) CompareSameType(op syntax.Token, y Value, depth int) (bool, error) {
+	ye, _ := y.(OverflowError)
+	if ye.error == nil {
+		return (op == syntax.EQL && e.error == nil) || (op == syntax.NEQ && e.error != nil), nil
+	}
+	return (op == syntax.EQL && e.Error() == ye.Error()) || (op == syntax.NEQ && e.Error() != ye.Error()), nil
+}
+func (e OverflowError) Class() *ExceptionClass          { return OverflowErrorClass }
+func (e OverflowError) Unwrap() error                   { return e.error }
+func (e OverflowError) Attr(name string) (Value, error) { return exceptionAttr(e.error, name) }
+func (e OverflowError) AttrNames() []string             { return exceptionAttrNames }
+
+// RecursionError is the type of a Skylark recursion-error exception,
+// raised when a function is called recursively,
+// or a comparison exceeds the maximum recursion depth.
+type RecursionError struct {
+	error
+}
+
+func NewRecursionError(err error) RecursionError { return RecursionError{err} }
+func RecursionErrorf(format string, args ...interface{}) RecursionError {
+	return NewRecursionError(fmt.Errorf(format, args...))
+}
+func (e RecursionError) String() string        { return e.Type() + ": " + e.Error() }
+func (e RecursionError) Type() string          { return "RecursionError" }
+func (e RecursionError) Name() string          { return e.Type() }
+func (e RecursionError) Freeze()               {} // immutable
+func (e RecursionError) Truth() Bool           { return true }
+func (e RecursionError) Hash() (uint32, error) { return String(e.String()).Hash() }
+func (e RecursionError) CompareSameType(op syntax.Token, y Value, depth int) (bool, error) {
+	ye, _ := y.(RecursionError)
+	if ye.error == nil {
+		return (op == syntax.EQL && e.error == nil) || (op == syntax.NEQ && e.error != nil), nil
+	}
+	return (op == syntax.EQL && e.Error() == ye.Error()) || (op == syntax.NEQ && e.Error() != ye.Error()), nil
+}
+func (e RecursionError) Class() *ExceptionClass          { return RecursionErrorClass }
+func (e RecursionError) Unwrap() error                   { return e.error }
+func (e RecursionError) Attr(name string) (Value, error) { return exceptionAttr(e.error, name) }
+func (e RecursionError) AttrNames() []string             { return exceptionAttrNames }
 
 // toString returns the string form of value v.
 // It may be more efficient than v.String() for larger values.
@@ -1150,7 +1454,7 @@ func Compare(op syntax.Token, x, y Value) (bool, error) {
 // in cyclic data structures.
 func CompareDepth(op syntax.Token, x, y Value, depth int) (bool, error) {
 	if depth < 1 {
-		return false, ValueErrorf("comparison exceeded maximum recursion depth")
+		return false, RecursionErrorf("comparison exceeded maximum recursion depth")
 	}
 	if sameType(x, y) {
 		if xcomp, ok := x.(Comparable); ok {